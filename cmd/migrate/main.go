@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+)
+
+// Converts amounts stored before the Money type into minor units
+// and single currency wallets into multi-currency wallets,
+// then gives transactions that share a reference their own
+// and ties budgets to the event they were locked for
+// It is safe to run more than once
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	counts, err := hp.MigrateMoneyFields(ctx)
+	if err != nil {
+		log.Fatal("Error migrating money fields: ", err)
+	}
+
+	for field, count := range counts {
+		log.Printf("%s: %d documents migrated", field, count)
+	}
+
+	counts, err = hp.MigrateWalletCurrencies(ctx)
+	if err != nil {
+		log.Fatal("Error migrating wallet currencies: ", err)
+	}
+
+	for collection, count := range counts {
+		log.Printf("%s: %d documents migrated", collection, count)
+	}
+
+	count, err := hp.MigrateTransactionReferences(ctx)
+	if err != nil {
+		log.Fatal("Error migrating transaction references: ", err)
+	}
+
+	log.Printf("transactions: %d references regenerated", count)
+
+	counts, err = hp.MigrateBudgets(ctx)
+	if err != nil {
+		log.Fatal("Error migrating budgets: ", err)
+	}
+
+	log.Printf("budgets: %d assigned to events, %d released", counts["assigned"], counts["released"])
+}
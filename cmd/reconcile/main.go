@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Checks every wallet against its transaction history and open budgets,
+// looks for transactions stuck in start or pending and saves a report
+// admins can read at /admin/protected/reconciliation
+// It exits with an error if the run fails or finds anything
+func main() {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ReconcileTimeout)
+	defer cancel()
+
+	report, err := hp.RunReconciliation(ctx, primitive.NilObjectID)
+	if err != nil {
+		log.Fatal("Error running reconciliation: ", err)
+	}
+
+	log.Printf("report %s: %d wallets checked, %d mismatches, %d stuck transactions",
+		report.ID.Hex(), report.WalletsChecked, report.Mismatches, report.StuckTransactions)
+
+	if report.Mismatches > 0 || report.StuckTransactions > 0 {
+		log.Fatal("reconciliation found problems")
+	}
+}
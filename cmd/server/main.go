@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+
 	"github.com/Rhaqim/thedutchapp/pkg/handlers"
+	"github.com/Rhaqim/thedutchapp/pkg/jobs"
 	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
 )
 
@@ -13,5 +16,8 @@ func main() {
 		port = "8080"
 	}
 
+	// Background jobs such as monthly statements
+	jobs.Start(context.Background())
+
 	run.Run(port)
 }
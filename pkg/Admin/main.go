@@ -2,7 +2,9 @@ package admin
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/Rhaqim/thedutchapp/pkg/config"
 	"github.com/Rhaqim/thedutchapp/pkg/database"
@@ -12,6 +14,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func Create(c *gin.Context) {
@@ -114,3 +117,285 @@ func SendNotificationtoUsers(c *gin.Context) {
 	response := hp.SetSuccess("Notification sent", nil, funcName)
 	c.JSON(http.StatusOK, response)
 }
+
+// BackfillLedger posts opening balances to the ledger for wallets and budgets
+// that existed before the ledger was introduced
+func BackfillLedger(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	count, err := hp.BackfillOpeningBalances(ctx)
+	if err != nil {
+		response := hp.SetError(err, "Error backfilling ledger", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Ledger backfilled", gin.H{"accounts": count}, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetFXRates returns the exchange rates used to convert payments between currencies
+func GetFXRates(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	rates, err := hp.GetFXRates(ctx, bson.M{})
+	if err != nil {
+		response := hp.SetError(err, "Error getting exchange rates", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Exchange rates", rates, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// SetFXRate creates or replaces the exchange rate for a currency pair
+func SetFXRate(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	var request hp.FXRate
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	request.UpdatedBy = user.ID
+
+	rate, err := hp.SetFXRate(ctx, request)
+	if err != nil {
+		response := hp.SetError(err, "Error setting exchange rate", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Exchange rate set", rate, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteFXRate removes the exchange rate for a currency pair
+func DeleteFXRate(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	err := hp.DeleteFXRate(ctx, c.Param("base"), c.Param("quote"))
+	if err != nil {
+		response := hp.SetError(err, "Error deleting exchange rate", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Exchange rate deleted", nil, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetKYCLimits returns the limits of every KYC tier, set by admins or the defaults
+func GetKYCLimits(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	limits, err := hp.GetKYCLimits(ctx)
+	if err != nil {
+		response := hp.SetError(err, "Error getting KYC limits", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("KYC limits", limits, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// SetKYCLimit creates or replaces the limit of a KYC tier for an operation
+func SetKYCLimit(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	var request hp.KYCLimit
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	request.UpdatedBy = user.ID
+
+	limit, err := hp.SetKYCLimit(ctx, request)
+	if err != nil {
+		response := hp.SetError(err, "Error setting KYC limit", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("KYC limit set", limit, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteKYCLimit removes the limit set for a KYC tier and operation so the default applies again
+func DeleteKYCLimit(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	err := hp.DeleteKYCLimit(ctx, hp.KYCStatus(c.Param("tier")), hp.LimitOperation(c.Param("operation")))
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		response := hp.SetError(err, "No KYC limit set for this tier and operation", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error deleting KYC limit", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("KYC limit deleted", nil, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// RunReconciliation checks every wallet against its transaction history and
+// reports mismatches and stuck transactions
+func RunReconciliation(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ReconcileTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	report, err := hp.RunReconciliation(ctx, user.ID)
+	if err != nil {
+		response := hp.SetError(err, "Error running reconciliation", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Reconciliation complete", report, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetReconciliationReports returns a page of reconciliation reports, newest first
+func GetReconciliationReports(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	page, err := hp.GetReconciliationReports(ctx, c.Query("cursor"), limit)
+	if err != nil {
+		response := hp.SetError(err, "Error getting reconciliation reports", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Reconciliation reports", page, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetReconciliationReport returns a reconciliation report with a page of its items
+// kind=balance_mismatch or kind=stuck_transaction shows only one kind of item
+func GetReconciliationReport(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid report id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	page, err := hp.GetReconciliationReport(ctx, id, c.Query("kind"), c.Query("cursor"), limit)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		response := hp.SetError(err, "Reconciliation report not found", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error getting reconciliation report", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Reconciliation report", page, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetFeeRevenue reports the platform fees earned from venue payments by restaurant and period
+// restaurant_id, from, to and interval (day or month) filter and split the report
+func GetFeeRevenue(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+	defer cancel()
+
+	var funcName = ut.GetFunctionName()
+
+	var request hp.FeeRevenueRequest
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		response := hp.SetError(err, "Error binding query", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	revenue, err := hp.GetFeeRevenue(ctx, request)
+	if err != nil {
+		response := hp.SetError(err, "Error getting fee revenue", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	wallet, err := hp.GetPlatformWallet(ctx)
+	if err != nil {
+		response := hp.SetError(err, "Error getting platform wallet", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Fee revenue", gin.H{
+		"revenue":         revenue,
+		"platform_wallet": wallet,
+	}, funcName)
+	c.JSON(http.StatusOK, response)
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/go-redis/redis/v9"
 	"github.com/joho/godotenv"
@@ -64,6 +65,47 @@ func (c *Cache) Set() error {
 	return nil
 }
 
+// SetEx sets a key-value pair in the cache that expires after the given duration
+func (c *Cache) SetEx(expiration time.Duration) error {
+	defer c.client.Close()
+	err := c.client.Set(context.Background(), c.Key, c.Value, expiration).Err()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Incr increments the counter at the key and returns its new value
+// The counter expires after the given duration from its first increment
+func (c *Cache) Incr(expiration time.Duration) (int64, error) {
+	defer c.client.Close()
+	val, err := c.client.Incr(context.Background(), c.Key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if val == 1 {
+		err = c.client.Expire(context.Background(), c.Key, expiration).Err()
+		if err != nil {
+			return val, err
+		}
+	}
+
+	return val, nil
+}
+
+// TTL returns how long the key has left, it is not positive if the key does not expire or does not exist
+func (c *Cache) TTL() (time.Duration, error) {
+	defer c.client.Close()
+	val, err := c.client.TTL(context.Background(), c.Key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	return val, nil
+}
+
 // Get gets a value from the cache
 func (c *Cache) Get() ([]byte, error) {
 	defer c.client.Close()
@@ -31,6 +31,9 @@ var (
 	GoogleMapsAPIKey = os.Getenv("GOOGLE_MAPS_API_KEY")
 )
 
+// Currency used for amounts that do not name one
+const DefaultCurrency = "NGN"
+
 // token expiration time
 var (
 	AccessTokenExpireTime  = time.Now().Add(time.Hour * 24)
@@ -43,52 +46,88 @@ var (
 	JWTRefreshSecret = os.Getenv("REFRESH_SECRET")
 )
 
+// Paystack
+// PAYSTACK_BASE_URL is only set to point at a stand-in for Paystack
+var (
+	PaystackSecretKey   = os.Getenv("PAYSTACK_SECRET_KEY")
+	PaystackBaseURL     = os.Getenv("PAYSTACK_BASE_URL")
+	PaystackCallbackURL = os.Getenv("PAYSTACK_CALLBACK_URL")
+)
+
 // Database Collections
 const (
-	DB           = "thedutchapp"
-	ADMIN        = "admins"
-	ATTENDEE     = "attendees"
-	BUDGET       = "budgets"
-	CITY         = "city"
-	COUNTRY      = "country"
-	EVENT        = "events"
-	FRIENDSHIP   = "friendship"
-	NOTIFICATION = "notifications"
-	ORDER        = "orders"
-	PRODUCT      = "products"
-	RESTAURAUNT  = "restaurants"
-	REVIEW       = "reviews"
-	SESSION      = "sessions"
-	STATE        = "state"
-	TRANSACTION  = "transactions"
-	USERS        = "users"
-	WALLET       = "wallets"
+	DB                  = "thedutchapp"
+	ADMIN               = "admins"
+	ATTENDEE            = "attendees"
+	BUDGET              = "budgets"
+	CITY                = "city"
+	COUNTRY             = "country"
+	EVENT               = "events"
+	FRIENDSHIP          = "friendship"
+	FX_RATE             = "fx_rates"
+	IDEMPOTENCY         = "idempotency_keys"
+	JOB                 = "jobs"
+	KYC_LIMIT           = "kyc_limits"
+	LEDGER              = "ledger"
+	NOTIFICATION        = "notifications"
+	ORDER               = "orders"
+	PAYMENT_REQUEST     = "payment_requests"
+	PLATFORM_WALLET     = "platform_wallets"
+	PRODUCT             = "products"
+	RECONCILIATION      = "reconciliation_reports"
+	RECONCILIATION_ITEM = "reconciliation_items"
+	RESTAURAUNT         = "restaurants"
+	REVIEW              = "reviews"
+	SCHEDULED_TRANSFER  = "scheduled_transfers"
+	SESSION             = "sessions"
+	SPLIT               = "event_splits"
+	STATE               = "state"
+	STATEMENT           = "statements"
+	TRANSACTION         = "transactions"
+	USERS               = "users"
+	WALLET              = "wallets"
 )
 
+// MongoClient is shared by every collection so that operations on
+// different collections can take part in the same session and transaction
+var MongoClient = database.ConnectMongoDB()
+
 // Open Collections
 func OpenCollection(name string) *mongo.Collection {
-	return database.OpenCollection(database.ConnectMongoDB(), DB, name)
+	return database.OpenCollection(MongoClient, DB, name)
 }
 
 // Open Database Collections
 var (
-	AdminCollection        = OpenCollection(ADMIN)
-	AttendeeCollection     = OpenCollection(ATTENDEE)
-	BudgetCollection       = OpenCollection(BUDGET)
-	CityCollection         = OpenCollection(CITY)
-	CountryCollection      = OpenCollection(COUNTRY)
-	EventCollection        = OpenCollection(EVENT)
-	FriendshipCollection   = OpenCollection(FRIENDSHIP)
-	NotificationCollection = OpenCollection(NOTIFICATION)
-	OrderCollection        = OpenCollection(ORDER)
-	ProductCollection      = OpenCollection(PRODUCT)
-	RestaurantCollection   = OpenCollection(RESTAURAUNT)
-	ReviewCollection       = OpenCollection(REVIEW)
-	SessionCollection      = OpenCollection(SESSION)
-	StateCollection        = OpenCollection(STATE)
-	TransactionCollection  = OpenCollection(TRANSACTION)
-	UserCollection         = OpenCollection(USERS)
-	WalletCollection       = OpenCollection(WALLET)
+	AdminCollection              = OpenCollection(ADMIN)
+	AttendeeCollection           = OpenCollection(ATTENDEE)
+	BudgetCollection             = OpenCollection(BUDGET)
+	CityCollection               = OpenCollection(CITY)
+	CountryCollection            = OpenCollection(COUNTRY)
+	EventCollection              = OpenCollection(EVENT)
+	FriendshipCollection         = OpenCollection(FRIENDSHIP)
+	FXRateCollection             = OpenCollection(FX_RATE)
+	IdempotencyCollection        = OpenCollection(IDEMPOTENCY)
+	JobCollection                = OpenCollection(JOB)
+	KYCLimitCollection           = OpenCollection(KYC_LIMIT)
+	LedgerCollection             = OpenCollection(LEDGER)
+	NotificationCollection       = OpenCollection(NOTIFICATION)
+	OrderCollection              = OpenCollection(ORDER)
+	PaymentRequestCollection     = OpenCollection(PAYMENT_REQUEST)
+	PlatformWalletCollection     = OpenCollection(PLATFORM_WALLET)
+	ProductCollection            = OpenCollection(PRODUCT)
+	ReconciliationCollection     = OpenCollection(RECONCILIATION)
+	ReconciliationItemCollection = OpenCollection(RECONCILIATION_ITEM)
+	RestaurantCollection         = OpenCollection(RESTAURAUNT)
+	ReviewCollection             = OpenCollection(REVIEW)
+	ScheduledTransferCollection  = OpenCollection(SCHEDULED_TRANSFER)
+	SessionCollection            = OpenCollection(SESSION)
+	SplitCollection              = OpenCollection(SPLIT)
+	StateCollection              = OpenCollection(STATE)
+	StatementCollection          = OpenCollection(STATEMENT)
+	TransactionCollection        = OpenCollection(TRANSACTION)
+	UserCollection               = OpenCollection(USERS)
+	WalletCollection             = OpenCollection(WALLET)
 )
 
 /* LOG MESSAGES */
@@ -157,6 +196,7 @@ func coloriseFunc(message string) string {
 
 // Types of messages sent over Websocket
 const (
+	Bill_         = "bill: "
 	Chat_         = "chat: "
 	Invite_       = "invite: "
 	Notification_ = "notification: "
@@ -178,6 +218,32 @@ const (
 	EventCancelled NotificationMessage = "Event has been cancelled"
 	EventCreated   NotificationMessage = "Event has been created"
 	EventUpdated   NotificationMessage = "Event has been updated"
+	WalletLocked   NotificationMessage = "Wallet has been locked"
+	PinChanged     NotificationMessage = "Transaction pin has been changed"
+
+	ScheduledTransferSent   NotificationMessage = "Scheduled transfer has been sent"
+	ScheduledTransferFailed NotificationMessage = "Scheduled transfer has failed"
+	ScheduledTransferPaused NotificationMessage = "Scheduled transfer has been paused"
+
+	PaymentRequested        NotificationMessage = "Payment has been requested"
+	PaymentRequestPaid      NotificationMessage = "Payment request has been paid"
+	PaymentRequestDeclined  NotificationMessage = "Payment request has been declined"
+	PaymentRequestCancelled NotificationMessage = "Payment request has been cancelled"
+
+	SplitConfirmed NotificationMessage = "Bill split has been confirmed"
+	SplitSharePaid NotificationMessage = "Bill split share has been paid"
+	SplitSettled   NotificationMessage = "Bill split has been settled"
+	SplitCancelled NotificationMessage = "Bill split has been cancelled"
+
+	SettlementPaid NotificationMessage = "Settlement has been paid"
+
+	SettlementDeadlineSet NotificationMessage = "Settlement deadline has been set"
+	PaymentDueSoon        NotificationMessage = "Payment is due soon"
+	PaymentDue            NotificationMessage = "Payment is due"
+	PaymentOverdue        NotificationMessage = "Payment is overdue"
+	PaymentAutoCharged    NotificationMessage = "Payment has been charged automatically"
+	AutoChargeFailed      NotificationMessage = "Automatic payment has failed"
+	SettlementOverdue     NotificationMessage = "Event payments are overdue"
 )
 
 func (nm NotificationMessage) String() string {
@@ -186,7 +252,35 @@ func (nm NotificationMessage) String() string {
 
 // Context Timeout
 const (
-	ContextTimeout = 15 * time.Second
+	ContextTimeout   = 15 * time.Second
+	ExportTimeout    = 10 * time.Minute
+	ReconcileTimeout = 30 * time.Minute
+	JobTimeout       = 30 * time.Minute
+)
+
+// Transaction Pin
+// A wallet is locked for PinLockDuration after MaxPinAttempts incorrect pins in a row
+// PinResetCodeTTL is how long an emailed pin reset code can be used
+const (
+	MaxPinAttempts  = 5
+	PinLockDuration = 30 * time.Minute
+	PinResetCodeTTL = 15 * time.Minute
+)
+
+// Scheduled transfers
+// A recurring transfer is paused after MaxScheduledTransferFailures failures in a row
+const (
+	ScheduledTransferInterval    = 5 * time.Minute
+	MaxScheduledTransferFailures = 3
+)
+
+// Settlement deadlines
+// Attendees who still owe are reminded SettlementReminderLead before the deadline,
+// at the deadline and SettlementOverdueAfter past it
+const (
+	SettlementReminderInterval = 15 * time.Minute
+	SettlementReminderLead     = 24 * time.Hour
+	SettlementOverdueAfter     = 72 * time.Hour
 )
 
 // Redis Keys
@@ -198,6 +292,12 @@ const (
 	AdminRole    CacheKey = "user_role_admin"
 	Users        CacheKey = "users"
 	Restaurants  CacheKey = "restaurants"
+
+	// Prefixes, the user id is appended
+	PinAttempts      CacheKey = "pin_attempts:"
+	PinLock          CacheKey = "pin_lock:"
+	PinReset         CacheKey = "pin_reset:"
+	PinResetAttempts CacheKey = "pin_reset_attempts:"
 )
 
 func (ck CacheKey) String() string {
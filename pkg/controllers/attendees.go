@@ -229,13 +229,29 @@ func acceptInvite(c *gin.Context, ctx context.Context) {
 		return
 	}
 
+	// The budget is locked in the wallet's home currency
+	request.Budget = request.Budget.InCurrency(wallet.Currency)
+	if request.Budget.Currency != wallet.Currency {
+		response := hp.SetError(nil, "Budget must be in the wallet currency "+wallet.Currency, funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
 	// Check User has enough budget in wallet
-	if wallet.Balance < request.Budget {
+	if wallet.HomeBalance().LessThan(request.Budget) {
 		response := hp.SetError(err, "User does not have enough budget in wallet", funcName)
 		c.AbortWithStatusJSON(http.StatusBadRequest, response)
 		return
 	}
 
+	// The event budget is kept in the host's currency
+	eventBudget, _, err := hp.Convert(ctx, request.Budget, event.Budget.Currency)
+	if err != nil {
+		response := hp.SetError(err, "Error converting budget to the event currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
 	// Update the attendee and event with go routines
 	var wg sync.WaitGroup
 	wg.Add(3)
@@ -249,11 +265,12 @@ func acceptInvite(c *gin.Context, ctx context.Context) {
 		filter := bson.M{"event_id": request.EventID, "user_id": user.ID}
 		update := bson.M{
 			"$set": bson.M{
-				"status":      hp.Attending,
-				"accepted_at": primitive.NewDateTimeFromTime(time.Now()),
+				"status":          hp.Attending,
+				"accepted_at":     primitive.NewDateTimeFromTime(time.Now()),
+				"budget.currency": request.Budget.Currency,
 			},
 			"$inc": bson.M{
-				"budget": +request.Budget,
+				"budget.amount": request.Budget.Amount,
 			}}
 
 		_, err = attendeeCollection.UpdateOne(ctx, filter, update)
@@ -273,7 +290,7 @@ func acceptInvite(c *gin.Context, ctx context.Context) {
 			"$push": bson.M{"attendees": user.ID},
 			"$inc": bson.M{
 				"attendee_count": 1,
-				"budget":         +request.Budget,
+				"budget.amount":  eventBudget.Amount,
 			}}
 
 		_, err = eventCollection.UpdateOne(ctx, filter, update)
@@ -287,13 +304,7 @@ func acceptInvite(c *gin.Context, ctx context.Context) {
 	go func() {
 		defer wg.Done()
 
-		venue, err := hp.GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
-		if err != nil {
-			errChan <- err
-			return
-		}
-
-		err = hp.LockBudget(ctx, wallet, request.Budget, venue.OwnerID)
+		_, err := hp.LockBudget(ctx, wallet, request.Budget, request.EventID)
 		if err != nil {
 			errChan <- err
 			return
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	nf "github.com/Rhaqim/thedutchapp/pkg/notifications"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	GetEventBill = AbstractConnection(getEventBill)
+)
+
+// pushEventBill sends the event's bill breakdown to every participant over the websocket
+// It runs in the background with its own context so the request is not held up
+func pushEventBill(eventID primitive.ObjectID, funcName string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), config.ContextTimeout)
+		defer cancel()
+
+		event, err := hp.GetEvent(ctx, bson.M{"_id": eventID})
+		if err != nil {
+			hp.SetDebug("Error fetching event for bill update: "+err.Error(), funcName)
+			return
+		}
+
+		breakdown, err := hp.GetEventBillBreakdown(ctx, event)
+		if err != nil {
+			hp.SetDebug("Error working out bill update: "+err.Error(), funcName)
+			return
+		}
+
+		body, err := json.Marshal(breakdown)
+		if err != nil {
+			hp.SetDebug("Error encoding bill update: "+err.Error(), funcName)
+			return
+		}
+
+		msg := append([]byte(config.Bill_), body...)
+		for _, userID := range hp.EventParticipants(event) {
+			nf.SendNotification(userID, msg)
+		}
+	}()
+}
+
+// GetEventBill returns what every participant of the event had, paid and still owes
+// The same breakdown is sent over the websocket whenever it changes
+func getEventBill(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	eventID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid event id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	event, ok := participantEvent(c, ctx, eventID, user, funcName)
+	if !ok {
+		return
+	}
+
+	breakdown, err := hp.GetEventBillBreakdown(ctx, event)
+	if err != nil {
+		response := hp.SetError(err, "Error working out event bill", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Event bill", breakdown, funcName)
+	c.JSON(http.StatusOK, response)
+}
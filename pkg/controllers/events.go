@@ -82,16 +82,37 @@ func createEvent(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	if wallet.Balance < request.Budget {
+	// The budget is locked in the wallet's home currency
+	request.Budget = request.Budget.InCurrency(wallet.Currency)
+	if request.Budget.Currency != wallet.Currency {
+		response := hp.SetError(nil, "Budget must be in the wallet currency "+wallet.Currency, funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	if wallet.HomeBalance().LessThan(request.Budget) {
 		response := hp.SetError(err, "Insufficient balance to create Event", funcName)
 		c.AbortWithStatusJSON(http.StatusBadRequest, response)
 		return
 	}
 
+	// Get Venue
+	venue, err := hp.GetRestaurant(ctx, bson.M{"_id": request.RestaurantID})
+	if err != nil {
+		response := hp.SetError(err, "Error getting venue", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
 	request.ID = primitive.NewObjectID()
 	request.HostID = user.ID
 	request.EventType = hp.EventType(hp.EventType(request.EventType).String())
 	request.EventStatus = hp.Upcoming
+	// The bill is charged in the venue's currency
+	request.Bill = hp.ZeroMoney(venue.Currency)
+	request.Subtotal = hp.ZeroMoney(venue.Currency)
+	request.Tax = hp.ZeroMoney(venue.Currency)
+	request.ServiceCharge = hp.ZeroMoney(venue.Currency)
 	request.CreatedAt, request.UpdatedAt = hp.CreatedAtUpdatedAt()
 	// Add Host to Attendees
 	request.Attendees = append(request.Attendees, user.ID)
@@ -103,41 +124,15 @@ func createEvent(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	// Get Venue
-	venue, err := hp.GetRestaurant(ctx, bson.M{"_id": request.RestaurantID})
-	if err != nil {
-		response := hp.SetError(err, "Error getting venue", funcName)
-		c.AbortWithStatusJSON(http.StatusBadRequest, response)
-		return
-	}
-
 	// LOCK BUDGET
-	err = hp.LockBudget(ctx, wallet, request.Budget, venue.OwnerID)
+	// the budget stays locked until the host pays or the event ends
+	_, err = hp.LockBudget(ctx, wallet, request.Budget, request.ID)
 	if err != nil {
 		response := hp.SetError(err, "Error locking budget", funcName)
 		c.AbortWithStatusJSON(http.StatusBadRequest, response)
 		return
 	}
 
-	// Unlock Budget and return to wallet after 24 hours
-	go func() {
-		time.Sleep(24 * time.Hour)
-
-		c := context.Background()
-
-		err = hp.BudgetoWallet(c, venue.OwnerID, user)
-		if err != nil {
-			hp.SetDebug("Error returning budget to wallet: "+err.Error(), funcName)
-		}
-
-		msg := "Your budget of " + fmt.Sprintf("%.2f", request.Budget) + " has been returned to your wallet."
-
-		err = nf.AlertUser(config.BudgetReturned, msg, user.ID)
-		if err != nil {
-			hp.SetDebug("Error sending notification: "+err.Error(), funcName)
-		}
-	}()
-
 	// send invite to invited users
 	err = hp.SendInviteToEvent(ctx, request.ID, request.Invited, user)
 	if err != nil {
@@ -469,15 +464,17 @@ func deleteEvent(c *gin.Context, ctx context.Context) {
 
 	filter := bson.M{"_id": id, "host_id": user.ID}
 
-	deleteResult, err := eventCollection.DeleteOne(ctx, filter)
-
+	// Delete the event and return the budgets locked for it
+	event, released, err := hp.DeleteEvent(ctx, filter)
 	if err != nil {
 		response := hp.SetError(err, "Error deleting hosted event", funcName)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
 		return
 	}
 
-	response := hp.SetSuccess(" event deleted", deleteResult, funcName)
+	notifyBudgetsReleased(released, event.Title)
+
+	response := hp.SetSuccess(" event deleted", event, funcName)
 	c.JSON(http.StatusOK, response)
 }
 
@@ -517,34 +514,30 @@ func cancelEvent(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	// Get Venue
-	filter = bson.M{"_id": event.RestaurantID}
-	venue, err := hp.GetRestaurant(ctx, filter)
-	if err != nil {
-		response := hp.SetError(err, "Error getting venue", funcName)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
-		return
-	}
-
-	// Return the budget to the wallet
-	err = hp.BudgetoWallet(ctx, venue.OwnerID, user)
-	if err != nil {
-		response := hp.SetError(err, "Error returning budget to wallet", funcName)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
-		return
-	}
-
-	update := bson.M{
-		"$set": bson.M{"event_status": hp.Cancelled},
-	}
-
-	_, err = eventCollection.UpdateOne(ctx, filter, update)
+	// Cancel the event and return the budgets locked for it
+	released, err := hp.CancelEvent(ctx, filter)
 	if err != nil {
 		response := hp.SetError(err, "Error cancelling event", funcName)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
 		return
 	}
 
+	notifyBudgetsReleased(released, event.Title)
+
 	response := hp.SetSuccess(" event cancelled", nil, funcName)
 	c.JSON(http.StatusOK, response)
 }
+
+// notifyBudgetsReleased tells the owners of the budgets that they are back in their wallets
+func notifyBudgetsReleased(budgets []hp.Budget, title string) {
+	var funcName = ut.GetFunctionName()
+
+	for _, budget := range budgets {
+		msg := "Your budget of " + budget.Released.String() + " for " + title + " has been returned to your wallet."
+
+		err := nf.AlertUser(config.BudgetReturned, msg, budget.UserID)
+		if err != nil {
+			hp.SetDebug("Error sending notification: "+err.Error(), funcName)
+		}
+	}
+}
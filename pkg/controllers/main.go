@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"time"
 
 	"github.com/Rhaqim/thedutchapp/pkg/config"
 	"github.com/Rhaqim/thedutchapp/pkg/database"
@@ -11,8 +12,14 @@ import (
 type handlerFunc func(*gin.Context, context.Context)
 
 func AbstractConnection(fn handlerFunc) gin.HandlerFunc {
+	return AbstractConnectionWithTimeout(fn, config.ContextTimeout)
+}
+
+// AbstractConnectionWithTimeout is AbstractConnection for handlers that need longer
+// than config.ContextTimeout, such as exports that stream rows
+func AbstractConnectionWithTimeout(fn handlerFunc, timeout time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(c.Request.Context(), config.ContextTimeout)
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
 		defer cancel()
 		defer database.DisconnectMongoDB()
 		fn(c, ctx)
@@ -59,6 +59,20 @@ func createOrder(c *gin.Context, ctx context.Context) {
 		return
 	}
 
+	// The split covers the orders that were in when it was confirmed
+	if !event.SplitID.IsZero() {
+		response := hp.SetError(hp.ErrEventBillSplit, "Event bill is being split", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Shared lines can only be shared with people at the event
+	if err := hp.ValidateOrderShares(event, request); err != nil {
+		response := hp.SetError(err, "Invalid shared order line", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
 	request.ID = primitive.NewObjectID()
 	request.CustomerID = user.ID
 	request.CreatedAt = primitive.NewDateTimeFromTime(time.Now())
@@ -70,8 +84,8 @@ func createOrder(c *gin.Context, ctx context.Context) {
 
 	// Update Bill
 	billErrChan := make(chan error)
-	totalChan := make(chan float64)
-	go hp.UpdateBill(ctx, request, billErrChan, totalChan)
+	totalChan := make(chan hp.OrderBill)
+	go hp.UpdateBill(ctx, request, event, billErrChan, totalChan)
 
 	// Check for errors in UpdateStock goroutine
 	for err := range stockErrChan {
@@ -85,9 +99,17 @@ func createOrder(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	// Get total bill for all products from UpdateBill goroutine
-	// and add it to the order bill
-	request.Bill = <-totalChan
+	// Get the bill for all products with the venue's charges from UpdateBill goroutine
+	// and add it to the order
+	bill := <-totalChan
+	request.Subtotal = bill.Subtotal
+	request.Tax = bill.Tax
+	request.ServiceCharge = bill.ServiceCharge
+	request.Charges = bill.Charges
+	request.Bill = bill.Total
+
+	// Work out what each user owes for the order
+	request.Shares = hp.OrderPortions(request)
 
 	// Add order to database
 	insertResult, err := orderCollection.InsertOne(ctx, request)
@@ -157,6 +179,8 @@ func createOrder(c *gin.Context, ctx context.Context) {
 	)
 	notifyGroup.Send()
 
+	pushEventBill(event.ID, funcName)
+
 	response := hp.SetSuccess("Order created", insertResult, funcName)
 	c.JSON(http.StatusOK, response)
 }
@@ -239,7 +263,11 @@ func getUserEventOrders(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	filter := bson.M{"customer_id": user.ID, "event_id": event_id}
+	// orders the user placed or shares a line of
+	filter := bson.M{"event_id": event_id, "$or": bson.A{
+		bson.M{"customer_id": user.ID},
+		bson.M{"shares.user_id": user.ID},
+	}}
 
 	cursor, err := orderCollection.Find(ctx, filter)
 	if err != nil {
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	nf "github.com/Rhaqim/thedutchapp/pkg/notifications"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	CreatePaymentRequest  = AbstractConnection(createPaymentRequest)
+	GetPaymentRequests    = AbstractConnection(getPaymentRequests)
+	PayPaymentRequest     = AbstractConnection(payPaymentRequest)
+	DeclinePaymentRequest = AbstractConnection(declinePaymentRequest)
+	CancelPaymentRequest  = AbstractConnection(cancelPaymentRequest)
+)
+
+// CreatePaymentRequest asks one or more friends for an amount, optionally for an event
+func createPaymentRequest(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.CreatePaymentRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	// Ask in the requester's home currency unless another one is given
+	wallet, err := hp.GetWallet(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		response := hp.SetError(err, "Error getting wallet", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	currency := strings.ToUpper(request.Currency)
+	if currency == "" {
+		currency = wallet.Currency
+	}
+	if err := hp.ValidateCurrency(currency); err != nil {
+		response := hp.SetError(err, "Invalid currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	requests, err := hp.CreatePaymentRequests(ctx, user, request, hp.MoneyFromMajor(request.Amount, currency))
+	if err != nil {
+		response := hp.SetError(err, "Error creating payment request", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	for _, pr := range requests {
+		msg := user.Username + " has requested " + pr.Amount.String() + " from you"
+		if pr.Note != "" {
+			msg += " for " + pr.Note
+		}
+		nf.AlertUserOrLog(config.PaymentRequested, msg, pr.PayerID, funcName)
+	}
+
+	response := hp.SetSuccess("Payment requested", requests, funcName)
+	c.JSON(http.StatusCreated, response)
+}
+
+// GetPaymentRequests returns the user's payment requests
+// direction is sent or received, status filters them
+func getPaymentRequests(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	requests, err := hp.GetPaymentRequests(ctx, user.ID, c.Query("direction"), hp.PaymentRequestStatus(c.Query("status")))
+	if err != nil {
+		response := hp.SetError(err, "Error getting payment requests", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Payment requests", requests, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// PayPaymentRequest pays all or part of a payment request made to the user
+func payPaymentRequest(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.PayRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid payment request id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Veryfy Pin of the User is correct
+	if err := hp.VeryfyPin(ctx, user, request.TxnPin); err != nil {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
+
+	pr, err := hp.GetPaymentRequest(ctx, id, user.ID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		response := hp.SetError(err, "Payment request not found", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error getting payment request", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	// Payments are in the currency of the request
+	amount := hp.MoneyFromMajor(request.Amount, pr.Amount.Currency)
+
+	pr, txn, err := hp.PayPaymentRequest(ctx, user, id, amount)
+	if abortLimitError(c, err, funcName) {
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error paying payment request", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	requester := hp.GetUserByID(ctx, pr.RequesterID)
+	nf.AlertUserOrLog(config.PaymentRequestPaid,
+		user.Username+" has paid "+txn.Amount.String()+" of your "+pr.Amount.String()+" request, "+pr.Remaining().String()+" left",
+		pr.RequesterID, funcName)
+	nf.AlertUserOrLog(config.PaymentRequestPaid,
+		"You paid "+txn.Amount.String()+" of "+requester.Username+"'s "+pr.Amount.String()+" request",
+		user.ID, funcName)
+
+	response := hp.SetSuccess("Payment request paid", gin.H{
+		"payment_request": pr,
+		"transaction":     txn,
+	}, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// DeclinePaymentRequest refuses what is left of a payment request made to the user
+func declinePaymentRequest(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.DeclineRequest
+
+	// the reason is optional so an empty body is fine
+	if err := c.ShouldBind(&request); err != nil && !errors.Is(err, io.EOF) {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid payment request id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	pr, err := hp.DeclinePaymentRequest(ctx, user, id, request.Reason)
+	if err != nil {
+		response := hp.SetError(err, "Error declining payment request", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	msg := user.Username + " has declined your request for " + pr.Amount.String()
+	if pr.DeclineReason != "" {
+		msg += ": " + pr.DeclineReason
+	}
+	nf.AlertUserOrLog(config.PaymentRequestDeclined, msg, pr.RequesterID, funcName)
+	nf.AlertUserOrLog(config.PaymentRequestDeclined, "You declined a request for "+pr.Amount.String(), user.ID, funcName)
+
+	response := hp.SetSuccess("Payment request declined", pr, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// CancelPaymentRequest withdraws a payment request the user made
+func cancelPaymentRequest(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid payment request id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	pr, err := hp.CancelPaymentRequest(ctx, user, id)
+	if err != nil {
+		response := hp.SetError(err, "Error cancelling payment request", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	nf.AlertUserOrLog(config.PaymentRequestCancelled,
+		user.Username+" has cancelled their request for "+pr.Amount.String(), pr.PayerID, funcName)
+
+	response := hp.SetSuccess("Payment request cancelled", pr, funcName)
+	c.JSON(http.StatusOK, response)
+}
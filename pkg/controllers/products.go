@@ -49,6 +49,14 @@ func addProduct(c *gin.Context, ctx context.Context) {
 		return
 	}
 
+	// Products are priced in the restaurant's currency
+	request.Price, err = hp.PriceInVenueCurrency(ctx, request)
+	if err != nil {
+		response := hp.SetError(err, "Invalid price", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
 	// Check that product name is unique
 	filter := bson.M{"name": request.Name, "restaurant_id": request.RestaurantID}
 	_, err = hp.GetProduct(ctx, filter)
@@ -233,6 +241,14 @@ func updateProduct(c *gin.Context, ctx context.Context) {
 		return
 	}
 
+	// Products are priced in the restaurant's currency
+	request.Price, err = hp.PriceInVenueCurrency(ctx, request)
+	if err != nil {
+		response := hp.SetError(err, "Invalid price", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
 	request.UpdatedAt = primitive.NewDateTimeFromTime(time.Now())
 
 	updateResult, err := productCollection.UpdateOne(ctx, bson.M{"_id": request.ID}, request)
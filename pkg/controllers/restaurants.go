@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"net/http"
+	"strings"
 
 	"github.com/Rhaqim/thedutchapp/pkg/config"
 	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
@@ -15,11 +16,14 @@ import (
 var (
 	restaurantCollection = config.RestaurantCollection
 
-	CreateRestaurant = AbstractConnection(createRestaurant)
-	GetRestaurant    = AbstractConnection(getRestaurant)
-	GetRestaurants   = AbstractConnection(getRestaurants)
-	UpdateRestaurant = AbstractConnection(updateRestaurant)
-	DeleteRestaurant = AbstractConnection(deleteRestaurant)
+	CreateRestaurant  = AbstractConnection(createRestaurant)
+	GetRestaurant     = AbstractConnection(getRestaurant)
+	GetRestaurants    = AbstractConnection(getRestaurants)
+	UpdateRestaurant  = AbstractConnection(updateRestaurant)
+	DeleteRestaurant  = AbstractConnection(deleteRestaurant)
+	SetTipSuggestions = AbstractConnection(setTipSuggestions)
+	SetChargeRules    = AbstractConnection(setChargeRules)
+	GetTipTotals      = AbstractConnection(getTipTotals)
 )
 
 func createRestaurant(c *gin.Context, ctx context.Context) {
@@ -64,6 +68,12 @@ func createRestaurant(c *gin.Context, ctx context.Context) {
 	request.RestaurantUID = hp.RestaurantUID
 	request.Slug = ut.Slugify(request.Name)
 	request.OwnerID = user.ID
+	request.Currency = strings.ToUpper(request.Currency)
+	if err := hp.ValidateCurrency(request.Currency); err != nil {
+		response := hp.SetError(err, "Invalid currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
 	request.Category = hp.RestaurantCategory(hp.RestaurantCategory(request.Category).String())
 	request.CreatedAt, request.UpdatedAt = hp.CreatedAtUpdatedAt()
 	request.MapInfo.Lat, request.MapInfo.Long, request.MapInfo.PlaceID, _ = hp.GetLatLong(request.Address)
@@ -231,6 +241,17 @@ func updateRestaurant(c *gin.Context, ctx context.Context) {
 		return
 	}
 
+	// The fee is set by the platform, tip suggestions and charges have their own endpoints
+	current, err := hp.GetRestaurant(ctx, bson.M{"_id": request.ID, "owner_id": user.ID})
+	if err != nil {
+		response := hp.SetError(err, "Error getting restaurant", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+	request.FeePercentage = current.FeePercentage
+	request.TipSuggestions = current.TipSuggestions
+	request.Charges = current.Charges
+
 	// Modify the request
 	request.UpdatedAt, _ = hp.CreatedAtUpdatedAt()
 
@@ -304,3 +325,108 @@ func deleteRestaurant(c *gin.Context, ctx context.Context) {
 	response := hp.SetSuccess("Restaurant deleted successfully", id.Hex(), funcName)
 	c.JSON(http.StatusOK, response)
 }
+
+// SetTipSuggestions sets the tip percentages the restaurant suggests when customers pay
+func setTipSuggestions(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.TipSuggestionsRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	restaurant, err := hp.SetTipSuggestions(ctx, user, request)
+	if err != nil {
+		response := hp.SetError(err, "Error setting tip suggestions", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Tip suggestions set", restaurant.TipSuggestions, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// SetChargeRules sets the tax and service charges the restaurant adds to its bills
+func setChargeRules(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.ChargeRulesRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	restaurant, err := hp.SetChargeRules(ctx, user, request)
+	if err != nil {
+		response := hp.SetError(err, "Error setting charges", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Charges set", restaurant.Charges, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetTipTotals returns the tips the user's restaurant received
+// from, to and interval (day or month) filter and split the totals
+func getTipTotals(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.TipTotalsRequest
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		response := hp.SetError(err, "Error binding query", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(request.RestaurantID)
+	if err != nil {
+		response := hp.SetError(err, "Invalid restaurant id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Check Restaurant Belongs to User
+	if owner, err := hp.CheckRestaurantBelongsToUser(ctx, id, user); !owner {
+		response := hp.SetError(err, "restaurant does not belong to user", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	totals, err := hp.GetTipTotals(ctx, id, request)
+	if err != nil {
+		response := hp.SetError(err, "Error getting tip totals", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Tip totals", totals, funcName)
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	CreateScheduledTransfer = AbstractConnection(createScheduledTransfer)
+	GetScheduledTransfers   = AbstractConnection(getScheduledTransfers)
+	PauseScheduledTransfer  = AbstractConnection(pauseScheduledTransfer)
+	ResumeScheduledTransfer = AbstractConnection(resumeScheduledTransfer)
+	CancelScheduledTransfer = AbstractConnection(cancelScheduledTransfer)
+)
+
+// CreateScheduledTransfer schedules money to be sent to another user once or on a recurring rule
+// The transfers are sent by the scheduled_transfers job
+func createScheduledTransfer(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.ScheduledTransferRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	// Veryfy Pin of the User is correct
+	if err := hp.VeryfyPin(ctx, user, request.TxnPin); err != nil {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
+
+	receiver, err := hp.GetUser(ctx, bson.M{"username": request.Username})
+	if err != nil {
+		response := hp.SetError(err, "Error fetching user", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Send in the sender's home currency unless another one is asked for
+	wallet, err := hp.GetWallet(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		response := hp.SetError(err, "Error getting wallet", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	currency := strings.ToUpper(request.Currency)
+	if currency == "" {
+		currency = wallet.Currency
+	}
+	if err := hp.ValidateCurrency(currency); err != nil {
+		response := hp.SetError(err, "Invalid currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	transfer, err := hp.CreateScheduledTransfer(ctx, user, receiver, hp.MoneyFromMajor(request.Amount, currency), request)
+	if err != nil {
+		response := hp.SetError(err, "Error scheduling transfer", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Transfer scheduled", transfer, funcName)
+	c.JSON(http.StatusCreated, response)
+}
+
+// GetScheduledTransfers returns the transfers the user scheduled or will receive
+// status filters them, for example active or paused
+func getScheduledTransfers(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	transfers, err := hp.GetScheduledTransfers(ctx, user.ID, hp.ScheduleStatus(c.Query("status")))
+	if err != nil {
+		response := hp.SetError(err, "Error getting scheduled transfers", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Scheduled transfers", transfers, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// changeScheduledTransfer runs one of the sender's changes to a schedule and responds with the result
+func changeScheduledTransfer(c *gin.Context, ctx context.Context, change func(context.Context, primitive.ObjectID, primitive.ObjectID) (hp.ScheduledTransfer, error), msg, funcName string) {
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid scheduled transfer id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	transfer, err := change(ctx, id, user.ID)
+	if err != nil {
+		response := hp.SetError(err, "Error updating scheduled transfer", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess(msg, transfer, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// PauseScheduledTransfer stops an active schedule until it is resumed
+func pauseScheduledTransfer(c *gin.Context, ctx context.Context) {
+	changeScheduledTransfer(c, ctx, hp.PauseScheduledTransfer, "Scheduled transfer paused", ut.GetFunctionName())
+}
+
+// ResumeScheduledTransfer restarts a paused schedule from its next occurrence
+func resumeScheduledTransfer(c *gin.Context, ctx context.Context) {
+	changeScheduledTransfer(c, ctx, hp.ResumeScheduledTransfer, "Scheduled transfer resumed", ut.GetFunctionName())
+}
+
+// CancelScheduledTransfer stops a schedule for good
+func cancelScheduledTransfer(c *gin.Context, ctx context.Context) {
+	changeScheduledTransfer(c, ctx, hp.CancelScheduledTransfer, "Scheduled transfer cancelled", ut.GetFunctionName())
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	nf "github.com/Rhaqim/thedutchapp/pkg/notifications"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	GetSettlementPlan     = AbstractConnection(getSettlementPlan)
+	PaySettlement         = AbstractConnection(paySettlement)
+	SetSettlementDeadline = AbstractConnection(setSettlementDeadline)
+	GetOverdueShares      = AbstractConnection(getOverdueShares)
+)
+
+// participantEvent gets the event and checks the user is its host or an attendee
+func participantEvent(c *gin.Context, ctx context.Context, eventID primitive.ObjectID, user hp.UserResponse, funcName string) (hp.Event, bool) {
+	event, err := hp.GetEvent(ctx, bson.M{"_id": eventID})
+	if err != nil {
+		response := hp.SetError(err, "Error fetching event", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return event, false
+	}
+
+	if !hp.IsEventParticipant(event, user.ID) {
+		response := hp.SetError(errors.New("not a participant of the event"), "You are not part of this event", funcName)
+		c.AbortWithStatusJSON(http.StatusForbidden, response)
+		return event, false
+	}
+
+	return event, true
+}
+
+// GetSettlementPlan returns everyone's net balance for the event and the transfers that settle them
+func getSettlementPlan(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	eventID, err := primitive.ObjectIDFromHex(c.Query("event_id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid event id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	event, ok := participantEvent(c, ctx, eventID, user, funcName)
+	if !ok {
+		return
+	}
+
+	plan, err := hp.GetSettlementPlan(ctx, event)
+	if err != nil {
+		response := hp.SetError(err, "Error working out settlement", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Settlement plan", plan, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// PaySettlement pays the user's transfer to another participant in the event's settlement plan
+func paySettlement(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.PaySettlementRequest
+
+	if err := c.ShouldBind(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	event, ok := participantEvent(c, ctx, request.EventID, user, funcName)
+	if !ok {
+		return
+	}
+
+	// Veryfy Pin of the User is correct
+	if err := hp.VeryfyPin(ctx, user, request.TxnPin); err != nil {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
+
+	transfer, txn, err := hp.PaySettlement(ctx, user, event, request.ToID)
+	if abortLimitError(c, err, funcName) {
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error paying settlement", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	nf.AlertUserOrLog(config.SettlementPaid,
+		user.Username+" has paid you "+transfer.Amount.String()+" to settle up for "+event.Title,
+		transfer.ToID, funcName)
+
+	pushEventBill(event.ID, funcName)
+
+	response := hp.SetSuccess("Settlement paid", gin.H{
+		"transfer":    transfer,
+		"transaction": txn,
+	}, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// SetSettlementDeadline sets when the attendees of an event the user hosts must have paid
+// and whether what is left unpaid is charged automatically then
+func setSettlementDeadline(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.SettlementDeadlineRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	event, err := hp.SetSettlementDeadline(ctx, user, request, time.Now())
+	if err != nil {
+		response := hp.SetError(err, "Error setting settlement deadline", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	msg := user.Username + " wants everyone to have paid for " + event.Title + " by " +
+		event.SettlementDeadline.Time().UTC().Format(time.RFC1123)
+	if event.AutoCharge == hp.AutoChargeBudget {
+		msg += ", anything unpaid is then taken from your budget for the event if it covers it"
+	}
+	if event.AutoCharge == hp.AutoChargeWallet {
+		msg += ", anything unpaid is then taken from your budget for the event and your wallet"
+	}
+	for _, userID := range hp.EventParticipants(event) {
+		if userID != user.ID {
+			nf.AlertUserOrLog(config.SettlementDeadlineSet, msg, userID, funcName)
+		}
+	}
+
+	response := hp.SetSuccess("Settlement deadline set", event, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetOverdueShares returns who has not paid their share of the user's events past the
+// settlement deadline, event_id narrows it to one event
+func getOverdueShares(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	var eventID primitive.ObjectID
+	if id := c.Query("event_id"); id != "" {
+		eventID, err = primitive.ObjectIDFromHex(id)
+		if err != nil {
+			response := hp.SetError(err, "Invalid event id", funcName)
+			c.AbortWithStatusJSON(http.StatusBadRequest, response)
+			return
+		}
+	}
+
+	shares, err := hp.GetOverdueShares(ctx, user, eventID, time.Now())
+	if err != nil {
+		response := hp.SetError(err, "Error getting overdue shares", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Overdue shares", shares, funcName)
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	nf "github.com/Rhaqim/thedutchapp/pkg/notifications"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	PreviewSplit  = AbstractConnection(previewSplit)
+	GetSplits     = AbstractConnection(getSplits)
+	ConfirmSplit  = AbstractConnection(confirmSplit)
+	CancelSplit   = AbstractConnection(cancelSplit)
+	PaySplitShare = AbstractConnection(paySplitShare)
+)
+
+// splitID reads the split id from the path
+func splitID(c *gin.Context, funcName string) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid split id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return id, false
+	}
+	return id, true
+}
+
+// PreviewSplit works out everyone's share of the event's unpaid orders
+// under the strategy asked for, nobody is charged until the host confirms it
+func previewSplit(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.SplitRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	split, err := hp.PreviewSplit(ctx, user, request)
+	if err != nil {
+		response := hp.SetError(err, "Error splitting bill", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Bill split preview", split, funcName)
+	c.JSON(http.StatusCreated, response)
+}
+
+// GetSplits returns the splits of an event the user created or has a share in
+func getSplits(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	eventID, err := primitive.ObjectIDFromHex(c.Query("event_id"))
+	if err != nil {
+		response := hp.SetError(err, "Invalid event id", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	splits, err := hp.GetSplits(ctx, eventID, user.ID)
+	if err != nil {
+		response := hp.SetError(err, "Error getting splits", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Bill splits", splits, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// ConfirmSplit makes a previewed split the split of the event and tells everyone what they owe
+func confirmSplit(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, ok := splitID(c, funcName)
+	if !ok {
+		return
+	}
+
+	split, err := hp.ConfirmSplit(ctx, user, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		response := hp.SetError(err, "Split not found", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error confirming split", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	event, err := hp.GetEvent(ctx, bson.M{"_id": split.EventID})
+	if err != nil {
+		hp.SetError(err, "Error fetching event", funcName)
+	}
+
+	for _, share := range split.Shares {
+		nf.AlertUserOrLog(config.SplitConfirmed,
+			user.Username+" has split the bill for "+event.Title+", your share is "+share.Amount.String(),
+			share.UserID, funcName)
+	}
+
+	response := hp.SetSuccess("Bill split confirmed", split, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// CancelSplit drops a split nobody has paid into
+func cancelSplit(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, ok := splitID(c, funcName)
+	if !ok {
+		return
+	}
+
+	split, err := hp.CancelSplit(ctx, user, id)
+	if err != nil {
+		response := hp.SetError(err, "Error cancelling split", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// only a confirmed split was sent to the participants
+	if split.ConfirmedAt != 0 {
+		for _, share := range split.Shares {
+			nf.AlertUserOrLog(config.SplitCancelled, user.Username+" has cancelled the bill split", share.UserID, funcName)
+		}
+	}
+
+	response := hp.SetSuccess("Bill split cancelled", split, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// PaySplitShare pays the user's share of a confirmed split to the venue, with an optional tip
+func paySplitShare(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.PaySplitShareRequest
+
+	if err := c.ShouldBind(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	id, ok := splitID(c, funcName)
+	if !ok {
+		return
+	}
+
+	// Veryfy Pin of the User is correct
+	if err := hp.VeryfyPin(ctx, user, request.TxnPin); err != nil {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
+
+	split, txn, released, err := hp.PaySplitShare(ctx, user, id, request.TipRequest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		response := hp.SetError(err, "Split not found", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+	if abortLimitError(c, err, funcName) {
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error paying split share", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	event, err := hp.GetEvent(ctx, bson.M{"_id": split.EventID})
+	if err != nil {
+		hp.SetError(err, "Error fetching event", funcName)
+	}
+
+	venue, err := hp.GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
+	if err != nil {
+		hp.SetError(err, "Error fetching venue", funcName)
+	}
+
+	msg := user.Username + " has paid their share of " + txn.Amount.String() + tipNote(txn) + " for " + event.Title
+	nf.AlertUserOrLog(config.SplitSharePaid, msg, venue.OwnerID, funcName)
+	if event.HostID != user.ID {
+		nf.AlertUserOrLog(config.SplitSharePaid, msg, event.HostID, funcName)
+	}
+
+	if split.Status == hp.SplitSettled {
+		for _, share := range split.Shares {
+			nf.AlertUserOrLog(config.SplitSettled, "Everyone has paid their share of the bill for "+event.Title, share.UserID, funcName)
+		}
+		notifyBudgetsReleased(released, event.Title)
+	}
+
+	pushEventBill(split.EventID, funcName)
+
+	response := hp.SetSuccess("Split share paid", gin.H{
+		"split":       split,
+		"transaction": txn,
+	}, funcName)
+	c.JSON(http.StatusOK, response)
+}
@@ -2,8 +2,12 @@ package controllers
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Rhaqim/thedutchapp/pkg/auth"
 	"github.com/Rhaqim/thedutchapp/pkg/config"
@@ -19,6 +23,9 @@ var (
 	CreateTransaction       = AbstractConnection(createTransaction)
 	UpdateTransactionStatus = AbstractConnection(updateTransactionStatus)
 	GetTransactions         = AbstractConnection(getTransactions)
+	ExportTransactions      = AbstractConnectionWithTimeout(exportTransactions, config.ExportTimeout)
+	GetTransactionReceipt   = AbstractConnection(getTransactionReceipt)
+	RefundTransaction       = AbstractConnection(refundTransaction)
 	PayBillforEvent         = AbstractConnection(payBillforEvent)
 	SendMoneytoHost         = AbstractConnection(sendMoneytoHost)
 	PayOwnBill              = AbstractConnection(payOwnBill)
@@ -53,6 +60,20 @@ func createTransaction(c *gin.Context, ctx context.Context) {
 		return
 	}
 
+	wallet, err := hp.GetWallet(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		response := hp.SetError(err, "Error getting wallet", funcName)
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
+	request.Amount = request.Amount.InCurrency(wallet.Currency)
+	if err := hp.ValidateCurrency(request.Amount.Currency); err != nil {
+		response := hp.SetError(err, "Invalid currency", funcName)
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
 	sufficientBalance := hp.VerifyWalletSufficientBalance(ctx, user, request.Amount)
 
 	if !sufficientBalance {
@@ -61,9 +82,17 @@ func createTransaction(c *gin.Context, ctx context.Context) {
 		return
 	}
 
+	// Record what the transfer costs the sender
+	request.SourceAmount, request.ExchangeRate, err = hp.QuotePayment(ctx, wallet, request.Amount)
+	if err != nil {
+		response := hp.SetError(err, "Error converting amount", funcName)
+		c.JSON(http.StatusBadRequest, response)
+		return
+	}
+
 	// modify the request
 	request.ID = primitive.NewObjectID()
-	request.TransactionUID = hp.TransactionUID
+	request.TransactionUID = hp.NewTransactionUID()
 	request.FromID = user.ID
 	request.Status = hp.TxnPending
 
@@ -167,10 +196,21 @@ func updateTransactionStatus(c *gin.Context, ctx context.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
+// getTransactions returns a page of the user's transactions, newest first
+// It can be filtered by type, status, date range (from, to), counterparty and event_id
+// Pass next_cursor from the response as cursor to get the next page
 func getTransactions(c *gin.Context, ctx context.Context) {
 
 	var funcName = ut.GetFunctionName()
 
+	var request hp.TransactionFilter
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		response := hp.SetError(err, "Error binding query", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
 	user, err := hp.GetUserFromToken(c)
 	if err != nil {
 		response := hp.SetError(err, "User not logged in", funcName)
@@ -178,36 +218,251 @@ func getTransactions(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	filter := bson.M{
-		"$or": []bson.M{
-			{"fromId": user.ID},
-			{"toId": user.ID},
-		},
+	page, err := hp.GetTransactionPage(ctx, user, request)
+	if err != nil {
+		response := hp.SetError(err, "Error fetching transactions", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
 	}
 
-	var transactions []hp.Transactions
+	response := hp.SetSuccess("Transactions fetched successfully", page, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// exportTransactions streams all of the user's transactions matching the filters
+// of getTransactions as CSV (the default) or as a JSON array with format=json
+// Rows are written as they are read so large histories do not time out
+func exportTransactions(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	var request hp.TransactionFilter
+
+	if err := c.ShouldBindQuery(&request); err != nil {
+		response := hp.SetError(err, "Error binding query", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	format := strings.ToLower(c.DefaultQuery("format", "csv"))
+	if format != "csv" && format != "json" {
+		response := hp.SetError(nil, "format must be csv or json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
 
-	cursor, err := config.TransactionCollection.Find(ctx, filter)
+	cursor, err := hp.StreamTransactions(ctx, user, request)
 	if err != nil {
 		response := hp.SetError(err, "Error fetching transactions", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	filename := "transactions-" + time.Now().UTC().Format("20060102") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	var rows int
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		w.Write(hp.TransactionCSVHeader)
+
+		for cursor.Next(ctx) {
+			var txn hp.Transactions
+			if err = cursor.Decode(&txn); err != nil {
+				break
+			}
+			w.Write(hp.TransactionCSVRow(txn, user))
+
+			// flush in batches so the client gets rows while the export runs
+			if rows++; rows%100 == 0 {
+				w.Flush()
+				c.Writer.Flush()
+			}
+		}
+		w.Flush()
+	} else {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Writer.WriteString("[")
+		enc := json.NewEncoder(c.Writer)
+
+		for cursor.Next(ctx) {
+			var txn hp.Transactions
+			if err = cursor.Decode(&txn); err != nil {
+				break
+			}
+			if rows > 0 {
+				c.Writer.WriteString(",")
+			}
+			enc.Encode(txn)
+
+			if rows++; rows%100 == 0 {
+				c.Writer.Flush()
+			}
+		}
+		c.Writer.WriteString("]")
+	}
+	c.Writer.Flush()
+
+	// the status is already sent, an error can only end the stream early
+	if err == nil {
+		err = cursor.Err()
+	}
+	if err != nil {
+		hp.SetDebug("transaction export stopped after "+strconv.Itoa(rows)+" rows: "+err.Error(), funcName)
+		return
+	}
+
+	hp.SetInfo("exported "+strconv.Itoa(rows)+" transactions", funcName)
+}
+
+// getTransactionReceipt returns the transaction with the reference and its receipt
+// Only the payer, the payee or an admin can see it
+// format=html or format=text returns the rendered receipt instead of JSON
+func getTransactionReceipt(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	txn, err := hp.GetTransactionByReference(ctx, c.Param("reference"))
+	if err != nil {
+		response := hp.SetError(err, "Transaction not found", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+
+	if txn.FromID != user.ID && txn.ToID != user.ID && user.Role != hp.Admin {
+		response := hp.SetError(nil, "Transaction not found", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+
+	receipt, err := hp.BuildReceipt(ctx, txn)
+	if err != nil {
+		response := hp.SetError(err, "Error building receipt", funcName)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
 		return
 	}
 
-	if err = cursor.All(ctx, &transactions); err != nil {
-		response := hp.SetError(err, "Error fetching transactions", funcName)
+	format := strings.ToLower(c.DefaultQuery("format", "json"))
+	if format == "json" {
+		response := hp.SetSuccess("Transaction fetched successfully", gin.H{
+			"transaction": txn,
+			"receipt":     receipt,
+		}, funcName)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	html, text, err := hp.RenderReceipt(receipt)
+	if err != nil {
+		response := hp.SetError(err, "Error rendering receipt", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	switch format {
+	case "html":
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+	case "text":
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(text))
+	default:
+		response := hp.SetError(nil, "format must be json, html or text", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+	}
+}
+
+// refundTransaction reverses part or all of a payment for an event or its orders
+// Only the restaurant owner that received the payment or an admin can refund it
+// The money goes back to the payer's wallet and the payer is notified
+// it returns the refund transaction
+func refundTransaction(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	var request hp.RefundRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		response := hp.SetError(err, "Error binding JSON", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	txn, err := hp.GetTransactionByReference(ctx, request.Reference)
+	if err != nil {
+		response := hp.SetError(err, "Transaction not found", funcName)
+		c.AbortWithStatusJSON(http.StatusNotFound, response)
+		return
+	}
+
+	allowed, err := hp.CanRefundTransaction(ctx, txn, user)
+	if err != nil {
+		response := hp.SetError(err, "Error checking refund permission", funcName)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
 		return
 	}
+	if !allowed {
+		response := hp.SetError(nil, "You are not allowed to refund this transaction", funcName)
+		c.AbortWithStatusJSON(http.StatusForbidden, response)
+		return
+	}
 
-	response := hp.SetSuccess("Transactions fetched successfully", transactions, funcName)
+	refund, err := hp.RefundTransaction(ctx, request, user)
+	if err != nil {
+		response := hp.SetError(err, "Error refunding transaction", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Send Notification to the payer
+	msg := "A refund of " + refund.Amount.String() + " for " + txn.TransactionUID + " has been sent to your wallet"
+
+	err = nf.AlertUser(config.OrderRefunded, msg, refund.ToID)
+	if err != nil {
+		hp.SetDebug("Error sending notification: "+err.Error(), funcName)
+	}
+
+	if !txn.EventID.IsZero() {
+		pushEventBill(txn.EventID, funcName)
+	}
+
+	response := hp.SetSuccess("Transaction refunded successfully", refund, funcName)
 	c.JSON(http.StatusOK, response)
 }
 
 /* EVENT TRANSACTION */
 
+// tipNote describes the tip included in a bill payment for notifications
+func tipNote(txn hp.Transactions) string {
+	if txn.Tip.IsZero() {
+		return ""
+	}
+	return " including a " + txn.Tip.String() + " tip"
+}
+
 // PayBill sends money to the venue of the event
-// it takes the event id and the pin of the user paying for the event
+// it takes the event id, the pin of the user paying for the event and an optional tip
 // Verifies the pin and confirms user has suffiecient amount in wallet
 // Sends the money to the venue's owner's wallet
 // Updates the Event Status to Finished and the bills for the Users to Paid
@@ -245,6 +500,10 @@ func payBillforEvent(c *gin.Context, ctx context.Context) {
 
 	// Verify Event for Payment
 	err = hp.VerificationforEventPayment(ctx, request, event, user)
+	if hp.IsPinError(err) {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
 	if err != nil {
 		response := hp.SetError(err, "Error verifying event payment", funcName)
 		c.JSON(http.StatusBadRequest, response)
@@ -252,35 +511,26 @@ func payBillforEvent(c *gin.Context, ctx context.Context) {
 	}
 
 	// Begin Transaction
-	txn, err := hp.SendtoVenuePayforEvent(ctx, event, user)
+	// Event Status to Finished
+	// Orders Paid to True
+	// Budgets left over are returned
+	txn, released, err := hp.SendtoVenuePayforEvent(ctx, event, user, request.TipRequest)
+	if abortLimitError(c, err, funcName) {
+		return
+	}
 	if err != nil {
 		response := hp.SetError(err, "Error sending money to venue", funcName)
 		c.JSON(http.StatusBadRequest, response)
 		return
 	}
-
-	// Update Event and Orders
-	// Event Status to Finished
-	// Orders Paid to True
-	eventErrChan := make(chan error, 1)
-	orderErrChan := make(chan error, 1)
-
-	go hp.UpdateEventandOrders(ctx, event, txn, eventErrChan, orderErrChan)
-
-	select {
-	case err := <-eventErrChan:
-		hp.SetError(err, "Error updating event status", funcName)
-	case err := <-orderErrChan:
-		hp.SetError(err, "Error updating order status", funcName)
-	default:
-	}
+	notifyBudgetsReleased(released, event.Title)
 
 	// Send Notification to the Venue
-	billAmount := strconv.FormatFloat(txn.Amount, 'f', 2, 64)
+	billAmount := txn.Amount.String()
 
 	msgVenue := []byte(config.Transaction_ +
 		user.Username + " has paid the bill for " + event.Title +
-		" of " + billAmount + " money has been sent to your wallet",
+		" of " + billAmount + tipNote(txn) + " money has been sent to your wallet",
 	)
 
 	venue, err := hp.GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
@@ -297,12 +547,14 @@ func payBillforEvent(c *gin.Context, ctx context.Context) {
 
 	notifyVenue.Send()
 
+	pushEventBill(event.ID, funcName)
+
 	response := hp.SetSuccess("Money sent to venue successfully", txn, funcName)
 	c.JSON(http.StatusOK, response)
 }
 
 // SendMoneytoHost sends money for Orders to the host of the event
-// it takes the event id and the pin of the user sending the money
+// it takes the event id, the pin of the user sending the money and an optional tip
 // Verifies the pin and confirms user has suffiecient amount in wallet
 // It sends the money directly to the host's wallet
 // Sends a notification to the host about the payment
@@ -338,13 +590,20 @@ func sendMoneytoHost(c *gin.Context, ctx context.Context) {
 	}
 
 	err = hp.VerificationforEventPayment(ctx, request, event, user)
+	if hp.IsPinError(err) {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
 	if err != nil {
 		response := hp.SetError(err, "Error verifying event payment", funcName)
 		c.JSON(http.StatusBadRequest, response)
 		return
 	}
 
-	txn, err := hp.SendToHost(ctx, event, user)
+	txn, err := hp.SendToHost(ctx, event, user, request.TipRequest)
+	if abortLimitError(c, err, funcName) {
+		return
+	}
 	if err != nil {
 		response := hp.SetError(err, "Error sending money to host", funcName)
 		c.JSON(http.StatusBadRequest, response)
@@ -352,10 +611,10 @@ func sendMoneytoHost(c *gin.Context, ctx context.Context) {
 	}
 
 	// Send Notification to the Host
-	billAmount := strconv.FormatFloat(txn.Amount, 'f', 2, 64)
+	billAmount := txn.Amount.String()
 
 	msgHost := []byte(config.Transaction_ +
-		user.Username + " has sent you " + billAmount +
+		user.Username + " has sent you " + billAmount + tipNote(txn) +
 		" for " + event.Title,
 	)
 
@@ -368,12 +627,14 @@ func sendMoneytoHost(c *gin.Context, ctx context.Context) {
 
 	notifyHost.Send()
 
+	pushEventBill(event.ID, funcName)
+
 	response := hp.SetSuccess("Money sent to host successfully", txn, funcName)
 	c.JSON(http.StatusOK, response)
 }
 
 // PayOwnBill pays the bill for Orders made by the user
-// it takes the event id and the pin of the user sending the money
+// it takes the event id, the pin of the user sending the money and an optional tip
 // Verifies the pin and confirms user has suffiecient amount in wallet
 // It sends the money directly to the venue owner's wallet
 // Sends a notification to the venue owner about the payment
@@ -411,6 +672,10 @@ func payOwnBill(c *gin.Context, ctx context.Context) {
 
 	// Verify Payment for Event
 	err = hp.VerificationforEventPayment(ctx, request, event, user)
+	if hp.IsPinError(err) {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
 	if err != nil {
 		response := hp.SetError(err, "Error verifying event payment", funcName)
 		c.JSON(http.StatusBadRequest, response)
@@ -418,32 +683,19 @@ func payOwnBill(c *gin.Context, ctx context.Context) {
 	}
 
 	// Pay Own Bill
-	txn, err := hp.PayOwnBillforEvent(ctx, event, user)
+	// All Customer Orders for the Event are updated to paid with the payment
+	txn, err := hp.PayOwnBillforEvent(ctx, event, user, request.TipRequest)
+	if abortLimitError(c, err, funcName) {
+		return
+	}
 	if err != nil {
 		response := hp.SetError(err, "Error paying own bill", funcName)
 		c.JSON(http.StatusBadRequest, response)
 		return
 	}
 
-	// Update All Customer Orders for the Event to paid
-	orderErrChan := make(chan error)
-	eventErrChan := make(chan error)
-
-	go hp.UpdateCustomerOrders(ctx, event, user, txn, orderErrChan, eventErrChan)
-
-	select {
-	case err := <-orderErrChan:
-		if err != nil {
-			hp.SetError(err, "Error updating customer orders", funcName)
-		}
-	case err := <-eventErrChan:
-		if err != nil {
-			hp.SetError(err, "Error updating event", funcName)
-		}
-	}
-
 	// Send Notification to the Host
-	billAmount := strconv.FormatFloat(txn.Amount, 'f', 2, 64)
+	billAmount := txn.Amount.String()
 
 	venue, err := hp.GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
 	if err != nil {
@@ -452,7 +704,7 @@ func payOwnBill(c *gin.Context, ctx context.Context) {
 
 	msgHost := []byte(config.Transaction_ +
 		user.Username + " has paid their bill for " + event.Title +
-		" amount of " + billAmount + " has been sent to " + venue.Name,
+		" amount of " + billAmount + tipNote(txn) + " has been sent to " + venue.Name,
 	)
 
 	hostList := []primitive.ObjectID{event.HostID, venue.OwnerID}
@@ -464,6 +716,8 @@ func payOwnBill(c *gin.Context, ctx context.Context) {
 
 	notifyHost.Send()
 
+	pushEventBill(event.ID, funcName)
+
 	response := hp.SetSuccess("Bill paid successfully", txn, funcName)
 	c.JSON(http.StatusOK, response)
 }
@@ -493,9 +747,8 @@ func sendToOtherUsers(c *gin.Context, ctx context.Context) {
 	}
 
 	// Veryfy Pin of the User is correct
-	if !hp.VeryfyPin(ctx, user, request.TxnPin) {
-		response := hp.SetError(err, "Incorrect Pin", funcName)
-		c.JSON(http.StatusBadRequest, response)
+	if err := hp.VeryfyPin(ctx, user, request.TxnPin); err != nil {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
 		return
 	}
 
@@ -510,7 +763,28 @@ func sendToOtherUsers(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	txn, err := hp.SendToOtherUsers(ctx, user2, user, request.Amount)
+	// Send in the sender's home currency unless another one is asked for
+	wallet, err := hp.GetWallet(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		response := hp.SetError(err, "Error getting wallet", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	currency := strings.ToUpper(request.Currency)
+	if currency == "" {
+		currency = wallet.Currency
+	}
+	if err := hp.ValidateCurrency(currency); err != nil {
+		response := hp.SetError(err, "Invalid currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	txn, err := hp.SendToOtherUsers(ctx, user2, user, hp.MoneyFromMajor(request.Amount, currency))
+	if abortLimitError(c, err, funcName) {
+		return
+	}
 	if err != nil {
 		response := hp.SetError(err, "Error sending money to other users", funcName)
 		c.JSON(http.StatusBadRequest, response)
@@ -518,7 +792,7 @@ func sendToOtherUsers(c *gin.Context, ctx context.Context) {
 	}
 
 	// Send Notification to the Users
-	billAmount := strconv.FormatFloat(txn.Amount, 'f', 2, 64)
+	billAmount := txn.Amount.String()
 
 	msg := user.Username + " has sent you " + billAmount
 
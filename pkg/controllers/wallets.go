@@ -2,11 +2,16 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Rhaqim/thedutchapp/pkg/auth"
 	"github.com/Rhaqim/thedutchapp/pkg/config"
 	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	nf "github.com/Rhaqim/thedutchapp/pkg/notifications"
 	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
@@ -16,10 +21,17 @@ import (
 var (
 	walletCollection = config.WalletCollection
 
-	CreateWallet     = AbstractConnection(createWallet)
-	ChangePin        = AbstractConnection(changePin)
-	FundWallet       = AbstractConnection(fundWallet)
-	GetWalletBalance = AbstractConnection(getWalletBalance)
+	CreateWallet       = AbstractConnection(createWallet)
+	ChangePin          = AbstractConnection(changePin)
+	RequestPinReset    = AbstractConnection(requestPinReset)
+	ResetPin           = AbstractConnection(resetPin)
+	FundWallet         = AbstractConnection(fundWallet)
+	GetWalletBalance   = AbstractConnection(getWalletBalance)
+	GetWalletLedger    = AbstractConnection(getWalletLedger)
+	GetLockedFunds     = AbstractConnection(getLockedFunds)
+	GetWalletLimits    = AbstractConnection(getWalletLimits)
+	GetWalletStatement = AbstractConnection(getWalletStatement)
+	WithdrawFromWallet = AbstractConnection(withdrawFromWallet)
 )
 
 func createWallet(c *gin.Context, ctx context.Context) {
@@ -27,7 +39,8 @@ func createWallet(c *gin.Context, ctx context.Context) {
 	var funcName = ut.GetFunctionName()
 
 	var walletPin struct {
-		TxnPin string `form:"txn_pin" binding:"required"`
+		TxnPin   string `form:"txn_pin" binding:"required"`
+		Currency string `form:"currency"`
 	}
 
 	var request hp.Wallet
@@ -68,6 +81,16 @@ func createWallet(c *gin.Context, ctx context.Context) {
 	// modify request
 	request.ID = primitive.NewObjectID()
 	request.UserID = user.ID
+	request.Currency = strings.ToUpper(walletPin.Currency)
+	if request.Currency == "" {
+		request.Currency = config.DefaultCurrency
+	}
+	if err := hp.ValidateCurrency(request.Currency); err != nil {
+		response := hp.SetError(err, "Invalid wallet currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+	request.Balances = map[string]int64{request.Currency: 0}
 	request.TxnPin, err = auth.HashPassword(walletPin.TxnPin)
 	if err != nil {
 		response := hp.SetError(err, "Error hashing password", funcName)
@@ -128,11 +151,9 @@ func changePin(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	// Check if old pin is correct
-	ok := auth.CheckPasswordHash(request.OldPin, wallet.TxnPin)
-	if !ok {
-		response := hp.SetError(err, "Old pin is incorrect", funcName)
-		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+	// Check if old pin is correct, it counts towards the lockout like any other pin
+	if err := hp.VeryfyPin(ctx, user, request.OldPin); err != nil {
+		abortPinError(c, user, err, "Old pin is incorrect", funcName)
 		return
 	}
 
@@ -163,6 +184,136 @@ func changePin(c *gin.Context, ctx context.Context) {
 	c.JSON(http.StatusOK, response)
 }
 
+// abortPinError responds to a pin that was not accepted
+// A locked wallet gets 423 and the user is told when their wallet gets locked
+func abortPinError(c *gin.Context, user hp.UserResponse, err error, msg, funcName string) {
+	if !hp.IsPinError(err) {
+		response := hp.SetError(err, "Error verifying pin", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	if !errors.Is(err, hp.ErrWalletLocked) {
+		response := hp.SetError(err, msg, funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	if errors.Is(err, hp.ErrTooManyPinAttempts) {
+		alert := "Your wallet has been locked for " + config.PinLockDuration.String() +
+			" after too many incorrect pins. If this was not you, reset your pin."
+		if err := nf.AlertUser(config.WalletLocked, alert, user.ID); err != nil {
+			hp.SetDebug("Error sending notification: "+err.Error(), funcName)
+		}
+	}
+
+	if lockedFor, lockErr := hp.PinLockedFor(user.ID); lockErr == nil && lockedFor > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(lockedFor.Seconds())))
+	}
+
+	response := hp.SetError(err, "Wallet is locked, try again later or reset your pin", funcName)
+	c.AbortWithStatusJSON(http.StatusLocked, response)
+}
+
+// abortLimitError responds with 403 and the limit that was hit if the error is a *hp.LimitError
+// It returns false for any other error
+func abortLimitError(c *gin.Context, err error, funcName string) bool {
+	var limitErr *hp.LimitError
+	if !errors.As(err, &limitErr) {
+		return false
+	}
+
+	response := hp.SetError(err, "Limit exceeded", funcName)
+	response.Data = limitErr
+	c.AbortWithStatusJSON(http.StatusForbidden, response)
+	return true
+}
+
+// GetWalletLimits returns the user's limits for their KYC tier and how much of them is used
+func getWalletLimits(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	usage, err := hp.GetLimitUsage(ctx, user)
+	if err != nil {
+		response := hp.SetError(err, "Error getting limits", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess("Wallet limits", usage, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// RequestPinReset emails the user a code to reset their transaction pin
+func requestPinReset(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	err = hp.SendPinResetCode(ctx, user)
+	if err != nil {
+		response := hp.SetError(err, "Error sending pin reset code", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Pin reset code sent to "+user.Email, nil, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPin sets a new transaction pin with the code from RequestPinReset
+// It also unlocks a wallet locked by incorrect pins
+func resetPin(c *gin.Context, ctx context.Context) {
+	var funcName = ut.GetFunctionName()
+
+	var request hp.PinResetRequest
+
+	if err := c.Bind(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	err = hp.ResetPin(ctx, user, request.Code, request.NewPin)
+	if errors.Is(err, hp.ErrInvalidPinResetCode) {
+		response := hp.SetError(err, "Invalid pin reset code", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error resetting pin", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	err = nf.AlertUser(config.PinChanged, "Your transaction pin was reset.", user.ID)
+	if err != nil {
+		hp.SetDebug("Error sending notification: "+err.Error(), funcName)
+	}
+
+	response := hp.SetSuccess("Pin reset", nil, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
 func fundWallet(c *gin.Context, ctx context.Context) {
 
 	var funcName = ut.GetFunctionName()
@@ -182,23 +333,112 @@ func fundWallet(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	// Perform Transaction Fund Wallet to Paystack
-	amount, err := hp.FundWalletPaystack(request, user)
+	wallet, err := hp.GetWallet(ctx, bson.M{"user_id": user.ID})
 	if err != nil {
-		response := hp.SetError(err, "Couldn't complete wallet funding", funcName)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		response := hp.SetError(err, "Error getting wallet", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Fund in the home currency unless another one is asked for
+	request.Currency = strings.ToUpper(request.Currency)
+	if request.Currency == "" {
+		request.Currency = wallet.Currency
+	}
+	if err := hp.ValidateCurrency(request.Currency); err != nil {
+		response := hp.SetError(err, "Invalid currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
 		return
 	}
 
-	// Update user wallet
-	err = hp.AddMoney(ctx, user, amount)
+	// Start the charge with Paystack
+	// the wallet is credited when Paystack confirms the payment through the webhook
+	funding, err := hp.FundWalletPaystack(ctx, request, user)
+	if abortLimitError(c, err, funcName) {
+		return
+	}
 	if err != nil {
-		response := hp.SetError(err, "Error updating user", funcName)
+		response := hp.SetError(err, "Couldn't start wallet funding", funcName)
+		c.AbortWithStatusJSON(http.StatusBadGateway, response)
+		return
+	}
+
+	response := hp.SetSuccess("Complete the payment to fund your wallet", funding, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// withdrawFromWallet pays money from the wallet out to the user's linked bank account
+// it takes the amount, the currency and the pin of the user
+// The amount is held in the wallet until the bank confirms the transfer,
+// if the transfer fails it is returned to the wallet
+func withdrawFromWallet(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	var request hp.SenfMoneyOtherBank
+
+	if err := c.Bind(&request); err != nil {
+		response := hp.SetError(err, "Error binding json", funcName)
 		c.AbortWithStatusJSON(http.StatusBadRequest, response)
 		return
 	}
 
-	response := hp.SetSuccess("Wallet funded", user, funcName)
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	// Veryfy Pin of the User is correct
+	if err := hp.VeryfyPin(ctx, user, request.TxnPin); err != nil {
+		abortPinError(c, user, err, "Incorrect Pin", funcName)
+		return
+	}
+
+	account, err := hp.LinkedBankAccount(user, request)
+	if err != nil {
+		response := hp.SetError(err, "Invalid bank account", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	wallet, err := hp.GetWallet(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		response := hp.SetError(err, "Error getting wallet", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	// Withdraw in the home currency unless another one is asked for
+	currency := strings.ToUpper(request.Currency)
+	if currency == "" {
+		currency = wallet.Currency
+	}
+	if err := hp.ValidateCurrency(currency); err != nil {
+		response := hp.SetError(err, "Invalid currency", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	txn, err := hp.WithdrawToBank(ctx, user, hp.MoneyFromMajor(request.Amount, currency), account)
+	if abortLimitError(c, err, funcName) {
+		return
+	}
+	if err != nil && txn.Status == hp.TxnPending {
+		// The payout may still go through, the webhook settles it either way
+		hp.SetDebug("withdrawal left pending: "+err.Error(), funcName)
+		response := hp.SetSuccess("Withdrawal is waiting for the bank", txn, funcName)
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+	if err != nil {
+		response := hp.SetError(err, "Error withdrawing from wallet", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Withdrawal is being processed", txn, funcName)
 	c.JSON(http.StatusOK, response)
 }
 
@@ -220,6 +460,112 @@ func getWalletBalance(c *gin.Context, ctx context.Context) {
 		return
 	}
 
-	response := hp.SetSuccess("Wallet balance", wallet.Balance, funcName)
+	response := hp.SetSuccess("Wallet balance", gin.H{
+		"currency": wallet.Currency,
+		"balances": wallet.AllBalances(),
+	}, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetWalletLedger returns the ledger entries for the user's wallet
+// along with the ledger balance and whether it agrees with the wallet balance
+func getWalletLedger(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	summary, err := hp.GetLedgerSummary(ctx, user)
+	if err != nil {
+		response := hp.SetError(err, "Error getting wallet ledger", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	if !summary.Balanced {
+		hp.SetDebug("wallet balance does not match ledger for user: "+user.ID.Hex(), funcName)
+	}
+
+	response := hp.SetSuccess("Wallet ledger", summary, funcName)
 	c.JSON(http.StatusOK, response)
 }
+
+// GetLockedFunds returns the money held out of the user's wallet,
+// their locked event budgets and withdrawals waiting for the bank
+func getLockedFunds(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	funds, err := hp.GetLockedFunds(ctx, user)
+	if err != nil {
+		response := hp.SetError(err, "Error getting locked funds", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	response := hp.SetSuccess("Locked funds", funds, funcName)
+	c.JSON(http.StatusOK, response)
+}
+
+// GetWalletStatement returns the user's wallet statement for a month
+// month is 2006-01 and defaults to the last full month
+// format is html (the default), text or json, html and text are sent as a download
+func getWalletStatement(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	user, err := hp.GetUserFromToken(c)
+	if err != nil {
+		response := hp.SetError(err, "User not logged in", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	month := c.DefaultQuery("month", hp.PreviousStatementMonth(time.Now()))
+
+	statement, err := hp.BuildStatement(ctx, user, month)
+	if err != nil {
+		response := hp.SetError(err, "Error building statement", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	format := strings.ToLower(c.DefaultQuery("format", "html"))
+	if format == "json" {
+		response := hp.SetSuccess("Wallet statement", statement, funcName)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	html, text, err := hp.RenderStatement(statement)
+	if err != nil {
+		response := hp.SetError(err, "Error rendering statement", funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	filename := "statement-" + statement.Month
+	switch format {
+	case "html":
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.html"`)
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+	case "text":
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.txt"`)
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(text))
+	default:
+		response := hp.SetError(nil, "format must be html, text or json", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+	}
+}
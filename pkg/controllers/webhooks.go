@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	PaystackWebhook = AbstractConnection(paystackWebhook)
+)
+
+// paystackWebhook settles wallet funding once Paystack confirms the charge
+// and withdrawals once Paystack reports on the transfer
+// The body must be signed with the Paystack secret key, unsigned requests are rejected
+// Other events and references with nothing pending are acknowledged so Paystack
+// stops sending them
+func paystackWebhook(c *gin.Context, ctx context.Context) {
+
+	var funcName = ut.GetFunctionName()
+
+	payload, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		response := hp.SetError(err, "Error reading request", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	if !hp.Payments.VerifyWebhook(payload, c.GetHeader(hp.PaystackSignatureHeader)) {
+		response := hp.SetError(nil, "Invalid signature", funcName)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+		return
+	}
+
+	event, err := hp.Payments.ParseWebhook(payload)
+	if err != nil {
+		response := hp.SetError(err, "Error parsing webhook", funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	}
+
+	var txn hp.Transactions
+	var notPending error
+	switch event.Event {
+	case "charge.success":
+		txn, err = hp.CompleteWalletFunding(ctx, event.Charge)
+		notPending = hp.ErrFundingNotPending
+	case "transfer.success":
+		txn, err = hp.CompleteWithdrawal(ctx, event.Charge.Reference, event.Charge.Amount, true)
+		notPending = hp.ErrWithdrawalNotPending
+	case "transfer.failed", "transfer.reversed":
+		txn, err = hp.CompleteWithdrawal(ctx, event.Charge.Reference, event.Charge.Amount, false)
+		notPending = hp.ErrWithdrawalNotPending
+	default:
+		hp.SetInfo("ignoring paystack event: "+event.Event, funcName)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments), errors.Is(err, notPending):
+		hp.SetInfo("nothing pending for "+event.Event+": "+event.Charge.Reference, funcName)
+		c.Status(http.StatusOK)
+		return
+	case errors.Is(err, hp.ErrWithdrawalMismatch):
+		response := hp.SetError(err, "Error handling "+event.Event, funcName)
+		c.AbortWithStatusJSON(http.StatusBadRequest, response)
+		return
+	case err != nil:
+		// Paystack retries until it gets a 200
+		response := hp.SetError(err, "Error handling "+event.Event, funcName)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+		return
+	}
+
+	response := hp.SetSuccess(string(txn.Type)+" "+string(txn.Status), txn.TransactionUID, funcName)
+	c.JSON(http.StatusOK, response)
+}
@@ -2,10 +2,14 @@ package email
 
 import (
 	"bytes"
+	"encoding/base64"
 	"html/template"
 	"log"
+	"mime/multipart"
 	"net/smtp"
+	"net/textproto"
 	"os"
+	textTemplate "text/template"
 
 	"github.com/Rhaqim/thedutchapp/pkg/config"
 	"github.com/joho/godotenv"
@@ -14,9 +18,17 @@ import (
 // New
 // Request struct
 type Request struct {
-	to      []string
-	subject string
-	body    string
+	to          []string
+	subject     string
+	body        string
+	attachments []Attachment
+}
+
+// Attachment is a file sent along with the email
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
 }
 
 func NewRequest(to []string, subject, body string) *Request {
@@ -70,6 +82,13 @@ func (r *Request) SendEmail() (bool, error) {
 		msg = append([]byte(k+": "+v+"\r\n"), msg...)
 	}
 
+	if len(r.attachments) > 0 {
+		msg, err = r.multipartMessage(from)
+		if err != nil {
+			return false, err
+		}
+	}
+
 	addr := host + ":" + port
 
 	if err := smtp.SendMail(addr, auth, from, r.to, msg); err != nil {
@@ -97,3 +116,84 @@ func (r *Request) ParseTemplate(templateFileName string, data interface{}) error
 
 	return nil
 }
+
+// ParseTextTemplate renders a plain text template into the body
+// Unlike ParseTemplate nothing is HTML escaped
+func (r *Request) ParseTextTemplate(templateFileName string, data interface{}) error {
+	templateFileName = "pkg/email/templates/" + templateFileName
+
+	t, err := textTemplate.ParseFiles(templateFileName)
+
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, data); err != nil {
+		return err
+	}
+
+	r.body = buf.String()
+
+	return nil
+}
+
+// Body returns the body of the email
+func (r *Request) Body() string {
+	return r.body
+}
+
+// Attach adds a file to the email
+func (r *Request) Attach(filename, contentType string, data []byte) {
+	r.attachments = append(r.attachments, Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Data:        data,
+	})
+}
+
+// multipartMessage builds an email with the HTML body followed by the attachments
+func (r *Request) multipartMessage(from string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writer := multipart.NewWriter(buf)
+
+	buf.WriteString("From: " + from + "\r\n" +
+		"To: " + r.to[0] + "\r\n" +
+		"Subject: " + r.subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"" + writer.Boundary() + "\"\r\n" +
+		"\r\n")
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/html; charset=\"UTF-8\""},
+	})
+	if err != nil {
+		return nil, err
+	}
+	part.Write([]byte(r.body))
+
+	for _, attachment := range r.attachments {
+		part, err = writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {"attachment; filename=\"" + attachment.Filename + "\""},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// base64 lines must not be longer than 76 characters
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -20,7 +20,7 @@ func GinRouter() *gin.Engine {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders: []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
+		AllowHeaders: []string{"Origin", "Content-Length", "Content-Type", "Authorization", IdempotencyKeyHeader},
 	}))
 
 	router := r.Group("/api/v1")
@@ -70,11 +70,29 @@ func GinRouter() *gin.Engine {
 			/* Transaction Routes */
 			transactions := user.Group("/transactions")
 			{
-				transactions.POST("/paybill", views.PayBillforEvent)
-				transactions.POST("/pay_own_bill", views.PayOwnBill)
-				transactions.POST("/send_money_to_host", views.SendMoneytoHost)
-				transactions.POST("/send_money_to_user", views.SendToOtherUsers)
+				transactions.POST("/paybill", IdempotencyMiddleware(), views.PayBillforEvent)
+				transactions.POST("/pay_own_bill", IdempotencyMiddleware(), views.PayOwnBill)
+				transactions.POST("/send_money_to_host", IdempotencyMiddleware(), views.SendMoneytoHost)
+				transactions.POST("/send_money_to_user", IdempotencyMiddleware(), views.SendToOtherUsers)
 				transactions.GET("/get_transactions", views.GetTransactions)
+				transactions.GET("/export", views.ExportTransactions)
+				transactions.POST("/refund", IdempotencyMiddleware(), views.RefundTransaction)
+				transactions.POST("/scheduled", IdempotencyMiddleware(), views.CreateScheduledTransfer)
+				transactions.GET("/scheduled", views.GetScheduledTransfers)
+				transactions.POST("/scheduled/:id/pause", views.PauseScheduledTransfer)
+				transactions.POST("/scheduled/:id/resume", views.ResumeScheduledTransfer)
+				transactions.DELETE("/scheduled/:id", views.CancelScheduledTransfer)
+				transactions.GET("/:reference", views.GetTransactionReceipt)
+			}
+
+			/* Payment Request Routes */
+			paymentRequests := user.Group("/payment_requests")
+			{
+				paymentRequests.POST("", views.CreatePaymentRequest)
+				paymentRequests.GET("", views.GetPaymentRequests)
+				paymentRequests.POST("/:id/pay", IdempotencyMiddleware(), views.PayPaymentRequest)
+				paymentRequests.POST("/:id/decline", views.DeclinePaymentRequest)
+				paymentRequests.POST("/:id/cancel", views.CancelPaymentRequest)
 			}
 
 			/* Social Routes */
@@ -94,9 +112,16 @@ func GinRouter() *gin.Engine {
 			wallet := user.Group("/wallet")
 			{
 				wallet.POST("/create", views.CreateWallet)
-				wallet.POST("/fund", views.FundWallet)
+				wallet.POST("/fund", IdempotencyMiddleware(), views.FundWallet)
+				wallet.POST("/withdraw", IdempotencyMiddleware(), views.WithdrawFromWallet)
 				wallet.POST("/pin_change", views.ChangePin)
+				wallet.POST("/pin_reset/request", views.RequestPinReset)
+				wallet.POST("/pin_reset/confirm", views.ResetPin)
 				wallet.GET("/balance", views.GetWalletBalance)
+				wallet.GET("/ledger", views.GetWalletLedger)
+				wallet.GET("/locked_funds", views.GetLockedFunds)
+				wallet.GET("/limits", views.GetWalletLimits)
+				wallet.GET("/statement", views.GetWalletStatement)
 			}
 
 			/* Notification Routes */
@@ -120,6 +145,7 @@ func GinRouter() *gin.Engine {
 			event.PUT("/update", views.UpdateEvent)
 			event.DELETE("/delete/:id", views.DeleteEvent)
 			event.GET("/cancel/:id", views.CancelEvent)
+			event.GET("/bill/:id", views.GetEventBill)
 
 			/* Order Routes */
 			order := event.Group("/order")
@@ -131,6 +157,25 @@ func GinRouter() *gin.Engine {
 				order.GET("getUserEventOrders/:id", views.GetUserEventOrders)
 			}
 
+			/* Bill Split Routes */
+			split := event.Group("/split")
+			{
+				split.POST("", views.PreviewSplit)
+				split.GET("", views.GetSplits)
+				split.POST("/:id/confirm", views.ConfirmSplit)
+				split.POST("/:id/pay", IdempotencyMiddleware(), views.PaySplitShare)
+				split.DELETE("/:id", views.CancelSplit)
+			}
+
+			/* Settlement Routes */
+			settlement := event.Group("/settlement")
+			{
+				settlement.GET("", views.GetSettlementPlan)
+				settlement.POST("/pay", IdempotencyMiddleware(), views.PaySettlement)
+				settlement.PUT("/deadline", views.SetSettlementDeadline)
+				settlement.GET("/overdue", views.GetOverdueShares)
+			}
+
 			attend := event.Group("/attend")
 			{
 				attend.POST("/send_invites", views.SendEventInvites)
@@ -151,6 +196,9 @@ func GinRouter() *gin.Engine {
 			restaurant.POST("/create", views.CreateRestaurant)
 			restaurant.PUT("/update", views.UpdateRestaurant)
 			restaurant.DELETE("/delete", views.DeleteRestaurant)
+			restaurant.PUT("/tip_suggestions", views.SetTipSuggestions)
+			restaurant.PUT("/charges", views.SetChargeRules)
+			restaurant.GET("/tips", views.GetTipTotals)
 			restaurant.POST("/add_review", views.AddReview)
 		}
 
@@ -165,6 +213,12 @@ func GinRouter() *gin.Engine {
 			product.DELETE("/delete", views.DeleteProduct)
 		}
 
+		/* Webhook Routes */
+		webhooks := router.Group("/webhooks")
+		{
+			webhooks.POST("/paystack", views.PaystackWebhook)
+		}
+
 		/* Admin Routes */
 		admin := router.Group("/admin")
 		admin.Use(TokenGuardMiddleware())
@@ -174,6 +228,17 @@ func GinRouter() *gin.Engine {
 		protected.Use(AdminGuardMiddleware())
 		{
 			protected.POST("/send_notification", ad.SendNotificationtoUsers)
+			protected.POST("/ledger/backfill", ad.BackfillLedger)
+			protected.GET("/fx_rates", ad.GetFXRates)
+			protected.POST("/fx_rates", ad.SetFXRate)
+			protected.DELETE("/fx_rates/:base/:quote", ad.DeleteFXRate)
+			protected.GET("/kyc_limits", ad.GetKYCLimits)
+			protected.POST("/kyc_limits", ad.SetKYCLimit)
+			protected.DELETE("/kyc_limits/:tier/:operation", ad.DeleteKYCLimit)
+			protected.GET("/fee_revenue", ad.GetFeeRevenue)
+			protected.POST("/reconciliation", ad.RunReconciliation)
+			protected.GET("/reconciliation", ad.GetReconciliationReports)
+			protected.GET("/reconciliation/:id", ad.GetReconciliationReport)
 		}
 	}
 
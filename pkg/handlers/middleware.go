@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"log"
 	"net/http"
 	"strings"
@@ -178,3 +180,120 @@ func CookieGuardMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// IdempotencyKeyHeader is the header clients send to make a request safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyWriter keeps a copy of the response so that it can be replayed
+type idempotencyWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotencyWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware makes money moving requests safe to retry
+// A request sent with an Idempotency-Key header runs once per user and key,
+// repeating it returns the stored response instead of running the handler again
+// Reusing a key for a different request is rejected
+// Requests without the header run as usual
+// It must run after TokenGuardMiddleware
+func IdempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		funcName := ut.GetFunctionName()
+
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > 255 {
+			response := hp.SetError(nil, "Idempotency-Key must be at most 255 characters", funcName)
+			c.AbortWithStatusJSON(http.StatusBadRequest, response)
+			return
+		}
+
+		user, err := hp.GetUserFromToken(c)
+		if err != nil {
+			response := hp.SetError(err, "User not logged in", funcName)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, response)
+			return
+		}
+
+		// Read the body for the fingerprint and put it back for the handler
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			response := hp.SetError(err, "Error reading request", funcName)
+			c.AbortWithStatusJSON(http.StatusBadRequest, response)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		fingerprint := hp.RequestFingerprint(c.Request.Method, c.Request.URL.RequestURI(), body)
+
+		record, claimed, err := hp.ClaimIdempotencyKey(ctx, user.ID, key, fingerprint)
+		if err != nil {
+			response := hp.SetError(err, "Error checking Idempotency-Key", funcName)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, response)
+			return
+		}
+
+		if !claimed {
+			switch {
+			case record.Fingerprint != fingerprint:
+				response := hp.SetError(nil, "Idempotency-Key was already used for a different request", funcName)
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, response)
+			case record.Status != hp.IdempotencyCompleted:
+				response := hp.SetError(nil, "A request with this Idempotency-Key is still being processed", funcName)
+				c.AbortWithStatusJSON(http.StatusConflict, response)
+			default:
+				hp.SetInfo("replaying response for Idempotency-Key: "+key, funcName)
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(record.ResponseCode, record.ContentType, record.ResponseBody)
+				c.Abort()
+			}
+			return
+		}
+
+		writer := &idempotencyWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = writer
+
+		// If the handler panics the key is released so the request can be retried
+		completed := false
+		defer func() {
+			if !completed {
+				releaseCtx, releaseCancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer releaseCancel()
+
+				if err := hp.ReleaseIdempotencyKey(releaseCtx, record); err != nil {
+					hp.SetDebug("error releasing Idempotency-Key: "+err.Error(), funcName)
+				}
+			}
+		}()
+
+		c.Next()
+
+		// The handler may outlive the claim context
+		saveCtx, saveCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer saveCancel()
+
+		err = hp.CompleteIdempotencyKey(saveCtx, record, writer.Status(), writer.Header().Get("Content-Type"), writer.body.Bytes())
+		if err != nil {
+			hp.SetDebug("error storing Idempotency-Key response: "+err.Error(), funcName)
+			return
+		}
+		completed = true
+	}
+}
@@ -39,7 +39,7 @@ func APICallTransferFunds(ctx context.Context, txn Transactions) (int, []byte, e
 	trans := BankTransfer{
 		From:   fromUser.Account.AccountNumber,
 		To:     toUser.Account.AccountNumber,
-		Amount: txn.Amount,
+		Amount: txn.Amount.Major(),
 	}
 
 	var buf bytes.Buffer
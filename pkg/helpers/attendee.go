@@ -21,7 +21,7 @@ type InviteFriendsToEventRequest struct {
 // AcceptInviteRequest is the request to accept an invite
 type AcceptInviteRequest struct {
 	EventID primitive.ObjectID `json:"event_id" bson:"event_id"`
-	Budget  float64            `json:"budget" bson:"budget"`
+	Budget  Money              `json:"budget" bson:"budget"`
 }
 
 // DeclineInviteRequest is the request to decline an invite
@@ -57,7 +57,7 @@ type EventAttendee struct {
 	EventID    primitive.ObjectID `json:"event_id" bson:"event_id"`
 	UserID     primitive.ObjectID `json:"user_id" bson:"user_id"`
 	Status     AttendingStatus    `json:"status" bson:"status"`
-	Budget     float64            `json:"budget" bson:"budget"`
+	Budget     Money              `json:"budget" bson:"budget"`
 	InvitedBy  primitive.ObjectID `json:"invited_by" bson:"invited_by"`
 	InvitedAt  primitive.DateTime `json:"invited_at" bson:"invited_at"`
 	AttendedAt primitive.DateTime `json:"attended_at" bson:"attended_at"`
@@ -0,0 +1,212 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BillItem is one order line on an attendee's bill
+// Amount is the attendee's part of the line, Total what the whole line costs
+type BillItem struct {
+	OrderID   primitive.ObjectID `json:"order_id"`
+	ProductID primitive.ObjectID `json:"product_id"`
+	Name      string             `json:"name"`
+	Quantity  int                `json:"quantity"`
+	Amount    Money              `json:"amount"`
+	Total     Money              `json:"total"`
+	Shared    bool               `json:"shared"`
+	Paid      bool               `json:"paid"`
+}
+
+// AttendeeBill is what one participant of an event had, paid and still owes
+// Subtotal is the lines they had alone and Shared their part of the shared lines
+// Total adds the tax and service charge on their orders, the tip is what they
+// tipped on their payments for the event and Paid what those payments covered of the bill
+// Remaining is their part of the orders nobody has paid for yet
+type AttendeeBill struct {
+	UserID        primitive.ObjectID `json:"user_id"`
+	Username      string             `json:"username"`
+	Items         []BillItem         `json:"items"`
+	Subtotal      Money              `json:"subtotal"`
+	Shared        Money              `json:"shared"`
+	Tax           Money              `json:"tax"`
+	ServiceCharge Money              `json:"service_charge"`
+	Total         Money              `json:"total"`
+	Tip           Money              `json:"tip"`
+	Budget        Money              `json:"budget"`
+	Paid          Money              `json:"paid"`
+	Remaining     Money              `json:"remaining"`
+}
+
+// EventBillBreakdown is who owes what for an event
+type EventBillBreakdown struct {
+	EventID   primitive.ObjectID `json:"event_id"`
+	Title     string             `json:"title"`
+	Bill      Money              `json:"bill"`
+	Attendees []AttendeeBill     `json:"attendees"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// GetEventBillBreakdown works out the bill of every participant of the event, host first
+// Orders without a customer were entered by the host and refunded orders are left out
+func GetEventBillBreakdown(ctx context.Context, event Event) (EventBillBreakdown, error) {
+	funcName := ut.GetFunctionName()
+
+	currency := event.Bill.Currency
+	breakdown := EventBillBreakdown{
+		EventID:   event.ID,
+		Title:     event.Title,
+		Bill:      event.Bill,
+		Attendees: []AttendeeBill{},
+		UpdatedAt: time.Now(),
+	}
+
+	participants := EventParticipants(event)
+	bills := make(map[primitive.ObjectID]*AttendeeBill)
+	for _, userID := range participants {
+		bills[userID] = &AttendeeBill{
+			UserID:        userID,
+			Username:      GetUserByID(ctx, userID).Username,
+			Items:         []BillItem{},
+			Subtotal:      ZeroMoney(currency),
+			Shared:        ZeroMoney(currency),
+			Tax:           ZeroMoney(currency),
+			ServiceCharge: ZeroMoney(currency),
+			Tip:           ZeroMoney(currency),
+			Budget:        ZeroMoney(currency),
+			Paid:          ZeroMoney(currency),
+			Remaining:     ZeroMoney(currency),
+		}
+	}
+	billFor := func(userID primitive.ObjectID) *AttendeeBill {
+		if bill, ok := bills[userID]; ok {
+			return bill
+		}
+		return bills[event.HostID]
+	}
+
+	orders, err := GetOrders(ctx, bson.M{"event_id": event.ID, "refunded": bson.M{"$ne": true}})
+	if err != nil {
+		SetDebug("error getting orders: "+err.Error(), funcName)
+		return breakdown, err
+	}
+
+	products, err := orderProducts(ctx, orders)
+	if err != nil {
+		return breakdown, err
+	}
+
+	for _, order := range orders {
+		if !order.Bill.sameCurrency(breakdown.Bill) {
+			return breakdown, errors.New("orders of the event are in different currencies")
+		}
+
+		for _, line := range order.Products {
+			product := products[line.ProductID]
+			// orders from before lines were priced on their own
+			if line.Bill.Currency == "" && line.Bill.IsZero() {
+				line.Bill = product.Price.Mul(int64(line.Quantity))
+			}
+
+			shared := len(line.SharedWith) > 0
+			for _, portion := range order.LinePortions(line) {
+				if order.portionRefunded(portion.UserID) {
+					continue
+				}
+				bill := billFor(portion.UserID)
+				bill.Items = append(bill.Items, BillItem{
+					OrderID:   order.ID,
+					ProductID: line.ProductID,
+					Name:      product.Name,
+					Quantity:  line.Quantity,
+					Amount:    portion.Amount,
+					Total:     line.Bill,
+					Shared:    shared,
+					Paid:      order.Paid || order.PortionFor(portion.UserID).IsZero(),
+				})
+				if shared {
+					bill.Shared = bill.Shared.Add(portion.Amount)
+				} else {
+					bill.Subtotal = bill.Subtotal.Add(portion.Amount)
+				}
+			}
+		}
+
+		for _, portion := range order.Portions() {
+			bill := billFor(portion.UserID)
+			bill.Tax = bill.Tax.Add(portion.Tax)
+			bill.ServiceCharge = bill.ServiceCharge.Add(portion.ServiceCharge)
+			bill.Remaining = bill.Remaining.Add(order.PortionFor(portion.UserID))
+		}
+	}
+
+	var txns []Transactions
+	cursor, err := transactionCollection.Find(ctx, bson.M{
+		"event_id": event.ID,
+		"type":     Debit,
+		"status":   bson.M{"$in": bson.A{TxnSuccess, TxnPartiallyRefunded, TxnRefunded}},
+	})
+	if err != nil {
+		return breakdown, err
+	}
+	if err = cursor.All(ctx, &txns); err != nil {
+		return breakdown, err
+	}
+
+	for _, txn := range txns {
+		bill, ok := bills[txn.FromID]
+		if !ok || !txn.Amount.sameCurrency(breakdown.Bill) {
+			continue
+		}
+		bill.Paid = bill.Paid.Add(settlementPaid(txn))
+		bill.Tip = bill.Tip.Add(txn.Tip)
+	}
+
+	for _, userID := range participants {
+		bill := bills[userID]
+
+		budget, err := GetBudget(ctx, event.ID, userID)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return breakdown, err
+		}
+		if err == nil {
+			bill.Budget = budget.Amount
+		}
+
+		bill.Total = bill.Subtotal.Add(bill.Shared).Add(bill.Tax).Add(bill.ServiceCharge)
+		breakdown.Attendees = append(breakdown.Attendees, *bill)
+	}
+
+	return breakdown, nil
+}
+
+// orderProducts returns the products on the orders by id
+func orderProducts(ctx context.Context, orders Orders) (map[primitive.ObjectID]Product, error) {
+	products := make(map[primitive.ObjectID]Product)
+
+	var ids []primitive.ObjectID
+	for _, order := range orders {
+		for _, line := range order.Products {
+			ids = append(ids, line.ProductID)
+		}
+	}
+	if len(ids) == 0 {
+		return products, nil
+	}
+
+	found, err := GetProducts(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return products, err
+	}
+	for _, product := range found {
+		products[product.ID] = product
+	}
+
+	return products, nil
+}
@@ -0,0 +1,318 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var budgetCollection = config.BudgetCollection
+
+// BudgetStatus is where the money of a budget is
+// A locked budget is held out of the wallet for an event, a consumed budget paid
+// for the event and a released budget went back to the wallet
+type BudgetStatus string
+
+const (
+	BudgetLocked   BudgetStatus = "locked"
+	BudgetConsumed BudgetStatus = "consumed"
+	BudgetReleased BudgetStatus = "released"
+)
+
+func (bs BudgetStatus) String() string {
+	return string(bs)
+}
+
+// Budget is money an attendee sets aside from their wallet for an event
+// Every attendee has at most one locked budget per event
+// Spent is what paid for the event and Released what went back to the wallet
+type Budget struct {
+	ID            primitive.ObjectID `json:"id,omitempty" bson:"_id"`
+	UserID        primitive.ObjectID `json:"user_id" bson:"user_id"`
+	EventID       primitive.ObjectID `json:"event_id" bson:"event_id"`
+	Amount        Money              `json:"amount" bson:"amount"`
+	Spent         Money              `json:"spent,omitempty" bson:"spent,omitempty"`
+	Released      Money              `json:"released,omitempty" bson:"released,omitempty"`
+	Status        BudgetStatus       `json:"status" bson:"status"`
+	TransactionID primitive.ObjectID `json:"transaction_id,omitempty" bson:"transaction_id,omitempty"`
+	CreatedAt     primitive.DateTime `json:"created_at" bson:"created_at"`
+	UpdatedAt     primitive.DateTime `json:"updated_at" bson:"updated_at"`
+}
+
+// LockedFunds is the money held out of a user's wallet
+// Withdrawals are held until the bank confirms them
+type LockedFunds struct {
+	Budgets     []Budget       `json:"budgets"`
+	Withdrawals []Transactions `json:"withdrawals"`
+	Totals      []Money        `json:"totals"`
+}
+
+// openBudgets matches the budgets that still hold money
+// Budgets from before budgets had a status are still locked
+func openBudgets(filter bson.M) bson.M {
+	filter["status"] = bson.M{"$nin": bson.A{BudgetConsumed, BudgetReleased}}
+	return filter
+}
+
+// GetBudget returns the user's locked budget for the event
+func GetBudget(ctx context.Context, eventID, userID primitive.ObjectID) (Budget, error) {
+	var budget Budget
+
+	err := budgetCollection.FindOne(ctx, bson.M{"event_id": eventID, "user_id": userID, "status": BudgetLocked}).Decode(&budget)
+	return budget, err
+}
+
+// GetBudgets returns the budgets matching the filter, newest first
+func GetBudgets(ctx context.Context, filter bson.M) ([]Budget, error) {
+	budgets := []Budget{}
+
+	cursor, err := budgetCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": -1}))
+	if err != nil {
+		return budgets, err
+	}
+
+	err = cursor.All(ctx, &budgets)
+	return budgets, err
+}
+
+// LockBudget moves the amount from the wallet into a budget for the event
+// A zero amount locks nothing
+// It fails if the wallet cannot cover the amount or the user already has a budget for the event
+func LockBudget(ctx context.Context, wallet Wallet, amount Money, eventID primitive.ObjectID) (Budget, error) {
+	createdAt, updatedAt := CreatedAtUpdatedAt()
+	budget := Budget{
+		ID:        primitive.NewObjectID(),
+		UserID:    wallet.UserID,
+		EventID:   eventID,
+		Amount:    amount,
+		Status:    BudgetLocked,
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+	}
+
+	if amount.IsZero() {
+		return budget, nil
+	}
+	if amount.IsNegative() {
+		return budget, errors.New("budget cannot be negative")
+	}
+
+	// Move the amount from the wallet to the budget in one transaction
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		if _, err := GetBudget(sessCtx, eventID, wallet.UserID); err == nil {
+			return errors.New("a budget is already locked for this event")
+		}
+
+		// Subtract amount from wallet balance if the wallet can cover it
+		filter := walletHasAtLeast(amount)
+		filter["_id"] = wallet.ID
+		update := bson.M{"$inc": walletInc(amount.Neg())}
+
+		updateResult, err := walletCollection.UpdateOne(sessCtx, filter, update)
+		if err != nil {
+			return err
+		}
+		if updateResult.MatchedCount != 1 {
+			return errors.New("insufficient balance")
+		}
+
+		_, err = budgetCollection.InsertOne(sessCtx, budget)
+		if err != nil {
+			return err
+		}
+
+		// Post the lock to the ledger
+		return PostLedgerEntries(sessCtx, BudgetLockLedgerEntries(budget))
+	})
+
+	return budget, err
+}
+
+// releaseBudget closes the budget and returns what was not spent to the wallet
+// It must be called inside a transaction
+// A budget that was already closed is left alone and false is returned
+func releaseBudget(ctx context.Context, budget Budget, spent Money, status BudgetStatus, txnID primitive.ObjectID) (Budget, bool, error) {
+	funcName := ut.GetFunctionName()
+
+	released := budget.Amount.Sub(spent)
+
+	set := bson.M{
+		"status":     status,
+		"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+	}
+	if !spent.IsZero() {
+		set["spent"] = spent
+	}
+	if !released.IsZero() {
+		set["released"] = released
+	}
+	if !txnID.IsZero() {
+		set["transaction_id"] = txnID
+	}
+
+	// only one caller closes the budget
+	result, err := budgetCollection.UpdateOne(ctx, openBudgets(bson.M{"_id": budget.ID}), bson.M{"$set": set})
+	if err != nil {
+		SetDebug("error closing budget: "+err.Error(), funcName)
+		return budget, false, err
+	}
+	if result.ModifiedCount != 1 {
+		return budget, false, nil
+	}
+
+	budget.Status, budget.Spent, budget.Released, budget.TransactionID = status, spent, released, txnID
+
+	if released.IsZero() {
+		return budget, true, nil
+	}
+
+	result, err = walletCollection.UpdateOne(ctx, bson.M{"user_id": budget.UserID}, bson.M{"$inc": walletInc(released)})
+	if err != nil {
+		SetDebug("error returning budget to wallet: "+err.Error(), funcName)
+		return budget, false, err
+	}
+	if result.MatchedCount != 1 {
+		return budget, false, errors.New("wallet not found")
+	}
+
+	// Post the release to the ledger
+	err = PostLedgerEntries(ctx, BudgetReleaseLedgerEntries(budget))
+	if err != nil {
+		SetDebug("error posting budget release to ledger: "+err.Error(), funcName)
+		return budget, false, err
+	}
+
+	return budget, true, nil
+}
+
+// ConsumeBudget pays up to amount from the user's locked budget for the event
+// and returns what is left of the budget to the wallet
+// The budget is only used if it is in the currency of the amount
+// It returns how much of the amount the budget covered
+// It must be called inside a transaction, see UpdateSenderTransaction
+func ConsumeBudget(ctx context.Context, eventID, userID primitive.ObjectID, amount Money, txnID primitive.ObjectID) (Money, error) {
+	budget, err := GetBudget(ctx, eventID, userID)
+	if errors.Is(err, mongo.ErrNoDocuments) || (err == nil && budget.Amount.Currency != amount.Currency) {
+		return ZeroMoney(amount.Currency), nil
+	}
+	if err != nil {
+		return Money{}, err
+	}
+
+	spent := budget.Amount
+	if amount.LessThan(spent) {
+		spent = amount
+	}
+
+	_, ok, err := releaseBudget(ctx, budget, spent, BudgetConsumed, txnID)
+	if err != nil {
+		return Money{}, err
+	}
+	if !ok {
+		return ZeroMoney(amount.Currency), nil
+	}
+
+	return spent, nil
+}
+
+// ReleaseBudget returns the user's locked budget for the event to their wallet
+// It returns false if the user has no locked budget for the event
+func ReleaseBudget(ctx context.Context, eventID, userID primitive.ObjectID) (Budget, bool, error) {
+	var budget Budget
+	var released bool
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		var err error
+		budget, err = GetBudget(sessCtx, eventID, userID)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		budget, released, err = releaseBudget(sessCtx, budget, ZeroMoney(budget.Amount.Currency), BudgetReleased, primitive.NilObjectID)
+		return err
+	})
+
+	return budget, released, err
+}
+
+// ReleaseEventBudgets returns every budget still locked for the event to its owner's wallet
+// It is called when the event is cancelled, deleted or finished
+// It returns the budgets that were released so their owners can be told
+func ReleaseEventBudgets(ctx context.Context, eventID primitive.ObjectID) ([]Budget, error) {
+	var released []Budget
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		released = nil
+
+		budgets, err := GetBudgets(sessCtx, bson.M{"event_id": eventID, "status": BudgetLocked})
+		if err != nil {
+			return err
+		}
+
+		for _, budget := range budgets {
+			budget, ok, err := releaseBudget(sessCtx, budget, ZeroMoney(budget.Amount.Currency), BudgetReleased, primitive.NilObjectID)
+			if err != nil {
+				return err
+			}
+			if ok {
+				released = append(released, budget)
+			}
+		}
+
+		return nil
+	})
+
+	return released, err
+}
+
+// GetLockedFunds returns the user's locked budgets and held withdrawals with their totals
+func GetLockedFunds(ctx context.Context, user UserResponse) (LockedFunds, error) {
+	funds := LockedFunds{Withdrawals: []Transactions{}, Totals: []Money{}}
+
+	budgets, err := GetBudgets(ctx, openBudgets(bson.M{"user_id": user.ID}))
+	if err != nil {
+		return funds, err
+	}
+	funds.Budgets = budgets
+
+	cursor, err := transactionCollection.Find(ctx,
+		bson.M{"from_id": user.ID, "type": Withdrawal, "status": TxnPending},
+		options.Find().SetSort(bson.M{"created_at": -1}),
+	)
+	if err != nil {
+		return funds, err
+	}
+	if err = cursor.All(ctx, &funds.Withdrawals); err != nil {
+		return funds, err
+	}
+
+	totals := make(map[string]int64)
+	var currencies []string
+	add := func(m Money) {
+		if _, ok := totals[m.Currency]; !ok {
+			currencies = append(currencies, m.Currency)
+		}
+		totals[m.Currency] += m.Amount
+	}
+	for _, budget := range funds.Budgets {
+		add(budget.Amount)
+	}
+	for _, withdrawal := range funds.Withdrawals {
+		add(withdrawal.Amount)
+	}
+	for _, currency := range currencies {
+		funds.Totals = append(funds.Totals, NewMoney(totals[currency], currency))
+	}
+
+	return funds, nil
+}
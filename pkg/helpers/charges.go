@@ -0,0 +1,135 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxChargeRules is how many tax and service charge rules a restaurant can have
+const MaxChargeRules = 10
+
+// ChargeType is what a charge on a bill is for
+type ChargeType string
+
+const (
+	ChargeTax     ChargeType = "tax"
+	ChargeService ChargeType = "service"
+)
+
+func (ct ChargeType) String() string {
+	return string(ct)
+}
+
+// ChargeRule is a tax or service charge a restaurant adds to its bills
+// It is a percentage of the subtotal of an order, and only applies to parties
+// of at least MinPartySize people when that is set
+type ChargeRule struct {
+	Name         string     `json:"name" bson:"name" binding:"required,max=50"`
+	Type         ChargeType `json:"type" bson:"type" binding:"required,oneof=tax service"`
+	Percentage   float64    `json:"percentage" bson:"percentage" binding:"gt=0,lte=100"`
+	MinPartySize int        `json:"min_party_size,omitempty" bson:"min_party_size,omitempty" binding:"gte=0"`
+}
+
+// Applies reports whether the rule applies to a party of the size given
+func (cr ChargeRule) Applies(partySize int) bool {
+	return cr.MinPartySize == 0 || partySize >= cr.MinPartySize
+}
+
+// AppliedCharge is a charge rule worked out on an order
+type AppliedCharge struct {
+	Name       string     `json:"name" bson:"name"`
+	Type       ChargeType `json:"type" bson:"type"`
+	Percentage float64    `json:"percentage" bson:"percentage"`
+	Amount     Money      `json:"amount" bson:"amount"`
+}
+
+// OrderBill is what an order costs, the charges are worked out on the subtotal of its lines
+type OrderBill struct {
+	Subtotal      Money           `json:"subtotal"`
+	Tax           Money           `json:"tax"`
+	ServiceCharge Money           `json:"service_charge"`
+	Charges       []AppliedCharge `json:"charges,omitempty"`
+	Total         Money           `json:"total"`
+}
+
+type ChargeRulesRequest struct {
+	RestaurantID primitive.ObjectID `json:"restaurant_id" binding:"required"`
+	Charges      []ChargeRule       `json:"charges" binding:"max=10,dive"`
+}
+
+// ApplyCharges works out the restaurant's charges that apply to a party of partySize on the subtotal
+// Every charge is a percentage of the subtotal rounded to the nearest minor unit
+func ApplyCharges(rules []ChargeRule, subtotal Money, partySize int) OrderBill {
+	bill := OrderBill{
+		Subtotal:      subtotal,
+		Tax:           ZeroMoney(subtotal.Currency),
+		ServiceCharge: ZeroMoney(subtotal.Currency),
+	}
+
+	for _, rule := range rules {
+		if !rule.Applies(partySize) {
+			continue
+		}
+
+		amount := subtotal.Percent(rule.Percentage)
+		bill.Charges = append(bill.Charges, AppliedCharge{
+			Name:       rule.Name,
+			Type:       rule.Type,
+			Percentage: rule.Percentage,
+			Amount:     amount,
+		})
+
+		switch rule.Type {
+		case ChargeTax:
+			bill.Tax = bill.Tax.Add(amount)
+		case ChargeService:
+			bill.ServiceCharge = bill.ServiceCharge.Add(amount)
+		}
+	}
+
+	bill.Total = subtotal.Add(bill.Tax).Add(bill.ServiceCharge)
+	return bill
+}
+
+// SetChargeRules replaces the tax and service charges the restaurant adds to its bills
+// Orders already placed keep the charges they were placed with, an empty list removes them
+func SetChargeRules(ctx context.Context, owner UserResponse, request ChargeRulesRequest) (Restaurant, error) {
+	funcName := ut.GetFunctionName()
+
+	var restaurant Restaurant
+
+	if len(request.Charges) > MaxChargeRules {
+		return restaurant, errors.New("too many charge rules")
+	}
+
+	charges := request.Charges
+	if charges == nil {
+		charges = []ChargeRule{}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := restaurantCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": request.RestaurantID, "owner_id": owner.ID},
+		bson.M{"$set": bson.M{
+			"charges":    charges,
+			"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+		}},
+		opts,
+	).Decode(&restaurant)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return restaurant, errors.New("restaurant not found")
+	}
+	if err != nil {
+		SetDebug("error setting charge rules: "+err.Error(), funcName)
+		return restaurant, err
+	}
+
+	return restaurant, nil
+}
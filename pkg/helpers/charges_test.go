@@ -0,0 +1,51 @@
+package helpers
+
+import "testing"
+
+func TestApplyCharges(t *testing.T) {
+	vat := ChargeRule{Name: "VAT", Type: ChargeTax, Percentage: 7.5}
+	service := ChargeRule{Name: "Service", Type: ChargeService, Percentage: 10}
+	largeParty := ChargeRule{Name: "Large party", Type: ChargeService, Percentage: 12.5, MinPartySize: 6}
+
+	tests := []struct {
+		name      string
+		rules     []ChargeRule
+		subtotal  int64
+		partySize int
+		tax       int64
+		service   int64
+		charges   int
+	}{
+		{"no rules", nil, 1999, 2, 0, 0, 0},
+		{"percentages that do not divide evenly", []ChargeRule{vat, service}, 1999, 2, 150, 200, 2},
+		{"rounds half away from zero", []ChargeRule{{Name: "City", Type: ChargeTax, Percentage: 12.345}}, 10000, 2, 1235, 0, 1},
+		{"taxes add up", []ChargeRule{vat, {Name: "Consumption", Type: ChargeTax, Percentage: 5}}, 1001, 2, 125, 0, 2},
+		{"party too small", []ChargeRule{vat, largeParty}, 2000, 5, 150, 0, 1},
+		{"party large enough", []ChargeRule{vat, largeParty}, 2000, 6, 150, 250, 2},
+		{"nothing ordered", []ChargeRule{vat, service}, 0, 2, 0, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bill := ApplyCharges(tt.rules, NewMoney(tt.subtotal, "NGN"), tt.partySize)
+
+			if bill.Tax.Amount != tt.tax || bill.ServiceCharge.Amount != tt.service {
+				t.Errorf("tax %d service %d, want %d %d", bill.Tax.Amount, bill.ServiceCharge.Amount, tt.tax, tt.service)
+			}
+			if len(bill.Charges) != tt.charges {
+				t.Errorf("got %d charges, want %d", len(bill.Charges), tt.charges)
+			}
+			if want := tt.subtotal + tt.tax + tt.service; bill.Total.Amount != want {
+				t.Errorf("total = %d, want %d", bill.Total.Amount, want)
+			}
+
+			var charged int64
+			for _, charge := range bill.Charges {
+				charged += charge.Amount.Amount
+			}
+			if charged != tt.tax+tt.service {
+				t.Errorf("charges add up to %d, want %d", charged, tt.tax+tt.service)
+			}
+		})
+	}
+}
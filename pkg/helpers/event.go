@@ -2,12 +2,12 @@ package helpers
 
 import (
 	"context"
-	"sync"
 	"time"
 
 	"github.com/Rhaqim/thedutchapp/pkg/config"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var eventCollection = config.EventCollection
@@ -43,22 +43,29 @@ func (h EventStatus) String() string {
 }
 
 type Event struct {
-	ID             primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
-	HostID         primitive.ObjectID   `json:"host_id" bson:"host_id"`
-	Title          string               `json:"title" binding:"required" bson:"title"`
-	RestaurantID   primitive.ObjectID   `json:"restaurant_id" bson:"restaurant_id" binding:"required"`
-	Date           CustomDate           `json:"date" bson:"date" binding:"required" time_format:"2006-01-02"`
-	Time           CustomTime           `json:"time" bson:"time" binding:"required" time_format:"15:04"`
-	Invited        []primitive.ObjectID `json:"invited" bson:"invited" default:"[]"`
-	Attendees      []primitive.ObjectID `json:"attendees" bson:"attendees" default:"[]"`
-	Declined       []primitive.ObjectID `json:"declined" bson:"declined" default:"[]"`
-	EventType      EventType            `json:"event_type" bson:"event_type"`
-	EventStatus    EventStatus          `json:"event_status" bson:"event_status"`
-	SpecialRequest string               `json:"special_request,omitempty" bson:"special_request,omitempty"`
-	Budget         float64              `json:"budget" bson:"budget" binding:"required,number"`
-	Bill           float64              `json:"bill,omitempty" bson:"bill,omitempty" default:"0"`
-	CreatedAt      primitive.DateTime   `bson:"created_at" json:"created_at" default:"Now()"`
-	UpdatedAt      primitive.DateTime   `bson:"updated_at" json:"updated_at" default:"Now()"`
+	ID                 primitive.ObjectID   `json:"_id,omitempty" bson:"_id,omitempty"`
+	HostID             primitive.ObjectID   `json:"host_id" bson:"host_id"`
+	Title              string               `json:"title" binding:"required" bson:"title"`
+	RestaurantID       primitive.ObjectID   `json:"restaurant_id" bson:"restaurant_id" binding:"required"`
+	Date               CustomDate           `json:"date" bson:"date" binding:"required" time_format:"2006-01-02"`
+	Time               CustomTime           `json:"time" bson:"time" binding:"required" time_format:"15:04"`
+	Invited            []primitive.ObjectID `json:"invited" bson:"invited" default:"[]"`
+	Attendees          []primitive.ObjectID `json:"attendees" bson:"attendees" default:"[]"`
+	Declined           []primitive.ObjectID `json:"declined" bson:"declined" default:"[]"`
+	EventType          EventType            `json:"event_type" bson:"event_type"`
+	EventStatus        EventStatus          `json:"event_status" bson:"event_status"`
+	SpecialRequest     string               `json:"special_request,omitempty" bson:"special_request,omitempty"`
+	Budget             Money                `json:"budget" bson:"budget" binding:"required"`
+	Bill               Money                `json:"bill,omitempty" bson:"bill"`
+	Subtotal           Money                `json:"subtotal,omitempty" bson:"subtotal,omitempty"`
+	Tax                Money                `json:"tax,omitempty" bson:"tax,omitempty"`
+	ServiceCharge      Money                `json:"service_charge,omitempty" bson:"service_charge,omitempty"`
+	SplitID            primitive.ObjectID   `json:"split_id,omitempty" bson:"split_id,omitempty"`
+	SettlementDeadline primitive.DateTime   `json:"settlement_deadline,omitempty" bson:"settlement_deadline,omitempty"`
+	AutoCharge         AutoChargeMode       `json:"auto_charge,omitempty" bson:"auto_charge,omitempty"`
+	ReminderStage      ReminderStage        `json:"-" bson:"reminder_stage,omitempty"`
+	CreatedAt          primitive.DateTime   `bson:"created_at" json:"created_at" default:"Now()"`
+	UpdatedAt          primitive.DateTime   `bson:"updated_at" json:"updated_at" default:"Now()"`
 }
 
 func GetEvent(ctx context.Context, filter bson.M) (Event, error) {
@@ -112,14 +119,44 @@ func UpdateEvent(ctx context.Context, filter bson.M, update bson.M) (Event, erro
 	return event, nil
 }
 
-func DeleteEvent(ctx context.Context, filter bson.M) (Event, error) {
+// DeleteEvent deletes the event and returns the budgets locked for it to their owners
+// It returns the budgets that were released
+func DeleteEvent(ctx context.Context, filter bson.M) (Event, []Budget, error) {
 	var event Event
-	err := eventCollection.FindOneAndDelete(ctx, filter).Decode(&event)
-	if err != nil {
-		return event, err
-	}
+	var released []Budget
 
-	return event, nil
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		err := eventCollection.FindOneAndDelete(sessCtx, filter).Decode(&event)
+		if err != nil {
+			return err
+		}
+
+		released, err = ReleaseEventBudgets(sessCtx, event.ID)
+		return err
+	})
+
+	return event, released, err
+}
+
+// CancelEvent cancels the event and returns the budgets locked for it to their owners
+// It returns the budgets that were released
+func CancelEvent(ctx context.Context, filter bson.M) ([]Budget, error) {
+	var released []Budget
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		event, err := UpdateEvent(sessCtx, filter, bson.M{"$set": bson.M{
+			"event_status": Cancelled,
+			"updated_at":   primitive.NewDateTimeFromTime(time.Now()),
+		}})
+		if err != nil {
+			return err
+		}
+
+		released, err = ReleaseEventBudgets(sessCtx, event.ID)
+		return err
+	})
+
+	return released, err
 }
 
 // Return the difference in minutes between current time and the event time
@@ -140,52 +177,46 @@ func VeryifyDateTimeAfterNow(eventDate CustomDate, eventTime CustomTime) bool {
 
 // Update Event Status to Finished
 // Update all orders for the event to paid
-func UpdateEventandOrders(ctx context.Context, event Event, txn Transactions, eventErrChan, orderErrChan chan error) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Update event status to Finished once bill is paid
-	// Deduct the amount from the bill
-	filter := bson.M{
-		"_id": event.ID,
-	}
-	go func() {
-		defer wg.Done()
-
+// Return the budgets still locked for the event to their owners
+// The updates run in one transaction, it returns the budgets that were released
+func UpdateEventandOrders(ctx context.Context, event Event, txn Transactions) ([]Budget, error) {
+	var released []Budget
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		// Update event status to Finished once bill is paid
+		// Deduct the amount from the bill
+		filter := bson.M{
+			"_id": event.ID,
+		}
 		update := bson.M{
 			"$set": bson.M{
 				"event_status": Finished,
 			},
-			"$inc": bson.M{
-				"bill": -txn.Amount,
-			},
+			"$inc": moneyInc("bill", billPaid(txn).Neg()),
 		}
-		_, err := UpdateEvent(ctx, filter, update)
+		_, err := UpdateEvent(sessCtx, filter, update)
 		if err != nil {
-			eventErrChan <- err
-			return
+			return err
 		}
-	}()
-
-	go func() {
-		defer wg.Done()
 
 		// Update all Orders Paid to True
-		update := bson.M{
+		filter = bson.M{
+			"event_id": event.ID,
+		}
+		update = bson.M{
 			"$set": bson.M{
 				"paid": true,
 			},
 		}
-		_, err := UpdateManyOrders(ctx, filter, update)
+		_, err = UpdateManyOrders(sessCtx, filter, update)
 		if err != nil {
-			orderErrChan <- err
-			return
+			return err
 		}
-	}()
 
-	go func() {
-		wg.Wait()
-		close(eventErrChan)
-		close(orderErrChan)
-	}()
+		// Nobody else pays for a finished event
+		released, err = ReleaseEventBudgets(sessCtx, event.ID)
+		return err
+	})
+
+	return released, err
 }
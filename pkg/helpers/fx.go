@@ -0,0 +1,205 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var fxRateCollection = config.FXRateCollection
+
+var ErrNoFXRate = errors.New("no exchange rate for currency pair")
+
+// FXRate is the rate admins set for a currency pair
+// One unit of Base buys Rate units of Quote
+type FXRate struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Base      string             `json:"base" bson:"base" binding:"required,len=3"`
+	Quote     string             `json:"quote" bson:"quote" binding:"required,len=3"`
+	Rate      float64            `json:"rate" bson:"rate" binding:"required,gt=0"`
+	UpdatedBy primitive.ObjectID `json:"updated_by,omitempty" bson:"updated_by,omitempty"`
+	CreatedAt primitive.DateTime `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+}
+
+var (
+	currencyCodeRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+	supportedCurrencies     map[string]bool
+	supportedCurrenciesErr  error
+	supportedCurrenciesOnce sync.Once
+)
+
+// SupportedCurrencies returns the currencies listed in countries.json
+func SupportedCurrencies() (map[string]bool, error) {
+	supportedCurrenciesOnce.Do(func() {
+		data, err := os.ReadFile("countries.json")
+		if err != nil {
+			supportedCurrenciesErr = err
+			return
+		}
+
+		var countries []Country
+		if err = json.Unmarshal(data, &countries); err != nil {
+			supportedCurrenciesErr = err
+			return
+		}
+
+		supportedCurrencies = make(map[string]bool)
+		for _, country := range countries {
+			for _, currency := range country.Currencies {
+				supportedCurrencies[currency] = true
+			}
+		}
+	})
+
+	return supportedCurrencies, supportedCurrenciesErr
+}
+
+// ValidateCurrency checks that the code is a currency used by one of the countries
+// Currency codes end up in field names of the wallet balances so they must be checked
+// before they reach the database
+func ValidateCurrency(currency string) error {
+	if !currencyCodeRegex.MatchString(currency) {
+		return fmt.Errorf("invalid currency code: %q", currency)
+	}
+
+	currencies, err := SupportedCurrencies()
+	if err != nil {
+		return err
+	}
+	if !currencies[currency] {
+		return fmt.Errorf("unsupported currency: %s", currency)
+	}
+
+	return nil
+}
+
+// SetFXRate creates or replaces the rate for the currency pair
+func SetFXRate(ctx context.Context, rate FXRate) (FXRate, error) {
+	rate.Base = strings.ToUpper(rate.Base)
+	rate.Quote = strings.ToUpper(rate.Quote)
+
+	for _, currency := range []string{rate.Base, rate.Quote} {
+		if err := ValidateCurrency(currency); err != nil {
+			return rate, err
+		}
+	}
+	if rate.Base == rate.Quote {
+		return rate, errors.New("base and quote currency must differ")
+	}
+	if rate.Rate <= 0 {
+		return rate, errors.New("rate must be greater than zero")
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.M{"base": rate.Base, "quote": rate.Quote}
+	update := bson.M{
+		"$set": bson.M{
+			"rate":       rate.Rate,
+			"updated_by": rate.UpdatedBy,
+			"updated_at": now,
+		},
+		"$setOnInsert": bson.M{"created_at": now},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	err := fxRateCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&rate)
+	return rate, err
+}
+
+// GetFXRates returns the rates matching the filter
+func GetFXRates(ctx context.Context, filter bson.M) ([]FXRate, error) {
+	var rates []FXRate
+
+	cursor, err := fxRateCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "base", Value: 1}, {Key: "quote", Value: 1}}))
+	if err != nil {
+		return rates, err
+	}
+
+	err = cursor.All(ctx, &rates)
+	return rates, err
+}
+
+// DeleteFXRate removes the rate for the currency pair
+func DeleteFXRate(ctx context.Context, base, quote string) error {
+	result, err := fxRateCollection.DeleteOne(ctx, bson.M{"base": strings.ToUpper(base), "quote": strings.ToUpper(quote)})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNoFXRate
+	}
+
+	return nil
+}
+
+// GetFXRate returns how many units of quote one unit of base buys
+// If only the opposite pair is set its inverse is used
+func GetFXRate(ctx context.Context, base, quote string) (float64, error) {
+	funcName := ut.GetFunctionName()
+
+	if base == quote {
+		return 1, nil
+	}
+
+	var rate FXRate
+	err := fxRateCollection.FindOne(ctx, bson.M{"base": base, "quote": quote}).Decode(&rate)
+	if err == nil {
+		return rate.Rate, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		SetDebug("error getting fx rate: "+err.Error(), funcName)
+		return 0, err
+	}
+
+	err = fxRateCollection.FindOne(ctx, bson.M{"base": quote, "quote": base}).Decode(&rate)
+	if err == nil {
+		return 1 / rate.Rate, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		SetDebug("error getting fx rate: "+err.Error(), funcName)
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("%w: %s/%s", ErrNoFXRate, base, quote)
+}
+
+// ConvertMoney converts the amount to the currency at the rate given
+// rate is how many units of the target currency one unit of the amount's currency buys
+// The result is rounded half away from zero to the nearest minor unit
+func ConvertMoney(amount Money, currency string, rate float64) Money {
+	if amount.Currency == currency {
+		return amount
+	}
+
+	exp := CurrencyExponent(currency) - CurrencyExponent(amount.Currency)
+	converted := float64(amount.Amount) * rate * math.Pow10(exp)
+
+	return NewMoney(int64(math.Round(converted)), currency)
+}
+
+// Convert converts the amount to the currency using the rate table
+// It returns the converted amount and the rate used
+func Convert(ctx context.Context, amount Money, currency string) (Money, float64, error) {
+	rate, err := GetFXRate(ctx, amount.Currency, currency)
+	if err != nil {
+		return Money{}, 0, err
+	}
+
+	return ConvertMoney(amount, currency, rate), rate, nil
+}
@@ -0,0 +1,134 @@
+package helpers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var idempotencyCollection = config.IdempotencyCollection
+
+// IdempotencyKeyTTL is how long a key and its stored response are kept
+const IdempotencyKeyTTL = 24 * time.Hour
+
+type IdempotencyStatus string
+
+const (
+	IdempotencyProcessing IdempotencyStatus = "processing"
+	IdempotencyCompleted  IdempotencyStatus = "completed"
+)
+
+// IdempotencyRecord is the stored outcome of a request sent with an Idempotency-Key
+// Keys are scoped to the user that sent them
+type IdempotencyRecord struct {
+	ID           primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	Key          string             `json:"key" bson:"key"`
+	UserID       primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Fingerprint  string             `json:"fingerprint" bson:"fingerprint"`
+	Status       IdempotencyStatus  `json:"status" bson:"status"`
+	ResponseCode int                `json:"response_code,omitempty" bson:"response_code,omitempty"`
+	ContentType  string             `json:"content_type,omitempty" bson:"content_type,omitempty"`
+	ResponseBody []byte             `json:"-" bson:"response_body,omitempty"`
+	CreatedAt    primitive.DateTime `json:"created_at" bson:"created_at"`
+	CompletedAt  primitive.DateTime `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+}
+
+var idempotencyIndexesOnce sync.Once
+
+// ensureIdempotencyIndexes makes keys unique per user and expires them after IdempotencyKeyTTL
+func ensureIdempotencyIndexes(ctx context.Context) {
+	idempotencyIndexesOnce.Do(func() {
+		_, err := idempotencyCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "key", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{
+				Keys:    bson.D{{Key: "created_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(int32(IdempotencyKeyTTL.Seconds())),
+			},
+		})
+		if err != nil {
+			SetDebug("error creating idempotency indexes: "+err.Error(), ut.GetFunctionName())
+		}
+	})
+}
+
+// RequestFingerprint hashes the parts of a request that must match when a key is replayed
+func RequestFingerprint(method, uri string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + uri + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ClaimIdempotencyKey stores the key for the user as processing
+// It returns true if this request claimed the key and should run
+// Otherwise it returns the record of the request that claimed it first
+func ClaimIdempotencyKey(ctx context.Context, userID primitive.ObjectID, key, fingerprint string) (IdempotencyRecord, bool, error) {
+	funcName := ut.GetFunctionName()
+
+	ensureIdempotencyIndexes(ctx)
+
+	record := IdempotencyRecord{
+		ID:          primitive.NewObjectID(),
+		Key:         key,
+		UserID:      userID,
+		Fingerprint: fingerprint,
+		Status:      IdempotencyProcessing,
+		CreatedAt:   primitive.NewDateTimeFromTime(time.Now()),
+	}
+
+	_, err := idempotencyCollection.InsertOne(ctx, record)
+	if err == nil {
+		return record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		SetDebug("error claiming idempotency key: "+err.Error(), funcName)
+		return record, false, err
+	}
+
+	var existing IdempotencyRecord
+	err = idempotencyCollection.FindOne(ctx, bson.M{"user_id": userID, "key": key}).Decode(&existing)
+	if err != nil {
+		// the key expired between the insert and the lookup
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ClaimIdempotencyKey(ctx, userID, key, fingerprint)
+		}
+		SetDebug("error getting idempotency key: "+err.Error(), funcName)
+		return existing, false, err
+	}
+
+	return existing, false, nil
+}
+
+// CompleteIdempotencyKey stores the response so replays of the key return it
+func CompleteIdempotencyKey(ctx context.Context, record IdempotencyRecord, code int, contentType string, body []byte) error {
+	update := bson.M{"$set": bson.M{
+		"status":        IdempotencyCompleted,
+		"response_code": code,
+		"content_type":  contentType,
+		"response_body": body,
+		"completed_at":  primitive.NewDateTimeFromTime(time.Now()),
+	}}
+
+	_, err := idempotencyCollection.UpdateOne(ctx, bson.M{"_id": record.ID}, update)
+	return err
+}
+
+// ReleaseIdempotencyKey removes a key whose request never produced a response
+// so that the client can retry it
+func ReleaseIdempotencyKey(ctx context.Context, record IdempotencyRecord) error {
+	_, err := idempotencyCollection.DeleteOne(ctx, bson.M{"_id": record.ID, "status": IdempotencyProcessing})
+	return err
+}
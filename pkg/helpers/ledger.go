@@ -0,0 +1,501 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ledgerCollection = config.LedgerCollection
+
+// LedgerAccountType is the kind of account a ledger entry is posted to
+// Wallet, Budget and Hold accounts belong to a user, Hold is money set aside
+// for a withdrawal that the bank has not confirmed yet, External is money
+// entering or leaving the platform (card funding, bank payouts),
+// FX is the platform account that exchanges one currency for another
+// and Platform is the platform revenue wallet the fees on venue payments go to
+type LedgerAccountType string
+
+const (
+	WalletAccount   LedgerAccountType = "wallet"
+	BudgetAccount   LedgerAccountType = "budget"
+	HoldAccount     LedgerAccountType = "hold"
+	ExternalAccount LedgerAccountType = "external"
+	FXAccount       LedgerAccountType = "fx"
+	PlatformAccount LedgerAccountType = "platform"
+)
+
+func (la LedgerAccountType) String() string {
+	return string(la)
+}
+
+// EntryDirection is the side of the ledger an entry is posted to
+// A credit increases the balance of a user account, a debit decreases it
+type EntryDirection string
+
+const (
+	EntryDebit  EntryDirection = "debit"
+	EntryCredit EntryDirection = "credit"
+)
+
+func (ed EntryDirection) String() string {
+	return string(ed)
+}
+
+// LedgerEntry is a single line in the double-entry ledger
+// Every money movement posts at least two entries that share a reference
+// and whose debits and credits sum to the same amount
+type LedgerEntry struct {
+	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	TransactionID primitive.ObjectID `json:"transaction_id,omitempty" bson:"transaction_id,omitempty"`
+	Reference     string             `json:"reference" bson:"reference"`
+	AccountType   LedgerAccountType  `json:"account_type" bson:"account_type"`
+	AccountID     primitive.ObjectID `json:"account_id" bson:"account_id"`
+	Direction     EntryDirection     `json:"direction" bson:"direction"`
+	Amount        Money              `json:"amount" bson:"amount"`
+	Description   string             `json:"description,omitempty" bson:"description,omitempty"`
+	CreatedAt     primitive.DateTime `json:"created_at" bson:"created_at"`
+}
+
+// LedgerBalance is a wallet balance alongside the balance derived from the ledger
+type LedgerBalance struct {
+	WalletBalance Money `json:"wallet_balance"`
+	LedgerBalance Money `json:"ledger_balance"`
+	Balanced      bool  `json:"balanced"`
+}
+
+// LedgerSummary is the wallet ledger with the balance check for every currency
+type LedgerSummary struct {
+	Balances []LedgerBalance `json:"balances"`
+	Balanced bool            `json:"balanced"`
+	Entries  []LedgerEntry   `json:"entries"`
+}
+
+// NewLedgerEntry creates a ledger entry for the account and direction given
+// A negative amount flips the direction so entries are always stored as positive amounts
+func NewLedgerEntry(reference string, txnID primitive.ObjectID, accountType LedgerAccountType, accountID primitive.ObjectID, direction EntryDirection, amount Money, description string) LedgerEntry {
+	if amount.IsNegative() {
+		amount = amount.Neg()
+		if direction == EntryDebit {
+			direction = EntryCredit
+		} else {
+			direction = EntryDebit
+		}
+	}
+
+	createdAt, _ := CreatedAtUpdatedAt()
+
+	return LedgerEntry{
+		ID:            primitive.NewObjectID(),
+		TransactionID: txnID,
+		Reference:     reference,
+		AccountType:   accountType,
+		AccountID:     accountID,
+		Direction:     direction,
+		Amount:        amount,
+		Description:   description,
+		CreatedAt:     createdAt,
+	}
+}
+
+// ValidateLedgerEntries checks that the entries are balanced
+// The total of the debits must equal the total of the credits in every currency
+func ValidateLedgerEntries(entries []LedgerEntry) error {
+	if len(entries) < 2 {
+		return errors.New("a ledger posting needs at least two entries")
+	}
+
+	debits := make(map[string]int64)
+	credits := make(map[string]int64)
+	for _, entry := range entries {
+		if entry.Amount.Currency == "" {
+			return errors.New("ledger entry has no currency")
+		}
+
+		switch entry.Direction {
+		case EntryDebit:
+			debits[entry.Amount.Currency] += entry.Amount.Amount
+		case EntryCredit:
+			credits[entry.Amount.Currency] += entry.Amount.Amount
+		default:
+			return fmt.Errorf("invalid entry direction: %s", entry.Direction)
+		}
+	}
+
+	for currency := range debits {
+		if _, ok := credits[currency]; !ok {
+			credits[currency] = 0
+		}
+	}
+	for currency, credit := range credits {
+		if debits[currency] != credit {
+			return fmt.Errorf("unbalanced ledger posting: debits %s, credits %s", NewMoney(debits[currency], currency), NewMoney(credit, currency))
+		}
+	}
+
+	return nil
+}
+
+// PostLedgerEntries validates the entries and stores them in the ledger
+// Entries with a zero amount are skipped
+func PostLedgerEntries(ctx context.Context, entries []LedgerEntry) error {
+	funcName := ut.GetFunctionName()
+
+	var lines []LedgerEntry
+	for _, entry := range entries {
+		if !entry.Amount.IsZero() {
+			lines = append(lines, entry)
+		}
+	}
+
+	// nothing moved
+	if len(lines) == 0 {
+		return nil
+	}
+
+	if err := ValidateLedgerEntries(lines); err != nil {
+		SetDebug("error validating ledger entries: "+err.Error(), funcName)
+		return err
+	}
+
+	docs := make([]interface{}, len(lines))
+	for i := range lines {
+		docs[i] = lines[i]
+	}
+
+	_, err := ledgerCollection.InsertMany(ctx, docs)
+	if err != nil {
+		SetDebug("error posting ledger entries: "+err.Error(), funcName)
+		return err
+	}
+
+	return nil
+}
+
+// TransferLedgerEntries returns the entries for a transfer between two wallets
+// The part of the amount covered by the sender's budget is taken from the budget account
+// and the rest from the sender's wallet
+// When the sender paid in another currency the FX account takes the source amount
+// and pays out the converted amount
+// The platform fee on a venue payment is posted as its own line to the platform account,
+// a tip as its own line to the receiver and the receiver is credited the rest
+func TransferLedgerEntries(txn Transactions) []LedgerEntry {
+	description := "transfer " + txn.TransactionUID
+
+	entries := []LedgerEntry{
+		NewLedgerEntry(txn.TransactionUID, txn.ID, BudgetAccount, txn.FromID, EntryDebit, txn.BudgetAmount, description),
+		NewLedgerEntry(txn.TransactionUID, txn.ID, WalletAccount, txn.FromID, EntryDebit, txn.SourceAmount.Sub(txn.BudgetAmount), description),
+	}
+
+	if txn.SourceAmount.Currency != txn.Amount.Currency {
+		entries = append(entries,
+			NewLedgerEntry(txn.TransactionUID, txn.ID, FXAccount, primitive.NilObjectID, EntryCredit, txn.SourceAmount, description),
+			NewLedgerEntry(txn.TransactionUID, txn.ID, FXAccount, primitive.NilObjectID, EntryDebit, txn.Amount, description),
+		)
+	}
+
+	if txn.Type != Debit {
+		return append(entries, NewLedgerEntry(txn.TransactionUID, txn.ID, WalletAccount, txn.ToID, EntryCredit, txn.Amount, description))
+	}
+
+	return append(entries,
+		NewLedgerEntry(txn.TransactionUID, txn.ID, PlatformAccount, primitive.NilObjectID, EntryCredit, txn.Fee, "platform fee "+txn.TransactionUID),
+		NewLedgerEntry(txn.TransactionUID, txn.ID, WalletAccount, txn.ToID, EntryCredit, txn.Tip, "tip "+txn.TransactionUID),
+		NewLedgerEntry(txn.TransactionUID, txn.ID, WalletAccount, txn.ToID, EntryCredit, txn.NetAmount().Sub(txn.Tip), description),
+	)
+}
+
+// RefundLedgerEntries returns the entries for a refund
+// A refund is a transfer from the payee back to the payer
+// The part of the platform fee given back comes from the platform account
+// and the payee returns the rest
+func RefundLedgerEntries(refund Transactions) []LedgerEntry {
+	description := "refund " + refund.TransactionUID
+
+	entries := []LedgerEntry{
+		NewLedgerEntry(refund.TransactionUID, refund.ID, WalletAccount, refund.FromID, EntryDebit, refund.SourceAmount.Sub(refund.Fee), description),
+		NewLedgerEntry(refund.TransactionUID, refund.ID, PlatformAccount, primitive.NilObjectID, EntryDebit, refund.Fee, "platform fee "+description),
+	}
+
+	if refund.SourceAmount.Currency != refund.Amount.Currency {
+		entries = append(entries,
+			NewLedgerEntry(refund.TransactionUID, refund.ID, FXAccount, primitive.NilObjectID, EntryCredit, refund.SourceAmount, description),
+			NewLedgerEntry(refund.TransactionUID, refund.ID, FXAccount, primitive.NilObjectID, EntryDebit, refund.Amount, description),
+		)
+	}
+
+	return append(entries, NewLedgerEntry(refund.TransactionUID, refund.ID, WalletAccount, refund.ToID, EntryCredit, refund.Amount, description))
+}
+
+// FundingLedgerEntries returns the entries for money entering a wallet from outside the platform
+func FundingLedgerEntries(txn Transactions) []LedgerEntry {
+	description := "wallet funding " + txn.TransactionUID
+
+	return []LedgerEntry{
+		NewLedgerEntry(txn.TransactionUID, txn.ID, ExternalAccount, primitive.NilObjectID, EntryDebit, txn.Amount, description),
+		NewLedgerEntry(txn.TransactionUID, txn.ID, WalletAccount, txn.ToID, EntryCredit, txn.Amount, description),
+	}
+}
+
+// WithdrawalHoldLedgerEntries moves the withdrawal from the user's wallet into their hold account
+func WithdrawalHoldLedgerEntries(txn Transactions) []LedgerEntry {
+	description := "withdrawal hold " + txn.TransactionUID
+
+	return []LedgerEntry{
+		NewLedgerEntry(txn.TransactionUID, txn.ID, WalletAccount, txn.FromID, EntryDebit, txn.Amount, description),
+		NewLedgerEntry(txn.TransactionUID, txn.ID, HoldAccount, txn.FromID, EntryCredit, txn.Amount, description),
+	}
+}
+
+// WithdrawalSettledLedgerEntries pays the held withdrawal out of the platform
+func WithdrawalSettledLedgerEntries(txn Transactions) []LedgerEntry {
+	description := "withdrawal " + txn.TransactionUID
+
+	return []LedgerEntry{
+		NewLedgerEntry(txn.TransactionUID, txn.ID, HoldAccount, txn.FromID, EntryDebit, txn.Amount, description),
+		NewLedgerEntry(txn.TransactionUID, txn.ID, ExternalAccount, primitive.NilObjectID, EntryCredit, txn.Amount, description),
+	}
+}
+
+// WithdrawalReversedLedgerEntries returns the held withdrawal to the user's wallet
+func WithdrawalReversedLedgerEntries(txn Transactions) []LedgerEntry {
+	description := "withdrawal reversed " + txn.TransactionUID
+
+	return []LedgerEntry{
+		NewLedgerEntry(txn.TransactionUID, txn.ID, HoldAccount, txn.FromID, EntryDebit, txn.Amount, description),
+		NewLedgerEntry(txn.TransactionUID, txn.ID, WalletAccount, txn.FromID, EntryCredit, txn.Amount, description),
+	}
+}
+
+// BudgetLockLedgerEntries moves the amount from the user's wallet into their budget account
+func BudgetLockLedgerEntries(budget Budget) []LedgerEntry {
+	reference := "BL-" + budget.ID.Hex()
+
+	return []LedgerEntry{
+		NewLedgerEntry(reference, primitive.NilObjectID, WalletAccount, budget.UserID, EntryDebit, budget.Amount, "budget lock"),
+		NewLedgerEntry(reference, primitive.NilObjectID, BudgetAccount, budget.UserID, EntryCredit, budget.Amount, "budget lock"),
+	}
+}
+
+// BudgetReleaseLedgerEntries moves what was released of the budget from the user's budget account back into their wallet
+func BudgetReleaseLedgerEntries(budget Budget) []LedgerEntry {
+	reference := "BR-" + budget.ID.Hex()
+
+	return []LedgerEntry{
+		NewLedgerEntry(reference, primitive.NilObjectID, BudgetAccount, budget.UserID, EntryDebit, budget.Released, "budget release"),
+		NewLedgerEntry(reference, primitive.NilObjectID, WalletAccount, budget.UserID, EntryCredit, budget.Released, "budget release"),
+	}
+}
+
+// GetLedgerEntries returns the ledger entries matching the filter, newest first
+func GetLedgerEntries(ctx context.Context, filter bson.M) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+
+	cursor, err := ledgerCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return entries, err
+	}
+
+	if err = cursor.All(ctx, &entries); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// GetLedgerBalance sums the entries posted to an account in the currency
+// credits increase the balance and debits decrease it
+func GetLedgerBalance(ctx context.Context, accountType LedgerAccountType, accountID primitive.ObjectID, currency string) (Money, error) {
+	balance := ZeroMoney(currency)
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"account_type": accountType, "account_id": accountID, "amount.currency": balance.Currency}},
+		{"$group": bson.M{
+			"_id": "$direction",
+			"total": bson.M{
+				"$sum": "$amount.amount",
+			},
+		}},
+	}
+
+	cursor, err := ledgerCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return balance, err
+	}
+
+	var totals []struct {
+		Direction EntryDirection `bson:"_id"`
+		Total     int64          `bson:"total"`
+	}
+	if err = cursor.All(ctx, &totals); err != nil {
+		return balance, err
+	}
+
+	for _, t := range totals {
+		if t.Direction == EntryCredit {
+			balance.Amount += t.Total
+		} else {
+			balance.Amount -= t.Total
+		}
+	}
+
+	return balance, nil
+}
+
+// VerifyWalletAgainstLedger compares every stored wallet balance with the ledger balance
+// in the same currency, including currencies only the ledger knows about
+// It returns the balances and whether all of them agree
+func VerifyWalletAgainstLedger(ctx context.Context, wallet Wallet) ([]LedgerBalance, bool, error) {
+	var balances []LedgerBalance
+
+	currencies, err := ledgerCollection.Distinct(ctx, "amount.currency", bson.M{"account_type": WalletAccount, "account_id": wallet.UserID})
+	if err != nil {
+		return balances, false, err
+	}
+
+	walletBalances := wallet.AllBalances()
+	for _, currency := range currencies {
+		if code, ok := currency.(string); ok && code != "" {
+			if _, held := wallet.Balances[code]; !held {
+				walletBalances = append(walletBalances, ZeroMoney(code))
+			}
+		}
+	}
+
+	balanced := true
+	for _, walletBalance := range walletBalances {
+		ledgerBalance, err := GetLedgerBalance(ctx, WalletAccount, wallet.UserID, walletBalance.Currency)
+		if err != nil {
+			return balances, false, err
+		}
+
+		ok := ledgerBalance.Amount == walletBalance.Amount
+		balanced = balanced && ok
+		balances = append(balances, LedgerBalance{
+			WalletBalance: walletBalance,
+			LedgerBalance: ledgerBalance,
+			Balanced:      ok,
+		})
+	}
+
+	return balances, balanced, nil
+}
+
+// GetLedgerSummary returns the user's wallet ledger with the balance check
+func GetLedgerSummary(ctx context.Context, user UserResponse) (LedgerSummary, error) {
+	var summary LedgerSummary
+
+	wallet, err := GetWallet(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return summary, err
+	}
+
+	entries, err := GetLedgerEntries(ctx, bson.M{"account_type": WalletAccount, "account_id": user.ID})
+	if err != nil {
+		return summary, err
+	}
+
+	balances, balanced, err := VerifyWalletAgainstLedger(ctx, wallet)
+	if err != nil {
+		return summary, err
+	}
+
+	summary.Balances = balances
+	summary.Balanced = balanced
+	summary.Entries = entries
+
+	return summary, nil
+}
+
+// BackfillOpeningBalances posts an opening balance for wallets and budgets
+// that were funded before the ledger existed
+// An account is only backfilled if it has no entries yet
+// It returns the number of accounts backfilled
+func BackfillOpeningBalances(ctx context.Context) (int, error) {
+	funcName := ut.GetFunctionName()
+
+	var count int
+
+	cursor, err := walletCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return count, err
+	}
+
+	var wallets []Wallet
+	if err = cursor.All(ctx, &wallets); err != nil {
+		return count, err
+	}
+
+	for _, wallet := range wallets {
+		n, err := ledgerCollection.CountDocuments(ctx, bson.M{"account_type": WalletAccount, "account_id": wallet.UserID})
+		if err != nil {
+			return count, err
+		}
+		if n > 0 {
+			continue
+		}
+
+		reference := "OB-" + wallet.ID.Hex()
+		var entries []LedgerEntry
+		for _, balance := range wallet.AllBalances() {
+			if balance.IsZero() {
+				continue
+			}
+			entries = append(entries,
+				NewLedgerEntry(reference, primitive.NilObjectID, ExternalAccount, primitive.NilObjectID, EntryDebit, balance, "opening balance"),
+				NewLedgerEntry(reference, primitive.NilObjectID, WalletAccount, wallet.UserID, EntryCredit, balance, "opening balance"),
+			)
+		}
+
+		if err = PostLedgerEntries(ctx, entries); err != nil {
+			return count, err
+		}
+		if len(entries) > 0 {
+			count++
+		}
+	}
+
+	cursor, err = budgetCollection.Find(ctx, openBudgets(bson.M{}))
+	if err != nil {
+		return count, err
+	}
+
+	var budgets []Budget
+	if err = cursor.All(ctx, &budgets); err != nil {
+		return count, err
+	}
+
+	for _, budget := range budgets {
+		// budgets locked since the ledger existed have a BL- entry, backfilled ones an OB- entry
+		reference := "OB-" + budget.ID.Hex()
+		n, err := ledgerCollection.CountDocuments(ctx, bson.M{"reference": bson.M{"$in": bson.A{reference, "BL-" + budget.ID.Hex()}}})
+		if err != nil {
+			return count, err
+		}
+		if n > 0 {
+			continue
+		}
+
+		entries := []LedgerEntry{
+			NewLedgerEntry(reference, primitive.NilObjectID, ExternalAccount, primitive.NilObjectID, EntryDebit, budget.Amount, "opening budget"),
+			NewLedgerEntry(reference, primitive.NilObjectID, BudgetAccount, budget.UserID, EntryCredit, budget.Amount, "opening budget"),
+		}
+
+		if err = PostLedgerEntries(ctx, entries); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	SetInfo(fmt.Sprintf("backfilled %d ledger accounts", count), funcName)
+
+	return count, nil
+}
@@ -0,0 +1,414 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var kycLimitCollection = config.KYCLimitCollection
+
+// LimitOperation is a kind of money movement that is limited by KYC tier
+type LimitOperation string
+
+const (
+	OpSend        LimitOperation = "send"
+	OpBillPayment LimitOperation = "bill_payment"
+	OpFund        LimitOperation = "fund"
+	OpWithdraw    LimitOperation = "withdraw"
+)
+
+func (op LimitOperation) String() string {
+	return string(op)
+}
+
+var limitOperations = []LimitOperation{OpSend, OpBillPayment, OpFund, OpWithdraw}
+
+// KYCLimit is what a user of a KYC tier can move in one operation
+// A zero limit is no limit and a disabled operation is not allowed at all
+// Daily and monthly limits are for the calendar day and month in UTC
+type KYCLimit struct {
+	ID             primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Tier           KYCStatus          `json:"tier" bson:"tier" binding:"required"`
+	Operation      LimitOperation     `json:"operation" bson:"operation" binding:"required"`
+	Currency       string             `json:"currency" bson:"currency" binding:"required,len=3"`
+	PerTransaction Money              `json:"per_transaction" bson:"per_transaction"`
+	Daily          Money              `json:"daily" bson:"daily"`
+	Monthly        Money              `json:"monthly" bson:"monthly"`
+	Disabled       bool               `json:"disabled" bson:"disabled"`
+	UpdatedBy      primitive.ObjectID `json:"updated_by,omitempty" bson:"updated_by,omitempty"`
+	CreatedAt      primitive.DateTime `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt      primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+}
+
+// defaultLimit builds a limit in the default currency from major units
+func defaultLimit(tier KYCStatus, op LimitOperation, perTransaction, daily, monthly float64) KYCLimit {
+	return KYCLimit{
+		Tier:           tier,
+		Operation:      op,
+		Currency:       config.DefaultCurrency,
+		PerTransaction: MoneyFromMajor(perTransaction, config.DefaultCurrency),
+		Daily:          MoneyFromMajor(daily, config.DefaultCurrency),
+		Monthly:        MoneyFromMajor(monthly, config.DefaultCurrency),
+	}
+}
+
+// DefaultKYCLimits apply to a tier and operation admins have not set a limit for
+// Rejected users get the limits of unverified users
+var DefaultKYCLimits = []KYCLimit{
+	defaultLimit(Unverified, OpSend, 20000, 50000, 200000),
+	defaultLimit(Unverified, OpBillPayment, 50000, 100000, 300000),
+	defaultLimit(Unverified, OpFund, 50000, 100000, 300000),
+	defaultLimit(Unverified, OpWithdraw, 20000, 50000, 200000),
+
+	defaultLimit(Pending, OpSend, 100000, 200000, 1000000),
+	defaultLimit(Pending, OpBillPayment, 100000, 300000, 1000000),
+	defaultLimit(Pending, OpFund, 200000, 500000, 2000000),
+	defaultLimit(Pending, OpWithdraw, 100000, 200000, 1000000),
+
+	defaultLimit(Verified, OpSend, 1000000, 5000000, 20000000),
+	defaultLimit(Verified, OpBillPayment, 1000000, 5000000, 20000000),
+	defaultLimit(Verified, OpFund, 5000000, 10000000, 50000000),
+	defaultLimit(Verified, OpWithdraw, 1000000, 5000000, 20000000),
+}
+
+// LimitError is returned when an operation goes over the user's limit
+// Code says which limit, Limit and Used are in the currency of the limit
+type LimitError struct {
+	Code      Codes          `json:"code"`
+	Operation LimitOperation `json:"operation"`
+	Tier      KYCStatus      `json:"tier"`
+	Amount    Money          `json:"amount"`
+	Limit     Money          `json:"limit"`
+	Used      Money          `json:"used"`
+	Remaining Money          `json:"remaining"`
+}
+
+func (e *LimitError) Error() string {
+	if e.Code == LimitNotAllowed {
+		return fmt.Sprintf("%s is not allowed for %s accounts", e.Operation, e.Tier)
+	}
+
+	return fmt.Sprintf("%s: %s of %s would go over the %s limit for %s accounts, %s left",
+		e.Code, e.Operation, e.Amount, e.Limit, e.Tier, e.Remaining)
+}
+
+// LimitUsage is how much of a limit a user has used
+type LimitUsage struct {
+	KYCLimit
+	UsedToday     Money `json:"used_today"`
+	UsedThisMonth Money `json:"used_this_month"`
+}
+
+// limitTier is the tier whose limits apply to the user
+func limitTier(status KYCStatus) KYCStatus {
+	switch status {
+	case Pending, Verified, Rejected:
+		return status
+	default:
+		return Unverified
+	}
+}
+
+func validLimitOperation(op LimitOperation) bool {
+	for _, o := range limitOperations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// GetKYCLimit returns the limit for the tier and operation
+// It falls back to DefaultKYCLimits, and rejected users to the unverified limits
+func GetKYCLimit(ctx context.Context, tier KYCStatus, op LimitOperation) (KYCLimit, error) {
+	var limit KYCLimit
+
+	err := kycLimitCollection.FindOne(ctx, bson.M{"tier": tier, "operation": op}).Decode(&limit)
+	if err == nil {
+		return limit, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return limit, err
+	}
+
+	if tier == Rejected {
+		return GetKYCLimit(ctx, Unverified, op)
+	}
+	for _, limit := range DefaultKYCLimits {
+		if limit.Tier == tier && limit.Operation == op {
+			return limit, nil
+		}
+	}
+
+	return KYCLimit{Tier: tier, Operation: op, Currency: config.DefaultCurrency}, nil
+}
+
+// GetKYCLimits returns the limit of every tier and operation, set or default
+func GetKYCLimits(ctx context.Context) ([]KYCLimit, error) {
+	var limits []KYCLimit
+
+	for _, tier := range []KYCStatus{Unverified, Pending, Verified, Rejected} {
+		for _, op := range limitOperations {
+			limit, err := GetKYCLimit(ctx, tier, op)
+			if err != nil {
+				return limits, err
+			}
+			limit.Tier = tier
+			limits = append(limits, limit)
+		}
+	}
+
+	return limits, nil
+}
+
+// SetKYCLimit creates or replaces the limit for the tier and operation
+// Limits sent as plain numbers are taken to be in the limit's currency
+func SetKYCLimit(ctx context.Context, limit KYCLimit) (KYCLimit, error) {
+	limit.Currency = strings.ToUpper(limit.Currency)
+
+	if limitTier(limit.Tier) != limit.Tier {
+		return limit, fmt.Errorf("invalid tier: %q", limit.Tier)
+	}
+	if !validLimitOperation(limit.Operation) {
+		return limit, fmt.Errorf("invalid operation: %q", limit.Operation)
+	}
+	if err := ValidateCurrency(limit.Currency); err != nil {
+		return limit, err
+	}
+
+	for _, amount := range []*Money{&limit.PerTransaction, &limit.Daily, &limit.Monthly} {
+		*amount = amount.InCurrency(limit.Currency)
+		if amount.Currency != limit.Currency {
+			return limit, errors.New("limits must be in the currency of the limit")
+		}
+		if amount.IsNegative() {
+			return limit, errors.New("limits cannot be negative")
+		}
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	filter := bson.M{"tier": limit.Tier, "operation": limit.Operation}
+	update := bson.M{
+		"$set": bson.M{
+			"currency":        limit.Currency,
+			"per_transaction": limit.PerTransaction,
+			"daily":           limit.Daily,
+			"monthly":         limit.Monthly,
+			"disabled":        limit.Disabled,
+			"updated_by":      limit.UpdatedBy,
+			"updated_at":      now,
+		},
+		"$setOnInsert": bson.M{"created_at": now},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	err := kycLimitCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&limit)
+	return limit, err
+}
+
+// DeleteKYCLimit removes the limit set for the tier and operation so the default applies again
+func DeleteKYCLimit(ctx context.Context, tier KYCStatus, op LimitOperation) error {
+	result, err := kycLimitCollection.DeleteOne(ctx, bson.M{"tier": tier, "operation": op})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+// limitFilter matches the user's transactions that count towards the operation's limits
+// Failed and reversed transactions do not count, nor do fundings left pending for longer
+// than StuckTransactionAge because the user never paid
+func limitFilter(userID primitive.ObjectID, op LimitOperation, since time.Time) bson.M {
+	counted := bson.A{TxnSuccess, TxnPending, TxnRefunded, TxnPartiallyRefunded}
+	filter := bson.M{
+		"created_at": bson.M{"$gte": primitive.NewDateTimeFromTime(since)},
+		"status":     bson.M{"$in": counted},
+	}
+
+	switch op {
+	case OpSend:
+		filter["type"] = Debit
+		filter["from_id"] = userID
+		filter["event_id"] = bson.M{"$exists": false}
+	case OpBillPayment:
+		filter["type"] = Debit
+		filter["from_id"] = userID
+		filter["event_id"] = bson.M{"$exists": true}
+	case OpFund:
+		filter["type"] = Credit
+		filter["to_id"] = userID
+		filter["$or"] = bson.A{
+			bson.M{"status": bson.M{"$ne": TxnPending}},
+			bson.M{"created_at": bson.M{"$gte": primitive.NewDateTimeFromTime(time.Now().Add(-StuckTransactionAge))}},
+		}
+	case OpWithdraw:
+		filter["type"] = Withdrawal
+		filter["from_id"] = userID
+	}
+
+	return filter
+}
+
+// limitUsed returns how much the user moved in the operation since the time given
+// in the currency of the limit, transactions in other currencies are converted
+func limitUsed(ctx context.Context, userID primitive.ObjectID, op LimitOperation, since time.Time, currency string) (Money, error) {
+	used := ZeroMoney(currency)
+
+	// What left or reached the wallet, older transactions only have an amount
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: limitFilter(userID, op, since)}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$ifNull": bson.A{"$source_amount.currency", "$amount.currency"}},
+			"total": bson.M{"$sum": bson.M{"$ifNull": bson.A{"$source_amount.amount", "$amount.amount"}}},
+		}}},
+	}
+
+	cursor, err := transactionCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return used, err
+	}
+
+	var totals []struct {
+		Currency string `bson:"_id"`
+		Total    int64  `bson:"total"`
+	}
+	if err = cursor.All(ctx, &totals); err != nil {
+		return used, err
+	}
+
+	for _, total := range totals {
+		amount, _, err := Convert(ctx, NewMoney(total.Total, total.Currency), currency)
+		if err != nil {
+			return used, err
+		}
+		used = used.Add(amount)
+	}
+
+	return used, nil
+}
+
+// limitPeriods returns the start of the current UTC day and month
+func limitPeriods(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
+
+// CheckLimit checks that the user's KYC tier allows the operation for the amount
+// It returns a *LimitError naming the limit that would be exceeded
+func CheckLimit(ctx context.Context, user UserResponse, op LimitOperation, amount Money) error {
+	funcName := ut.GetFunctionName()
+
+	tier := limitTier(user.KYCStatus)
+
+	limit, err := GetKYCLimit(ctx, tier, op)
+	if err != nil {
+		SetDebug("error getting limit: "+err.Error(), funcName)
+		return err
+	}
+
+	if limit.Disabled {
+		return &LimitError{Code: LimitNotAllowed, Operation: op, Tier: tier, Amount: amount}
+	}
+
+	converted, _, err := Convert(ctx, amount, limit.Currency)
+	if err != nil {
+		SetDebug("error converting amount to limit currency: "+err.Error(), funcName)
+		return err
+	}
+
+	if limit.PerTransaction.IsPositive() && converted.GreaterThan(limit.PerTransaction) {
+		return &LimitError{
+			Code:      PerTransactionLimitExceeded,
+			Operation: op,
+			Tier:      tier,
+			Amount:    amount,
+			Limit:     limit.PerTransaction,
+			Remaining: limit.PerTransaction,
+		}
+	}
+
+	day, month := limitPeriods(time.Now())
+	periods := []struct {
+		code  Codes
+		limit Money
+		since time.Time
+	}{
+		{DailyLimitExceeded, limit.Daily, day},
+		{MonthlyLimitExceeded, limit.Monthly, month},
+	}
+
+	for _, period := range periods {
+		if !period.limit.IsPositive() {
+			continue
+		}
+
+		used, err := limitUsed(ctx, user.ID, op, period.since, limit.Currency)
+		if err != nil {
+			SetDebug("error getting limit usage: "+err.Error(), funcName)
+			return err
+		}
+
+		if used.Add(converted).GreaterThan(period.limit) {
+			remaining := period.limit.Sub(used)
+			if remaining.IsNegative() {
+				remaining = ZeroMoney(limit.Currency)
+			}
+
+			SetInfo(fmt.Sprintf("%s limit hit by user %s", period.code, user.ID.Hex()), funcName)
+			return &LimitError{
+				Code:      period.code,
+				Operation: op,
+				Tier:      tier,
+				Amount:    amount,
+				Limit:     period.limit,
+				Used:      used,
+				Remaining: remaining,
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetLimitUsage returns the user's limits for every operation and how much of them is used
+func GetLimitUsage(ctx context.Context, user UserResponse) ([]LimitUsage, error) {
+	usage := []LimitUsage{}
+	tier := limitTier(user.KYCStatus)
+	day, month := limitPeriods(time.Now())
+
+	for _, op := range limitOperations {
+		limit, err := GetKYCLimit(ctx, tier, op)
+		if err != nil {
+			return usage, err
+		}
+
+		today, err := limitUsed(ctx, user.ID, op, day, limit.Currency)
+		if err != nil {
+			return usage, err
+		}
+		thisMonth, err := limitUsed(ctx, user.ID, op, month, limit.Currency)
+		if err != nil {
+			return usage, err
+		}
+
+		usage = append(usage, LimitUsage{KYCLimit: limit, UsedToday: today, UsedThisMonth: thisMonth})
+	}
+
+	return usage, nil
+}
@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/Rhaqim/thedutchapp/pkg/config"
-	"github.com/Rhaqim/thedutchapp/pkg/database"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -41,6 +40,12 @@ const (
 	InsufficientFunds Codes = "insufficient_funds"
 	SuccessCode       Codes = "success"
 	AlreadyCompleted  Codes = "already_completed"
+
+	// KYC limits, see CheckLimit
+	LimitNotAllowed             Codes = "operation_not_allowed"
+	PerTransactionLimitExceeded Codes = "per_transaction_limit_exceeded"
+	DailyLimitExceeded          Codes = "daily_limit_exceeded"
+	MonthlyLimitExceeded        Codes = "monthly_limit_exceeded"
 )
 
 type Address struct {
@@ -122,7 +127,7 @@ func SetWarning(message string, funcName string) {
 // REMOVE PASSWORD FROM USER STRUCT
 var PasswordOpts = options.FindOne().SetProjection(bson.M{"password": 0})
 
-var usersCollection = database.OpenCollection(database.ConnectMongoDB(), config.DB, config.USERS)
+var usersCollection = config.UserCollection
 
 // UPDATE REFRESH TOKEN
 func UpdateRefreshToken(ctx context.Context, id primitive.ObjectID, refreshToken string) error {
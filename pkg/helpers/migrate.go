@@ -0,0 +1,307 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// moneyField is a document field that used to hold a float64 amount
+type moneyField struct {
+	Collection *mongo.Collection
+	Field      string
+}
+
+var moneyFields = []moneyField{
+	{walletCollection, "balance"},
+	{transactionCollection, "amount"},
+	{transactionCollection, "budget_amount"},
+	{orderCollection, "bill"},
+	{eventCollection, "bill"},
+	{eventCollection, "budget"},
+	{productCollection, "price"},
+	{budgetCollection, "amount"},
+	{attendeeCollection, "budget"},
+	{ledgerCollection, "amount"},
+}
+
+// toMinorUnits returns the aggregation expression that converts a major unit
+// field to minor units, rounding half away from zero like MoneyFromMajor
+func toMinorUnits(field string, scale float64) bson.M {
+	scaled := bson.M{"$multiply": bson.A{bson.M{"$toDecimal": "$" + field}, scale}}
+
+	return bson.M{"$toLong": bson.M{
+		"$cond": bson.A{
+			bson.M{"$gte": bson.A{scaled, 0}},
+			bson.M{"$floor": bson.M{"$add": bson.A{scaled, 0.5}}},
+			bson.M{"$ceil": bson.M{"$subtract": bson.A{scaled, 0.5}}},
+		},
+	}}
+}
+
+// MigrateMoneyFields rewrites amounts stored as plain numbers into
+// {amount, currency} documents in minor units of the default currency
+// Documents that were already migrated are left alone so it is safe to run again
+// It returns the number of documents updated per collection and field
+func MigrateMoneyFields(ctx context.Context) (map[string]int64, error) {
+	funcName := ut.GetFunctionName()
+
+	counts := make(map[string]int64)
+	scale := math.Pow10(CurrencyExponent(config.DefaultCurrency))
+
+	for _, mf := range moneyFields {
+		key := mf.Collection.Name() + "." + mf.Field
+
+		filter := bson.M{mf.Field: bson.M{"$type": bson.A{"double", "int", "long", "decimal"}}}
+		update := bson.A{
+			bson.M{"$set": bson.M{
+				mf.Field: bson.M{
+					"amount":   toMinorUnits(mf.Field, scale),
+					"currency": config.DefaultCurrency,
+				},
+			}},
+		}
+
+		result, err := mf.Collection.UpdateMany(ctx, filter, update)
+		if err != nil {
+			SetDebug("error migrating "+key+": "+err.Error(), funcName)
+			return counts, err
+		}
+
+		counts[key] = result.ModifiedCount
+		SetInfo(fmt.Sprintf("migrated %d documents in %s", result.ModifiedCount, key), funcName)
+	}
+
+	return counts, nil
+}
+
+// MigrateWalletCurrencies moves the single wallet balance into the per currency
+// balances and records the source amount on transactions made before FX support
+// Run it after MigrateMoneyFields, it is safe to run again
+// It returns the number of documents updated per collection
+func MigrateWalletCurrencies(ctx context.Context) (map[string]int64, error) {
+	funcName := ut.GetFunctionName()
+
+	counts := make(map[string]int64)
+
+	filter := bson.M{"balance": bson.M{"$type": "object"}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"currency": "$balance.currency",
+			"balances": bson.M{"$arrayToObject": bson.A{
+				bson.A{bson.M{"k": "$balance.currency", "v": "$balance.amount"}},
+			}},
+		}},
+		bson.M{"$unset": "balance"},
+	}
+
+	result, err := walletCollection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		SetDebug("error migrating wallet balances: "+err.Error(), funcName)
+		return counts, err
+	}
+	counts[walletCollection.Name()] = result.ModifiedCount
+
+	filter = bson.M{"source_amount": bson.M{"$exists": false}}
+	update = bson.A{
+		bson.M{"$set": bson.M{
+			"source_amount": "$amount",
+			"exchange_rate": 1,
+		}},
+	}
+
+	result, err = transactionCollection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		SetDebug("error migrating transaction amounts: "+err.Error(), funcName)
+		return counts, err
+	}
+	counts[transactionCollection.Name()] = result.ModifiedCount
+
+	SetInfo(fmt.Sprintf("migrated wallet currencies: %v", counts), funcName)
+
+	return counts, nil
+}
+
+// MigrateTransactionReferences gives a new reference to every transaction that
+// shares its reference with another, which all transactions did while the
+// reference was generated once at startup
+// Ledger entries of the transaction get the new reference too
+// Once references are unique it adds a unique index on them, it is safe to run again
+// It returns the number of transactions updated
+func MigrateTransactionReferences(ctx context.Context) (int64, error) {
+	funcName := ut.GetFunctionName()
+
+	pipeline := bson.A{
+		bson.M{"$group": bson.M{
+			"_id":   "$transaction_uid",
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}},
+		bson.M{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}
+
+	cursor, err := transactionCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		SetDebug("error finding shared references: "+err.Error(), funcName)
+		return 0, err
+	}
+
+	var groups []struct {
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		SetDebug("error decoding shared references: "+err.Error(), funcName)
+		return 0, err
+	}
+
+	var count int64
+	for _, group := range groups {
+		for _, id := range group.IDs {
+			reference := NewTransactionUID()
+
+			_, err = transactionCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"transaction_uid": reference}})
+			if err != nil {
+				SetDebug("error updating transaction reference: "+err.Error(), funcName)
+				return count, err
+			}
+
+			_, err = ledgerCollection.UpdateMany(ctx, bson.M{"transaction_id": id}, bson.M{"$set": bson.M{"reference": reference}})
+			if err != nil {
+				SetDebug("error updating ledger reference: "+err.Error(), funcName)
+				return count, err
+			}
+
+			count++
+		}
+	}
+
+	_, err = transactionCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "transaction_uid", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		SetDebug("error creating transaction reference index: "+err.Error(), funcName)
+		return count, err
+	}
+
+	SetInfo(fmt.Sprintf("gave %d transactions a new reference", count), funcName)
+
+	return count, nil
+}
+
+// MigrateBudgets ties budgets from before budgets were kept per event to the event they were locked for
+// They were only keyed by the owner of the restaurant, a budget goes to the user's one upcoming
+// or ongoing event at that owner's restaurants and is returned to the wallet if there is no such
+// event or more than one
+// Opening balances are backfilled first, releasing a budget posts to the ledger and
+// BackfillOpeningBalances skips any account that already has entries
+// It then adds a unique index so a user has one locked budget per event, it is safe to run again
+// It returns the number of budgets assigned to an event and released
+func MigrateBudgets(ctx context.Context) (map[string]int64, error) {
+	funcName := ut.GetFunctionName()
+
+	counts := map[string]int64{"assigned": 0, "released": 0}
+
+	cursor, err := budgetCollection.Find(ctx, bson.M{"status": bson.M{"$exists": false}})
+	if err != nil {
+		SetDebug("error finding budgets: "+err.Error(), funcName)
+		return counts, err
+	}
+
+	var legacy []struct {
+		Budget     `bson:",inline"`
+		IntendedID primitive.ObjectID `bson:"intended_id"`
+	}
+	if err = cursor.All(ctx, &legacy); err != nil {
+		SetDebug("error decoding budgets: "+err.Error(), funcName)
+		return counts, err
+	}
+
+	if len(legacy) > 0 {
+		if _, err = BackfillOpeningBalances(ctx); err != nil {
+			SetDebug("error backfilling opening balances: "+err.Error(), funcName)
+			return counts, err
+		}
+	}
+
+	for _, old := range legacy {
+		budget := old.Budget
+
+		restaurants, err := restaurantCollection.Distinct(ctx, "_id", bson.M{"owner_id": old.IntendedID})
+		if err != nil {
+			return counts, err
+		}
+
+		events, err := eventCollection.Distinct(ctx, "_id", bson.M{
+			"restaurant_id": bson.M{"$in": restaurants},
+			"attendees":     budget.UserID,
+			"event_status":  bson.M{"$in": bson.A{Upcoming, Ongoing}},
+		})
+		if err != nil {
+			return counts, err
+		}
+
+		var eventID primitive.ObjectID
+		if len(events) == 1 {
+			eventID, _ = events[0].(primitive.ObjectID)
+			if _, err := GetBudget(ctx, eventID, budget.UserID); err == nil {
+				eventID = primitive.NilObjectID
+			}
+		}
+
+		if !eventID.IsZero() {
+			createdAt := primitive.NewDateTimeFromTime(budget.ID.Timestamp())
+			_, err = budgetCollection.UpdateOne(ctx, bson.M{"_id": budget.ID}, bson.M{
+				"$set": bson.M{
+					"event_id":   eventID,
+					"status":     BudgetLocked,
+					"created_at": createdAt,
+					"updated_at": createdAt,
+				},
+				"$unset": bson.M{"intended_id": ""},
+			})
+			if err != nil {
+				SetDebug("error assigning budget: "+err.Error(), funcName)
+				return counts, err
+			}
+			counts["assigned"]++
+			continue
+		}
+
+		err = RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+			_, _, err := releaseBudget(sessCtx, budget, ZeroMoney(budget.Amount.Currency), BudgetReleased, primitive.NilObjectID)
+			if err != nil {
+				return err
+			}
+
+			_, err = budgetCollection.UpdateOne(sessCtx, bson.M{"_id": budget.ID}, bson.M{"$unset": bson.M{"intended_id": ""}})
+			return err
+		})
+		if err != nil {
+			SetDebug("error releasing budget: "+err.Error(), funcName)
+			return counts, err
+		}
+		counts["released"]++
+	}
+
+	_, err = budgetCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "event_id", Value: 1}, {Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"status": BudgetLocked}),
+	})
+	if err != nil {
+		SetDebug("error creating budget index: "+err.Error(), funcName)
+		return counts, err
+	}
+
+	SetInfo(fmt.Sprintf("assigned %d budgets to events and released %d", counts["assigned"], counts["released"]), funcName)
+
+	return counts, nil
+}
@@ -0,0 +1,347 @@
+package helpers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// Money is an amount in the minor unit of its currency, e.g. kobo for NGN
+// Amounts are integers so that sums and splits never drift
+type Money struct {
+	Amount   int64  `json:"amount" bson:"amount"`
+	Currency string `json:"currency" bson:"currency"`
+}
+
+var ErrCurrencyMismatch = errors.New("currency mismatch")
+
+// currencyExponents lists the currencies that do not use two decimal places
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// CurrencyExponent returns the number of decimal places of the currency
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// NewMoney returns an amount of minor units in the currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// ZeroMoney returns a zero amount in the currency
+func ZeroMoney(currency string) Money {
+	return NewMoney(0, currency)
+}
+
+// MoneyFromMajor converts an amount in major units, e.g. 12.50, to Money
+// rounding half away from zero to the nearest minor unit
+func MoneyFromMajor(amount float64, currency string) Money {
+	if currency == "" {
+		currency = config.DefaultCurrency
+	}
+	scale := math.Pow10(CurrencyExponent(currency))
+	return NewMoney(int64(math.Round(amount*scale)), currency)
+}
+
+// Major returns the amount in major units
+// Only use it for display and for external APIs that expect major units
+func (m Money) Major() float64 {
+	return float64(m.Amount) / math.Pow10(CurrencyExponent(m.Currency))
+}
+
+// Format returns the amount in major units without the currency, e.g. 12.50
+func (m Money) Format() string {
+	exp := CurrencyExponent(m.Currency)
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if exp == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	scale := int64(math.Pow10(exp))
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, exp, amount%scale)
+}
+
+// String returns the amount with its currency, e.g. NGN 12.50
+func (m Money) String() string {
+	return strings.TrimSpace(m.Currency + " " + m.Format())
+}
+
+// sameCurrency reports whether both amounts can be combined
+// A zero value without a currency combines with anything
+func (m Money) sameCurrency(o Money) bool {
+	return m.Currency == o.Currency || m.Currency == "" || o.Currency == ""
+}
+
+func (m Money) currencyWith(o Money) string {
+	if m.Currency != "" {
+		return m.Currency
+	}
+	return o.Currency
+}
+
+func (m Money) mustMatch(o Money) {
+	if !m.sameCurrency(o) {
+		panic(fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency))
+	}
+}
+
+// Add returns m + o, it panics if the currencies differ
+func (m Money) Add(o Money) Money {
+	m.mustMatch(o)
+	return Money{Amount: m.Amount + o.Amount, Currency: m.currencyWith(o)}
+}
+
+// Sub returns m - o, it panics if the currencies differ
+func (m Money) Sub(o Money) Money {
+	m.mustMatch(o)
+	return Money{Amount: m.Amount - o.Amount, Currency: m.currencyWith(o)}
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Abs returns the absolute amount
+func (m Money) Abs() Money {
+	if m.Amount < 0 {
+		return m.Neg()
+	}
+	return m
+}
+
+// Mul returns m multiplied by a whole quantity
+func (m Money) Mul(quantity int64) Money {
+	return Money{Amount: m.Amount * quantity, Currency: m.Currency}
+}
+
+// Percent returns percent% of m rounded half away from zero
+func (m Money) Percent(percent float64) Money {
+	return Money{Amount: int64(math.Round(float64(m.Amount) * percent / 100)), Currency: m.Currency}
+}
+
+// Cmp returns -1, 0 or 1 if m is less than, equal to or greater than o
+// It panics if the currencies differ
+func (m Money) Cmp(o Money) int {
+	m.mustMatch(o)
+	switch {
+	case m.Amount < o.Amount:
+		return -1
+	case m.Amount > o.Amount:
+		return 1
+	}
+	return 0
+}
+
+func (m Money) LessThan(o Money) bool {
+	return m.Cmp(o) < 0
+}
+
+func (m Money) GreaterThan(o Money) bool {
+	return m.Cmp(o) > 0
+}
+
+func (m Money) GreaterThanOrEqual(o Money) bool {
+	return m.Cmp(o) >= 0
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// Split divides m into n parts that differ by at most one minor unit
+// and always add up to m
+func (m Money) Split(n int) []Money {
+	if n <= 0 {
+		return nil
+	}
+	weights := make([]int64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return m.Allocate(weights...)
+}
+
+// Allocate divides m in proportion to the weights
+// The minor units left over by rounding go to the largest remainders first,
+// so the parts always add up to m
+func (m Money) Allocate(weights ...int64) []Money {
+	var total int64
+	for _, w := range weights {
+		if w > 0 {
+			total += w
+		}
+	}
+	parts := make([]Money, len(weights))
+	if total == 0 {
+		for i := range parts {
+			parts[i] = ZeroMoney(m.Currency)
+		}
+		return parts
+	}
+
+	sign := int64(1)
+	amount := m.Amount
+	if amount < 0 {
+		sign, amount = -1, -amount
+	}
+
+	remainders := make([]int64, len(weights))
+	var allocated int64
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		share := amount * w / total
+		remainders[i] = amount*w - share*total
+		parts[i].Amount = share
+		allocated += share
+	}
+
+	// hand out the leftover minor units, largest remainder first
+	for left := amount - allocated; left > 0; left-- {
+		best := -1
+		for i, r := range remainders {
+			if weights[i] > 0 && (best == -1 || r > remainders[best]) {
+				best = i
+			}
+		}
+		parts[best].Amount++
+		remainders[best] = -1
+	}
+
+	for i := range parts {
+		parts[i].Amount *= sign
+		parts[i].Currency = m.Currency
+	}
+	return parts
+}
+
+// SumMoney adds up the amounts, it panics if the currencies differ
+func SumMoney(amounts ...Money) Money {
+	var total Money
+	for _, a := range amounts {
+		total = total.Add(a)
+	}
+	return total
+}
+
+// moneyDocument has no methods so it is encoded as a plain struct
+type moneyDocument Money
+
+// MarshalBSONValue stores Money as {amount, currency}
+func (m Money) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(moneyDocument(m))
+}
+
+// UnmarshalBSONValue reads Money stored as {amount, currency}
+// Amounts stored as plain numbers before the migration are read as
+// major units in the default currency
+func (m *Money) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+
+	switch t {
+	case bsontype.EmbeddedDocument:
+		var doc moneyDocument
+		if err := raw.Unmarshal(&doc); err != nil {
+			return err
+		}
+		*m = NewMoney(doc.Amount, doc.Currency)
+	case bsontype.Double:
+		*m = MoneyFromMajor(raw.Double(), config.DefaultCurrency)
+	case bsontype.Int32:
+		*m = MoneyFromMajor(float64(raw.Int32()), config.DefaultCurrency)
+	case bsontype.Int64:
+		*m = MoneyFromMajor(float64(raw.Int64()), config.DefaultCurrency)
+	case bsontype.Decimal128:
+		f, err := strconv.ParseFloat(raw.Decimal128().String(), 64)
+		if err != nil {
+			return err
+		}
+		*m = MoneyFromMajor(f, config.DefaultCurrency)
+	case bsontype.Null, bsontype.Undefined:
+		*m = Money{}
+	default:
+		return fmt.Errorf("cannot decode %s into Money", t)
+	}
+
+	return nil
+}
+
+// UnmarshalJSON accepts {"amount": 1250, "currency": "NGN"} in minor units
+// or a plain number such as 12.50 in major units
+// Amounts sent without a currency are kept in minor units of the default currency
+// with an empty currency, see InCurrency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	trimmed := strings.TrimSpace(string(data))
+	if trimmed == "null" {
+		return nil
+	}
+
+	if strings.HasPrefix(trimmed, "{") {
+		var doc moneyDocument
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		*m = NewMoney(doc.Amount, doc.Currency)
+		return nil
+	}
+
+	var major float64
+	if err := json.Unmarshal(data, &major); err != nil {
+		return errors.New("money must be a number or an object with amount and currency")
+	}
+	*m = MoneyFromMajor(major, config.DefaultCurrency)
+	m.Currency = ""
+	return nil
+}
+
+// InCurrency gives an amount that came without a currency the currency given
+// rescaling it from the minor units of the default currency
+// Amounts that already have a currency are returned unchanged
+func (m Money) InCurrency(currency string) Money {
+	if m.Currency != "" {
+		return m
+	}
+
+	amount := m.Amount
+	exp := CurrencyExponent(currency) - CurrencyExponent(config.DefaultCurrency)
+	if exp > 0 {
+		amount *= int64(math.Pow10(exp))
+	} else if exp < 0 {
+		amount = int64(math.Round(float64(amount) / math.Pow10(-exp)))
+	}
+
+	return NewMoney(amount, currency)
+}
+
+// moneyInc returns the $inc document that moves the amount stored in field by m
+func moneyInc(field string, m Money) bson.M {
+	return bson.M{field + ".amount": m.Amount}
+}
@@ -0,0 +1,44 @@
+package helpers
+
+import "testing"
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int64
+		weights []int64
+		want    []int64
+	}{
+		{"divides exactly", 100, []int64{200, 300}, []int64{40, 60}},
+		{"equal weights with a remainder", 100, []int64{1, 1, 1}, []int64{34, 33, 33}},
+		{"unequal weights with a remainder", 81, []int64{1300, 300}, []int64{66, 15}},
+		{"zero weights get nothing", 1, []int64{0, 1, 1}, []int64{0, 1, 0}},
+		{"no weights", 100, []int64{0, 0}, []int64{0, 0}},
+		{"nothing to share", 0, []int64{5, 5}, []int64{0, 0}},
+		{"negative total", -100, []int64{1, 1, 1}, []int64{-34, -33, -33}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amounts := NewMoney(tt.total, "NGN").Allocate(tt.weights...)
+
+			got := make([]int64, len(amounts))
+			var sum int64
+			for i, amount := range amounts {
+				got[i] = amount.Amount
+				sum += amount.Amount
+			}
+			if !equalAmounts(got, tt.want) {
+				t.Errorf("Allocate(%d, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+			}
+
+			var weighted int64
+			for _, weight := range tt.weights {
+				weighted += weight
+			}
+			if weighted > 0 && sum != tt.total {
+				t.Errorf("amounts add up to %d, want %d", sum, tt.total)
+			}
+		})
+	}
+}
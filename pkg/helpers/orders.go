@@ -2,35 +2,244 @@ package helpers
 
 import (
 	"context"
+	"errors"
+	"math"
 	"sync"
 
 	"github.com/Rhaqim/thedutchapp/pkg/config"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var orderCollection = config.OrderCollection
 
 type Order struct {
-	ID         primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	EventID    primitive.ObjectID `json:"event_id" bson:"event_id" binding:"required"`
-	CustomerID primitive.ObjectID `json:"customer_id,omitempty" bson:"customer_id,omitempty"`
-	Products   []OrderRequest     `json:"products,omitempty" bson:"products" min:"1" binding:"required"`
-	Bill       float64            `json:"bill,omitempty" bson:"bill" binding:"number" default:"0"`
-	Paid       bool               `json:"paid,omitempty" bson:"paid" default:"false"`
-	CreatedAt  primitive.DateTime `json:"created_at" bson:"created_at" default:"time.Now()"`
-	UpdatedAt  primitive.DateTime `json:"updated_at" bson:"updated_at" default:"time.Now()"`
+	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	EventID       primitive.ObjectID `json:"event_id" bson:"event_id" binding:"required"`
+	CustomerID    primitive.ObjectID `json:"customer_id,omitempty" bson:"customer_id,omitempty"`
+	Products      []OrderRequest     `json:"products,omitempty" bson:"products" min:"1" binding:"required"`
+	Subtotal      Money              `json:"subtotal,omitempty" bson:"subtotal,omitempty"`
+	Tax           Money              `json:"tax,omitempty" bson:"tax,omitempty"`
+	ServiceCharge Money              `json:"service_charge,omitempty" bson:"service_charge,omitempty"`
+	Charges       []AppliedCharge    `json:"charges,omitempty" bson:"charges,omitempty"`
+	Bill          Money              `json:"bill,omitempty" bson:"bill"`
+	Shares        []OrderPortion     `json:"shares,omitempty" bson:"shares,omitempty"`
+	Paid          bool               `json:"paid,omitempty" bson:"paid" default:"false"`
+	Refunded      bool               `json:"refunded,omitempty" bson:"refunded,omitempty"`
+	CreatedAt     primitive.DateTime `json:"created_at" bson:"created_at" default:"time.Now()"`
+	UpdatedAt     primitive.DateTime `json:"updated_at" bson:"updated_at" default:"time.Now()"`
 }
 
 type Orders []Order
 
 type OrderRequest struct {
-	ProductID primitive.ObjectID `json:"product_id," bson:"product_id" binding:"required,len=24,notblank"`
-	Quantity  int                `json:"quantity," bson:"quantity" binding:"required,number,gt=0"`
+	ProductID  primitive.ObjectID `json:"product_id," bson:"product_id" binding:"required,len=24,notblank"`
+	Quantity   int                `json:"quantity," bson:"quantity" binding:"required,number,gt=0"`
+	SharedWith []OrderLineShare   `json:"shared_with,omitempty" bson:"shared_with,omitempty" binding:"dive"`
+	Bill       Money              `json:"bill,omitempty" bson:"bill,omitempty"`
 }
 
-func UpdateBill(ctx context.Context, request Order, billErrChan chan error, totalchan chan float64) {
-	billChan := make(chan float64)
+// OrderLineShare is one attendee's part of a shared order line
+// Lines are shared equally unless weights are given, a missing weight counts as 1
+type OrderLineShare struct {
+	UserID primitive.ObjectID `json:"user_id" bson:"user_id" binding:"required"`
+	Weight float64            `json:"weight,omitempty" bson:"weight,omitempty" binding:"gte=0"`
+}
+
+// OrderPortion is what one user owes for an order
+// The lines of an order are charged to the customer unless they are shared
+// Amount is the user's part of the lines and their share of the order's tax and service charge
+type OrderPortion struct {
+	UserID        primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Subtotal      Money              `json:"subtotal,omitempty" bson:"subtotal,omitempty"`
+	Tax           Money              `json:"tax,omitempty" bson:"tax,omitempty"`
+	ServiceCharge Money              `json:"service_charge,omitempty" bson:"service_charge,omitempty"`
+	Amount        Money              `json:"amount" bson:"amount"`
+	Paid          bool               `json:"paid" bson:"paid"`
+	Refunded      bool               `json:"refunded,omitempty" bson:"refunded,omitempty"`
+}
+
+// Portions returns who owes what for the order, refunded portions are left out
+// Orders from before lines could be shared are owed by the customer
+func (o Order) Portions() []OrderPortion {
+	if len(o.Shares) == 0 {
+		return []OrderPortion{{UserID: o.CustomerID, Amount: o.Bill, Paid: o.Paid}}
+	}
+	portions := make([]OrderPortion, 0, len(o.Shares))
+	for _, portion := range o.Shares {
+		if !portion.Refunded {
+			portions = append(portions, portion)
+		}
+	}
+	return portions
+}
+
+// portionRefunded reports whether the user's portion of the order has been refunded
+func (o Order) portionRefunded(userID primitive.ObjectID) bool {
+	for _, portion := range o.Shares {
+		if portion.UserID == userID && portion.Refunded {
+			return true
+		}
+	}
+	return false
+}
+
+// PortionFor returns what the user still owes for the order
+func (o Order) PortionFor(userID primitive.ObjectID) Money {
+	owed := ZeroMoney(o.Bill.Currency)
+	if o.Paid {
+		return owed
+	}
+	for _, portion := range o.Portions() {
+		if portion.UserID == userID && !portion.Paid {
+			owed = owed.Add(portion.Amount)
+		}
+	}
+	return owed
+}
+
+// Unpaid returns what is still owed for the order
+func (o Order) Unpaid() Money {
+	owed := ZeroMoney(o.Bill.Currency)
+	if o.Paid {
+		return owed
+	}
+	for _, portion := range o.Portions() {
+		if !portion.Paid {
+			owed = owed.Add(portion.Amount)
+		}
+	}
+	return owed
+}
+
+// ValidateOrderShares checks every shared line is shared between participants of the event
+func ValidateOrderShares(event Event, order Order) error {
+	participants := make(map[primitive.ObjectID]bool)
+	for _, userID := range EventParticipants(event) {
+		participants[userID] = true
+	}
+
+	for _, line := range order.Products {
+		var weights int64
+		seen := make(map[primitive.ObjectID]bool)
+		for _, share := range line.SharedWith {
+			if !participants[share.UserID] {
+				return errors.New("user " + share.UserID.Hex() + " is not a participant of the event")
+			}
+			if seen[share.UserID] {
+				return errors.New("user " + share.UserID.Hex() + " is listed twice on a line")
+			}
+			seen[share.UserID] = true
+			weights += share.lineWeight()
+		}
+		if len(line.SharedWith) > 0 && weights <= 0 {
+			return errors.New("a shared line needs a weight above zero")
+		}
+	}
+
+	return nil
+}
+
+// lineWeight is the sharer's weight to four decimal places, a missing weight counts as one
+func (ols OrderLineShare) lineWeight() int64 {
+	if ols.Weight == 0 {
+		return 1e4
+	}
+	return int64(math.Round(ols.Weight * 1e4))
+}
+
+// LinePortions works out what each user owes for one line of the order
+// A shared line is divided by weight, the minor units left over by rounding go
+// to the largest remainders first, any other line is the customer's
+func (o Order) LinePortions(line OrderRequest) []OrderPortion {
+	if len(line.SharedWith) == 0 {
+		return []OrderPortion{{UserID: o.CustomerID, Amount: line.Bill}}
+	}
+
+	weights := make([]int64, 0, len(line.SharedWith))
+	for _, share := range line.SharedWith {
+		weights = append(weights, share.lineWeight())
+	}
+
+	portions := make([]OrderPortion, 0, len(line.SharedWith))
+	for i, amount := range line.Bill.Allocate(weights...) {
+		portions = append(portions, OrderPortion{UserID: line.SharedWith[i].UserID, Amount: amount})
+	}
+	return portions
+}
+
+// OrderPortions works out what each user owes for the order from the bill of every line
+// The order's tax and service charge are shared in proportion to each user's lines
+// It must be called after UpdateBill has set the bill of each line and the charges of the order
+func OrderPortions(order Order) []OrderPortion {
+	var portions []OrderPortion
+	index := make(map[primitive.ObjectID]int)
+
+	for _, line := range order.Products {
+		for _, portion := range order.LinePortions(line) {
+			i, ok := index[portion.UserID]
+			if !ok {
+				i = len(portions)
+				index[portion.UserID] = i
+				portions = append(portions, OrderPortion{UserID: portion.UserID, Amount: ZeroMoney(portion.Amount.Currency)})
+			}
+			portions[i].Amount = portions[i].Amount.Add(portion.Amount)
+		}
+	}
+
+	subtotals := make([]int64, len(portions))
+	for i := range portions {
+		subtotals[i] = portions[i].Amount.Amount
+	}
+	taxes := order.Tax.Allocate(subtotals...)
+	serviceCharges := order.ServiceCharge.Allocate(subtotals...)
+	for i := range portions {
+		portions[i].Subtotal = portions[i].Amount
+		portions[i].Tax = taxes[i]
+		portions[i].ServiceCharge = serviceCharges[i]
+		portions[i].Amount = portions[i].Subtotal.Add(taxes[i]).Add(serviceCharges[i])
+	}
+
+	return portions
+}
+
+// OwnBill returns the user's unpaid orders for the event and what they owe for them
+// Only the user's portion of a shared order counts
+func OwnBill(ctx context.Context, eventID, userID primitive.ObjectID) (Orders, Money, error) {
+	var owed Money
+
+	orders, err := GetOrders(ctx, bson.M{
+		"event_id": eventID,
+		"paid":     false,
+		"$or": bson.A{
+			bson.M{"customer_id": userID, "shares": bson.M{"$exists": false}},
+			bson.M{"shares": bson.M{"$elemMatch": bson.M{"user_id": userID, "paid": false}}},
+		},
+	})
+	if err != nil {
+		return orders, owed, err
+	}
+
+	for _, order := range orders {
+		portion := order.PortionFor(userID)
+		if !owed.sameCurrency(portion) {
+			return orders, owed, errors.New("orders of the event are in different currencies")
+		}
+		owed = owed.Add(portion)
+	}
+
+	return orders, owed, nil
+}
+
+// UpdateBill prices every line of the order and sets the bill of each line, then applies
+// the restaurant's tax and service charges for the size of the event's party to the subtotal
+// The event bill and its breakdown go up by the order's and the order's bill is sent
+// through totalchan, nothing is added to the event if any line cannot be priced
+func UpdateBill(ctx context.Context, request Order, event Event, billErrChan chan error, totalchan chan OrderBill) {
+	billChan := make(chan Money)
+	lineErrChan := make(chan error, len(request.Products))
 
 	billWg := sync.WaitGroup{}
 
@@ -43,46 +252,86 @@ func UpdateBill(ctx context.Context, request Order, billErrChan chan error, tota
 			product_filter := bson.M{"_id": request.Products[i].ProductID}
 			product_fetched, err := GetProduct(ctx, product_filter)
 			if err != nil {
-				billErrChan <- err
+				lineErrChan <- err
 				return
 			}
 
-			bill := float64(float64(request.Products[i].Quantity) * product_fetched.Price)
+			bill := product_fetched.Price.Mul(int64(request.Products[i].Quantity))
+			request.Products[i].Bill = bill
 
 			// send bill value through the channel
 			billChan <- bill
-
-			// update event bill
-			event_filter := bson.M{"_id": request.EventID}
-			event_update := bson.M{
-				// update bill with new order
-				"$inc": bson.M{
-					"bill": +bill,
-				},
-			}
-
-			_, err = eventCollection.UpdateOne(ctx, event_filter, event_update)
-			if err != nil {
-				billErrChan <- err
-				return
-			}
 		}(i)
 	}
 
 	go func() {
 		billWg.Wait()
 		close(billChan)
-		close(billErrChan)
 	}()
 
-	// calculate total bill
-	var totalBill float64
+	// calculate subtotal, every line is still read so no pricing goroutine is left blocked
+	var subtotal Money
+	var mismatch error
 	for bill := range billChan {
-		totalBill += bill
+		if !subtotal.sameCurrency(bill) {
+			mismatch = errors.New("products of the order are priced in different currencies")
+			continue
+		}
+		subtotal = subtotal.Add(bill)
+	}
+
+	fail := func(err error) {
+		billErrChan <- err
+		close(billErrChan)
 	}
 
-	// send total bill through the channel
-	totalchan <- totalBill
+	if len(lineErrChan) > 0 {
+		fail(<-lineErrChan)
+		return
+	}
+	if mismatch != nil {
+		fail(mismatch)
+		return
+	}
+	if !event.Bill.sameCurrency(subtotal) {
+		fail(errors.New("the order is not in the currency of the event bill"))
+		return
+	}
+
+	restaurant, err := GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	bill := ApplyCharges(restaurant.Charges, subtotal, len(EventParticipants(event)))
+
+	// update event bill with new order
+	inc := moneyInc("bill", bill.Total)
+	for field, amount := range map[string]Money{"subtotal": bill.Subtotal, "tax": bill.Tax, "service_charge": bill.ServiceCharge} {
+		for k, v := range moneyInc(field, amount) {
+			inc[k] = v
+		}
+	}
+	event_update := bson.M{
+		"$inc": inc,
+		"$set": bson.M{
+			"subtotal.currency":       subtotal.Currency,
+			"tax.currency":            subtotal.Currency,
+			"service_charge.currency": subtotal.Currency,
+		},
+	}
+
+	_, err = eventCollection.UpdateOne(ctx, bson.M{"_id": request.EventID}, event_update)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	close(billErrChan)
+
+	// send the order's bill through the channel
+	totalchan <- bill
 }
 
 func UpdateStock(ctx context.Context, request Order, errChan chan error) {
@@ -188,52 +437,67 @@ func UpdateManyOrders(ctx context.Context, filter bson.M, update bson.M) (bool,
 	return true, nil
 }
 
-func UpdateCustomerOrders(ctx context.Context, event Event, user UserResponse, txn Transactions, orderErrChan, eventErrChan chan error) {
-	var wg sync.WaitGroup
-
-	// get orders by event id
-	filter := bson.M{"event_id": event.ID, "customer_id": user.ID, "paid": false}
-	update := bson.M{
-		"$set": bson.M{
-			"paid": true,
-		},
+// billPaid is what a transaction takes off the bill of its event
+// A payment to the venue takes off what it paid without the tip, anything else takes
+// nothing off, money sent to the host still has to reach the venue and refunds put
+// back what they return of the bill themselves, see refundedBill
+func billPaid(txn Transactions) Money {
+	if txn.Type != Debit || txn.RestaurantID.IsZero() {
+		return ZeroMoney(txn.Amount.Currency)
 	}
+	return txn.BillAmount()
+}
 
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-
+// UpdateCustomerOrders marks the user's unpaid orders for the event as paid
+// and deducts what the payment takes off the event bill, see billPaid
+// For shared orders only the user's portion is marked paid, the order is paid
+// once every portion is
+// The updates run in one transaction
+func UpdateCustomerOrders(ctx context.Context, event Event, user UserResponse, txn Transactions) error {
+	return RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
 		// update orders
-		_, err := UpdateManyOrders(ctx, filter, update)
-		if err != nil {
-			orderErrChan <- err
-			return
+		filter := bson.M{"event_id": event.ID, "customer_id": user.ID, "paid": false, "shares": bson.M{"$exists": false}}
+		update := bson.M{
+			"$set": bson.M{
+				"paid": true,
+			},
 		}
-	}()
 
-	go func() {
-		defer wg.Done()
+		_, err := UpdateManyOrders(sessCtx, filter, update)
+		if err != nil {
+			return err
+		}
 
-		// update event
-		filter := bson.M{"_id": event.ID}
-		update := bson.M{
-			"$inc": bson.M{
-				"bill": -txn.Amount,
-			},
+		// update the user's portions of orders with portions
+		_, err = orderCollection.UpdateMany(sessCtx,
+			bson.M{"event_id": event.ID, "paid": false, "shares": bson.M{"$elemMatch": bson.M{"user_id": user.ID, "paid": false}}},
+			bson.M{"$set": bson.M{"shares.$[portion].paid": true}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: bson.A{bson.M{"portion.user_id": user.ID}}}),
+		)
+		if err != nil {
+			return err
 		}
 
-		_, err := UpdateEvent(ctx, filter, update)
+		// orders with nothing left to pay are paid
+		_, err = UpdateManyOrders(sessCtx,
+			bson.M{"event_id": event.ID, "paid": false, "shares.0": bson.M{"$exists": true}, "shares.paid": bson.M{"$ne": false}},
+			bson.M{"$set": bson.M{"paid": true}},
+		)
 		if err != nil {
-			eventErrChan <- err
-			return
+			return err
 		}
 
-	}()
+		// update event
+		filter = bson.M{"_id": event.ID}
+		update = bson.M{
+			"$inc": moneyInc("bill", billPaid(txn).Neg()),
+		}
 
-	go func() {
-		wg.Wait()
-		close(orderErrChan)
-		close(eventErrChan)
-	}()
+		_, err = UpdateEvent(sessCtx, filter, update)
+		if err != nil {
+			return err
+		}
 
+		return nil
+	})
 }
@@ -0,0 +1,135 @@
+package helpers
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLinePortions(t *testing.T) {
+	customer, ada, bola, chidi := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	order := Order{CustomerID: customer}
+
+	tests := []struct {
+		name   string
+		bill   int64
+		shares []OrderLineShare
+		users  []primitive.ObjectID
+		want   []int64
+	}{
+		{"not shared", 1000, nil, []primitive.ObjectID{customer}, []int64{1000}},
+		{"equal with a remainder", 1000, []OrderLineShare{{UserID: ada}, {UserID: bola}, {UserID: chidi}},
+			[]primitive.ObjectID{ada, bola, chidi}, []int64{334, 333, 333}},
+		{"weights", 1000, []OrderLineShare{{UserID: ada, Weight: 1}, {UserID: bola, Weight: 3}},
+			[]primitive.ObjectID{ada, bola}, []int64{250, 750}},
+		{"weights that do not divide evenly", 100, []OrderLineShare{{UserID: ada, Weight: 1}, {UserID: bola, Weight: 2}},
+			[]primitive.ObjectID{ada, bola}, []int64{33, 67}},
+		{"a missing weight counts as 1", 1000, []OrderLineShare{{UserID: ada}, {UserID: bola, Weight: 3}},
+			[]primitive.ObjectID{ada, bola}, []int64{250, 750}},
+		{"fractional weights", 1000, []OrderLineShare{{UserID: ada, Weight: 0.5}, {UserID: bola, Weight: 1.5}},
+			[]primitive.ObjectID{ada, bola}, []int64{250, 750}},
+		{"less than one unit each", 2, []OrderLineShare{{UserID: ada}, {UserID: bola}, {UserID: chidi}},
+			[]primitive.ObjectID{ada, bola, chidi}, []int64{1, 1, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := OrderRequest{Quantity: 1, Bill: NewMoney(tt.bill, "NGN"), SharedWith: tt.shares}
+			portions := order.LinePortions(line)
+
+			if len(portions) != len(tt.want) {
+				t.Fatalf("got %d portions, want %d", len(portions), len(tt.want))
+			}
+			var sum int64
+			for i, portion := range portions {
+				if portion.UserID != tt.users[i] || portion.Amount.Amount != tt.want[i] {
+					t.Errorf("portion %d = %s %d, want %s %d", i, portion.UserID.Hex(), portion.Amount.Amount, tt.users[i].Hex(), tt.want[i])
+				}
+				sum += portion.Amount.Amount
+			}
+			if sum != tt.bill {
+				t.Errorf("portions add up to %d, want %d", sum, tt.bill)
+			}
+		})
+	}
+}
+
+func TestOrderPortions(t *testing.T) {
+	ada, bola := primitive.NewObjectID(), primitive.NewObjectID()
+	ngn := func(amount int64) Money { return NewMoney(amount, "NGN") }
+
+	tests := []struct {
+		name          string
+		order         Order
+		users         []primitive.ObjectID
+		subtotals     []int64
+		taxes         []int64
+		serviceCharge []int64
+	}{
+		{
+			name: "no charges",
+			order: Order{CustomerID: ada, Tax: ngn(0), ServiceCharge: ngn(0), Products: []OrderRequest{
+				{Quantity: 1, Bill: ngn(1000)},
+				{Quantity: 2, Bill: ngn(500), SharedWith: []OrderLineShare{{UserID: ada}, {UserID: bola}}},
+			}},
+			users:         []primitive.ObjectID{ada, bola},
+			subtotals:     []int64{1250, 250},
+			taxes:         []int64{0, 0},
+			serviceCharge: []int64{0, 0},
+		},
+		{
+			name: "charges shared by subtotal",
+			order: Order{CustomerID: ada, Tax: ngn(160), ServiceCharge: ngn(81), Products: []OrderRequest{
+				{Quantity: 1, Bill: ngn(1000)},
+				{Quantity: 1, Bill: ngn(600), SharedWith: []OrderLineShare{{UserID: ada}, {UserID: bola}}},
+			}},
+			users:         []primitive.ObjectID{ada, bola},
+			subtotals:     []int64{1300, 300},
+			taxes:         []int64{130, 30},
+			serviceCharge: []int64{66, 15},
+		},
+		{
+			name: "whole order shared",
+			order: Order{CustomerID: ada, Tax: ngn(75), ServiceCharge: ngn(0), Products: []OrderRequest{
+				{Quantity: 1, Bill: ngn(1001), SharedWith: []OrderLineShare{{UserID: bola, Weight: 2}, {UserID: ada, Weight: 1}}},
+			}},
+			users:         []primitive.ObjectID{bola, ada},
+			subtotals:     []int64{667, 334},
+			taxes:         []int64{50, 25},
+			serviceCharge: []int64{0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			portions := OrderPortions(tt.order)
+			if len(portions) != len(tt.users) {
+				t.Fatalf("got %d portions, want %d", len(portions), len(tt.users))
+			}
+
+			var total int64
+			for i, portion := range portions {
+				if portion.UserID != tt.users[i] {
+					t.Errorf("portion %d is for %s, want %s", i, portion.UserID.Hex(), tt.users[i].Hex())
+				}
+				if portion.Subtotal.Amount != tt.subtotals[i] || portion.Tax.Amount != tt.taxes[i] || portion.ServiceCharge.Amount != tt.serviceCharge[i] {
+					t.Errorf("portion %d = subtotal %d tax %d service %d, want %d %d %d", i,
+						portion.Subtotal.Amount, portion.Tax.Amount, portion.ServiceCharge.Amount,
+						tt.subtotals[i], tt.taxes[i], tt.serviceCharge[i])
+				}
+				if want := portion.Subtotal.Add(portion.Tax).Add(portion.ServiceCharge); portion.Amount.Cmp(want) != 0 {
+					t.Errorf("portion %d amount = %s, want %s", i, portion.Amount, want)
+				}
+				total += portion.Amount.Amount
+			}
+
+			want := tt.order.Tax.Amount + tt.order.ServiceCharge.Amount
+			for _, line := range tt.order.Products {
+				want += line.Bill.Amount
+			}
+			if total != want {
+				t.Errorf("portions add up to %d, want %d", total, want)
+			}
+		})
+	}
+}
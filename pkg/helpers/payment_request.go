@@ -0,0 +1,305 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var paymentRequestCollection = config.PaymentRequestCollection
+
+// PaymentRequestStatus is how far a payment request has been paid
+type PaymentRequestStatus string
+
+const (
+	RequestPending       PaymentRequestStatus = "pending"
+	RequestPartiallyPaid PaymentRequestStatus = "partially_paid"
+	RequestPaid          PaymentRequestStatus = "paid"
+	RequestDeclined      PaymentRequestStatus = "declined"
+	RequestCancelled     PaymentRequestStatus = "cancelled"
+)
+
+func (prs PaymentRequestStatus) String() string {
+	return string(prs)
+}
+
+// openPaymentRequestStatuses can still be paid, declined or cancelled
+var openPaymentRequestStatuses = bson.A{RequestPending, RequestPartiallyPaid}
+
+// PaymentRequest asks one user to pay another
+// Asking several friends at once makes one request each, sharing a GroupID
+// Paid grows with every payment, the request is paid once it reaches Amount
+type PaymentRequest struct {
+	ID             primitive.ObjectID   `json:"id,omitempty" bson:"_id"`
+	GroupID        primitive.ObjectID   `json:"group_id" bson:"group_id"`
+	RequesterID    primitive.ObjectID   `json:"requester_id" bson:"requester_id"`
+	PayerID        primitive.ObjectID   `json:"payer_id" bson:"payer_id"`
+	Amount         Money                `json:"amount" bson:"amount"`
+	Paid           Money                `json:"paid" bson:"paid"`
+	EventID        primitive.ObjectID   `json:"event_id,omitempty" bson:"event_id,omitempty"`
+	Note           string               `json:"note,omitempty" bson:"note,omitempty"`
+	Status         PaymentRequestStatus `json:"status" bson:"status"`
+	DeclineReason  string               `json:"decline_reason,omitempty" bson:"decline_reason,omitempty"`
+	TransactionIDs []primitive.ObjectID `json:"transaction_ids,omitempty" bson:"transaction_ids,omitempty"`
+	CreatedAt      primitive.DateTime   `json:"created_at" bson:"created_at"`
+	UpdatedAt      primitive.DateTime   `json:"updated_at" bson:"updated_at"`
+}
+
+// Remaining is what is left to pay
+func (pr PaymentRequest) Remaining() Money {
+	return pr.Amount.Sub(pr.Paid)
+}
+
+type CreatePaymentRequest struct {
+	Usernames []string           `json:"usernames" form:"usernames" binding:"required,min=1"`
+	Amount    float64            `json:"amount" form:"amount" binding:"required,gt=0"`
+	Currency  string             `json:"currency" form:"currency"`
+	EventID   primitive.ObjectID `json:"event_id" form:"event_id"`
+	Note      string             `json:"note" form:"note" binding:"max=140"`
+}
+
+// PayRequest pays a payment request, all of what is left unless an amount is given
+type PayRequest struct {
+	Amount float64 `json:"amount" form:"amount" binding:"gte=0"`
+	TxnPin string  `json:"txn_pin" form:"txn_pin" binding:"required"`
+}
+
+type DeclineRequest struct {
+	Reason string `json:"reason" form:"reason" binding:"max=140"`
+}
+
+// CreatePaymentRequests asks each of the requester's friends for the amount
+// Every user asked must be a friend of the requester
+func CreatePaymentRequests(ctx context.Context, requester UserResponse, request CreatePaymentRequest, amount Money) ([]PaymentRequest, error) {
+	funcName := ut.GetFunctionName()
+
+	if !amount.IsPositive() {
+		return nil, errors.New("amount must be greater than zero")
+	}
+
+	if !request.EventID.IsZero() {
+		if _, err := GetEvent(ctx, bson.M{"_id": request.EventID}); err != nil {
+			SetDebug("error getting event: "+err.Error(), funcName)
+			return nil, errors.New("event not found")
+		}
+	}
+
+	var payers []UserResponse
+	seen := make(map[primitive.ObjectID]bool)
+	for _, username := range request.Usernames {
+		payer, err := GetUser(ctx, bson.M{"username": username})
+		if err != nil {
+			return nil, errors.New("user not found: " + username)
+		}
+		if payer.ID == requester.ID {
+			return nil, errors.New("cannot request money from yourself")
+		}
+		if seen[payer.ID] {
+			continue
+		}
+		if !VerifyFriends(ctx, requester, payer.ID) {
+			return nil, errors.New("you can only request money from friends: " + username)
+		}
+
+		seen[payer.ID] = true
+		payers = append(payers, payer)
+	}
+
+	groupID := primitive.NewObjectID()
+	createdAt, updatedAt := CreatedAtUpdatedAt()
+
+	requests := make([]PaymentRequest, 0, len(payers))
+	docs := make([]interface{}, 0, len(payers))
+	for _, payer := range payers {
+		pr := PaymentRequest{
+			ID:          primitive.NewObjectID(),
+			GroupID:     groupID,
+			RequesterID: requester.ID,
+			PayerID:     payer.ID,
+			Amount:      amount,
+			Paid:        ZeroMoney(amount.Currency),
+			EventID:     request.EventID,
+			Note:        strings.TrimSpace(request.Note),
+			Status:      RequestPending,
+			CreatedAt:   createdAt,
+			UpdatedAt:   updatedAt,
+		}
+		requests = append(requests, pr)
+		docs = append(docs, pr)
+	}
+
+	_, err := paymentRequestCollection.InsertMany(ctx, docs)
+	if err != nil {
+		SetDebug("error inserting payment requests: "+err.Error(), funcName)
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// GetPaymentRequest returns the request if the user made it or was asked to pay it
+func GetPaymentRequest(ctx context.Context, id, userID primitive.ObjectID) (PaymentRequest, error) {
+	var pr PaymentRequest
+
+	filter := bson.M{"_id": id, "$or": bson.A{bson.M{"requester_id": userID}, bson.M{"payer_id": userID}}}
+	err := paymentRequestCollection.FindOne(ctx, filter).Decode(&pr)
+	return pr, err
+}
+
+// GetPaymentRequests returns the requests the user sent or received, newest first
+// direction is sent or received, anything else returns both
+func GetPaymentRequests(ctx context.Context, userID primitive.ObjectID, direction string, status PaymentRequestStatus) ([]PaymentRequest, error) {
+	requests := []PaymentRequest{}
+
+	var filter bson.M
+	switch direction {
+	case "sent":
+		filter = bson.M{"requester_id": userID}
+	case "received":
+		filter = bson.M{"payer_id": userID}
+	default:
+		filter = bson.M{"$or": bson.A{bson.M{"requester_id": userID}, bson.M{"payer_id": userID}}}
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	cursor, err := paymentRequestCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": -1}))
+	if err != nil {
+		return requests, err
+	}
+
+	err = cursor.All(ctx, &requests)
+	return requests, err
+}
+
+// PayPaymentRequest sends the amount to the requester through SendToOtherUsers
+// A zero amount pays all that is left, a smaller amount pays part of the request
+// The amount is reserved on the request before the money moves so two payments
+// cannot pay more than was asked, and the reservation is undone if the transfer fails
+func PayPaymentRequest(ctx context.Context, payer UserResponse, id primitive.ObjectID, amount Money) (PaymentRequest, Transactions, error) {
+	funcName := ut.GetFunctionName()
+
+	var pr PaymentRequest
+	var txn Transactions
+
+	err := paymentRequestCollection.FindOne(ctx, bson.M{"_id": id, "payer_id": payer.ID}).Decode(&pr)
+	if err != nil {
+		return pr, txn, err
+	}
+	if pr.Status != RequestPending && pr.Status != RequestPartiallyPaid {
+		return pr, txn, errors.New("payment request is " + pr.Status.String())
+	}
+
+	if amount.IsZero() {
+		amount = pr.Remaining()
+	}
+	if amount.Currency != pr.Amount.Currency {
+		return pr, txn, errors.New("payment must be in " + pr.Amount.Currency)
+	}
+	if !amount.IsPositive() {
+		return pr, txn, errors.New("amount must be greater than zero")
+	}
+	if amount.GreaterThan(pr.Remaining()) {
+		return pr, txn, errors.New("amount is more than the " + pr.Remaining().String() + " left to pay")
+	}
+
+	// Reserve the amount, the filter fails if another payment got there first
+	result, err := paymentRequestCollection.UpdateOne(ctx,
+		bson.M{
+			"_id":         pr.ID,
+			"status":      bson.M{"$in": openPaymentRequestStatuses},
+			"paid.amount": bson.M{"$lte": pr.Amount.Amount - amount.Amount},
+		},
+		bson.M{"$inc": moneyInc("paid", amount)},
+	)
+	if err != nil {
+		return pr, txn, err
+	}
+	if result.ModifiedCount != 1 {
+		return pr, txn, errors.New("payment request changed, try again")
+	}
+
+	requester := GetUserByID(ctx, pr.RequesterID)
+	if requester.ID.IsZero() {
+		err = errors.New("requester not found")
+	} else {
+		// the event stays on the payment so settlement plans and bills count it
+		txn, err = sendToOtherUsers(ctx, requester, payer, amount, pr.EventID)
+	}
+	if err != nil {
+		_, undoErr := paymentRequestCollection.UpdateOne(ctx, bson.M{"_id": pr.ID}, bson.M{"$inc": moneyInc("paid", amount.Neg())})
+		if undoErr != nil {
+			SetError(undoErr, "Error undoing payment request reservation", funcName)
+		}
+		return pr, txn, err
+	}
+
+	// The request is settled once the payments reach the amount asked
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = paymentRequestCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": pr.ID},
+		bson.A{bson.M{"$set": bson.M{
+			"transaction_ids": bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$transaction_ids", bson.A{}}}, bson.A{txn.ID}}},
+			"updated_at":      primitive.NewDateTimeFromTime(time.Now()),
+			// a request declined or cancelled while the money moved keeps its status
+			"status": bson.M{"$cond": bson.A{
+				bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$status", openPaymentRequestStatuses}}}},
+				"$status",
+				bson.M{"$cond": bson.A{
+					bson.M{"$gte": bson.A{"$paid.amount", "$amount.amount"}},
+					RequestPaid,
+					RequestPartiallyPaid,
+				}},
+			}},
+		}}},
+		opts,
+	).Decode(&pr)
+	if err != nil {
+		// the money has moved, the request catches up on the next payment or reconciliation
+		SetError(err, "Error updating payment request after payment", funcName)
+		return pr, txn, nil
+	}
+
+	return pr, txn, nil
+}
+
+// closePaymentRequest moves an open request to the status given
+func closePaymentRequest(ctx context.Context, filter bson.M, set bson.M) (PaymentRequest, error) {
+	var pr PaymentRequest
+
+	filter["status"] = bson.M{"$in": openPaymentRequestStatuses}
+	set["updated_at"] = primitive.NewDateTimeFromTime(time.Now())
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := paymentRequestCollection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&pr)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return pr, errors.New("no open payment request found")
+	}
+
+	return pr, err
+}
+
+// DeclinePaymentRequest refuses what is left of the request, payments already made stay
+func DeclinePaymentRequest(ctx context.Context, payer UserResponse, id primitive.ObjectID, reason string) (PaymentRequest, error) {
+	return closePaymentRequest(ctx,
+		bson.M{"_id": id, "payer_id": payer.ID},
+		bson.M{"status": RequestDeclined, "decline_reason": strings.TrimSpace(reason)},
+	)
+}
+
+// CancelPaymentRequest withdraws the request, payments already made stay
+func CancelPaymentRequest(ctx context.Context, requester UserResponse, id primitive.ObjectID) (PaymentRequest, error) {
+	return closePaymentRequest(ctx,
+		bson.M{"_id": id, "requester_id": requester.ID},
+		bson.M{"status": RequestCancelled},
+	)
+}
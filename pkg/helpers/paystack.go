@@ -1,3 +1,287 @@
 package helpers
 
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+)
+
 // Paystack API's and helpers with customer details
+
+const PaystackDefaultBaseURL = "https://api.paystack.co"
+
+// PaystackSignatureHeader carries the HMAC-SHA512 of a webhook body signed with the secret key
+const PaystackSignatureHeader = "X-Paystack-Signature"
+
+// PaymentProvider is a payment gateway that takes card payments into wallets
+// and pays wallet withdrawals out to bank accounts
+type PaymentProvider interface {
+	// InitializeCharge starts a charge and returns where the customer pays for it
+	InitializeCharge(ctx context.Context, charge Charge) (ChargeAuthorization, error)
+	// VerifyCharge asks the provider for the outcome of a charge
+	VerifyCharge(ctx context.Context, reference string) (ChargeResult, error)
+	// SendPayout starts a transfer to a bank account, its outcome arrives by webhook
+	SendPayout(ctx context.Context, payout Payout) (PayoutResult, error)
+	// VerifyWebhook checks that the webhook body was signed by the provider
+	VerifyWebhook(payload []byte, signature string) bool
+	// ParseWebhook reads a verified webhook body
+	ParseWebhook(payload []byte) (WebhookEvent, error)
+}
+
+// Charge is a payment the customer is asked to make
+type Charge struct {
+	Email     string
+	Amount    Money
+	Reference string
+	Metadata  map[string]string
+}
+
+// ChargeAuthorization is where the customer completes a charge
+type ChargeAuthorization struct {
+	AuthorizationURL string `json:"authorization_url"`
+	AccessCode       string `json:"access_code"`
+	Reference        string `json:"reference"`
+}
+
+// ChargeResult is the outcome of a charge
+type ChargeResult struct {
+	Reference string `json:"reference"`
+	Status    string `json:"status"`
+	Amount    Money  `json:"amount"`
+}
+
+// Succeeded reports whether the customer paid
+func (cr ChargeResult) Succeeded() bool {
+	return cr.Status == "success"
+}
+
+// Payout is money sent from the platform to a bank account
+type Payout struct {
+	Reference string
+	Amount    Money
+	Account   BankAccount
+	Reason    string
+}
+
+// PayoutResult is what the provider reports when a payout is sent
+type PayoutResult struct {
+	Reference    string `json:"reference"`
+	Status       string `json:"status"`
+	TransferCode string `json:"transfer_code"`
+}
+
+// WebhookEvent is a notification from the provider about a charge or a payout
+type WebhookEvent struct {
+	Event string
+	// Charge is the charge or transfer the event is about
+	Charge ChargeResult
+}
+
+// ProviderError is a request the provider answered with an error
+type ProviderError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("payment provider: %s (%d)", e.Message, e.StatusCode)
+}
+
+// Rejected reports whether the provider refused the request, so it was not carried out
+// Any other failure may have been carried out and has to wait for the webhook
+func (e *ProviderError) Rejected() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// Paystack is the PaymentProvider for https://paystack.com
+type Paystack struct {
+	SecretKey   string
+	BaseURL     string
+	CallbackURL string
+	HTTPClient  *http.Client
+}
+
+// NewPaystack returns a Paystack client using the API at baseURL
+// An empty baseURL uses the live API
+func NewPaystack(secretKey, baseURL, callbackURL string) *Paystack {
+	if baseURL == "" {
+		baseURL = PaystackDefaultBaseURL
+	}
+
+	return &Paystack{
+		SecretKey:   secretKey,
+		BaseURL:     baseURL,
+		CallbackURL: callbackURL,
+		HTTPClient:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Payments is the provider wallets are funded and withdrawn through
+var Payments PaymentProvider = NewPaystack(config.PaystackSecretKey, config.PaystackBaseURL, config.PaystackCallbackURL)
+
+// paystackResponse is the envelope of every Paystack API response
+type paystackResponse struct {
+	Status  bool            `json:"status"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// paystackCharge is a charge as Paystack reports it, amounts are in minor units
+type paystackCharge struct {
+	Reference string `json:"reference"`
+	Status    string `json:"status"`
+	Amount    int64  `json:"amount"`
+	Currency  string `json:"currency"`
+}
+
+func (pc paystackCharge) result() ChargeResult {
+	return ChargeResult{
+		Reference: pc.Reference,
+		Status:    pc.Status,
+		Amount:    NewMoney(pc.Amount, pc.Currency),
+	}
+}
+
+// do sends the request to Paystack and decodes the data of the response into out
+func (p *Paystack) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	api := ut.NewBankAPIRequest(ctx, ut.APIMethods(method), p.BaseURL+path, reader, "Bearer "+p.SecretKey)
+	api.Client = p.HTTPClient
+
+	status, payload, err := api.Call()
+	if err != nil {
+		return err
+	}
+
+	var envelope paystackResponse
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return &ProviderError{StatusCode: status, Message: "invalid response: " + err.Error()}
+	}
+	if status != http.StatusOK || !envelope.Status {
+		return &ProviderError{StatusCode: status, Message: envelope.Message}
+	}
+
+	return json.Unmarshal(envelope.Data, out)
+}
+
+// InitializeCharge starts a Paystack transaction for the charge
+func (p *Paystack) InitializeCharge(ctx context.Context, charge Charge) (ChargeAuthorization, error) {
+	var authorization ChargeAuthorization
+
+	if !charge.Amount.IsPositive() {
+		return authorization, errors.New("paystack: amount must be greater than zero")
+	}
+
+	body := map[string]interface{}{
+		"email":     charge.Email,
+		"amount":    charge.Amount.Amount,
+		"currency":  charge.Amount.Currency,
+		"reference": charge.Reference,
+	}
+	if p.CallbackURL != "" {
+		body["callback_url"] = p.CallbackURL
+	}
+	if len(charge.Metadata) > 0 {
+		body["metadata"] = charge.Metadata
+	}
+
+	err := p.do(ctx, http.MethodPost, "/transaction/initialize", body, &authorization)
+	return authorization, err
+}
+
+// VerifyCharge fetches the Paystack transaction with the reference
+func (p *Paystack) VerifyCharge(ctx context.Context, reference string) (ChargeResult, error) {
+	var charge paystackCharge
+
+	err := p.do(ctx, http.MethodGet, "/transaction/verify/"+url.PathEscape(reference), nil, &charge)
+	if err != nil {
+		return ChargeResult{}, err
+	}
+
+	return charge.result(), nil
+}
+
+// SendPayout creates a transfer recipient for the bank account and transfers the amount to it
+// Transfers must not require an OTP, Paystack reports the outcome with transfer.success,
+// transfer.failed or transfer.reversed webhooks
+func (p *Paystack) SendPayout(ctx context.Context, payout Payout) (PayoutResult, error) {
+	var result PayoutResult
+
+	if !payout.Amount.IsPositive() {
+		return result, errors.New("paystack: amount must be greater than zero")
+	}
+
+	var recipient struct {
+		RecipientCode string `json:"recipient_code"`
+	}
+	err := p.do(ctx, http.MethodPost, "/transferrecipient", map[string]interface{}{
+		"type":           "nuban",
+		"name":           payout.Account.AccountName,
+		"account_number": payout.Account.AccountNumber,
+		"bank_code":      payout.Account.BankCode,
+		"currency":       payout.Amount.Currency,
+	}, &recipient)
+	if err != nil {
+		return result, err
+	}
+
+	err = p.do(ctx, http.MethodPost, "/transfer", map[string]interface{}{
+		"source":    "balance",
+		"amount":    payout.Amount.Amount,
+		"currency":  payout.Amount.Currency,
+		"recipient": recipient.RecipientCode,
+		"reference": payout.Reference,
+		"reason":    payout.Reason,
+	}, &result)
+	return result, err
+}
+
+// VerifyWebhook checks the X-Paystack-Signature of a webhook body
+func (p *Paystack) VerifyWebhook(payload []byte, signature string) bool {
+	if p.SecretKey == "" || signature == "" {
+		return false
+	}
+
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha512.New, []byte(p.SecretKey))
+	mac.Write(payload)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// ParseWebhook reads the event and charge of a Paystack webhook
+func (p *Paystack) ParseWebhook(payload []byte) (WebhookEvent, error) {
+	var body struct {
+		Event string         `json:"event"`
+		Data  paystackCharge `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return WebhookEvent{Event: body.Event, Charge: body.Data.result()}, nil
+}
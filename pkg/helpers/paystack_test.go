@@ -0,0 +1,231 @@
+package helpers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testPaystackSecret = "sk_test_secret"
+
+// newTestPaystack returns a client for a stand-in Paystack served by handler
+func newTestPaystack(t *testing.T, handler http.HandlerFunc) *Paystack {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return NewPaystack(testPaystackSecret, server.URL, "https://example.com/callback")
+}
+
+func signPaystack(payload []byte, secret string) string {
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPaystackInitializeCharge(t *testing.T) {
+	var received map[string]interface{}
+
+	paystack := newTestPaystack(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/transaction/initialize" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer "+testPaystackSecret {
+			t.Errorf("Authorization = %q", got)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("invalid body: %v", err)
+		}
+
+		io.WriteString(w, `{"status":true,"message":"Authorization URL created","data":{"authorization_url":"https://checkout.paystack.com/abc","access_code":"abc","reference":"TC-REF"}}`)
+	})
+
+	authorization, err := paystack.InitializeCharge(context.Background(), Charge{
+		Email:     "user@example.com",
+		Amount:    NewMoney(150000, "NGN"),
+		Reference: "TC-REF",
+		Metadata:  map[string]string{"user_id": "1"},
+	})
+	if err != nil {
+		t.Fatalf("InitializeCharge: %v", err)
+	}
+
+	if authorization.AuthorizationURL != "https://checkout.paystack.com/abc" || authorization.Reference != "TC-REF" {
+		t.Errorf("authorization = %+v", authorization)
+	}
+
+	// Paystack takes amounts in minor units
+	if received["amount"] != float64(150000) || received["currency"] != "NGN" {
+		t.Errorf("amount sent = %v %v", received["amount"], received["currency"])
+	}
+	if received["email"] != "user@example.com" || received["reference"] != "TC-REF" {
+		t.Errorf("charge sent = %v", received)
+	}
+	if received["callback_url"] != "https://example.com/callback" {
+		t.Errorf("callback_url = %v", received["callback_url"])
+	}
+}
+
+func TestPaystackInitializeChargeError(t *testing.T) {
+	paystack := newTestPaystack(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"status":false,"message":"Invalid currency"}`)
+	})
+
+	_, err := paystack.InitializeCharge(context.Background(), Charge{
+		Email:     "user@example.com",
+		Amount:    NewMoney(100, "XYZ"),
+		Reference: "TC-REF",
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestPaystackInitializeChargeRejectsZero(t *testing.T) {
+	paystack := newTestPaystack(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Paystack should not be called")
+	})
+
+	_, err := paystack.InitializeCharge(context.Background(), Charge{Amount: ZeroMoney("NGN")})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestPaystackVerifyCharge(t *testing.T) {
+	paystack := newTestPaystack(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/transaction/verify/TC-REF" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+
+		io.WriteString(w, `{"status":true,"message":"Verification successful","data":{"reference":"TC-REF","status":"success","amount":150000,"currency":"NGN"}}`)
+	})
+
+	result, err := paystack.VerifyCharge(context.Background(), "TC-REF")
+	if err != nil {
+		t.Fatalf("VerifyCharge: %v", err)
+	}
+
+	if !result.Succeeded() || result.Reference != "TC-REF" {
+		t.Errorf("result = %+v", result)
+	}
+	if result.Amount != NewMoney(150000, "NGN") {
+		t.Errorf("amount = %s", result.Amount)
+	}
+}
+
+func TestPaystackVerifyWebhook(t *testing.T) {
+	paystack := NewPaystack(testPaystackSecret, "", "")
+	payload := []byte(`{"event":"charge.success","data":{"reference":"TC-REF","status":"success","amount":150000,"currency":"NGN"}}`)
+
+	tests := []struct {
+		name      string
+		signature string
+		want      bool
+	}{
+		{"valid", signPaystack(payload, testPaystackSecret), true},
+		{"wrong secret", signPaystack(payload, "sk_test_other"), false},
+		{"tampered", signPaystack(append(payload, ' '), testPaystackSecret), false},
+		{"not hex", "not-a-signature", false},
+		{"missing", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := paystack.VerifyWebhook(payload, tt.signature); got != tt.want {
+			t.Errorf("%s: VerifyWebhook = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Without a secret nothing can be verified
+	if NewPaystack("", "", "").VerifyWebhook(payload, signPaystack(payload, "")) {
+		t.Error("VerifyWebhook accepted a webhook without a secret key")
+	}
+}
+
+func TestPaystackParseWebhook(t *testing.T) {
+	paystack := NewPaystack(testPaystackSecret, "", "")
+
+	event, err := paystack.ParseWebhook([]byte(`{"event":"charge.success","data":{"reference":"TC-REF","status":"success","amount":2500,"currency":"GHS"}}`))
+	if err != nil {
+		t.Fatalf("ParseWebhook: %v", err)
+	}
+
+	if event.Event != "charge.success" || event.Charge.Reference != "TC-REF" || !event.Charge.Succeeded() {
+		t.Errorf("event = %+v", event)
+	}
+	if event.Charge.Amount != NewMoney(2500, "GHS") {
+		t.Errorf("amount = %s", event.Charge.Amount)
+	}
+
+	if _, err := paystack.ParseWebhook([]byte(`not json`)); err == nil {
+		t.Error("expected an error for an invalid body")
+	}
+}
+
+func TestPaystackSendPayout(t *testing.T) {
+	var transfer map[string]interface{}
+
+	paystack := newTestPaystack(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		switch r.URL.Path {
+		case "/transferrecipient":
+			var recipient map[string]interface{}
+			json.Unmarshal(body, &recipient)
+			if recipient["account_number"] != "0123456789" || recipient["bank_code"] != "058" {
+				t.Errorf("recipient sent = %v", recipient)
+			}
+			io.WriteString(w, `{"status":true,"message":"Transfer recipient created","data":{"recipient_code":"RCP_1"}}`)
+		case "/transfer":
+			json.Unmarshal(body, &transfer)
+			io.WriteString(w, `{"status":true,"message":"Transfer has been queued","data":{"reference":"TC-OUT","status":"pending","transfer_code":"TRF_1"}}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+
+	result, err := paystack.SendPayout(context.Background(), Payout{
+		Reference: "TC-OUT",
+		Amount:    NewMoney(500000, "NGN"),
+		Account:   BankAccount{AccountName: "Ada", AccountNumber: "0123456789", BankCode: "058"},
+	})
+	if err != nil {
+		t.Fatalf("SendPayout: %v", err)
+	}
+
+	if result.Status != "pending" || result.TransferCode != "TRF_1" {
+		t.Errorf("result = %+v", result)
+	}
+	if transfer["recipient"] != "RCP_1" || transfer["amount"] != float64(500000) || transfer["reference"] != "TC-OUT" {
+		t.Errorf("transfer sent = %v", transfer)
+	}
+}
+
+func TestPaystackSendPayoutRejected(t *testing.T) {
+	paystack := newTestPaystack(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"status":false,"message":"Your balance is not enough to fulfil this request"}`)
+	})
+
+	_, err := paystack.SendPayout(context.Background(), Payout{
+		Reference: "TC-OUT",
+		Amount:    NewMoney(500000, "NGN"),
+		Account:   BankAccount{AccountNumber: "0123456789", BankCode: "058"},
+	})
+
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) || !providerErr.Rejected() {
+		t.Fatalf("expected a rejected ProviderError, got %v", err)
+	}
+}
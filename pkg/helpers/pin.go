@@ -0,0 +1,271 @@
+package helpers
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/auth"
+	db "github.com/Rhaqim/thedutchapp/pkg/cache"
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	em "github.com/Rhaqim/thedutchapp/pkg/email"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Pin errors
+// ErrTooManyPinAttempts is returned by the attempt that locks the wallet, it is also an ErrWalletLocked
+var (
+	ErrIncorrectPin        = errors.New("incorrect pin")
+	ErrWalletLocked        = errors.New("wallet is locked after too many incorrect pins")
+	ErrTooManyPinAttempts  = fmt.Errorf("too many incorrect pins: %w", ErrWalletLocked)
+	ErrInvalidPinResetCode = errors.New("invalid or expired pin reset code")
+)
+
+const pinResetCodeLength = 6
+
+type PinResetRequest struct {
+	Code   string `form:"code" binding:"required"`
+	NewPin string `form:"new_pin" binding:"required,min=4,max=4"`
+}
+
+// IsPinError reports whether the error came from checking the transaction pin
+func IsPinError(err error) bool {
+	return errors.Is(err, ErrIncorrectPin) || errors.Is(err, ErrWalletLocked)
+}
+
+func pinCacheKey(prefix config.CacheKey, userID primitive.ObjectID) string {
+	return prefix.String() + userID.Hex()
+}
+
+// PinLockedFor returns how long the user's wallet stays locked, zero if it is not locked
+func PinLockedFor(userID primitive.ObjectID) (time.Duration, error) {
+	ttl, err := db.NewCache(pinCacheKey(config.PinLock, userID), nil).TTL()
+	if err != nil || ttl <= 0 {
+		return 0, err
+	}
+
+	return ttl, nil
+}
+
+// ClearPinAttempts forgets the user's incorrect pins and unlocks their wallet
+func ClearPinAttempts(userID primitive.ObjectID) error {
+	err := db.NewCache(pinCacheKey(config.PinAttempts, userID), nil).Delete()
+	if err != nil {
+		return err
+	}
+
+	return db.NewCache(pinCacheKey(config.PinLock, userID), nil).Delete()
+}
+
+// VeryfyPin checks the pin against the user's wallet
+// Incorrect pins are counted and the wallet is locked for config.PinLockDuration
+// after config.MaxPinAttempts of them in a row
+// It returns ErrIncorrectPin, ErrWalletLocked or ErrTooManyPinAttempts when the pin is not accepted
+func VeryfyPin(ctx context.Context, user UserResponse, pin string) error {
+	funcName := ut.GetFunctionName()
+
+	locked, err := db.NewCache(pinCacheKey(config.PinLock, user.ID), nil).Exists()
+	if err != nil {
+		SetError(err, "Error checking wallet lock", funcName)
+		return err
+	}
+	if locked {
+		return ErrWalletLocked
+	}
+
+	// Check that pin sent is correct
+	// Get wallet
+	filter := bson.M{
+		"_id": user.Wallet,
+	}
+	wallet, err := GetWallet(ctx, filter)
+	if err != nil {
+		SetError(err, "Error fetching wallet", funcName)
+		return err
+	}
+
+	// Check if pin is correct
+	if auth.CheckPasswordHash(pin, wallet.TxnPin) {
+		err = db.NewCache(pinCacheKey(config.PinAttempts, user.ID), nil).Delete()
+		if err != nil {
+			SetDebug("error clearing pin attempts: "+err.Error(), funcName)
+		}
+		return nil
+	}
+
+	attempts, err := db.NewCache(pinCacheKey(config.PinAttempts, user.ID), nil).Incr(config.PinLockDuration)
+	if err != nil {
+		SetError(err, "Error counting pin attempts", funcName)
+		return err
+	}
+
+	if attempts < config.MaxPinAttempts {
+		SetInfo("Incorrect pin for user "+user.ID.Hex(), funcName)
+		return fmt.Errorf("%w, %d attempts left", ErrIncorrectPin, config.MaxPinAttempts-attempts)
+	}
+
+	// Lock the wallet and start counting again once the lock expires
+	err = db.NewCache(pinCacheKey(config.PinLock, user.ID), "1").SetEx(config.PinLockDuration)
+	if err != nil {
+		SetError(err, "Error locking wallet", funcName)
+		return err
+	}
+	err = db.NewCache(pinCacheKey(config.PinAttempts, user.ID), nil).Delete()
+	if err != nil {
+		SetDebug("error clearing pin attempts: "+err.Error(), funcName)
+	}
+
+	SetInfo("Wallet locked after too many incorrect pins for user "+user.ID.Hex(), funcName)
+	return ErrTooManyPinAttempts
+}
+
+// generatePinResetCode returns a random numeric code
+func generatePinResetCode() (string, error) {
+	code := make([]byte, pinResetCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + n.Int64())
+	}
+
+	return string(code), nil
+}
+
+// SendPinResetCode emails the user a one-time code to reset their transaction pin
+// Only a hash of the code is kept and it expires after config.PinResetCodeTTL
+// A new code replaces the previous one
+func SendPinResetCode(ctx context.Context, user UserResponse) error {
+	funcName := ut.GetFunctionName()
+
+	// The user must have a pin to reset
+	if _, err := GetWallet(ctx, bson.M{"_id": user.Wallet}); err != nil {
+		SetDebug("error fetching wallet: "+err.Error(), funcName)
+		return err
+	}
+
+	code, err := generatePinResetCode()
+	if err != nil {
+		SetError(err, "Error generating pin reset code", funcName)
+		return err
+	}
+
+	hash, err := auth.HashPassword(code)
+	if err != nil {
+		SetError(err, "Error hashing pin reset code", funcName)
+		return err
+	}
+
+	err = db.NewCache(pinCacheKey(config.PinReset, user.ID), hash).SetEx(config.PinResetCodeTTL)
+	if err != nil {
+		SetError(err, "Error storing pin reset code", funcName)
+		return err
+	}
+	err = db.NewCache(pinCacheKey(config.PinResetAttempts, user.ID), nil).Delete()
+	if err != nil {
+		SetDebug("error clearing pin reset attempts: "+err.Error(), funcName)
+	}
+
+	// Send email
+	r := em.NewRequest([]string{user.Email}, "Transaction Pin Reset", code)
+
+	template := struct {
+		Title   string
+		Body    string
+		Minutes string
+	}{
+		Title:   "Transaction Pin Reset",
+		Body:    code,
+		Minutes: strconv.Itoa(int(config.PinResetCodeTTL.Minutes())),
+	}
+
+	err = r.ParseTemplate("pin-reset.html", template)
+	if err != nil {
+		return err
+	}
+
+	ok, err := r.SendEmail()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("email not sent")
+	}
+
+	return nil
+}
+
+// ResetPin replaces the user's transaction pin if the emailed code is correct
+// A code stops working after config.MaxPinAttempts incorrect tries
+// A successful reset also unlocks the wallet
+func ResetPin(ctx context.Context, user UserResponse, code, newPin string) error {
+	funcName := ut.GetFunctionName()
+
+	hash, err := db.NewCache(pinCacheKey(config.PinReset, user.ID), nil).Get()
+	if errors.Is(err, db.ErrCacheNotFound) {
+		return ErrInvalidPinResetCode
+	}
+	if err != nil {
+		SetError(err, "Error fetching pin reset code", funcName)
+		return err
+	}
+
+	if !auth.CheckPasswordHash(code, string(hash)) {
+		attempts, err := db.NewCache(pinCacheKey(config.PinResetAttempts, user.ID), nil).Incr(config.PinResetCodeTTL)
+		if err != nil {
+			SetError(err, "Error counting pin reset attempts", funcName)
+			return err
+		}
+		if attempts >= config.MaxPinAttempts {
+			SetInfo("Pin reset code discarded after too many attempts for user "+user.ID.Hex(), funcName)
+			err = db.NewCache(pinCacheKey(config.PinReset, user.ID), nil).Delete()
+			if err != nil {
+				SetDebug("error discarding pin reset code: "+err.Error(), funcName)
+			}
+		}
+		return ErrInvalidPinResetCode
+	}
+
+	newPin, err = auth.HashPassword(newPin)
+	if err != nil {
+		SetError(err, "Error hashing pin", funcName)
+		return err
+	}
+
+	update_at, _ := CreatedAtUpdatedAt()
+
+	result, err := walletCollection.UpdateOne(ctx, bson.M{"_id": user.Wallet}, bson.M{
+		"$set": bson.M{
+			"txn_pin":    newPin,
+			"updated_at": update_at,
+		}})
+	if err != nil {
+		SetError(err, "Error updating pin", funcName)
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return errors.New("wallet not found")
+	}
+
+	// The code is used up and the wallet unlocked
+	for _, key := range []config.CacheKey{config.PinReset, config.PinResetAttempts} {
+		err = db.NewCache(pinCacheKey(key, user.ID), nil).Delete()
+		if err != nil {
+			SetDebug("error clearing "+key.String()+": "+err.Error(), funcName)
+		}
+	}
+	err = ClearPinAttempts(user.ID)
+	if err != nil {
+		SetDebug("error unlocking wallet: "+err.Error(), funcName)
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var platformWalletCollection = config.PlatformWalletCollection
+
+// PlatformRevenueWallet is the platform wallet the fees on venue payments are credited to
+const PlatformRevenueWallet = "revenue"
+
+// PlatformWallet holds money that belongs to the platform rather than a user
+type PlatformWallet struct {
+	ID        string             `json:"id" bson:"_id"`
+	Balances  map[string]int64   `json:"balances" bson:"balances"`
+	UpdatedAt primitive.DateTime `json:"updated_at" bson:"updated_at"`
+}
+
+// FeeRevenue is the platform fee earned from one restaurant in one currency and period
+// Period is empty when the report is not split by day or month
+type FeeRevenue struct {
+	RestaurantID   primitive.ObjectID `json:"restaurant_id" bson:"restaurant_id"`
+	RestaurantName string             `json:"restaurant_name" bson:"restaurant_name"`
+	Period         string             `json:"period,omitempty" bson:"period,omitempty"`
+	Payments       int                `json:"payments" bson:"payments"`
+	Fees           Money              `json:"fees" bson:"fees"`
+	Refunded       Money              `json:"refunded" bson:"refunded"`
+	Net            Money              `json:"net" bson:"net"`
+}
+
+// FeeRevenueRequest filters the fee revenue report
+// From and To are dates or RFC 3339 times, Interval splits the report by day or month
+type FeeRevenueRequest struct {
+	RestaurantID string `form:"restaurant_id"`
+	From         string `form:"from"`
+	To           string `form:"to"`
+	Interval     string `form:"interval" binding:"omitempty,oneof=day month"`
+}
+
+// reportIntervals are the date formats reports are split by
+var reportIntervals = map[string]string{
+	"day":   "%Y-%m-%d",
+	"month": "%Y-%m",
+}
+
+// PlatformFee returns the percentage of the amount taken as a platform fee
+// rounded to the nearest minor unit, percentages outside 0 to 100 are clamped
+func PlatformFee(amount Money, percentage float64) Money {
+	percentage = math.Max(0, math.Min(100, percentage))
+	fee := math.Round(float64(amount.Amount) * percentage / 100)
+	return NewMoney(int64(fee), amount.Currency)
+}
+
+// NetAmount is what the receiver of a transaction gets after the platform fee
+func (txn Transactions) NetAmount() Money {
+	return txn.Amount.Sub(txn.Fee)
+}
+
+// CreditPlatformWallet adds the fee to the platform revenue wallet
+// It must be called inside the transaction that moves the money
+func CreditPlatformWallet(ctx context.Context, fee Money) error {
+	if fee.IsZero() {
+		return nil
+	}
+
+	_, err := platformWalletCollection.UpdateOne(ctx,
+		bson.M{"_id": PlatformRevenueWallet},
+		bson.M{
+			"$inc": walletInc(fee),
+			"$set": bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// DebitPlatformWallet takes the fee back out of the platform revenue wallet when a payment is refunded
+// The balance filter stops the wallet from going below zero
+func DebitPlatformWallet(ctx context.Context, fee Money) error {
+	if fee.IsZero() {
+		return nil
+	}
+
+	filter := walletHasAtLeast(fee)
+	filter["_id"] = PlatformRevenueWallet
+	result, err := platformWalletCollection.UpdateOne(ctx, filter, bson.M{
+		"$inc": walletInc(fee.Neg()),
+		"$set": bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return errors.New("insufficient platform balance to refund fee")
+	}
+
+	return nil
+}
+
+// GetPlatformWallet returns the platform revenue wallet
+func GetPlatformWallet(ctx context.Context) (PlatformWallet, error) {
+	wallet := PlatformWallet{ID: PlatformRevenueWallet, Balances: map[string]int64{}}
+
+	err := platformWalletCollection.FindOne(ctx, bson.M{"_id": PlatformRevenueWallet}).Decode(&wallet)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// no fee has been collected yet
+		return wallet, nil
+	}
+
+	return wallet, err
+}
+
+// refundFee returns the part of the original payment's fee given back with a refund of amount
+// A refund that settles the payment gives back whatever fee earlier refunds did not
+func refundFee(ctx context.Context, original Transactions, amount Money, settles bool) (Money, error) {
+	if original.Fee.IsZero() {
+		return ZeroMoney(original.Amount.Currency), nil
+	}
+
+	if !settles {
+		share := float64(original.Fee.Amount) * float64(amount.Amount) / float64(original.Amount.Amount)
+		return NewMoney(int64(math.Round(share)), original.Fee.Currency), nil
+	}
+
+	var refunds []Transactions
+	cursor, err := transactionCollection.Find(ctx, bson.M{"original_id": original.ID, "type": Refund})
+	if err != nil {
+		return Money{}, err
+	}
+	if err = cursor.All(ctx, &refunds); err != nil {
+		return Money{}, err
+	}
+
+	returned := ZeroMoney(original.Fee.Currency)
+	for _, refund := range refunds {
+		returned = returned.Add(refund.Fee)
+	}
+
+	return original.Fee.Sub(returned), nil
+}
+
+// GetFeeRevenue reports the platform fees earned from venue payments, by restaurant and currency
+// Fees given back by refunds are taken off, and Interval splits the report by day or month
+func GetFeeRevenue(ctx context.Context, request FeeRevenueRequest) ([]FeeRevenue, error) {
+	revenue := []FeeRevenue{}
+
+	match := bson.M{
+		"restaurant_id": bson.M{"$exists": true},
+		"fee.amount":    bson.M{"$gt": 0},
+		"$or": bson.A{
+			bson.M{"type": Debit, "status": bson.M{"$in": bson.A{TxnSuccess, TxnRefunded, TxnPartiallyRefunded}}},
+			bson.M{"type": Refund, "status": TxnSuccess},
+		},
+	}
+
+	if request.RestaurantID != "" {
+		restaurantID, err := primitive.ObjectIDFromHex(request.RestaurantID)
+		if err != nil {
+			return revenue, errors.New("invalid restaurant id")
+		}
+		match["restaurant_id"] = restaurantID
+	}
+
+	createdAt, err := createdAtFilter(request.From, request.To)
+	if err != nil {
+		return revenue, err
+	}
+	if len(createdAt) > 0 {
+		match["created_at"] = createdAt
+	}
+
+	group := bson.M{"restaurant_id": "$restaurant_id", "currency": "$fee.currency"}
+	if format, ok := reportIntervals[request.Interval]; ok {
+		group["period"] = bson.M{"$dateToString": bson.M{"format": format, "date": "$created_at"}}
+	}
+
+	isPayment := bson.M{"$eq": bson.A{"$type", Debit}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      group,
+			"payments": bson.M{"$sum": bson.M{"$cond": bson.A{isPayment, 1, 0}}},
+			"fees":     bson.M{"$sum": bson.M{"$cond": bson.A{isPayment, "$fee.amount", 0}}},
+			"refunded": bson.M{"$sum": bson.M{"$cond": bson.A{isPayment, 0, "$fee.amount"}}},
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         config.RESTAURAUNT,
+			"localField":   "_id.restaurant_id",
+			"foreignField": "_id",
+			"as":           "restaurant",
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.period", Value: 1}, {Key: "fees", Value: -1}}}},
+	}
+
+	cursor, err := transactionCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return revenue, err
+	}
+
+	var rows []struct {
+		ID struct {
+			RestaurantID primitive.ObjectID `bson:"restaurant_id"`
+			Currency     string             `bson:"currency"`
+			Period       string             `bson:"period"`
+		} `bson:"_id"`
+		Payments   int          `bson:"payments"`
+		Fees       int64        `bson:"fees"`
+		Refunded   int64        `bson:"refunded"`
+		Restaurant []Restaurant `bson:"restaurant"`
+	}
+	if err = cursor.All(ctx, &rows); err != nil {
+		return revenue, err
+	}
+
+	for _, row := range rows {
+		fees := NewMoney(row.Fees, row.ID.Currency)
+		refunded := NewMoney(row.Refunded, row.ID.Currency)
+
+		item := FeeRevenue{
+			RestaurantID: row.ID.RestaurantID,
+			Period:       row.ID.Period,
+			Payments:     row.Payments,
+			Fees:         fees,
+			Refunded:     refunded,
+			Net:          fees.Sub(refunded),
+		}
+		if len(row.Restaurant) > 0 {
+			item.RestaurantName = row.Restaurant[0].Name
+		}
+
+		revenue = append(revenue, item)
+	}
+
+	return revenue, nil
+}
@@ -23,7 +23,7 @@ type Product struct {
 	Name         string             `json:"name" bson:"name" binding:"required,min=3,max=50,lowercase"`
 	ProductImage Avatar             `json:"product_image,omitempty" bson:"product_image,omitempty"`
 	Category     Categories         `json:"category,omitempty" bson:"category"`
-	Price        float64            `json:"price" bson:"price" binding:"required"`
+	Price        Money              `json:"price" bson:"price" binding:"required"`
 	Stock        uint64             `json:"stock" bson:"stock" binding:"required"`
 	CreatedAt    primitive.DateTime `json:"created_at,omitempty" bson:"created_at" default:"time.Now()"`
 	UpdatedAt    primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at" default:"time.Now()"`
@@ -132,3 +132,19 @@ func GetProducts(c context.Context, filter bson.M) (Products, error) {
 	SetInfo(fmt.Sprintf("Found %v products", len(products)), funcName)
 	return products, nil
 }
+
+// PriceInVenueCurrency returns the product price in the currency of its restaurant
+// A price sent without a currency takes the restaurant's currency
+func PriceInVenueCurrency(ctx context.Context, product Product) (Money, error) {
+	restaurant, err := GetRestaurantByID(ctx, product.RestaurantID)
+	if err != nil {
+		return Money{}, err
+	}
+
+	price := product.Price.InCurrency(restaurant.Currency)
+	if price.Currency != restaurant.Currency {
+		return price, fmt.Errorf("price must be in the restaurant currency %s", restaurant.Currency)
+	}
+
+	return price, nil
+}
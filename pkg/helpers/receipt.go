@@ -0,0 +1,167 @@
+package helpers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/email"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ReceiptItem is a line of a receipt
+type ReceiptItem struct {
+	Name      string `json:"name"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice Money  `json:"unit_price"`
+	Total     Money  `json:"total"`
+}
+
+// Receipt is what a transaction paid for and who was involved
+type Receipt struct {
+	Reference    string          `json:"reference"`
+	Date         string          `json:"date"`
+	Status       TxnStatus       `json:"status"`
+	Type         TxnType         `json:"type"`
+	Payer        string          `json:"payer"`
+	Payee        string          `json:"payee"`
+	Event        string          `json:"event,omitempty"`
+	Restaurant   string          `json:"restaurant,omitempty"`
+	Items        []ReceiptItem   `json:"items,omitempty"`
+	Charges      []AppliedCharge `json:"charges,omitempty"`
+	Amount       Money           `json:"amount"`
+	SourceAmount Money           `json:"source_amount"`
+	ExchangeRate float64         `json:"exchange_rate"`
+	Converted    bool            `json:"converted"`
+}
+
+// GetTransactionByReference returns the transaction with the reference
+func GetTransactionByReference(ctx context.Context, reference string) (Transactions, error) {
+	return GetTransaction(ctx, bson.M{"transaction_uid": strings.ToUpper(reference)})
+}
+
+// displayName returns the name shown for the user on receipts
+func displayName(user UserResponse) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if name == "" {
+		return user.Username
+	}
+	return name
+}
+
+// BuildReceipt gathers the payer, payee, event, restaurant, line items and charges of the transaction
+// Line items are priced with the products' current prices, charges with the same name
+// on several orders are added up
+func BuildReceipt(ctx context.Context, txn Transactions) (Receipt, error) {
+	funcName := ut.GetFunctionName()
+
+	receipt := Receipt{
+		Reference:    txn.TransactionUID,
+		Date:         txn.CreatedAt.Time().UTC().Format(time.RFC1123),
+		Status:       txn.Status,
+		Type:         txn.Type,
+		Payer:        displayName(GetUserByID(ctx, txn.FromID)),
+		Payee:        displayName(GetUserByID(ctx, txn.ToID)),
+		Amount:       txn.Amount,
+		SourceAmount: txn.SourceAmount,
+		ExchangeRate: txn.ExchangeRate,
+		Converted:    txn.SourceAmount.Currency != "" && txn.SourceAmount.Currency != txn.Amount.Currency,
+	}
+
+	if txn.EventID.IsZero() {
+		return receipt, nil
+	}
+
+	event, err := GetEvent(ctx, bson.M{"_id": txn.EventID})
+	if err != nil {
+		SetDebug("error getting event: "+err.Error(), funcName)
+		return receipt, err
+	}
+	receipt.Event = event.Title
+
+	restaurant, err := GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
+	if err != nil {
+		SetDebug("error getting restaurant: "+err.Error(), funcName)
+		return receipt, err
+	}
+	receipt.Restaurant = restaurant.Name
+
+	if len(txn.OrderIDs) == 0 {
+		return receipt, nil
+	}
+
+	orders, err := GetOrders(ctx, bson.M{"_id": bson.M{"$in": txn.OrderIDs}})
+	if err != nil {
+		SetDebug("error getting orders: "+err.Error(), funcName)
+		return receipt, err
+	}
+
+	// products deleted since the payment are left out of the map, the line keeps its price
+	products, err := orderProducts(ctx, orders)
+	if err != nil {
+		SetDebug("error getting products: "+err.Error(), funcName)
+		return receipt, err
+	}
+
+	for _, order := range orders {
+		for _, line := range order.Products {
+			product, ok := products[line.ProductID]
+			name := product.Name
+			if !ok {
+				name = "Product no longer available"
+			}
+
+			// lines are priced when ordered, orders from before that use the current price
+			total := line.Bill
+			if total.Currency == "" && total.IsZero() {
+				total = product.Price.Mul(int64(line.Quantity))
+			}
+
+			// a line without a quantity shows its total as the unit price
+			unitPrice := total
+			if line.Quantity > 0 {
+				unitPrice = NewMoney(total.Amount/int64(line.Quantity), total.Currency)
+			}
+
+			receipt.Items = append(receipt.Items, ReceiptItem{
+				Name:      name,
+				Quantity:  line.Quantity,
+				UnitPrice: unitPrice,
+				Total:     total,
+			})
+		}
+
+		for _, charge := range order.Charges {
+			added := false
+			for i := range receipt.Charges {
+				if receipt.Charges[i].Name == charge.Name && receipt.Charges[i].Type == charge.Type {
+					receipt.Charges[i].Amount = receipt.Charges[i].Amount.Add(charge.Amount)
+					added = true
+					break
+				}
+			}
+			if !added {
+				receipt.Charges = append(receipt.Charges, charge)
+			}
+		}
+	}
+
+	return receipt, nil
+}
+
+// RenderReceipt renders the receipt as HTML and as plain text
+func RenderReceipt(receipt Receipt) (string, string, error) {
+	r := email.NewRequest(nil, "Receipt "+receipt.Reference, "")
+
+	if err := r.ParseTemplate("receipt.html", receipt); err != nil {
+		return "", "", err
+	}
+	html := r.Body()
+
+	if err := r.ParseTextTemplate("receipt.txt", receipt); err != nil {
+		return "", "", err
+	}
+
+	return html, r.Body(), nil
+}
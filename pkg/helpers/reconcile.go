@@ -0,0 +1,486 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	reconciliationCollection     = config.ReconciliationCollection
+	reconciliationItemCollection = config.ReconciliationItemCollection
+)
+
+// StuckTransactionAge is how long a transaction can stay in start or pending
+// before reconciliation reports it as stuck
+const StuckTransactionAge = time.Hour
+
+const (
+	DefaultReconciliationPageSize = 50
+	MaxReconciliationPageSize     = 500
+)
+
+// ReconciliationKind is what a reconciliation item reports
+type ReconciliationKind string
+
+const (
+	BalanceMismatch  ReconciliationKind = "balance_mismatch"
+	StuckTransaction ReconciliationKind = "stuck_transaction"
+)
+
+// ReconciliationReport is the outcome of a reconciliation run
+// The mismatches and stuck transactions it found are stored as ReconciliationItems
+type ReconciliationReport struct {
+	ID                primitive.ObjectID `json:"id" bson:"_id"`
+	RunBy             primitive.ObjectID `json:"run_by,omitempty" bson:"run_by,omitempty"`
+	WalletsChecked    int                `json:"wallets_checked" bson:"wallets_checked"`
+	Mismatches        int                `json:"mismatches" bson:"mismatches"`
+	StuckTransactions int                `json:"stuck_transactions" bson:"stuck_transactions"`
+	Error             string             `json:"error,omitempty" bson:"error,omitempty"`
+	StartedAt         primitive.DateTime `json:"started_at" bson:"started_at"`
+	FinishedAt        primitive.DateTime `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+}
+
+// ReconciliationItem is a wallet balance that does not match its history
+// or a transaction that never finished
+type ReconciliationItem struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id"`
+	ReportID primitive.ObjectID `json:"report_id" bson:"report_id"`
+	Kind     ReconciliationKind `json:"kind" bson:"kind"`
+	UserID   primitive.ObjectID `json:"user_id,omitempty" bson:"user_id,omitempty"`
+
+	// balance mismatches, in minor units of the currency
+	WalletBalance   Money `json:"wallet_balance,omitempty" bson:"wallet_balance,omitempty"`
+	ExpectedBalance Money `json:"expected_balance,omitempty" bson:"expected_balance,omitempty"`
+	OpenBudgets     Money `json:"open_budgets,omitempty" bson:"open_budgets,omitempty"`
+	Difference      Money `json:"difference,omitempty" bson:"difference,omitempty"`
+
+	// stuck transactions
+	TransactionID primitive.ObjectID `json:"transaction_id,omitempty" bson:"transaction_id,omitempty"`
+	Reference     string             `json:"reference,omitempty" bson:"reference,omitempty"`
+	Type          TxnType            `json:"type,omitempty" bson:"type,omitempty"`
+	Status        TxnStatus          `json:"status,omitempty" bson:"status,omitempty"`
+	Amount        Money              `json:"amount,omitempty" bson:"amount,omitempty"`
+	UpdatedAt     primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+}
+
+// ReconciliationPage is a page of reports or of the items of a report
+// NextCursor is empty on the last page
+type ReconciliationPage struct {
+	Report     *ReconciliationReport  `json:"report,omitempty"`
+	Reports    []ReconciliationReport `json:"reports,omitempty"`
+	Items      []ReconciliationItem   `json:"items,omitempty"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
+}
+
+// openingBalances returns what the user held when the ledger was backfilled and when that was
+// Transactions before then are part of the opening balance, a user without one starts from zero
+// Opening budgets count towards the opening balance because the budget leaves the wallet
+// again when it is spent or stays open
+func openingBalances(ctx context.Context, userID primitive.ObjectID) (map[string]int64, primitive.DateTime, error) {
+	balances := make(map[string]int64)
+	var since primitive.DateTime
+
+	entries, err := GetLedgerEntries(ctx, bson.M{
+		"account_type": bson.M{"$in": bson.A{WalletAccount, BudgetAccount}},
+		"account_id":   userID,
+		"reference":    bson.M{"$regex": "^OB-"},
+	})
+	if err != nil {
+		return balances, since, err
+	}
+
+	for _, entry := range entries {
+		if entry.Direction == EntryCredit {
+			balances[entry.Amount.Currency] += entry.Amount.Amount
+		} else {
+			balances[entry.Amount.Currency] -= entry.Amount.Amount
+		}
+		if entry.CreatedAt > since {
+			since = entry.CreatedAt
+		}
+	}
+
+	return balances, since, nil
+}
+
+// applyTransaction adds what the transaction did to the user's wallet to balances
+// Payments and refunds count once they succeed, a refunded payment still moved the money
+// because the refund is a transaction of its own, funding counts once it is paid and
+// withdrawals count as soon as they are held
+func applyTransaction(balances map[string]int64, txn Transactions, userID primitive.ObjectID) {
+	switch txn.Type {
+	case Debit, Refund:
+		if txn.Status != TxnSuccess && txn.Status != TxnRefunded && txn.Status != TxnPartiallyRefunded {
+			return
+		}
+		// the platform fee on a venue payment never reaches the payee
+		// and is given back by the platform on a refund
+		if txn.FromID == userID {
+			// the budget part was taken from the wallet when the budget was locked
+			source := txn.SourceAmount
+			if source.Currency == "" {
+				source = txn.Amount
+			}
+			if txn.Type == Refund {
+				source.Amount -= txn.Fee.Amount
+			}
+			balances[source.Currency] -= source.Amount
+		}
+		if txn.ToID == userID {
+			received := txn.Amount
+			if txn.Type == Debit {
+				received.Amount -= txn.Fee.Amount
+			}
+			balances[received.Currency] += received.Amount
+		}
+	case Credit:
+		if txn.Status == TxnSuccess && txn.ToID == userID {
+			balances[txn.Amount.Currency] += txn.Amount.Amount
+		}
+	case Withdrawal:
+		if (txn.Status == TxnPending || txn.Status == TxnSuccess) && txn.FromID == userID {
+			balances[txn.Amount.Currency] -= txn.Amount.Amount
+		}
+	}
+}
+
+// ReconcileWallet recomputes what the wallet should hold from the user's opening balance,
+// their successful transactions and their open budgets, and returns a mismatch for every
+// currency where the wallet holds something else
+// Everything is read from one snapshot so payments made during the run do not show up as mismatches
+func ReconcileWallet(ctx context.Context, wallet Wallet) ([]ReconciliationItem, error) {
+	var items []ReconciliationItem
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		items = nil
+
+		// read the wallet again inside the snapshot
+		current, err := GetWallet(sessCtx, bson.M{"_id": wallet.ID})
+		if err != nil {
+			return err
+		}
+
+		expected, since, err := openingBalances(sessCtx, current.UserID)
+		if err != nil {
+			return err
+		}
+
+		filter := bson.M{"$or": bson.A{
+			bson.M{"from_id": current.UserID},
+			bson.M{"to_id": current.UserID},
+		}}
+		if since != 0 {
+			filter["created_at"] = bson.M{"$gt": since}
+		}
+
+		cursor, err := transactionCollection.Find(sessCtx, filter)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(sessCtx)
+
+		for cursor.Next(sessCtx) {
+			var txn Transactions
+			if err = cursor.Decode(&txn); err != nil {
+				return err
+			}
+			applyTransaction(expected, txn, current.UserID)
+		}
+		if err = cursor.Err(); err != nil {
+			return err
+		}
+
+		var budgets []Budget
+		budgetCursor, err := budgetCollection.Find(sessCtx, openBudgets(bson.M{"user_id": current.UserID}))
+		if err != nil {
+			return err
+		}
+		if err = budgetCursor.All(sessCtx, &budgets); err != nil {
+			return err
+		}
+
+		open := make(map[string]int64)
+		for _, budget := range budgets {
+			open[budget.Amount.Currency] += budget.Amount.Amount
+			expected[budget.Amount.Currency] -= budget.Amount.Amount
+		}
+
+		currencies := make(map[string]bool)
+		for currency := range current.Balances {
+			currencies[currency] = true
+		}
+		for currency := range expected {
+			currencies[currency] = true
+		}
+
+		for currency := range currencies {
+			actual := NewMoney(current.Balances[currency], currency)
+			want := NewMoney(expected[currency], currency)
+			if actual.Cmp(want) == 0 {
+				continue
+			}
+
+			items = append(items, ReconciliationItem{
+				ID:              primitive.NewObjectID(),
+				Kind:            BalanceMismatch,
+				UserID:          current.UserID,
+				WalletBalance:   actual,
+				ExpectedBalance: want,
+				OpenBudgets:     NewMoney(open[currency], currency),
+				Difference:      actual.Sub(want),
+			})
+		}
+
+		return nil
+	})
+
+	// report currencies in the same order every run
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].WalletBalance.Currency < items[j].WalletBalance.Currency
+	})
+
+	return items, err
+}
+
+// FindStuckTransactions returns the transactions that have been in start or pending
+// for longer than StuckTransactionAge
+func FindStuckTransactions(ctx context.Context, now time.Time) ([]ReconciliationItem, error) {
+	var items []ReconciliationItem
+
+	filter := bson.M{
+		"status":     bson.M{"$in": bson.A{TxnStart, TxnPending}},
+		"updated_at": bson.M{"$lt": primitive.NewDateTimeFromTime(now.Add(-StuckTransactionAge))},
+	}
+
+	cursor, err := transactionCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"updated_at": 1}))
+	if err != nil {
+		return items, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var txn Transactions
+		if err = cursor.Decode(&txn); err != nil {
+			return items, err
+		}
+
+		items = append(items, ReconciliationItem{
+			ID:            primitive.NewObjectID(),
+			Kind:          StuckTransaction,
+			UserID:        txn.FromID,
+			TransactionID: txn.ID,
+			Reference:     txn.TransactionUID,
+			Type:          txn.Type,
+			Status:        txn.Status,
+			Amount:        txn.Amount,
+			UpdatedAt:     txn.UpdatedAt,
+		})
+	}
+
+	return items, cursor.Err()
+}
+
+// saveReconciliationItems stores the items under the report
+func saveReconciliationItems(ctx context.Context, reportID primitive.ObjectID, items []ReconciliationItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, len(items))
+	for i := range items {
+		items[i].ReportID = reportID
+		docs[i] = items[i]
+	}
+
+	_, err := reconciliationItemCollection.InsertMany(ctx, docs)
+	return err
+}
+
+// RunReconciliation checks every wallet against its history, looks for stuck transactions
+// and saves what it finds as a report
+// The report is saved when the run starts so a run that fails part way still shows up with its error
+// runBy is the admin who started the run, it is empty for the reconcile command
+func RunReconciliation(ctx context.Context, runBy primitive.ObjectID) (ReconciliationReport, error) {
+	funcName := ut.GetFunctionName()
+
+	now := time.Now()
+	report := ReconciliationReport{
+		ID:        primitive.NewObjectID(),
+		RunBy:     runBy,
+		StartedAt: primitive.NewDateTimeFromTime(now),
+	}
+
+	if _, err := reconciliationCollection.InsertOne(ctx, report); err != nil {
+		SetDebug("error saving reconciliation report: "+err.Error(), funcName)
+		return report, err
+	}
+
+	runErr := func() error {
+		cursor, err := walletCollection.Find(ctx, bson.M{})
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			var wallet Wallet
+			if err = cursor.Decode(&wallet); err != nil {
+				return err
+			}
+
+			items, err := ReconcileWallet(ctx, wallet)
+			if err != nil {
+				return fmt.Errorf("wallet %s: %w", wallet.ID.Hex(), err)
+			}
+			if err = saveReconciliationItems(ctx, report.ID, items); err != nil {
+				return err
+			}
+
+			report.WalletsChecked++
+			report.Mismatches += len(items)
+		}
+		if err = cursor.Err(); err != nil {
+			return err
+		}
+
+		stuck, err := FindStuckTransactions(ctx, now)
+		if err != nil {
+			return err
+		}
+		report.StuckTransactions = len(stuck)
+
+		return saveReconciliationItems(ctx, report.ID, stuck)
+	}()
+	if runErr != nil {
+		SetDebug("reconciliation failed: "+runErr.Error(), funcName)
+		report.Error = runErr.Error()
+	}
+
+	report.FinishedAt = primitive.NewDateTimeFromTime(time.Now())
+
+	// the run may have used up ctx, the report still has to be closed
+	saveCtx, cancel := context.WithTimeout(context.Background(), config.ContextTimeout)
+	defer cancel()
+
+	_, err := reconciliationCollection.ReplaceOne(saveCtx, bson.M{"_id": report.ID}, report)
+	if err != nil {
+		SetDebug("error saving reconciliation report: "+err.Error(), funcName)
+		if runErr == nil {
+			runErr = err
+		}
+	}
+
+	SetInfo(fmt.Sprintf("reconciliation %s: %d wallets checked, %d mismatches, %d stuck transactions",
+		report.ID.Hex(), report.WalletsChecked, report.Mismatches, report.StuckTransactions), funcName)
+
+	return report, runErr
+}
+
+// reconciliationPageLimit clamps the page size asked for
+func reconciliationPageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultReconciliationPageSize
+	}
+	if limit > MaxReconciliationPageSize {
+		return MaxReconciliationPageSize
+	}
+	return limit
+}
+
+// decodeIDCursor reads a cursor that is the id of the last document of the previous page
+func decodeIDCursor(cursor string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(cursor)
+	if err != nil {
+		return id, errors.New("invalid cursor")
+	}
+	return id, nil
+}
+
+// GetReconciliationReports returns a page of reports, newest first
+func GetReconciliationReports(ctx context.Context, cursor string, limit int) (ReconciliationPage, error) {
+	page := ReconciliationPage{Reports: []ReconciliationReport{}}
+	limit = reconciliationPageLimit(limit)
+
+	filter := bson.M{}
+	if cursor != "" {
+		after, err := decodeIDCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		filter["_id"] = bson.M{"$lt": after}
+	}
+
+	opts := options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(limit + 1))
+
+	results, err := reconciliationCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return page, err
+	}
+	if err = results.All(ctx, &page.Reports); err != nil {
+		return page, err
+	}
+
+	if len(page.Reports) > limit {
+		page.Reports = page.Reports[:limit]
+		page.NextCursor = page.Reports[limit-1].ID.Hex()
+	}
+
+	return page, nil
+}
+
+// GetReconciliationReport returns the report with a page of its items
+// kind limits the items to balance mismatches or stuck transactions
+func GetReconciliationReport(ctx context.Context, id primitive.ObjectID, kind string, cursor string, limit int) (ReconciliationPage, error) {
+	page := ReconciliationPage{Items: []ReconciliationItem{}}
+	limit = reconciliationPageLimit(limit)
+
+	var report ReconciliationReport
+	if err := reconciliationCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&report); err != nil {
+		return page, err
+	}
+	page.Report = &report
+
+	filter := bson.M{"report_id": id}
+	if kind != "" {
+		k := ReconciliationKind(strings.ToLower(kind))
+		if k != BalanceMismatch && k != StuckTransaction {
+			return page, fmt.Errorf("invalid kind %q", kind)
+		}
+		filter["kind"] = k
+	}
+	if cursor != "" {
+		after, err := decodeIDCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		filter["_id"] = bson.M{"$gt": after}
+	}
+
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(limit + 1))
+
+	results, err := reconciliationItemCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return page, err
+	}
+	if err = results.All(ctx, &page.Items); err != nil {
+		return page, err
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = page.Items[limit-1].ID.Hex()
+	}
+
+	return page, nil
+}
@@ -0,0 +1,392 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RefundRequest reverses part or all of a payment for an event or its orders
+// Amount is in major units of the currency the payment was received in
+// Without an amount the orders given are refunded in full, and without
+// orders whatever has not been refunded yet is returned
+type RefundRequest struct {
+	Reference string               `json:"reference" binding:"required"`
+	Amount    float64              `json:"amount" binding:"gte=0"`
+	OrderIDs  []primitive.ObjectID `json:"order_ids"`
+	Reason    string               `json:"reason" binding:"max=255"`
+}
+
+// CanRefundTransaction reports whether the user may refund the transaction
+// Admins can refund any payment, restaurant owners only payments they received
+// for events held at their restaurant
+func CanRefundTransaction(ctx context.Context, txn Transactions, user UserResponse) (bool, error) {
+	if user.Role == Admin {
+		return true, nil
+	}
+
+	if txn.EventID.IsZero() || txn.ToID != user.ID {
+		return false, nil
+	}
+
+	event, err := GetEvent(ctx, bson.M{"_id": txn.EventID})
+	if err != nil {
+		return false, err
+	}
+
+	restaurant, err := GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
+	if err != nil {
+		return false, err
+	}
+
+	return restaurant.OwnerID == user.ID, nil
+}
+
+// refundedPortion returns what refunding the order gives back to the payer and
+// whether only the payer's portions of it are refunded
+// A payer who paid their own portions of a shared order gets back those portions
+// that are not refunded yet, the other sharers still owe theirs. Otherwise the
+// payment paid for the whole order and it is refunded whole
+func refundedPortion(order Order, payerID primitive.ObjectID) (Money, bool) {
+	amount, portion := ZeroMoney(order.Bill.Currency), false
+	for _, share := range order.Shares {
+		if share.UserID != payerID || !share.Paid {
+			continue
+		}
+		portion = true
+		if !share.Refunded {
+			amount = amount.Add(share.Amount)
+		}
+	}
+	if !portion {
+		return order.Bill, false
+	}
+	return amount, true
+}
+
+// refundableOrders returns the orders of the payment that are to be refunded
+// If no orders are asked for and the refund settles the payment, all of its
+// orders that are not refunded yet are returned
+func refundableOrders(ctx context.Context, original Transactions, ids []primitive.ObjectID, settles bool) ([]Order, error) {
+	if len(ids) == 0 {
+		if !settles || len(original.OrderIDs) == 0 {
+			return nil, nil
+		}
+		orders, err := GetOrders(ctx, bson.M{"_id": bson.M{"$in": original.OrderIDs}, "refunded": bson.M{"$ne": true}})
+		if err != nil {
+			return nil, err
+		}
+		var refundable []Order
+		for _, order := range orders {
+			if amount, _ := refundedPortion(order, original.FromID); amount.IsPositive() {
+				refundable = append(refundable, order)
+			}
+		}
+		return refundable, nil
+	}
+
+	paid := make(map[primitive.ObjectID]bool)
+	for _, id := range original.OrderIDs {
+		paid[id] = true
+	}
+	for _, id := range ids {
+		if !paid[id] {
+			return nil, fmt.Errorf("order %s was not paid by this transaction", id.Hex())
+		}
+	}
+
+	orders, err := GetOrders(ctx, bson.M{"_id": bson.M{"$in": ids}, "refunded": bson.M{"$ne": true}})
+	if err != nil {
+		return nil, err
+	}
+	if len(orders) != len(ids) {
+		return nil, errors.New("some of the orders have already been refunded")
+	}
+	for _, order := range orders {
+		if amount, _ := refundedPortion(order, original.FromID); !amount.IsPositive() {
+			return nil, errors.New("some of the orders have already been refunded")
+		}
+	}
+
+	return orders, nil
+}
+
+// refundSourceAmount works out how much of what the payer paid goes back to them
+// The payer gets back the same share of the source amount as the refund is of the amount,
+// the refund that settles the payment returns whatever is left so rounding never adds up
+// to more than was paid
+func refundSourceAmount(ctx context.Context, original Transactions, amount Money, settles bool) (Money, error) {
+	if original.SourceAmount.Currency == amount.Currency {
+		return amount, nil
+	}
+
+	if !settles {
+		share := float64(original.SourceAmount.Amount) * float64(amount.Amount) / float64(original.Amount.Amount)
+		return NewMoney(int64(math.Round(share)), original.SourceAmount.Currency), nil
+	}
+
+	var refunds []Transactions
+	cursor, err := transactionCollection.Find(ctx, bson.M{"original_id": original.ID, "type": Refund})
+	if err != nil {
+		return Money{}, err
+	}
+	if err = cursor.All(ctx, &refunds); err != nil {
+		return Money{}, err
+	}
+
+	returned := ZeroMoney(original.SourceAmount.Currency)
+	for _, refund := range refunds {
+		returned = returned.Add(refund.Amount)
+	}
+
+	return original.SourceAmount.Sub(returned), nil
+}
+
+// refundedBill is how much a refund puts back on the event bill
+// A refund gives back the bill before the tip, so what it returns of the bill is owed
+// again, less the orders or portions it refunds as those are no longer owed at all
+func refundedBill(original Transactions, amount, refundedOrders Money) Money {
+	bill := original.BillAmount().Sub(original.RefundedAmount)
+	if bill.IsNegative() {
+		bill = ZeroMoney(amount.Currency)
+	}
+	if amount.LessThan(bill) {
+		bill = amount
+	}
+	return bill.Sub(refundedOrders)
+}
+
+// RefundTransaction reverses part or all of a payment for an event or its orders
+// The refund is a new transaction from the payee back to the payer that points at the
+// original one, the original records how much of it has been refunded
+// The money is taken from the payee's wallet in the currency it was received in and
+// returned to the payer in the currency they paid in
+// The share of the platform fee on the refunded amount comes back from the platform wallet
+// Refunded orders, or the payer's portions of shared orders, are marked and left out
+// of what is owed for the event, and the event bill is adjusted, see refundedBill
+// Everything runs in one MongoDB transaction
+func RefundTransaction(ctx context.Context, request RefundRequest, user UserResponse) (Transactions, error) {
+	funcName := ut.GetFunctionName()
+
+	var refund Transactions
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		// Read the payment inside the transaction so concurrent refunds conflict
+		original, err := GetTransactionByReference(sessCtx, request.Reference)
+		if err != nil {
+			SetDebug("error getting transaction: "+err.Error(), funcName)
+			return err
+		}
+
+		if original.Type != Debit || (original.Status != TxnSuccess && original.Status != TxnPartiallyRefunded) {
+			return errors.New("only successful payments can be refunded")
+		}
+		if original.EventID.IsZero() {
+			return errors.New("only payments for events and orders can be refunded")
+		}
+
+		remaining := original.Amount.Sub(original.RefundedAmount)
+
+		var orders []Order
+		var amount Money
+		switch {
+		case request.Amount > 0:
+			amount = MoneyFromMajor(request.Amount, original.Amount.Currency)
+		case len(request.OrderIDs) > 0:
+			orders, err = refundableOrders(sessCtx, original, request.OrderIDs, false)
+			if err != nil {
+				return err
+			}
+			amount = ZeroMoney(original.Amount.Currency)
+			for _, order := range orders {
+				if order.Bill.Currency != amount.Currency {
+					return errors.New("order bill is not in the currency of the payment")
+				}
+				portion, _ := refundedPortion(order, original.FromID)
+				amount = amount.Add(portion)
+			}
+		default:
+			amount = remaining
+		}
+
+		if !amount.IsPositive() {
+			return errors.New("nothing to refund")
+		}
+		if amount.GreaterThan(remaining) {
+			return fmt.Errorf("refund of %s is more than the %s left to refund", amount, remaining)
+		}
+
+		settles := amount.Cmp(remaining) == 0
+
+		if orders == nil {
+			orders, err = refundableOrders(sessCtx, original, request.OrderIDs, settles)
+			if err != nil {
+				return err
+			}
+		}
+
+		source, err := refundSourceAmount(sessCtx, original, amount, settles)
+		if err != nil {
+			SetDebug("error working out refund amount: "+err.Error(), funcName)
+			return err
+		}
+
+		fee, err := refundFee(sessCtx, original, amount, settles)
+		if err != nil {
+			SetDebug("error working out refunded fee: "+err.Error(), funcName)
+			return err
+		}
+
+		// The refund is the payment the other way round
+		rate := 1.0
+		if original.ExchangeRate > 0 {
+			rate = 1 / original.ExchangeRate
+		}
+
+		createdAt, updatedAt := CreatedAtUpdatedAt()
+		refund = Transactions{
+			ID:             primitive.NewObjectID(),
+			TransactionUID: NewTransactionUID(),
+			FromID:         original.ToID,
+			ToID:           original.FromID,
+			Amount:         source,
+			SourceAmount:   amount,
+			ExchangeRate:   rate,
+			EventID:        original.EventID,
+			OrderIDs:       orderIDs(orders),
+			RestaurantID:   original.RestaurantID,
+			Fee:            fee,
+			FeePercentage:  original.FeePercentage,
+			OriginalID:     original.ID,
+			RefundedBy:     user.ID,
+			Reason:         request.Reason,
+			Type:           Refund,
+			Status:         TxnSuccess,
+			CreatedAt:      createdAt,
+			UpdatedAt:      updatedAt,
+		}
+
+		// Take the refund from the payee, the balance filter stops the wallet from going below zero
+		// The payee only received the amount less the platform fee, the platform gives the fee back
+		fromPayee := amount.Sub(fee)
+		filter := walletHasAtLeast(fromPayee)
+		filter["user_id"] = original.ToID
+		result, err := walletCollection.UpdateOne(sessCtx, filter, bson.M{"$inc": walletInc(fromPayee.Neg())})
+		if err != nil {
+			SetDebug("error updating payee wallet balance: "+err.Error(), funcName)
+			return err
+		}
+		if result.MatchedCount != 1 {
+			return errors.New("insufficient balance to refund")
+		}
+
+		if err = DebitPlatformWallet(sessCtx, fee); err != nil {
+			SetDebug("error returning platform fee: "+err.Error(), funcName)
+			return err
+		}
+
+		// Return it to the payer
+		result, err = walletCollection.UpdateOne(sessCtx, bson.M{"user_id": original.FromID}, bson.M{"$inc": walletInc(source)})
+		if err != nil {
+			SetDebug("error updating payer wallet balance: "+err.Error(), funcName)
+			return err
+		}
+		if result.MatchedCount != 1 {
+			return errors.New("payer wallet not found")
+		}
+
+		if _, err = transactionCollection.InsertOne(sessCtx, refund); err != nil {
+			SetDebug("error inserting refund: "+err.Error(), funcName)
+			return err
+		}
+
+		if err = PostLedgerEntries(sessCtx, RefundLedgerEntries(refund)); err != nil {
+			SetDebug("error posting refund to ledger: "+err.Error(), funcName)
+			return err
+		}
+
+		status := TxnPartiallyRefunded
+		if settles {
+			status = TxnRefunded
+		}
+		_, err = transactionCollection.UpdateOne(sessCtx, bson.M{"_id": original.ID}, bson.M{
+			"$set": bson.M{
+				"refunded_amount": original.RefundedAmount.Add(amount),
+				"status":          status,
+				"updated_at":      primitive.NewDateTimeFromTime(time.Now()),
+			},
+			"$push": bson.M{"refunds": refund.ID},
+		})
+		if err != nil {
+			SetDebug("error updating refunded transaction: "+err.Error(), funcName)
+			return err
+		}
+
+		// Shared orders the payer paid their own portions of only have those portions refunded
+		var whole, portions []primitive.ObjectID
+		refundedOrders := ZeroMoney(amount.Currency)
+		for _, order := range orders {
+			refunded, portion := refundedPortion(order, original.FromID)
+			refundedOrders = refundedOrders.Add(refunded)
+			if portion {
+				portions = append(portions, order.ID)
+			} else {
+				whole = append(whole, order.ID)
+			}
+		}
+
+		if len(whole) > 0 {
+			_, err = UpdateManyOrders(sessCtx, bson.M{"_id": bson.M{"$in": whole}}, bson.M{"$set": bson.M{
+				"refunded":   true,
+				"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+			}})
+			if err != nil {
+				SetDebug("error marking orders refunded: "+err.Error(), funcName)
+				return err
+			}
+		}
+
+		if len(portions) > 0 {
+			_, err = orderCollection.UpdateMany(sessCtx,
+				bson.M{"_id": bson.M{"$in": portions}},
+				bson.M{"$set": bson.M{
+					"shares.$[portion].refunded": true,
+					"updated_at":                 primitive.NewDateTimeFromTime(time.Now()),
+				}},
+				options.Update().SetArrayFilters(options.ArrayFilters{Filters: bson.A{
+					bson.M{"portion.user_id": original.FromID, "portion.paid": true},
+				}}),
+			)
+			if err != nil {
+				SetDebug("error marking order portions refunded: "+err.Error(), funcName)
+				return err
+			}
+		}
+
+		_, err = eventCollection.UpdateOne(sessCtx,
+			bson.M{"_id": original.EventID, "bill.currency": amount.Currency},
+			bson.M{"$inc": moneyInc("bill", refundedBill(original, amount, refundedOrders))},
+		)
+		if err != nil {
+			SetDebug("error updating event bill: "+err.Error(), funcName)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Transactions{}, err
+	}
+
+	SetInfo(fmt.Sprintf("refunded %s of %s as %s", refund.SourceAmount, request.Reference, refund.TransactionUID), funcName)
+
+	return refund, nil
+}
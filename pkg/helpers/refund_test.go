@@ -0,0 +1,110 @@
+package helpers
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRefundsKeepTheBillInStep(t *testing.T) {
+	ngn := func(amount int64) Money { return NewMoney(amount, "NGN") }
+	restaurant := primitive.NewObjectID()
+	payment := func(amount, tip int64) Transactions {
+		return Transactions{Type: Debit, Amount: ngn(amount), Tip: ngn(tip), RefundedAmount: ngn(0), RestaurantID: restaurant}
+	}
+	toHost := func(amount int64) Transactions {
+		return Transactions{Type: Debit, Amount: ngn(amount), Tip: ngn(0), RefundedAmount: ngn(0)}
+	}
+
+	// a refund of amount from the payment, orders is what it refunds of the orders
+	type refund struct {
+		payment, amount, orders int64
+	}
+
+	tests := []struct {
+		name     string
+		bill     int64
+		payments []Transactions
+		refunds  []refund
+		want     int64
+	}{
+		{"whole bill then its orders refunded", 5000, []Transactions{payment(5000, 0)}, []refund{{0, 5000, 5000}}, 0},
+		{"bill with tip then everything refunded", 5000, []Transactions{payment(5500, 500)}, []refund{{0, 5500, 5000}}, 0},
+		{"own bills then their orders refunded", 9000, []Transactions{payment(3000, 0), payment(3300, 300)}, []refund{{0, 1000, 1000}, {1, 2300, 2000}}, 3300},
+		{"amount refunded without orders is owed again", 9000, []Transactions{payment(3000, 0)}, []refund{{0, 1000, 0}}, 7000},
+		{"money sent to the host leaves the bill to the venue", 4000, []Transactions{toHost(1000), payment(4000, 0)}, nil, 0},
+		{"the tip is refunded last", 4000, []Transactions{payment(3300, 300)}, []refund{{0, 3000, 0}, {0, 300, 0}}, 4000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bill := ngn(tt.bill)
+			for _, txn := range tt.payments {
+				bill = bill.Sub(billPaid(txn))
+			}
+			for i, r := range tt.refunds {
+				original := &tt.payments[r.payment]
+				bill = bill.Add(refundedBill(*original, ngn(r.amount), ngn(r.orders)))
+				original.RefundedAmount = original.RefundedAmount.Add(ngn(r.amount))
+				if bill.IsNegative() {
+					t.Fatalf("bill is %s after refund %d", bill, i)
+				}
+			}
+			if bill.Amount != tt.want {
+				t.Errorf("bill = %d, want %d", bill.Amount, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefundedPortion(t *testing.T) {
+	ada, bola, host := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	ngn := func(amount int64) Money { return NewMoney(amount, "NGN") }
+
+	shared := func(adaPaid, adaRefunded bool) Order {
+		return Order{CustomerID: ada, Bill: ngn(900), Shares: []OrderPortion{
+			{UserID: ada, Amount: ngn(600), Paid: adaPaid, Refunded: adaRefunded},
+			{UserID: bola, Amount: ngn(300)},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		order       Order
+		payer       primitive.ObjectID
+		want        int64
+		wantPortion bool
+		unpaid      int64
+	}{
+		{"order that is not shared", Order{CustomerID: ada, Bill: ngn(900), Paid: true}, ada, 900, false, 0},
+		{"sharer who paid their portion", shared(true, false), ada, 600, true, 300},
+		{"portion already refunded", shared(true, true), ada, 0, true, 300},
+		{"payer who is not a sharer", shared(false, false), host, 900, false, 900},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			amount, portion := refundedPortion(tt.order, tt.payer)
+			if amount.Amount != tt.want || portion != tt.wantPortion {
+				t.Errorf("refundedPortion() = %d, %v, want %d, %v", amount.Amount, portion, tt.want, tt.wantPortion)
+			}
+
+			// the other sharers still owe their portions once the payer's is refunded
+			if portion {
+				for i := range tt.order.Shares {
+					if tt.order.Shares[i].UserID == tt.payer {
+						tt.order.Shares[i].Refunded = true
+					}
+				}
+			}
+			if unpaid := tt.order.Unpaid(); unpaid.Amount != tt.unpaid {
+				t.Errorf("Unpaid() = %d, want %d", unpaid.Amount, tt.unpaid)
+			}
+			for _, p := range tt.order.Portions() {
+				if p.Refunded {
+					t.Errorf("Portions() kept the refunded portion of %s", p.UserID.Hex())
+				}
+			}
+		})
+	}
+}
@@ -18,24 +18,26 @@ var restaurantCollection = config.RestaurantCollection
 var RestaurantUID = "RC-" + ut.GenerateUUID()
 
 type Restaurant struct {
-	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	RestaurantUID string             `json:"restaurant_uid,omitempty" bson:"restaurant_uid"`
-	Slug          string             `json:"slug,omitempty" bson:"slug"`
-	OwnerID       primitive.ObjectID `json:"owner_id,omitempty" bson:"owner_id,omitempty"`
-	Name          string             `json:"name,omitempty" bson:"name" binding:"required"`
-	Description   string             `json:"description,omitempty" bson:"description" binding:"required"`
-	Phone         string             `json:"phone,omitempty" bson:"phone" binding:"required"`
-	Email         string             `json:"email,omitempty" bson:"email" binding:"required,email"`
-	Address       Address            `json:"address,omitempty" bson:"address" binding:"required"`
-	Website       string             `json:"website,omitempty" bson:"website" binding:"required"`
-	MapInfo       MapInfo            `json:"map_info,omitempty" bson:"map_info" binding:"required"`
-	Category      RestaurantCategory `json:"category,omitempty" bson:"category" binding:"required"`
-	OpenHours     [7]OpenHours       `json:"open_hours,omitempty" bson:"open_hours" binding:"required,dive"`
-	Currency      string             `json:"currency,omitempty" bson:"currency" binding:"required"`
-	Verified      bool               `json:"verified,omitempty" bson:"verified"`
-	FeePercentage float64            `json:"fee_percentage,omitempty" bson:"fee_percentage"`
-	CreatedAt     primitive.DateTime `json:"created_at,omitempty" bson:"created_at" default:"time.Now()"`
-	UpdatedAt     primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at" default:"time.Now()"`
+	ID             primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	RestaurantUID  string             `json:"restaurant_uid,omitempty" bson:"restaurant_uid"`
+	Slug           string             `json:"slug,omitempty" bson:"slug"`
+	OwnerID        primitive.ObjectID `json:"owner_id,omitempty" bson:"owner_id,omitempty"`
+	Name           string             `json:"name,omitempty" bson:"name" binding:"required"`
+	Description    string             `json:"description,omitempty" bson:"description" binding:"required"`
+	Phone          string             `json:"phone,omitempty" bson:"phone" binding:"required"`
+	Email          string             `json:"email,omitempty" bson:"email" binding:"required,email"`
+	Address        Address            `json:"address,omitempty" bson:"address" binding:"required"`
+	Website        string             `json:"website,omitempty" bson:"website" binding:"required"`
+	MapInfo        MapInfo            `json:"map_info,omitempty" bson:"map_info" binding:"required"`
+	Category       RestaurantCategory `json:"category,omitempty" bson:"category" binding:"required"`
+	OpenHours      [7]OpenHours       `json:"open_hours,omitempty" bson:"open_hours" binding:"required,dive"`
+	Currency       string             `json:"currency,omitempty" bson:"currency" binding:"required"`
+	Verified       bool               `json:"verified,omitempty" bson:"verified"`
+	FeePercentage  float64            `json:"fee_percentage,omitempty" bson:"fee_percentage"`
+	TipSuggestions []float64          `json:"tip_suggestions,omitempty" bson:"tip_suggestions,omitempty"`
+	Charges        []ChargeRule       `json:"charges,omitempty" bson:"charges,omitempty" binding:"omitempty,max=10,dive"`
+	CreatedAt      primitive.DateTime `json:"created_at,omitempty" bson:"created_at" default:"time.Now()"`
+	UpdatedAt      primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at" default:"time.Now()"`
 }
 
 type RestaurantCategory string
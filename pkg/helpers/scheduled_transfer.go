@@ -0,0 +1,395 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var scheduledTransferCollection = config.ScheduledTransferCollection
+
+// ScheduleFrequency is how often a scheduled transfer repeats
+type ScheduleFrequency string
+
+const (
+	Once    ScheduleFrequency = "once"
+	Daily   ScheduleFrequency = "daily"
+	Weekly  ScheduleFrequency = "weekly"
+	Monthly ScheduleFrequency = "monthly"
+)
+
+func (sf ScheduleFrequency) String() string {
+	return string(sf)
+}
+
+// ScheduleStatus is where a scheduled transfer is in its life
+// A schedule is completed after its last transfer and failed when a one-off transfer fails
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	SchedulePaused    ScheduleStatus = "paused"
+	ScheduleCancelled ScheduleStatus = "cancelled"
+	ScheduleCompleted ScheduleStatus = "completed"
+	ScheduleFailed    ScheduleStatus = "failed"
+)
+
+func (ss ScheduleStatus) String() string {
+	return string(ss)
+}
+
+// ScheduledTransfer sends money to another user at NextRunAt and then every Frequency
+// Occurrences are counted from StartAt so a monthly transfer on the 31st stays at the
+// end of shorter months instead of drifting
+type ScheduledTransfer struct {
+	ID                primitive.ObjectID `json:"id,omitempty" bson:"_id"`
+	FromID            primitive.ObjectID `json:"from_id" bson:"from_id"`
+	ToID              primitive.ObjectID `json:"to_id" bson:"to_id"`
+	Amount            Money              `json:"amount" bson:"amount"`
+	Frequency         ScheduleFrequency  `json:"frequency" bson:"frequency"`
+	StartAt           primitive.DateTime `json:"start_at" bson:"start_at"`
+	EndAt             primitive.DateTime `json:"end_at,omitempty" bson:"end_at,omitempty"`
+	NextRunAt         primitive.DateTime `json:"next_run_at,omitempty" bson:"next_run_at,omitempty"`
+	Occurrence        int                `json:"occurrence" bson:"occurrence"`
+	Status            ScheduleStatus     `json:"status" bson:"status"`
+	Note              string             `json:"note,omitempty" bson:"note,omitempty"`
+	LastRunAt         primitive.DateTime `json:"last_run_at,omitempty" bson:"last_run_at,omitempty"`
+	LastTransactionID primitive.ObjectID `json:"last_transaction_id,omitempty" bson:"last_transaction_id,omitempty"`
+	LastError         string             `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	Failures          int                `json:"failures" bson:"failures"`
+	CreatedAt         primitive.DateTime `json:"created_at" bson:"created_at"`
+	UpdatedAt         primitive.DateTime `json:"updated_at" bson:"updated_at"`
+}
+
+type ScheduledTransferRequest struct {
+	Username  string            `json:"username" form:"username" binding:"required"`
+	Amount    float64           `json:"amount" form:"amount" binding:"required,gt=0"`
+	Currency  string            `json:"currency" form:"currency"`
+	Frequency ScheduleFrequency `json:"frequency" form:"frequency" binding:"required"`
+	StartAt   time.Time         `json:"start_at" form:"start_at" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	EndAt     time.Time         `json:"end_at" form:"end_at" time_format:"2006-01-02T15:04:05Z07:00"`
+	Note      string            `json:"note" form:"note" binding:"max=140"`
+	TxnPin    string            `json:"txn_pin" form:"txn_pin" binding:"required"`
+}
+
+// ScheduledTransferRun is the outcome of one due transfer
+// Err is set when the transfer failed, Transaction when it went through
+type ScheduledTransferRun struct {
+	Transfer    ScheduledTransfer
+	Transaction Transactions
+	Err         error
+}
+
+// occurrenceAt returns when the nth transfer of the schedule runs, the first is n = 0
+func occurrenceAt(start time.Time, frequency ScheduleFrequency, n int) time.Time {
+	switch frequency {
+	case Daily:
+		return start.AddDate(0, 0, n)
+	case Weekly:
+		return start.AddDate(0, 0, 7*n)
+	case Monthly:
+		// AddDate normalises the 31st of a short month into the next month, clamp to its last day instead
+		firstOfMonth := time.Date(start.Year(), start.Month()+time.Month(n), 1, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location())
+		lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+		day := start.Day()
+		if day > lastDay {
+			day = lastDay
+		}
+		return firstOfMonth.AddDate(0, 0, day-1)
+	default:
+		return start
+	}
+}
+
+// nextOccurrence returns the first occurrence from n on that is not before now
+// It returns false if the schedule has no occurrence left
+func (st ScheduledTransfer) nextOccurrence(n int, now time.Time) (int, time.Time, bool) {
+	start := st.StartAt.Time()
+
+	if st.Frequency == Once {
+		if n > 0 {
+			return n, time.Time{}, false
+		}
+		return 0, start, true
+	}
+
+	next := occurrenceAt(start, st.Frequency, n)
+	for next.Before(now) {
+		n++
+		next = occurrenceAt(start, st.Frequency, n)
+	}
+
+	if st.EndAt != 0 && next.After(st.EndAt.Time()) {
+		return n, time.Time{}, false
+	}
+
+	return n, next, true
+}
+
+// CreateScheduledTransfer schedules a transfer from the user to another user
+// The sender's pin is checked when the transfer is scheduled, not each time it runs
+func CreateScheduledTransfer(ctx context.Context, from, to UserResponse, amount Money, request ScheduledTransferRequest) (ScheduledTransfer, error) {
+	funcName := ut.GetFunctionName()
+
+	switch request.Frequency {
+	case Once, Daily, Weekly, Monthly:
+	default:
+		return ScheduledTransfer{}, fmt.Errorf("invalid frequency: %q", request.Frequency)
+	}
+
+	if from.ID == to.ID {
+		return ScheduledTransfer{}, errors.New("cannot schedule a transfer to yourself")
+	}
+	if !amount.IsPositive() {
+		return ScheduledTransfer{}, errors.New("amount must be greater than zero")
+	}
+	if request.StartAt.Before(time.Now()) {
+		return ScheduledTransfer{}, errors.New("start_at must be in the future")
+	}
+	if !request.EndAt.IsZero() && request.EndAt.Before(request.StartAt) {
+		return ScheduledTransfer{}, errors.New("end_at must be after start_at")
+	}
+
+	createdAt, updatedAt := CreatedAtUpdatedAt()
+	transfer := ScheduledTransfer{
+		ID:        primitive.NewObjectID(),
+		FromID:    from.ID,
+		ToID:      to.ID,
+		Amount:    amount,
+		Frequency: request.Frequency,
+		StartAt:   primitive.NewDateTimeFromTime(request.StartAt),
+		NextRunAt: primitive.NewDateTimeFromTime(request.StartAt),
+		Status:    ScheduleActive,
+		Note:      strings.TrimSpace(request.Note),
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+	}
+	if !request.EndAt.IsZero() {
+		transfer.EndAt = primitive.NewDateTimeFromTime(request.EndAt)
+	}
+
+	_, err := scheduledTransferCollection.InsertOne(ctx, transfer)
+	if err != nil {
+		SetDebug("error inserting scheduled transfer: "+err.Error(), funcName)
+		return transfer, err
+	}
+
+	return transfer, nil
+}
+
+// GetScheduledTransfers returns the user's scheduled transfers, sent or received, newest first
+func GetScheduledTransfers(ctx context.Context, userID primitive.ObjectID, status ScheduleStatus) ([]ScheduledTransfer, error) {
+	transfers := []ScheduledTransfer{}
+
+	filter := bson.M{"$or": bson.A{bson.M{"from_id": userID}, bson.M{"to_id": userID}}}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	cursor, err := scheduledTransferCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": -1}))
+	if err != nil {
+		return transfers, err
+	}
+
+	err = cursor.All(ctx, &transfers)
+	return transfers, err
+}
+
+// updateScheduledTransfer changes the sender's scheduled transfer if it is in one of the statuses given
+func updateScheduledTransfer(ctx context.Context, id, userID primitive.ObjectID, from []ScheduleStatus, set bson.M) (ScheduledTransfer, error) {
+	var transfer ScheduledTransfer
+
+	set["updated_at"] = primitive.NewDateTimeFromTime(time.Now())
+
+	filter := bson.M{"_id": id, "from_id": userID, "status": bson.M{"$in": from}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	err := scheduledTransferCollection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&transfer)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return transfer, fmt.Errorf("scheduled transfer not found or cannot be changed: %w", err)
+	}
+
+	return transfer, err
+}
+
+// PauseScheduledTransfer stops an active schedule from running until it is resumed
+func PauseScheduledTransfer(ctx context.Context, id, userID primitive.ObjectID) (ScheduledTransfer, error) {
+	return updateScheduledTransfer(ctx, id, userID, []ScheduleStatus{ScheduleActive}, bson.M{"status": SchedulePaused})
+}
+
+// ResumeScheduledTransfer restarts a paused schedule
+// Occurrences missed while it was paused are skipped, a one-off transfer that is past due runs at once
+func ResumeScheduledTransfer(ctx context.Context, id, userID primitive.ObjectID) (ScheduledTransfer, error) {
+	var transfer ScheduledTransfer
+
+	err := scheduledTransferCollection.FindOne(ctx, bson.M{"_id": id, "from_id": userID, "status": SchedulePaused}).Decode(&transfer)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return transfer, fmt.Errorf("no paused scheduled transfer found: %w", err)
+	}
+	if err != nil {
+		return transfer, err
+	}
+
+	set := bson.M{"status": ScheduleActive, "failures": 0}
+
+	n, next, ok := transfer.nextOccurrence(transfer.Occurrence, time.Now())
+	switch {
+	case !ok:
+		set["status"] = ScheduleCompleted
+	case transfer.Frequency != Once:
+		set["occurrence"] = n
+		set["next_run_at"] = primitive.NewDateTimeFromTime(next)
+	}
+
+	return updateScheduledTransfer(ctx, id, userID, []ScheduleStatus{SchedulePaused}, set)
+}
+
+// CancelScheduledTransfer stops a schedule for good
+func CancelScheduledTransfer(ctx context.Context, id, userID primitive.ObjectID) (ScheduledTransfer, error) {
+	return updateScheduledTransfer(ctx, id, userID, []ScheduleStatus{ScheduleActive, SchedulePaused}, bson.M{"status": ScheduleCancelled})
+}
+
+// claimScheduledTransfer moves the schedule on to its next occurrence before the transfer is sent
+// Only the caller whose update matches sends the transfer, so a transfer is never sent twice
+// It returns the schedule as it was claimed
+func claimScheduledTransfer(ctx context.Context, transfer ScheduledTransfer, now time.Time) (ScheduledTransfer, bool, error) {
+	set := bson.M{
+		"last_run_at": primitive.NewDateTimeFromTime(now),
+		"updated_at":  primitive.NewDateTimeFromTime(now),
+	}
+	unset := bson.M{}
+
+	claimed := transfer
+	claimed.LastRunAt = primitive.NewDateTimeFromTime(now)
+
+	n, next, ok := transfer.nextOccurrence(transfer.Occurrence+1, now)
+	if ok {
+		claimed.Occurrence, claimed.NextRunAt = n, primitive.NewDateTimeFromTime(next)
+		set["occurrence"] = n
+		set["next_run_at"] = claimed.NextRunAt
+	} else {
+		claimed.Status, claimed.NextRunAt = ScheduleCompleted, 0
+		set["status"] = ScheduleCompleted
+		unset["next_run_at"] = ""
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	result, err := scheduledTransferCollection.UpdateOne(ctx,
+		bson.M{"_id": transfer.ID, "status": ScheduleActive, "next_run_at": transfer.NextRunAt},
+		update,
+	)
+	if err != nil {
+		return transfer, false, err
+	}
+
+	return claimed, result.ModifiedCount == 1, nil
+}
+
+// recordScheduledTransferRun stores the outcome of a transfer on the schedule
+// A one-off transfer that fails is marked failed, a recurring one is paused after
+// config.MaxScheduledTransferFailures failures in a row unless that was its last transfer
+// A schedule cancelled while the transfer ran stays cancelled
+func recordScheduledTransferRun(ctx context.Context, run *ScheduledTransferRun) error {
+	filter := bson.M{"_id": run.Transfer.ID}
+	set := bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())}
+
+	if run.Err == nil {
+		set["failures"] = 0
+		set["last_error"] = ""
+		set["last_transaction_id"] = run.Transaction.ID
+	} else {
+		run.Transfer.Failures++
+		set["failures"] = run.Transfer.Failures
+		set["last_error"] = run.Err.Error()
+
+		if run.Transfer.Frequency == Once {
+			run.Transfer.Status = ScheduleFailed
+			set["status"] = ScheduleFailed
+		} else if run.Transfer.Status == ScheduleActive && run.Transfer.Failures >= config.MaxScheduledTransferFailures {
+			run.Transfer.Status = SchedulePaused
+			set["status"] = SchedulePaused
+		}
+	}
+
+	if _, ok := set["status"]; ok {
+		filter["status"] = bson.M{"$in": bson.A{ScheduleActive, ScheduleCompleted}}
+	}
+
+	result, err := scheduledTransferCollection.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		run.Transfer.Status = ScheduleCancelled
+	}
+
+	return nil
+}
+
+// RunDueScheduledTransfers sends every active scheduled transfer that is due
+// A failed transfer does not stop the others, each outcome is returned so the
+// sender and receiver can be told
+func RunDueScheduledTransfers(ctx context.Context, now time.Time) ([]ScheduledTransferRun, error) {
+	funcName := ut.GetFunctionName()
+
+	var runs []ScheduledTransferRun
+
+	cursor, err := scheduledTransferCollection.Find(ctx,
+		bson.M{"status": ScheduleActive, "next_run_at": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+		options.Find().SetSort(bson.M{"next_run_at": 1}),
+	)
+	if err != nil {
+		return runs, err
+	}
+
+	var due []ScheduledTransfer
+	if err = cursor.All(ctx, &due); err != nil {
+		return runs, err
+	}
+
+	for _, next := range due {
+		transfer, claimed, err := claimScheduledTransfer(ctx, next, now)
+		if err != nil {
+			SetDebug("error claiming scheduled transfer "+next.ID.Hex()+": "+err.Error(), funcName)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		run := ScheduledTransferRun{Transfer: transfer}
+
+		from := GetUserByID(ctx, transfer.FromID)
+		to := GetUserByID(ctx, transfer.ToID)
+		if from.ID.IsZero() || to.ID.IsZero() {
+			run.Err = errors.New("sender or receiver no longer exists")
+		} else {
+			run.Transaction, run.Err = SendToOtherUsers(ctx, to, from, transfer.Amount)
+		}
+
+		if run.Err != nil {
+			SetInfo("scheduled transfer "+transfer.ID.Hex()+" failed: "+run.Err.Error(), funcName)
+		}
+
+		if err := recordScheduledTransferRun(ctx, &run); err != nil {
+			SetDebug("error recording scheduled transfer "+transfer.ID.Hex()+": "+err.Error(), funcName)
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,41 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOccurrenceAt(t *testing.T) {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 9, 30, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		start     time.Time
+		frequency ScheduleFrequency
+		n         int
+		want      time.Time
+	}{
+		{"once ignores n", at(2024, time.March, 5), Once, 3, at(2024, time.March, 5)},
+		{"first occurrence is the start", at(2024, time.March, 5), Monthly, 0, at(2024, time.March, 5)},
+		{"daily", at(2024, time.February, 27), Daily, 3, at(2024, time.March, 1)},
+		{"weekly", at(2024, time.December, 25), Weekly, 2, at(2025, time.January, 8)},
+		{"monthly", at(2024, time.March, 15), Monthly, 1, at(2024, time.April, 15)},
+		{"31st into a 30 day month", at(2024, time.January, 31), Monthly, 3, at(2024, time.April, 30)},
+		{"31st into february of a leap year", at(2024, time.January, 31), Monthly, 1, at(2024, time.February, 29)},
+		{"31st into february", at(2023, time.January, 31), Monthly, 1, at(2023, time.February, 28)},
+		{"31st back to a 31 day month", at(2024, time.January, 31), Monthly, 2, at(2024, time.March, 31)},
+		{"30th into february", at(2024, time.November, 30), Monthly, 3, at(2025, time.February, 28)},
+		{"across the year", at(2024, time.October, 31), Monthly, 14, at(2025, time.December, 31)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := occurrenceAt(tt.start, tt.frequency, tt.n)
+			if !got.Equal(tt.want) {
+				t.Errorf("occurrenceAt(%s, %s, %d) = %s, want %s", tt.start, tt.frequency, tt.n, got, tt.want)
+			}
+		})
+	}
+}
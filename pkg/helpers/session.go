@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"context"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// RunInTransaction runs fn inside a MongoDB multi-document transaction
+// All the writes made with the session context passed to fn are committed together
+// or not at all
+// The driver retries the whole transaction on TransientTransactionError and
+// retries the commit on UnknownTransactionCommitResult until the context expires
+// If ctx already carries a running transaction fn joins it instead of starting a new one,
+// so helpers that use RunInTransaction can be composed
+// Requires MongoDB to run as a replica set
+func RunInTransaction(ctx context.Context, fn func(sessCtx mongo.SessionContext) error) error {
+	funcName := ut.GetFunctionName()
+
+	// Join the transaction the caller already started
+	// session contexts are only created by RunInTransaction
+	if sess := mongo.SessionFromContext(ctx); sess != nil {
+		return fn(mongo.NewSessionContext(ctx, sess))
+	}
+
+	session, err := config.MongoClient.StartSession()
+	if err != nil {
+		SetDebug("error starting session: "+err.Error(), funcName)
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	opts := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	}, opts)
+	if err != nil {
+		SetDebug("transaction aborted: "+err.Error(), funcName)
+		return err
+	}
+
+	return nil
+}
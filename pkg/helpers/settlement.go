@@ -0,0 +1,253 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SettlementBalance is where one participant of an event stands
+// Consumed is their portion of the orders, Paid what they paid the venue or other participants
+// for the event and Received what other participants paid them
+// Net is Paid less Received and Consumed, above zero they are owed money, below zero they owe it
+type SettlementBalance struct {
+	UserID   primitive.ObjectID `json:"user_id"`
+	Consumed Money              `json:"consumed"`
+	Paid     Money              `json:"paid"`
+	Received Money              `json:"received"`
+	Net      Money              `json:"net"`
+}
+
+// SettlementTransfer is one payment that settles part of the event
+type SettlementTransfer struct {
+	FromID primitive.ObjectID `json:"from_id"`
+	ToID   primitive.ObjectID `json:"to_id"`
+	Amount Money              `json:"amount"`
+}
+
+// SettlementPlan is the net balance of every participant of an event and the transfers that settle them
+// Unpaid is what is still owed to the venue, it is left out of the transfers
+type SettlementPlan struct {
+	EventID   primitive.ObjectID   `json:"event_id"`
+	Balances  []SettlementBalance  `json:"balances"`
+	Transfers []SettlementTransfer `json:"transfers"`
+	Unpaid    Money                `json:"unpaid"`
+	Settled   bool                 `json:"settled"`
+}
+
+// PaySettlementRequest pays the user's transfer to ToID in the settlement plan of the event
+type PaySettlementRequest struct {
+	EventID primitive.ObjectID `json:"event_id" form:"event_id" binding:"required"`
+	ToID    primitive.ObjectID `json:"to_id" form:"to_id" binding:"required"`
+	TxnPin  string             `json:"txn_pin" form:"txn_pin" binding:"required"`
+}
+
+// Transfer returns the transfer the plan has from one user to another
+func (sp SettlementPlan) Transfer(fromID, toID primitive.ObjectID) (SettlementTransfer, bool) {
+	for _, transfer := range sp.Transfers {
+		if transfer.FromID == fromID && transfer.ToID == toID {
+			return transfer, true
+		}
+	}
+	return SettlementTransfer{}, false
+}
+
+// settlementPaid is the part of a transaction that went to the bill, without the tip or refunds
+func settlementPaid(txn Transactions) Money {
+	paid := txn.BillAmount().Sub(txn.RefundedAmount)
+	if !paid.IsPositive() {
+		return ZeroMoney(txn.Amount.Currency)
+	}
+	return paid
+}
+
+// GetSettlementPlan works out the net balance of every participant of the event from its orders
+// and payments, and the fewest transfers that settle them
+// Payments from a budget count as payments by the budget's owner, and tips are left out
+// The largest debtor pays the largest creditor until everyone is settled, so there is
+// at most one transfer fewer than participants with a balance
+func GetSettlementPlan(ctx context.Context, event Event) (SettlementPlan, error) {
+	funcName := ut.GetFunctionName()
+
+	plan := SettlementPlan{
+		EventID:   event.ID,
+		Balances:  []SettlementBalance{},
+		Transfers: []SettlementTransfer{},
+	}
+
+	currency := event.Bill.Currency
+	participants := EventParticipants(event)
+
+	balances := make(map[primitive.ObjectID]*SettlementBalance)
+	for _, userID := range participants {
+		balances[userID] = &SettlementBalance{
+			UserID:   userID,
+			Consumed: ZeroMoney(currency),
+			Paid:     ZeroMoney(currency),
+			Received: ZeroMoney(currency),
+		}
+	}
+
+	orders, err := GetOrders(ctx, bson.M{"event_id": event.ID, "refunded": bson.M{"$ne": true}})
+	if err != nil {
+		SetDebug("error getting orders: "+err.Error(), funcName)
+		return plan, err
+	}
+
+	// what everyone had, orders without a customer were entered by the host
+	consumed := ZeroMoney(currency)
+	for _, order := range orders {
+		if !order.Bill.sameCurrency(consumed) {
+			return plan, errors.New("orders of the event are in different currencies")
+		}
+		for _, portion := range order.Portions() {
+			balance, ok := balances[portion.UserID]
+			if !ok {
+				balance = balances[event.HostID]
+			}
+			balance.Consumed = balance.Consumed.Add(portion.Amount)
+			consumed = consumed.Add(portion.Amount)
+		}
+	}
+
+	var txns []Transactions
+	cursor, err := transactionCollection.Find(ctx, bson.M{
+		"event_id": event.ID,
+		"type":     Debit,
+		"status":   bson.M{"$in": bson.A{TxnSuccess, TxnPartiallyRefunded, TxnRefunded}},
+	})
+	if err != nil {
+		return plan, err
+	}
+	if err = cursor.All(ctx, &txns); err != nil {
+		return plan, err
+	}
+
+	// what everyone paid the venue and each other
+	paidVenue := ZeroMoney(currency)
+	for _, txn := range txns {
+		from, ok := balances[txn.FromID]
+		if !ok {
+			continue
+		}
+		paid := settlementPaid(txn)
+		if !paid.sameCurrency(consumed) {
+			return plan, errors.New("payments of the event are in different currencies")
+		}
+
+		if !txn.RestaurantID.IsZero() {
+			from.Paid = from.Paid.Add(paid)
+			paidVenue = paidVenue.Add(paid)
+			continue
+		}
+		if to, ok := balances[txn.ToID]; ok {
+			from.Paid = from.Paid.Add(paid)
+			to.Received = to.Received.Add(paid)
+		}
+	}
+
+	var creditors, debtors []*SettlementBalance
+	for _, userID := range participants {
+		balance := balances[userID]
+		balance.Net = balance.Paid.Sub(balance.Received).Sub(balance.Consumed)
+		plan.Balances = append(plan.Balances, *balance)
+
+		switch {
+		case balance.Net.IsPositive():
+			creditors = append(creditors, balance)
+		case balance.Net.Neg().IsPositive():
+			debtors = append(debtors, balance)
+		}
+	}
+
+	plan.Unpaid = consumed.Sub(paidVenue)
+	if plan.Unpaid.Neg().IsPositive() {
+		plan.Unpaid = ZeroMoney(currency)
+	}
+
+	owed := func(list []*SettlementBalance, sign int64) {
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Net.Amount*sign > list[j].Net.Amount*sign
+		})
+	}
+	owed(creditors, 1)
+	owed(debtors, -1)
+
+	for c, d := 0, 0; c < len(creditors) && d < len(debtors); {
+		credit, debt := creditors[c].Net, debtors[d].Net.Neg()
+
+		amount := credit
+		if debt.LessThan(credit) {
+			amount = debt
+		}
+
+		plan.Transfers = append(plan.Transfers, SettlementTransfer{
+			FromID: debtors[d].UserID,
+			ToID:   creditors[c].UserID,
+			Amount: amount,
+		})
+
+		creditors[c].Net = credit.Sub(amount)
+		debtors[d].Net = debt.Sub(amount).Neg()
+		if creditors[c].Net.IsZero() {
+			c++
+		}
+		if debtors[d].Net.IsZero() {
+			d++
+		}
+	}
+
+	plan.Settled = len(plan.Transfers) == 0 && plan.Unpaid.IsZero()
+
+	return plan, nil
+}
+
+// PaySettlement pays the user's transfer to another participant in the event's settlement plan
+// The plan is worked out again first so a transfer already paid is not paid again, and the
+// payment goes through SendToOtherUsers with the event on it so it counts towards the next plan,
+// anything overpaid shows up as a transfer back
+// Working out the plan and paying run in one MongoDB transaction, so two payments of the
+// same transfer conflict and the one that is retried finds it paid
+func PaySettlement(ctx context.Context, user UserResponse, event Event, toID primitive.ObjectID) (SettlementTransfer, Transactions, error) {
+	funcName := ut.GetFunctionName()
+
+	var transfer SettlementTransfer
+	var txn Transactions
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		txn = Transactions{}
+
+		plan, err := GetSettlementPlan(sessCtx, event)
+		if err != nil {
+			return err
+		}
+
+		var ok bool
+		transfer, ok = plan.Transfer(user.ID, toID)
+		if !ok {
+			return errors.New("you have nothing to pay this user for the event")
+		}
+
+		toUser := GetUserByID(sessCtx, toID)
+		if toUser.ID.IsZero() {
+			return errors.New("user not found")
+		}
+
+		txn, err = sendToOtherUsers(sessCtx, toUser, user, transfer.Amount, event.ID)
+		if err != nil {
+			SetDebug("error paying settlement: "+err.Error(), funcName)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return transfer, recordFailedPayment(ctx, txn), err
+	}
+
+	return transfer, txn, nil
+}
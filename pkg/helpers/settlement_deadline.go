@@ -0,0 +1,416 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	"github.com/Rhaqim/thedutchapp/pkg/email"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AutoChargeMode is how unpaid shares are paid when the settlement deadline of an event passes
+type AutoChargeMode string
+
+const (
+	// AutoChargeNone only reminds attendees
+	AutoChargeNone AutoChargeMode = "none"
+	// AutoChargeBudget pays a share from the attendee's locked budget when it covers all of it
+	AutoChargeBudget AutoChargeMode = "budget"
+	// AutoChargeWallet pays a share from the locked budget first and the wallet for the rest
+	AutoChargeWallet AutoChargeMode = "wallet"
+)
+
+func (acm AutoChargeMode) String() string {
+	return string(acm)
+}
+
+// ReminderStage is how far the reminders for an event's settlement deadline have gone
+type ReminderStage int
+
+const (
+	ReminderNone ReminderStage = iota
+	// ReminderDueSoon is sent config.SettlementReminderLead before the deadline
+	ReminderDueSoon
+	// ReminderDue is sent at the deadline, when shares are auto-charged
+	ReminderDue
+	// ReminderOverdue is sent config.SettlementOverdueAfter past the deadline
+	ReminderOverdue
+)
+
+func (rs ReminderStage) String() string {
+	switch rs {
+	case ReminderDueSoon:
+		return "due_soon"
+	case ReminderDue:
+		return "due"
+	case ReminderOverdue:
+		return "overdue"
+	default:
+		return "none"
+	}
+}
+
+// SettlementDeadlineRequest sets when the attendees of an event must have paid their share
+type SettlementDeadlineRequest struct {
+	EventID    primitive.ObjectID `json:"event_id" binding:"required"`
+	Deadline   time.Time          `json:"deadline" binding:"required"`
+	AutoCharge AutoChargeMode     `json:"auto_charge" binding:"omitempty,oneof=none budget wallet"`
+}
+
+// UnpaidShare is what one participant of an event still owes for their orders
+// Transfers are who they owe it to once the event is finished, before that it is owed to the venue
+type UnpaidShare struct {
+	EventID       primitive.ObjectID   `json:"event_id"`
+	EventTitle    string               `json:"event_title"`
+	UserID        primitive.ObjectID   `json:"user_id"`
+	Username      string               `json:"username"`
+	Owed          Money                `json:"owed"`
+	Transfers     []SettlementTransfer `json:"transfers,omitempty"`
+	Budget        Money                `json:"budget"`
+	Deadline      primitive.DateTime   `json:"deadline"`
+	DaysOverdue   int                  `json:"days_overdue"`
+	ReminderStage string               `json:"reminder_stage"`
+}
+
+// AutoChargeRun is the outcome of paying one unpaid share at the deadline
+// A share owed to several participants is paid with a transaction to each
+type AutoChargeRun struct {
+	Share        UnpaidShare
+	Transactions []Transactions
+	Err          error
+}
+
+// Paid is what the run paid of the share
+func (acr AutoChargeRun) Paid() Money {
+	paid := ZeroMoney(acr.Share.Owed.Currency)
+	for _, txn := range acr.Transactions {
+		paid = paid.Add(txn.Amount)
+	}
+	return paid
+}
+
+// SettlementReminder is a reminder stage reached by an event, with the shares still
+// unpaid and the auto-charges made when the deadline passed
+type SettlementReminder struct {
+	Event   Event
+	Stage   ReminderStage
+	Shares  []UnpaidShare
+	Charges []AutoChargeRun
+}
+
+// ReminderStageAt returns the reminder stage the event's deadline has reached at now
+func ReminderStageAt(event Event, now time.Time) ReminderStage {
+	if event.SettlementDeadline == 0 {
+		return ReminderNone
+	}
+
+	deadline := event.SettlementDeadline.Time()
+	switch {
+	case !now.Before(deadline.Add(config.SettlementOverdueAfter)):
+		return ReminderOverdue
+	case !now.Before(deadline):
+		return ReminderDue
+	case !now.Before(deadline.Add(-config.SettlementReminderLead)):
+		return ReminderDueSoon
+	default:
+		return ReminderNone
+	}
+}
+
+// SetSettlementDeadline sets the settlement deadline of an event the user hosts
+// The reminders start over, so moving the deadline reminds everyone again
+func SetSettlementDeadline(ctx context.Context, host UserResponse, request SettlementDeadlineRequest, now time.Time) (Event, error) {
+	funcName := ut.GetFunctionName()
+
+	var event Event
+
+	if !request.Deadline.After(now) {
+		return event, errors.New("the deadline must be in the future")
+	}
+	if request.AutoCharge == "" {
+		request.AutoCharge = AutoChargeNone
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := eventCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": request.EventID, "host_id": host.ID, "event_status": bson.M{"$ne": Cancelled}},
+		bson.M{
+			"$set": bson.M{
+				"settlement_deadline": primitive.NewDateTimeFromTime(request.Deadline),
+				"auto_charge":         request.AutoCharge,
+				"updated_at":          primitive.NewDateTimeFromTime(now),
+			},
+			"$unset": bson.M{"reminder_stage": ""},
+		},
+		opts,
+	).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return event, errors.New("event not found")
+	}
+	if err != nil {
+		SetDebug("error setting settlement deadline: "+err.Error(), funcName)
+		return event, err
+	}
+
+	return event, nil
+}
+
+// UnpaidShares returns what every participant of the event still owes for their orders
+// Until the event is finished that is their unpaid orders, once it is finished the venue
+// has been paid and every order marked paid, so it is what the settlement plan has them
+// pay the participants who paid for them, see GetSettlementPlan
+// Participants who owe nothing are left out
+func UnpaidShares(ctx context.Context, event Event, now time.Time) ([]UnpaidShare, error) {
+	shares := []UnpaidShare{}
+
+	var daysOverdue int
+	if event.SettlementDeadline != 0 && now.After(event.SettlementDeadline.Time()) {
+		daysOverdue = int(now.Sub(event.SettlementDeadline.Time()).Hours() / 24)
+	}
+
+	finished := event.EventStatus == Finished
+	var plan SettlementPlan
+	if finished {
+		var err error
+		if plan, err = GetSettlementPlan(ctx, event); err != nil {
+			return shares, err
+		}
+	}
+
+	for _, userID := range EventParticipants(event) {
+		owed := ZeroMoney(event.Bill.Currency)
+		var transfers []SettlementTransfer
+		if finished {
+			for _, transfer := range plan.Transfers {
+				if transfer.FromID == userID {
+					owed = owed.Add(transfer.Amount)
+					transfers = append(transfers, transfer)
+				}
+			}
+		} else {
+			var err error
+			if _, owed, err = OwnBill(ctx, event.ID, userID); err != nil {
+				return shares, err
+			}
+		}
+		if !owed.IsPositive() {
+			continue
+		}
+
+		share := UnpaidShare{
+			EventID:       event.ID,
+			EventTitle:    event.Title,
+			UserID:        userID,
+			Username:      GetUserByID(ctx, userID).Username,
+			Owed:          owed,
+			Transfers:     transfers,
+			Budget:        ZeroMoney(owed.Currency),
+			Deadline:      event.SettlementDeadline,
+			DaysOverdue:   daysOverdue,
+			ReminderStage: event.ReminderStage.String(),
+		}
+
+		budget, err := GetBudget(ctx, event.ID, userID)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return shares, err
+		}
+		if err == nil {
+			share.Budget = budget.Amount
+		}
+
+		shares = append(shares, share)
+	}
+
+	return shares, nil
+}
+
+// GetOverdueShares returns the unpaid shares of the user's events whose deadline has passed
+// An event id narrows it to that event, whether or not its deadline has passed
+func GetOverdueShares(ctx context.Context, host UserResponse, eventID primitive.ObjectID, now time.Time) ([]UnpaidShare, error) {
+	overdue := []UnpaidShare{}
+
+	filter := bson.M{
+		"host_id":             host.ID,
+		"event_status":        bson.M{"$ne": Cancelled},
+		"settlement_deadline": bson.M{"$lte": primitive.NewDateTimeFromTime(now)},
+	}
+	if !eventID.IsZero() {
+		filter = bson.M{"_id": eventID, "host_id": host.ID}
+	}
+
+	events, err := GetEvents(ctx, filter)
+	if err != nil {
+		return overdue, err
+	}
+
+	for _, event := range events {
+		shares, err := UnpaidShares(ctx, event, now)
+		if err != nil {
+			return overdue, err
+		}
+		overdue = append(overdue, shares...)
+	}
+
+	return overdue, nil
+}
+
+// autoCharge pays the user's share of the event the way the host allowed
+// Until the event is finished it goes through PayOwnBillforEvent, so the budget pays first,
+// limits apply and the user's orders are marked paid just as if they had paid themselves
+// Once it is finished each of the user's transfers in the settlement plan is paid through
+// PaySettlement, budgets are returned when an event finishes so only the wallet can pay
+func autoCharge(ctx context.Context, event Event, share UnpaidShare) ([]Transactions, error) {
+	if event.AutoCharge == AutoChargeBudget &&
+		(share.Budget.Currency != share.Owed.Currency || share.Budget.LessThan(share.Owed)) {
+		return nil, errors.New("the budget for the event does not cover the share")
+	}
+
+	user := GetUserByID(ctx, share.UserID)
+	if user.ID.IsZero() {
+		return nil, errors.New("user not found")
+	}
+
+	if event.EventStatus != Finished {
+		txn, err := PayOwnBillforEvent(ctx, event, user, TipRequest{})
+		if err != nil {
+			return nil, err
+		}
+		return []Transactions{txn}, nil
+	}
+
+	var txns []Transactions
+	for _, transfer := range share.Transfers {
+		_, txn, err := PaySettlement(ctx, user, event, transfer.ToID)
+		if err != nil {
+			return txns, err
+		}
+		txns = append(txns, txn)
+	}
+
+	return txns, nil
+}
+
+// RunSettlementReminders moves every event with a settlement deadline to the reminder
+// stage it has reached and returns the reminders to send
+// Each stage is claimed on the event before anything happens so a stage is only sent once,
+// and the shares are auto-charged once, when the deadline is first reached
+// Events with a confirmed split are paid through the split and are not auto-charged
+func RunSettlementReminders(ctx context.Context, now time.Time) ([]SettlementReminder, error) {
+	funcName := ut.GetFunctionName()
+
+	var reminders []SettlementReminder
+
+	events, err := GetEvents(ctx, bson.M{
+		"event_status":        bson.M{"$ne": Cancelled},
+		"settlement_deadline": bson.M{"$lte": primitive.NewDateTimeFromTime(now.Add(config.SettlementReminderLead))},
+		"reminder_stage":      bson.M{"$not": bson.M{"$gte": ReminderOverdue}},
+	})
+	if err != nil {
+		return reminders, err
+	}
+
+	for _, event := range events {
+		stage := ReminderStageAt(event, now)
+		if stage <= event.ReminderStage {
+			continue
+		}
+
+		// claim the stage, another run may have got there first
+		previous := bson.M{"$exists": false}
+		if event.ReminderStage != ReminderNone {
+			previous = bson.M{"$eq": event.ReminderStage}
+		}
+		result, err := eventCollection.UpdateOne(ctx,
+			bson.M{"_id": event.ID, "reminder_stage": previous},
+			bson.M{"$set": bson.M{"reminder_stage": stage}},
+		)
+		if err != nil {
+			SetDebug("error claiming reminder stage: "+err.Error(), funcName)
+			continue
+		}
+		if result.ModifiedCount != 1 {
+			continue
+		}
+
+		reached := event.ReminderStage
+		event.ReminderStage = stage
+
+		shares, err := UnpaidShares(ctx, event, now)
+		if err != nil {
+			SetDebug("error getting unpaid shares: "+err.Error(), funcName)
+			continue
+		}
+		if len(shares) == 0 {
+			continue
+		}
+
+		reminder := SettlementReminder{Event: event, Stage: stage}
+
+		charge := stage >= ReminderDue && reached < ReminderDue &&
+			event.AutoCharge != "" && event.AutoCharge != AutoChargeNone && event.SplitID.IsZero()
+		for _, share := range shares {
+			if !charge {
+				reminder.Shares = append(reminder.Shares, share)
+				continue
+			}
+
+			txns, err := autoCharge(ctx, event, share)
+			reminder.Charges = append(reminder.Charges, AutoChargeRun{Share: share, Transactions: txns, Err: err})
+			if err != nil {
+				reminder.Shares = append(reminder.Shares, share)
+			}
+		}
+
+		reminders = append(reminders, reminder)
+	}
+
+	return reminders, nil
+}
+
+// SendSettlementReminderEmail emails the user a reminder to pay their share of the event
+func SendSettlementReminderEmail(user UserResponse, share UnpaidShare, stage ReminderStage) error {
+	if user.Email == "" {
+		return errors.New("user has no email address")
+	}
+
+	subject := "Your share of " + share.EventTitle + " is due"
+	if stage == ReminderOverdue {
+		subject = "Your share of " + share.EventTitle + " is overdue"
+	}
+
+	r := email.NewRequest([]string{user.Email}, subject, "")
+
+	template := struct {
+		Title    string
+		Event    string
+		Owed     string
+		Deadline string
+		Overdue  bool
+	}{
+		Title:    subject,
+		Event:    share.EventTitle,
+		Owed:     share.Owed.String(),
+		Deadline: share.Deadline.Time().UTC().Format(time.RFC1123),
+		Overdue:  stage == ReminderOverdue,
+	}
+
+	if err := r.ParseTemplate("settlement-reminder.html", template); err != nil {
+		return err
+	}
+
+	ok, err := r.SendEmail()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("email not sent")
+	}
+
+	return nil
+}
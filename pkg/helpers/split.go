@@ -0,0 +1,628 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var splitCollection = config.SplitCollection
+
+// ErrEventBillSplit is returned when the bill is paid another way while a split of it is confirmed
+var ErrEventBillSplit = errors.New("the bill of the event is being split, pay your share of the split instead")
+
+// SplitStrategy is how the bill of an event is shared between the participants
+type SplitStrategy string
+
+const (
+	// SplitEqual shares the bill equally between the host and the attendees
+	SplitEqual SplitStrategy = "equal"
+	// SplitByItems charges everyone for what they ordered
+	SplitByItems SplitStrategy = "items"
+	// SplitPercentage charges everyone a percentage of the bill, the percentages add up to 100
+	SplitPercentage SplitStrategy = "percentage"
+	// SplitCustom charges everyone a fixed amount, the amounts add up to the bill
+	SplitCustom SplitStrategy = "custom"
+	// SplitExclude shares the bill equally between everyone but the people excluded
+	SplitExclude SplitStrategy = "exclude"
+)
+
+func (ss SplitStrategy) String() string {
+	return string(ss)
+}
+
+// SplitStatus is where a split is between the preview and everyone paying
+type SplitStatus string
+
+const (
+	SplitDraft     SplitStatus = "draft"
+	SplitConfirmed SplitStatus = "confirmed"
+	SplitSettled   SplitStatus = "settled"
+	SplitCancelled SplitStatus = "cancelled"
+)
+
+func (ss SplitStatus) String() string {
+	return string(ss)
+}
+
+// SplitShare is what one participant owes under a split
+type SplitShare struct {
+	UserID        primitive.ObjectID   `json:"user_id" bson:"user_id"`
+	Amount        Money                `json:"amount" bson:"amount"`
+	Percentage    float64              `json:"percentage,omitempty" bson:"percentage,omitempty"`
+	OrderIDs      []primitive.ObjectID `json:"order_ids,omitempty" bson:"order_ids,omitempty"`
+	Paid          bool                 `json:"paid" bson:"paid"`
+	TransactionID primitive.ObjectID   `json:"transaction_id,omitempty" bson:"transaction_id,omitempty"`
+	PaidAt        primitive.DateTime   `json:"paid_at,omitempty" bson:"paid_at,omitempty"`
+}
+
+// EventSplit shares the unpaid orders of an event between its participants
+// A split is previewed as a draft, confirmed by the host and then every
+// participant pays their share to the venue
+// Only one split of an event can be confirmed at a time, see Event.SplitID
+type EventSplit struct {
+	ID          primitive.ObjectID   `json:"id" bson:"_id"`
+	EventID     primitive.ObjectID   `json:"event_id" bson:"event_id"`
+	CreatedBy   primitive.ObjectID   `json:"created_by" bson:"created_by"`
+	Strategy    SplitStrategy        `json:"strategy" bson:"strategy"`
+	Total       Money                `json:"total" bson:"total"`
+	OrderIDs    []primitive.ObjectID `json:"order_ids" bson:"order_ids"`
+	Shares      []SplitShare         `json:"shares" bson:"shares"`
+	Status      SplitStatus          `json:"status" bson:"status"`
+	ConfirmedAt primitive.DateTime   `json:"confirmed_at,omitempty" bson:"confirmed_at,omitempty"`
+	SettledAt   primitive.DateTime   `json:"settled_at,omitempty" bson:"settled_at,omitempty"`
+	CreatedAt   primitive.DateTime   `json:"created_at" bson:"created_at"`
+	UpdatedAt   primitive.DateTime   `json:"updated_at" bson:"updated_at"`
+}
+
+// Share returns the user's share of the split
+func (es EventSplit) Share(userID primitive.ObjectID) (SplitShare, bool) {
+	for _, share := range es.Shares {
+		if share.UserID == userID {
+			return share, true
+		}
+	}
+	return SplitShare{}, false
+}
+
+// Remaining is what is left of the split to pay
+func (es EventSplit) Remaining() Money {
+	remaining := ZeroMoney(es.Total.Currency)
+	for _, share := range es.Shares {
+		if !share.Paid {
+			remaining = remaining.Add(share.Amount)
+		}
+	}
+	return remaining
+}
+
+// SplitShareRequest is a participant's percentage or fixed amount of the bill
+type SplitShareRequest struct {
+	UserID     primitive.ObjectID `json:"user_id" binding:"required"`
+	Percentage float64            `json:"percentage" binding:"gte=0,lte=100"`
+	Amount     float64            `json:"amount" binding:"gte=0"`
+}
+
+// SplitRequest previews a split of the event bill
+// Shares are needed for the percentage and custom strategies and Exclude for exclude
+type SplitRequest struct {
+	EventID  primitive.ObjectID   `json:"event_id" binding:"required"`
+	Strategy SplitStrategy        `json:"strategy" binding:"required,oneof=equal items percentage custom exclude"`
+	Shares   []SplitShareRequest  `json:"shares" binding:"dive"`
+	Exclude  []primitive.ObjectID `json:"exclude"`
+}
+
+type PaySplitShareRequest struct {
+	TxnPin string `json:"txn_pin" form:"txn_pin" binding:"required"`
+	TipRequest
+}
+
+// EventParticipants returns the host and the attendees of the event, host first
+func EventParticipants(event Event) []primitive.ObjectID {
+	participants := []primitive.ObjectID{event.HostID}
+	seen := map[primitive.ObjectID]bool{event.HostID: true}
+	for _, attendee := range event.Attendees {
+		if !seen[attendee] {
+			seen[attendee] = true
+			participants = append(participants, attendee)
+		}
+	}
+	return participants
+}
+
+// IsEventParticipant reports whether the user is the host or an attendee of the event
+func IsEventParticipant(event Event, userID primitive.ObjectID) bool {
+	for _, participant := range EventParticipants(event) {
+		if participant == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// unpaidEventOrders returns the orders of the event that are not paid for and what is still owed
+// Portions of shared orders already paid are left out of the total
+func unpaidEventOrders(ctx context.Context, event Event) (Orders, Money, error) {
+	orders, err := GetOrders(ctx, bson.M{"event_id": event.ID, "paid": false, "refunded": bson.M{"$ne": true}})
+	if err != nil {
+		return orders, Money{}, err
+	}
+
+	total := ZeroMoney(event.Bill.Currency)
+	for _, order := range orders {
+		if !order.Bill.sameCurrency(total) {
+			return orders, total, errors.New("orders of the event are in different currencies")
+		}
+		total = total.Add(order.Unpaid())
+	}
+
+	return orders, total, nil
+}
+
+// divideEvenly shares the total between the users, the first ones
+// pay a minor unit more when it does not divide exactly
+func divideEvenly(total Money, users []primitive.ObjectID) []SplitShare {
+	shares := make([]SplitShare, 0, len(users))
+	for i, amount := range total.Split(len(users)) {
+		shares = append(shares, SplitShare{UserID: users[i], Amount: amount})
+	}
+	return shares
+}
+
+// requestedShares checks the shares asked for are for participants, once each
+func requestedShares(request SplitRequest, participants []primitive.ObjectID) error {
+	if len(request.Shares) == 0 {
+		return errors.New("shares are needed for a " + request.Strategy.String() + " split")
+	}
+
+	allowed := make(map[primitive.ObjectID]bool)
+	for _, userID := range participants {
+		allowed[userID] = true
+	}
+
+	seen := make(map[primitive.ObjectID]bool)
+	for _, share := range request.Shares {
+		if !allowed[share.UserID] {
+			return errors.New("user " + share.UserID.Hex() + " is not a participant of the event")
+		}
+		if seen[share.UserID] {
+			return errors.New("user " + share.UserID.Hex() + " has more than one share")
+		}
+		seen[share.UserID] = true
+	}
+
+	return nil
+}
+
+// splitShares works out every participant's share of the orders under the strategy
+// Participants who owe nothing get no share
+func splitShares(request SplitRequest, participants []primitive.ObjectID, orders Orders, total Money) ([]SplitShare, error) {
+	var shares []SplitShare
+
+	switch request.Strategy {
+	case SplitEqual:
+		shares = divideEvenly(total, participants)
+
+	case SplitExclude:
+		if len(request.Exclude) == 0 {
+			return nil, errors.New("nobody to exclude")
+		}
+		excluded := make(map[primitive.ObjectID]bool)
+		for _, userID := range request.Exclude {
+			excluded[userID] = true
+		}
+		var included []primitive.ObjectID
+		for _, userID := range participants {
+			if !excluded[userID] {
+				included = append(included, userID)
+			}
+		}
+		if len(included) == 0 {
+			return nil, errors.New("everyone is excluded")
+		}
+		shares = divideEvenly(total, included)
+
+	case SplitByItems:
+		// everyone pays the unpaid portions of the orders they ordered or share,
+		// orders without a customer were entered by the host
+		byUser := make(map[primitive.ObjectID]int)
+		for _, order := range orders {
+			for _, portion := range order.Portions() {
+				if portion.Paid {
+					continue
+				}
+				customer := portion.UserID
+				if customer.IsZero() {
+					customer = participants[0]
+				}
+				i, ok := byUser[customer]
+				if !ok {
+					i = len(shares)
+					byUser[customer] = i
+					shares = append(shares, SplitShare{UserID: customer, Amount: ZeroMoney(total.Currency)})
+				}
+				shares[i].Amount = shares[i].Amount.Add(portion.Amount)
+				shares[i].OrderIDs = append(shares[i].OrderIDs, order.ID)
+			}
+		}
+
+	case SplitPercentage:
+		if err := requestedShares(request, participants); err != nil {
+			return nil, err
+		}
+		var percentages float64
+		for _, share := range request.Shares {
+			percentages += share.Percentage
+		}
+		if math.Abs(percentages-100) > 1e-6 {
+			return nil, fmt.Errorf("percentages add up to %g, not 100", percentages)
+		}
+
+		// percentages are weighed to four decimal places, the rounding
+		// difference goes to the largest remainders
+		weights := make([]int64, 0, len(request.Shares))
+		for _, share := range request.Shares {
+			weights = append(weights, int64(math.Round(share.Percentage*1e4)))
+		}
+		for i, amount := range total.Allocate(weights...) {
+			shares = append(shares, SplitShare{UserID: request.Shares[i].UserID, Amount: amount, Percentage: request.Shares[i].Percentage})
+		}
+
+	case SplitCustom:
+		if err := requestedShares(request, participants); err != nil {
+			return nil, err
+		}
+		allocated := ZeroMoney(total.Currency)
+		for _, share := range request.Shares {
+			amount := MoneyFromMajor(share.Amount, total.Currency)
+			shares = append(shares, SplitShare{UserID: share.UserID, Amount: amount})
+			allocated = allocated.Add(amount)
+		}
+		if allocated.Cmp(total) != 0 {
+			return nil, fmt.Errorf("custom amounts add up to %s, the bill is %s", allocated, total)
+		}
+
+	default:
+		return nil, errors.New("unknown split strategy: " + request.Strategy.String())
+	}
+
+	owing := make([]SplitShare, 0, len(shares))
+	for _, share := range shares {
+		if share.Amount.IsPositive() {
+			owing = append(owing, share)
+		}
+	}
+
+	return owing, nil
+}
+
+// PreviewSplit works out the shares of the event's unpaid orders under the strategy asked for
+// and stores them as a draft the host can confirm
+func PreviewSplit(ctx context.Context, host UserResponse, request SplitRequest) (EventSplit, error) {
+	funcName := ut.GetFunctionName()
+
+	var split EventSplit
+
+	event, err := GetEvent(ctx, bson.M{"_id": request.EventID})
+	if err != nil {
+		return split, errors.New("event not found")
+	}
+	if event.HostID != host.ID {
+		return split, errors.New("only the host can split the bill")
+	}
+	if event.EventStatus != Ongoing {
+		return split, errors.New("event is not ongoing")
+	}
+	if !event.SplitID.IsZero() {
+		return split, errors.New("the bill of the event is already being split")
+	}
+
+	orders, total, err := unpaidEventOrders(ctx, event)
+	if err != nil {
+		SetDebug("error getting orders: "+err.Error(), funcName)
+		return split, err
+	}
+	if !total.IsPositive() {
+		return split, errors.New("there are no orders to pay for")
+	}
+
+	shares, err := splitShares(request, EventParticipants(event), orders, total)
+	if err != nil {
+		return split, err
+	}
+
+	createdAt, updatedAt := CreatedAtUpdatedAt()
+	split = EventSplit{
+		ID:        primitive.NewObjectID(),
+		EventID:   event.ID,
+		CreatedBy: host.ID,
+		Strategy:  request.Strategy,
+		Total:     total,
+		OrderIDs:  orderIDs(orders),
+		Shares:    shares,
+		Status:    SplitDraft,
+		CreatedAt: createdAt,
+		UpdatedAt: updatedAt,
+	}
+
+	if _, err = splitCollection.InsertOne(ctx, split); err != nil {
+		SetDebug("error inserting split: "+err.Error(), funcName)
+		return split, err
+	}
+
+	return split, nil
+}
+
+// GetSplit returns the split if the user created it or has a share in it
+func GetSplit(ctx context.Context, id, userID primitive.ObjectID) (EventSplit, error) {
+	var split EventSplit
+
+	filter := bson.M{"_id": id, "$or": bson.A{bson.M{"created_by": userID}, bson.M{"shares.user_id": userID}}}
+	err := splitCollection.FindOne(ctx, filter).Decode(&split)
+	return split, err
+}
+
+// GetSplits returns the splits of the event the user created or has a share in, newest first
+func GetSplits(ctx context.Context, eventID, userID primitive.ObjectID) ([]EventSplit, error) {
+	splits := []EventSplit{}
+
+	filter := bson.M{"event_id": eventID, "$or": bson.A{bson.M{"created_by": userID}, bson.M{"shares.user_id": userID}}}
+	cursor, err := splitCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": -1}))
+	if err != nil {
+		return splits, err
+	}
+
+	err = cursor.All(ctx, &splits)
+	return splits, err
+}
+
+// ConfirmSplit makes a draft the split of the event so the participants can pay their shares
+// It fails if the unpaid orders changed since the preview
+func ConfirmSplit(ctx context.Context, host UserResponse, id primitive.ObjectID) (EventSplit, error) {
+	funcName := ut.GetFunctionName()
+
+	var split EventSplit
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		err := splitCollection.FindOne(sessCtx, bson.M{"_id": id, "created_by": host.ID}).Decode(&split)
+		if err != nil {
+			return err
+		}
+		if split.Status != SplitDraft {
+			return errors.New("split is " + split.Status.String())
+		}
+
+		event, err := GetEvent(sessCtx, bson.M{"_id": split.EventID})
+		if err != nil {
+			return err
+		}
+		if event.EventStatus != Ongoing {
+			return errors.New("event is not ongoing")
+		}
+
+		orders, total, err := unpaidEventOrders(sessCtx, event)
+		if err != nil {
+			return err
+		}
+		previewed := make(map[primitive.ObjectID]bool)
+		for _, orderID := range split.OrderIDs {
+			previewed[orderID] = true
+		}
+		changed := len(orders) != len(split.OrderIDs) || total.Cmp(split.Total) != 0
+		for _, order := range orders {
+			changed = changed || !previewed[order.ID]
+		}
+		if changed {
+			return errors.New("the bill has changed since the preview, preview the split again")
+		}
+
+		// The event holds the confirmed split, the filter stops two splits being confirmed
+		result, err := eventCollection.UpdateOne(sessCtx,
+			bson.M{"_id": event.ID, "split_id": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"split_id": split.ID}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount != 1 {
+			return errors.New("the bill of the event is already being split")
+		}
+
+		now := primitive.NewDateTimeFromTime(time.Now())
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		return splitCollection.FindOneAndUpdate(sessCtx,
+			bson.M{"_id": split.ID, "status": SplitDraft},
+			bson.M{"$set": bson.M{"status": SplitConfirmed, "confirmed_at": now, "updated_at": now}},
+			opts,
+		).Decode(&split)
+	})
+	if err != nil {
+		SetDebug("error confirming split: "+err.Error(), funcName)
+		return split, err
+	}
+
+	return split, nil
+}
+
+// CancelSplit drops a split nobody has paid into, the bill can then be paid or split another way
+func CancelSplit(ctx context.Context, host UserResponse, id primitive.ObjectID) (EventSplit, error) {
+	var split EventSplit
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := splitCollection.FindOneAndUpdate(sessCtx,
+			bson.M{
+				"_id":         id,
+				"created_by":  host.ID,
+				"status":      bson.M{"$in": bson.A{SplitDraft, SplitConfirmed}},
+				"shares.paid": bson.M{"$ne": true},
+			},
+			bson.M{"$set": bson.M{"status": SplitCancelled, "updated_at": primitive.NewDateTimeFromTime(time.Now())}},
+			opts,
+		).Decode(&split)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errors.New("no split that can be cancelled found")
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = eventCollection.UpdateOne(sessCtx,
+			bson.M{"_id": split.EventID, "split_id": split.ID},
+			bson.M{"$unset": bson.M{"split_id": ""}},
+		)
+		return err
+	})
+
+	return split, err
+}
+
+// PaySplitShare pays the user's share of a confirmed split to the venue, with a tip if given
+// The share is marked paid in the same transaction as the money moves, so it is
+// never paid twice or paid without being recorded
+// Once every share is paid the split is settled, the orders are paid, the event
+// is finished and the budgets still locked for it are returned
+// It returns the split, the payment and the budgets released
+func PaySplitShare(ctx context.Context, user UserResponse, id primitive.ObjectID, tipRequest TipRequest) (EventSplit, Transactions, []Budget, error) {
+	funcName := ut.GetFunctionName()
+
+	var split EventSplit
+	var txn Transactions
+
+	err := splitCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&split)
+	if err != nil {
+		return split, txn, nil, err
+	}
+	if split.Status != SplitConfirmed {
+		return split, txn, nil, errors.New("split is " + split.Status.String())
+	}
+
+	share, ok := split.Share(user.ID)
+	if !ok {
+		return split, txn, nil, errors.New("you have no share in this split")
+	}
+	if share.Paid {
+		return split, txn, nil, errors.New("your share is already paid")
+	}
+
+	event, err := GetEvent(ctx, bson.M{"_id": split.EventID})
+	if err != nil {
+		SetDebug("error getting event: "+err.Error(), funcName)
+		return split, txn, nil, err
+	}
+
+	restaurant, err := GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
+	if err != nil {
+		SetDebug("error getting restaurant: "+err.Error(), funcName)
+		return split, txn, nil, err
+	}
+
+	tip, err := tipRequest.Tip(share.Amount)
+	if err != nil {
+		return split, txn, nil, err
+	}
+
+	if err := CheckLimit(ctx, user, OpBillPayment, share.Amount.Add(tip)); err != nil {
+		return split, txn, nil, err
+	}
+
+	if !VerifyEventPaymentBalance(ctx, user, event.ID, share.Amount.Add(tip)) {
+		return split, txn, nil, errors.New("insufficient balance")
+	}
+
+	var released []Budget
+	err = RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		txn, released = Transactions{}, nil
+
+		var err error
+		txn, err = startDebitTransaction(sessCtx, Transactions{
+			FromID:        user.ID,
+			ToID:          restaurant.OwnerID,
+			Amount:        share.Amount.Add(tip),
+			EventID:       event.ID,
+			OrderIDs:      share.OrderIDs,
+			RestaurantID:  restaurant.ID,
+			Fee:           PlatformFee(share.Amount, restaurant.FeePercentage),
+			FeePercentage: restaurant.FeePercentage,
+			Tip:           tip,
+		})
+		if err != nil {
+			SetDebug("error starting debit transaction: "+err.Error(), funcName)
+			return err
+		}
+
+		// the filter fails if another payment got there first, which undoes this one
+		now := primitive.NewDateTimeFromTime(time.Now())
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err = splitCollection.FindOneAndUpdate(sessCtx,
+			bson.M{"_id": split.ID, "status": SplitConfirmed, "shares": bson.M{"$elemMatch": bson.M{
+				"user_id": user.ID,
+				"paid":    false,
+			}}},
+			bson.M{"$set": bson.M{
+				"shares.$.paid":           true,
+				"shares.$.transaction_id": txn.ID,
+				"shares.$.paid_at":        now,
+				"updated_at":              now,
+			}},
+			opts,
+		).Decode(&split)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return errors.New("your share is already paid")
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = eventCollection.UpdateOne(sessCtx, bson.M{"_id": event.ID}, bson.M{"$inc": moneyInc("bill", billPaid(txn).Neg())})
+		if err != nil {
+			return err
+		}
+
+		if split.Remaining().IsPositive() {
+			return nil
+		}
+
+		// Everyone has paid
+		err = splitCollection.FindOneAndUpdate(sessCtx,
+			bson.M{"_id": split.ID, "status": SplitConfirmed},
+			bson.M{"$set": bson.M{"status": SplitSettled, "settled_at": now, "updated_at": now}},
+			opts,
+		).Decode(&split)
+		if err != nil {
+			return err
+		}
+
+		_, err = UpdateManyOrders(sessCtx, bson.M{"_id": bson.M{"$in": split.OrderIDs}}, bson.M{"$set": bson.M{"paid": true}})
+		if err != nil {
+			return err
+		}
+
+		_, err = eventCollection.UpdateOne(sessCtx, bson.M{"_id": event.ID}, bson.M{"$set": bson.M{
+			"event_status": Finished,
+			"updated_at":   now,
+		}})
+		if err != nil {
+			return err
+		}
+
+		// Nobody else pays for a finished event
+		released, err = ReleaseEventBudgets(sessCtx, event.ID)
+		return err
+	})
+	if err != nil {
+		SetDebug("error paying split share: "+err.Error(), funcName)
+		return split, recordFailedPayment(ctx, txn), nil, err
+	}
+
+	return split, txn, released, nil
+}
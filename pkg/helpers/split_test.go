@@ -0,0 +1,223 @@
+package helpers
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// shareAmounts returns the amount of every share in minor units
+func shareAmounts(shares []SplitShare) []int64 {
+	amounts := make([]int64, 0, len(shares))
+	for _, share := range shares {
+		amounts = append(amounts, share.Amount.Amount)
+	}
+	return amounts
+}
+
+func equalAmounts(got, want []int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDivideEvenly(t *testing.T) {
+	users := func(n int) []primitive.ObjectID {
+		ids := make([]primitive.ObjectID, n)
+		for i := range ids {
+			ids[i] = primitive.NewObjectID()
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name  string
+		total int64
+		users int
+		want  []int64
+	}{
+		{"divides exactly", 1000, 4, []int64{250, 250, 250, 250}},
+		{"remainder of one", 1000, 3, []int64{334, 333, 333}},
+		{"remainder of two", 1001, 3, []int64{334, 334, 333}},
+		{"less than one unit each", 2, 3, []int64{1, 1, 0}},
+		{"one user", 999, 1, []int64{999}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := users(tt.users)
+			shares := divideEvenly(NewMoney(tt.total, "NGN"), ids)
+
+			if got := shareAmounts(shares); !equalAmounts(got, tt.want) {
+				t.Errorf("divideEvenly(%d, %d users) = %v, want %v", tt.total, tt.users, got, tt.want)
+			}
+			for i, share := range shares {
+				if share.UserID != ids[i] || share.Amount.Currency != "NGN" {
+					t.Errorf("share %d is %+v", i, share)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitShares(t *testing.T) {
+	host, ada, bola, chidi := primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()
+	participants := []primitive.ObjectID{host, ada, bola, chidi}
+	ngn := func(amount int64) Money { return NewMoney(amount, "NGN") }
+
+	orders := Orders{
+		{ID: primitive.NewObjectID(), CustomerID: ada, Bill: ngn(600)},
+		{ID: primitive.NewObjectID(), CustomerID: bola, Bill: ngn(400), Shares: []OrderPortion{
+			{UserID: bola, Amount: ngn(300)},
+			{UserID: chidi, Amount: ngn(100), Paid: true},
+		}},
+		// entered by the host
+		{ID: primitive.NewObjectID(), Bill: ngn(200)},
+	}
+
+	tests := []struct {
+		name    string
+		request SplitRequest
+		total   int64
+		users   []primitive.ObjectID
+		want    []int64
+		wantErr bool
+	}{
+		{
+			name:    "equal with a remainder",
+			request: SplitRequest{Strategy: SplitEqual},
+			total:   1000,
+			users:   participants,
+			want:    []int64{250, 250, 250, 250},
+		},
+		{
+			name:    "equal leaves out who owes nothing",
+			request: SplitRequest{Strategy: SplitEqual},
+			total:   2,
+			users:   []primitive.ObjectID{host, ada},
+			want:    []int64{1, 1},
+		},
+		{
+			name:    "exclude",
+			request: SplitRequest{Strategy: SplitExclude, Exclude: []primitive.ObjectID{chidi}},
+			total:   1000,
+			users:   []primitive.ObjectID{host, ada, bola},
+			want:    []int64{334, 333, 333},
+		},
+		{
+			name:    "exclude nobody",
+			request: SplitRequest{Strategy: SplitExclude},
+			total:   1000,
+			wantErr: true,
+		},
+		{
+			name:    "exclude everyone",
+			request: SplitRequest{Strategy: SplitExclude, Exclude: participants},
+			total:   1000,
+			wantErr: true,
+		},
+		{
+			name:    "items charges unpaid portions and the host for orders without a customer",
+			request: SplitRequest{Strategy: SplitByItems},
+			total:   1100,
+			users:   []primitive.ObjectID{ada, bola, host},
+			want:    []int64{600, 300, 200},
+		},
+		{
+			name: "percentages that do not divide evenly",
+			request: SplitRequest{Strategy: SplitPercentage, Shares: []SplitShareRequest{
+				{UserID: host, Percentage: 33.33},
+				{UserID: ada, Percentage: 33.33},
+				{UserID: bola, Percentage: 33.34},
+			}},
+			total: 1000,
+			users: []primitive.ObjectID{host, ada, bola},
+			want:  []int64{333, 333, 334},
+		},
+		{
+			name: "rounding goes to the largest remainders",
+			request: SplitRequest{Strategy: SplitPercentage, Shares: []SplitShareRequest{
+				{UserID: host, Percentage: 12.5},
+				{UserID: ada, Percentage: 12.5},
+				{UserID: bola, Percentage: 75},
+			}},
+			total: 999,
+			users: []primitive.ObjectID{host, ada, bola},
+			want:  []int64{125, 125, 749},
+		},
+		{
+			name: "percentages not adding up to 100",
+			request: SplitRequest{Strategy: SplitPercentage, Shares: []SplitShareRequest{
+				{UserID: host, Percentage: 50},
+				{UserID: ada, Percentage: 40},
+			}},
+			total:   1000,
+			wantErr: true,
+		},
+		{
+			name: "percentage for someone outside the event",
+			request: SplitRequest{Strategy: SplitPercentage, Shares: []SplitShareRequest{
+				{UserID: primitive.NewObjectID(), Percentage: 100},
+			}},
+			total:   1000,
+			wantErr: true,
+		},
+		{
+			name: "custom amounts",
+			request: SplitRequest{Strategy: SplitCustom, Shares: []SplitShareRequest{
+				{UserID: ada, Amount: 4.5},
+				{UserID: bola, Amount: 5.5},
+				{UserID: chidi, Amount: 0},
+			}},
+			total: 1000,
+			users: []primitive.ObjectID{ada, bola},
+			want:  []int64{450, 550},
+		},
+		{
+			name: "custom amounts not adding up to the bill",
+			request: SplitRequest{Strategy: SplitCustom, Shares: []SplitShareRequest{
+				{UserID: ada, Amount: 4.5},
+			}},
+			total:   1000,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shares, err := splitShares(tt.request, participants, orders, ngn(tt.total))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("splitShares() = %v, want an error", shareAmounts(shares))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("splitShares() error = %v", err)
+			}
+
+			if got := shareAmounts(shares); !equalAmounts(got, tt.want) {
+				t.Errorf("splitShares() = %v, want %v", got, tt.want)
+			}
+			for i, share := range shares {
+				if share.UserID != tt.users[i] {
+					t.Errorf("share %d is for %s, want %s", i, share.UserID.Hex(), tt.users[i].Hex())
+				}
+			}
+
+			var sum int64
+			for _, amount := range shareAmounts(shares) {
+				sum += amount
+			}
+			if sum != tt.total {
+				t.Errorf("shares add up to %d, want %d", sum, tt.total)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	"github.com/Rhaqim/thedutchapp/pkg/email"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var statementCollection = config.StatementCollection
+
+// StatementMonthFormat is how statement months are written, 2006-01
+const StatementMonthFormat = "2006-01"
+
+// MaxStatementAttempts is how many times sending a statement is tried before it is given up
+const MaxStatementAttempts = 3
+
+// StatementLine is a movement of money in or out of the wallet
+// Budget locks and releases show up as money leaving and coming back to the wallet
+type StatementLine struct {
+	Date         string `json:"date"`
+	Reference    string `json:"reference"`
+	Description  string `json:"description"`
+	Counterparty string `json:"counterparty,omitempty"`
+	In           Money  `json:"in,omitempty"`
+	Out          Money  `json:"out,omitempty"`
+	Balance      Money  `json:"balance"`
+}
+
+// StatementSection is the statement for one currency of the wallet
+type StatementSection struct {
+	Currency string          `json:"currency"`
+	Opening  Money           `json:"opening_balance"`
+	TotalIn  Money           `json:"total_in"`
+	TotalOut Money           `json:"total_out"`
+	Closing  Money           `json:"closing_balance"`
+	Lines    []StatementLine `json:"lines"`
+}
+
+// Statement is a month of a user's wallet taken from the ledger
+type Statement struct {
+	Month       string             `json:"month"`
+	From        string             `json:"from"`
+	To          string             `json:"to"`
+	Name        string             `json:"name"`
+	Email       string             `json:"email"`
+	Sections    []StatementSection `json:"sections"`
+	GeneratedAt string             `json:"generated_at"`
+}
+
+// Empty reports whether nothing happened in the month and the wallet held nothing
+func (s Statement) Empty() bool {
+	for _, section := range s.Sections {
+		if len(section.Lines) > 0 || !section.Opening.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// StatementRecord is a monthly statement that was emailed, or that failed to send
+type StatementRecord struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id"`
+	UserID    primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Month     string             `json:"month" bson:"month"`
+	Sent      bool               `json:"sent" bson:"sent"`
+	Attempts  int                `json:"attempts" bson:"attempts"`
+	Error     string             `json:"error,omitempty" bson:"error,omitempty"`
+	UpdatedAt primitive.DateTime `json:"updated_at" bson:"updated_at"`
+}
+
+// StatementPeriod returns the start of the month and the start of the next one in UTC
+func StatementPeriod(month string) (time.Time, time.Time, error) {
+	from, err := time.Parse(StatementMonthFormat, month)
+	if err != nil {
+		return from, from, fmt.Errorf("invalid month %q, use %s", month, StatementMonthFormat)
+	}
+
+	return from, from.AddDate(0, 1, 0), nil
+}
+
+// PreviousStatementMonth returns the last full month before now
+func PreviousStatementMonth(now time.Time) string {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0).Format(StatementMonthFormat)
+}
+
+// ledgerBalanceBefore sums the entries posted to the account in the currency before the time
+func ledgerBalanceBefore(ctx context.Context, accountType LedgerAccountType, accountID primitive.ObjectID, currency string, before time.Time) (Money, error) {
+	balance := ZeroMoney(currency)
+
+	cursor, err := ledgerCollection.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{
+			"account_type":    accountType,
+			"account_id":      accountID,
+			"amount.currency": currency,
+			"created_at":      bson.M{"$lt": primitive.NewDateTimeFromTime(before)},
+		}},
+		bson.M{"$group": bson.M{"_id": "$direction", "total": bson.M{"$sum": "$amount.amount"}}},
+	})
+	if err != nil {
+		return balance, err
+	}
+
+	var totals []struct {
+		Direction EntryDirection `bson:"_id"`
+		Total     int64          `bson:"total"`
+	}
+	if err = cursor.All(ctx, &totals); err != nil {
+		return balance, err
+	}
+
+	for _, t := range totals {
+		if t.Direction == EntryCredit {
+			balance.Amount += t.Total
+		} else {
+			balance.Amount -= t.Total
+		}
+	}
+
+	return balance, nil
+}
+
+// statementCounterparties returns the name of the other party of every transaction
+// the entries were posted for
+func statementCounterparties(ctx context.Context, entries []LedgerEntry, user UserResponse) (map[primitive.ObjectID]string, error) {
+	names := make(map[primitive.ObjectID]string)
+
+	var ids []primitive.ObjectID
+	for _, entry := range entries {
+		if !entry.TransactionID.IsZero() {
+			ids = append(ids, entry.TransactionID)
+		}
+	}
+	if len(ids) == 0 {
+		return names, nil
+	}
+
+	var txns []Transactions
+	cursor, err := transactionCollection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return names, err
+	}
+	if err = cursor.All(ctx, &txns); err != nil {
+		return names, err
+	}
+
+	users := map[primitive.ObjectID]string{user.ID: displayName(user)}
+	for _, txn := range txns {
+		other := txn.ToID
+		if other == user.ID {
+			other = txn.FromID
+		}
+		// funding and withdrawals have no other user
+		if other == user.ID {
+			continue
+		}
+
+		if _, ok := users[other]; !ok {
+			users[other] = displayName(GetUserByID(ctx, other))
+		}
+		names[txn.ID] = users[other]
+	}
+
+	return names, nil
+}
+
+// BuildStatement builds the user's wallet statement for the month from the ledger
+// Every currency the wallet held or moved before the end of the month gets a section
+func BuildStatement(ctx context.Context, user UserResponse, month string) (Statement, error) {
+	funcName := ut.GetFunctionName()
+
+	from, to, err := StatementPeriod(month)
+	if err != nil {
+		return Statement{}, err
+	}
+
+	statement := Statement{
+		Month:       month,
+		From:        from.Format("02 Jan 2006"),
+		To:          to.AddDate(0, 0, -1).Format("02 Jan 2006"),
+		Name:        displayName(user),
+		Email:       user.Email,
+		Sections:    []StatementSection{},
+		GeneratedAt: time.Now().UTC().Format(time.RFC1123),
+	}
+
+	walletFilter := bson.M{"account_type": WalletAccount, "account_id": user.ID}
+
+	currencies, err := ledgerCollection.Distinct(ctx, "amount.currency", bson.M{
+		"account_type": WalletAccount,
+		"account_id":   user.ID,
+		"created_at":   bson.M{"$lt": primitive.NewDateTimeFromTime(to)},
+	})
+	if err != nil {
+		SetDebug("error getting statement currencies: "+err.Error(), funcName)
+		return statement, err
+	}
+
+	var codes []string
+	for _, currency := range currencies {
+		if code, ok := currency.(string); ok && code != "" {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+
+	walletFilter["created_at"] = bson.M{
+		"$gte": primitive.NewDateTimeFromTime(from),
+		"$lt":  primitive.NewDateTimeFromTime(to),
+	}
+
+	var entries []LedgerEntry
+	cursor, err := ledgerCollection.Find(ctx, walletFilter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		SetDebug("error getting statement entries: "+err.Error(), funcName)
+		return statement, err
+	}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return statement, err
+	}
+
+	counterparties, err := statementCounterparties(ctx, entries, user)
+	if err != nil {
+		SetDebug("error getting statement counterparties: "+err.Error(), funcName)
+		return statement, err
+	}
+
+	for _, currency := range codes {
+		opening, err := ledgerBalanceBefore(ctx, WalletAccount, user.ID, currency, from)
+		if err != nil {
+			SetDebug("error getting opening balance: "+err.Error(), funcName)
+			return statement, err
+		}
+
+		section := StatementSection{
+			Currency: currency,
+			Opening:  opening,
+			TotalIn:  ZeroMoney(currency),
+			TotalOut: ZeroMoney(currency),
+			Closing:  opening,
+			Lines:    []StatementLine{},
+		}
+
+		for _, entry := range entries {
+			if entry.Amount.Currency != currency {
+				continue
+			}
+
+			line := StatementLine{
+				Date:         entry.CreatedAt.Time().UTC().Format("02 Jan 2006 15:04"),
+				Reference:    entry.Reference,
+				Description:  entry.Description,
+				Counterparty: counterparties[entry.TransactionID],
+			}
+			if entry.Direction == EntryCredit {
+				line.In = entry.Amount
+				section.TotalIn = section.TotalIn.Add(entry.Amount)
+				section.Closing = section.Closing.Add(entry.Amount)
+			} else {
+				line.Out = entry.Amount
+				section.TotalOut = section.TotalOut.Add(entry.Amount)
+				section.Closing = section.Closing.Sub(entry.Amount)
+			}
+			line.Balance = section.Closing
+
+			section.Lines = append(section.Lines, line)
+		}
+
+		statement.Sections = append(statement.Sections, section)
+	}
+
+	return statement, nil
+}
+
+// RenderStatement renders the statement as HTML and as plain text
+func RenderStatement(statement Statement) (string, string, error) {
+	r := email.NewRequest(nil, "Statement "+statement.Month, "")
+
+	if err := r.ParseTemplate("statement.html", statement); err != nil {
+		return "", "", err
+	}
+	html := r.Body()
+
+	if err := r.ParseTextTemplate("statement.txt", statement); err != nil {
+		return "", "", err
+	}
+
+	return html, r.Body(), nil
+}
+
+// SendStatement emails the statement as HTML with the plain text version attached
+func SendStatement(statement Statement) error {
+	if statement.Email == "" {
+		return errors.New("user has no email address")
+	}
+
+	html, text, err := RenderStatement(statement)
+	if err != nil {
+		return err
+	}
+
+	r := email.NewRequest([]string{statement.Email}, "Your wallet statement for "+statement.Month, html)
+	r.Attach("statement-"+statement.Month+".txt", "text/plain; charset=\"UTF-8\"", []byte(text))
+
+	_, err = r.SendEmail()
+	return err
+}
+
+// SendMonthlyStatements emails every user their wallet statement for the last full month
+// Statements already sent are skipped and failed ones are tried again up to
+// MaxStatementAttempts times, so it can run as often as needed
+// Users with an empty statement are not emailed
+// It returns the number of statements sent
+func SendMonthlyStatements(ctx context.Context, now time.Time) (int, error) {
+	funcName := ut.GetFunctionName()
+
+	month := PreviousStatementMonth(now)
+
+	var sent int
+
+	cursor, err := walletCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return sent, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var wallet Wallet
+		if err = cursor.Decode(&wallet); err != nil {
+			return sent, err
+		}
+
+		var record StatementRecord
+		err = statementCollection.FindOne(ctx, bson.M{"user_id": wallet.UserID, "month": month}).Decode(&record)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return sent, err
+		}
+		if record.Sent || record.Attempts >= MaxStatementAttempts {
+			continue
+		}
+
+		user := GetUserByID(ctx, wallet.UserID)
+		if user.ID.IsZero() {
+			continue
+		}
+
+		statement, err := BuildStatement(ctx, user, month)
+		if err != nil {
+			return sent, err
+		}
+		if statement.Empty() {
+			continue
+		}
+
+		sendErr := SendStatement(statement)
+
+		update := bson.M{
+			"$set": bson.M{
+				"sent":       sendErr == nil,
+				"updated_at": primitive.NewDateTimeFromTime(time.Now()),
+			},
+			"$inc":         bson.M{"attempts": 1},
+			"$setOnInsert": bson.M{"_id": primitive.NewObjectID()},
+		}
+		if sendErr != nil {
+			SetDebug("error sending statement to "+user.ID.Hex()+": "+sendErr.Error(), funcName)
+			update["$set"].(bson.M)["error"] = sendErr.Error()
+		} else {
+			update["$unset"] = bson.M{"error": ""}
+			sent++
+		}
+
+		_, err = statementCollection.UpdateOne(ctx,
+			bson.M{"user_id": wallet.UserID, "month": month},
+			update,
+			options.Update().SetUpsert(true),
+		)
+		if err != nil {
+			return sent, err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return sent, err
+	}
+
+	SetInfo(fmt.Sprintf("sent %d statements for %s", sent, month), funcName)
+
+	return sent, nil
+}
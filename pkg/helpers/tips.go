@@ -0,0 +1,171 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxTipSuggestions is how many tip percentages a restaurant can suggest
+const MaxTipSuggestions = 5
+
+// TipRequest is the optional tip on a bill payment
+// It is either a fixed amount in the currency of the bill or a percentage of the bill
+type TipRequest struct {
+	TipAmount     float64 `json:"tip_amount" form:"tip_amount" bson:"tip_amount" binding:"gte=0"`
+	TipPercentage float64 `json:"tip_percentage" form:"tip_percentage" bson:"tip_percentage" binding:"gte=0,lte=100"`
+}
+
+// Tip returns the tip on the bill, zero if no tip was given
+func (tr TipRequest) Tip(bill Money) (Money, error) {
+	switch {
+	case tr.TipAmount > 0 && tr.TipPercentage > 0:
+		return Money{}, errors.New("give a tip amount or a tip percentage, not both")
+	case tr.TipAmount > 0:
+		return MoneyFromMajor(tr.TipAmount, bill.Currency), nil
+	case tr.TipPercentage > 0:
+		tip := math.Round(float64(bill.Amount) * tr.TipPercentage / 100)
+		return NewMoney(int64(tip), bill.Currency), nil
+	default:
+		return ZeroMoney(bill.Currency), nil
+	}
+}
+
+// BillAmount is the part of the transaction that paid the bill, without the tip
+func (txn Transactions) BillAmount() Money {
+	return txn.Amount.Sub(txn.Tip)
+}
+
+type TipSuggestionsRequest struct {
+	RestaurantID primitive.ObjectID `json:"restaurant_id" binding:"required"`
+	Suggestions  []float64          `json:"suggestions" binding:"max=5,dive,gt=0,lte=100"`
+}
+
+// TipTotal is the tips a restaurant received in one currency and period
+// Period is empty when the totals are not split by day or month
+type TipTotal struct {
+	Period   string `json:"period,omitempty"`
+	Payments int    `json:"payments"`
+	Tips     Money  `json:"tips"`
+}
+
+// TipTotalsRequest filters the tip totals of a restaurant
+// From and To are dates or RFC 3339 times, Interval splits the totals by day or month
+type TipTotalsRequest struct {
+	RestaurantID string `form:"id" binding:"required"`
+	From         string `form:"from"`
+	To           string `form:"to"`
+	Interval     string `form:"interval" binding:"omitempty,oneof=day month"`
+}
+
+// SetTipSuggestions replaces the tip percentages the restaurant suggests to its customers
+// The suggestions are stored lowest first without duplicates, an empty list removes them
+func SetTipSuggestions(ctx context.Context, owner UserResponse, request TipSuggestionsRequest) (Restaurant, error) {
+	funcName := ut.GetFunctionName()
+
+	var restaurant Restaurant
+
+	suggestions := []float64{}
+	seen := make(map[float64]bool)
+	for _, percentage := range request.Suggestions {
+		if !seen[percentage] {
+			seen[percentage] = true
+			suggestions = append(suggestions, percentage)
+		}
+	}
+	sort.Float64s(suggestions)
+
+	if len(suggestions) > MaxTipSuggestions {
+		return restaurant, errors.New("too many tip suggestions")
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := restaurantCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": request.RestaurantID, "owner_id": owner.ID},
+		bson.M{"$set": bson.M{
+			"tip_suggestions": suggestions,
+			"updated_at":      primitive.NewDateTimeFromTime(time.Now()),
+		}},
+		opts,
+	).Decode(&restaurant)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return restaurant, errors.New("restaurant not found")
+	}
+	if err != nil {
+		SetDebug("error setting tip suggestions: "+err.Error(), funcName)
+		return restaurant, err
+	}
+
+	return restaurant, nil
+}
+
+// GetTipTotals returns the tips paid to the restaurant with venue payments, by currency
+// Payments refunded in full are left out
+func GetTipTotals(ctx context.Context, restaurantID primitive.ObjectID, request TipTotalsRequest) ([]TipTotal, error) {
+	totals := []TipTotal{}
+
+	match := bson.M{
+		"restaurant_id": restaurantID,
+		"type":          Debit,
+		"status":        bson.M{"$in": bson.A{TxnSuccess, TxnPartiallyRefunded}},
+		"tip.amount":    bson.M{"$gt": 0},
+	}
+
+	createdAt, err := createdAtFilter(request.From, request.To)
+	if err != nil {
+		return totals, err
+	}
+	if len(createdAt) > 0 {
+		match["created_at"] = createdAt
+	}
+
+	group := bson.M{"currency": "$tip.currency"}
+	if format, ok := reportIntervals[request.Interval]; ok {
+		group["period"] = bson.M{"$dateToString": bson.M{"format": format, "date": "$created_at"}}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      group,
+			"payments": bson.M{"$sum": 1},
+			"tips":     bson.M{"$sum": "$tip.amount"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id.period", Value: 1}, {Key: "_id.currency", Value: 1}}}},
+	}
+
+	cursor, err := transactionCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return totals, err
+	}
+
+	var rows []struct {
+		ID struct {
+			Currency string `bson:"currency"`
+			Period   string `bson:"period"`
+		} `bson:"_id"`
+		Payments int   `bson:"payments"`
+		Tips     int64 `bson:"tips"`
+	}
+	if err = cursor.All(ctx, &rows); err != nil {
+		return totals, err
+	}
+
+	for _, row := range rows {
+		totals = append(totals, TipTotal{
+			Period:   row.ID.Period,
+			Payments: row.Payments,
+			Tips:     NewMoney(row.Tips, row.ID.Currency),
+		})
+	}
+
+	return totals, nil
+}
@@ -0,0 +1,277 @@
+package helpers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DefaultTransactionPageSize = 20
+	MaxTransactionPageSize     = 100
+)
+
+// TransactionFilter narrows down a user's transaction history
+// From and To are dates (2006-01-02) or times (RFC 3339), a date in To includes the whole day
+// Counterparty is the id or username of the other user
+type TransactionFilter struct {
+	Type         string `form:"type"`
+	Status       string `form:"status"`
+	From         string `form:"from"`
+	To           string `form:"to"`
+	Counterparty string `form:"counterparty"`
+	EventID      string `form:"event_id"`
+	Cursor       string `form:"cursor"`
+	Limit        int    `form:"limit" binding:"gte=0"`
+}
+
+// TransactionPage is a page of transactions, newest first
+// NextCursor is empty on the last page
+type TransactionPage struct {
+	Transactions []Transactions `json:"transactions"`
+	NextCursor   string         `json:"next_cursor,omitempty"`
+}
+
+var txnTypes = map[TxnType]bool{Debit: true, Credit: true, Refund: true, Withdrawal: true}
+
+var txnStatuses = map[TxnStatus]bool{
+	TxnStart: true, TxnSuccess: true, TxnPending: true, TxnFail: true,
+	TxnRefunded: true, TxnPartiallyRefunded: true, TxnReversed: true,
+}
+
+// parseFilterTime reads a date or an RFC 3339 time
+// endOfDay moves a date to the start of the next day so the whole day is included
+func parseFilterTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, use 2006-01-02 or RFC 3339", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// createdAtFilter returns the created_at filter for the period from and to, either may be empty
+func createdAtFilter(from, to string) (bson.M, error) {
+	createdAt := bson.M{}
+	if from != "" {
+		t, err := parseFilterTime(from, false)
+		if err != nil {
+			return nil, err
+		}
+		createdAt["$gte"] = primitive.NewDateTimeFromTime(t)
+	}
+	if to != "" {
+		t, err := parseFilterTime(to, true)
+		if err != nil {
+			return nil, err
+		}
+		createdAt["$lt"] = primitive.NewDateTimeFromTime(t)
+	}
+	return createdAt, nil
+}
+
+// encodeTransactionCursor returns the cursor for the page after the transaction
+func encodeTransactionCursor(txn Transactions) string {
+	raw := strconv.FormatInt(int64(txn.CreatedAt), 10) + ":" + txn.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeTransactionCursor returns the filter for the transactions after the cursor
+func decodeTransactionCursor(cursor string) (bson.M, error) {
+	invalid := errors.New("invalid cursor")
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalid
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+
+	millis, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+	id, err := primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		return nil, invalid
+	}
+
+	createdAt := primitive.DateTime(millis)
+
+	return bson.M{"$or": bson.A{
+		bson.M{"created_at": bson.M{"$lt": createdAt}},
+		bson.M{"created_at": createdAt, "_id": bson.M{"$lt": id}},
+	}}, nil
+}
+
+// TransactionHistoryFilter returns the query for the user's transactions matching the filter
+// The cursor is not part of it
+func TransactionHistoryFilter(ctx context.Context, user UserResponse, f TransactionFilter) (bson.M, error) {
+	clauses := bson.A{}
+
+	if f.Counterparty == "" {
+		clauses = append(clauses, bson.M{"$or": bson.A{
+			bson.M{"from_id": user.ID},
+			bson.M{"to_id": user.ID},
+		}})
+	} else {
+		counterparty, err := primitive.ObjectIDFromHex(f.Counterparty)
+		if err != nil {
+			other, err := GetUser(ctx, bson.M{"username": f.Counterparty})
+			if err != nil {
+				return nil, fmt.Errorf("unknown counterparty %q", f.Counterparty)
+			}
+			counterparty = other.ID
+		}
+
+		clauses = append(clauses, bson.M{"$or": bson.A{
+			bson.M{"from_id": user.ID, "to_id": counterparty},
+			bson.M{"from_id": counterparty, "to_id": user.ID},
+		}})
+	}
+
+	if f.Type != "" {
+		txnType := TxnType(strings.ToLower(f.Type))
+		if !txnTypes[txnType] {
+			return nil, fmt.Errorf("invalid type %q", f.Type)
+		}
+		clauses = append(clauses, bson.M{"type": txnType})
+	}
+
+	if f.Status != "" {
+		status := TxnStatus(strings.ToLower(f.Status))
+		if !txnStatuses[status] {
+			return nil, fmt.Errorf("invalid status %q", f.Status)
+		}
+		clauses = append(clauses, bson.M{"status": status})
+	}
+
+	createdAt, err := createdAtFilter(f.From, f.To)
+	if err != nil {
+		return nil, err
+	}
+	if len(createdAt) > 0 {
+		clauses = append(clauses, bson.M{"created_at": createdAt})
+	}
+
+	if f.EventID != "" {
+		eventID, err := primitive.ObjectIDFromHex(f.EventID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid event_id %q", f.EventID)
+		}
+		clauses = append(clauses, bson.M{"event_id": eventID})
+	}
+
+	return bson.M{"$and": clauses}, nil
+}
+
+// transactionHistorySort lists the newest transactions first, the id breaks ties
+var transactionHistorySort = bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+
+// GetTransactionPage returns a page of the user's transactions matching the filter
+func GetTransactionPage(ctx context.Context, user UserResponse, f TransactionFilter) (TransactionPage, error) {
+	page := TransactionPage{Transactions: []Transactions{}}
+
+	filter, err := TransactionHistoryFilter(ctx, user, f)
+	if err != nil {
+		return page, err
+	}
+
+	if f.Cursor != "" {
+		after, err := decodeTransactionCursor(f.Cursor)
+		if err != nil {
+			return page, err
+		}
+		filter["$and"] = append(filter["$and"].(bson.A), after)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultTransactionPageSize
+	}
+	if limit > MaxTransactionPageSize {
+		limit = MaxTransactionPageSize
+	}
+
+	// one more than the page tells whether there is a next page
+	opts := options.Find().SetSort(transactionHistorySort).SetLimit(int64(limit + 1))
+
+	cursor, err := transactionCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return page, err
+	}
+	if err = cursor.All(ctx, &page.Transactions); err != nil {
+		return page, err
+	}
+
+	if len(page.Transactions) > limit {
+		page.Transactions = page.Transactions[:limit]
+		page.NextCursor = encodeTransactionCursor(page.Transactions[limit-1])
+	}
+
+	return page, nil
+}
+
+// StreamTransactions returns a cursor over all of the user's transactions matching the filter
+// newest first, the caller must close it
+func StreamTransactions(ctx context.Context, user UserResponse, f TransactionFilter) (*mongo.Cursor, error) {
+	filter, err := TransactionHistoryFilter(ctx, user, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return transactionCollection.Find(ctx, filter, options.Find().SetSort(transactionHistorySort).SetBatchSize(500))
+}
+
+// TransactionCSVHeader is the first row of a transaction export
+var TransactionCSVHeader = []string{
+	"reference", "date", "type", "status", "direction", "counterparty_id",
+	"amount", "currency", "source_amount", "source_currency", "exchange_rate", "event_id",
+}
+
+// TransactionCSVRow is the transaction as a row of an export for the user
+// Amounts are in major units, direction is in for money the user received and out for money they sent
+func TransactionCSVRow(txn Transactions, user UserResponse) []string {
+	direction, counterparty := "out", txn.ToID
+	if txn.ToID == user.ID && txn.FromID != user.ID {
+		direction, counterparty = "in", txn.FromID
+	}
+
+	eventID := ""
+	if !txn.EventID.IsZero() {
+		eventID = txn.EventID.Hex()
+	}
+
+	return []string{
+		txn.TransactionUID,
+		txn.CreatedAt.Time().UTC().Format(time.RFC3339),
+		string(txn.Type),
+		string(txn.Status),
+		direction,
+		counterparty.Hex(),
+		txn.Amount.Format(),
+		txn.Amount.Currency,
+		txn.SourceAmount.Format(),
+		txn.SourceAmount.Currency,
+		strconv.FormatFloat(txn.ExchangeRate, 'f', -1, 64),
+		eventID,
+	}
+}
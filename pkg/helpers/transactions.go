@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"sync"
@@ -11,20 +12,39 @@ import (
 	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var transactionCollection = config.TransactionCollection
 
-// unique id for transactions
-var TransactionUID = "TC-" + ut.GenerateReferenceNumber()
+// referenceAlphabet leaves out characters that are easy to misread
+// Its length divides 256 so every character is equally likely
+const referenceAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// NewTransactionUID returns a new reference for a transaction
+func NewTransactionUID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "TC-" + ut.GenerateReferenceNumber()
+	}
+
+	for i := range b {
+		b[i] = referenceAlphabet[int(b[i])%len(referenceAlphabet)]
+	}
+
+	return "TC-" + string(b)
+}
 
 type TxnType string
 
 type TxnStatus string
 
 const (
-	Debit  TxnType = "debit"
-	Credit TxnType = "credit"
+	Debit      TxnType = "debit"
+	Credit     TxnType = "credit"
+	Refund     TxnType = "refund"
+	Withdrawal TxnType = "withdrawal"
 )
 
 const (
@@ -32,18 +52,39 @@ const (
 	TxnSuccess TxnStatus = "success"
 	TxnPending TxnStatus = "pending"
 	TxnFail    TxnStatus = "fail"
+
+	// a successful payment that has been refunded in full or in part
+	TxnRefunded          TxnStatus = "refunded"
+	TxnPartiallyRefunded TxnStatus = "partially_refunded"
+
+	// a withdrawal the bank did not pay out, the money is back in the wallet
+	TxnReversed TxnStatus = "reversed"
 )
 
 type Transactions struct {
-	ID             primitive.ObjectID `json:"id,omitempty" bson:"_id"`
-	TransactionUID string             `json:"transaction_uid,omitempty" bson:"transaction_uid"`
-	FromID         primitive.ObjectID `json:"from_id" binding:"required" bson:"from_id"`
-	ToID           primitive.ObjectID `json:"to_id" binding:"required" bson:"to_id"`
-	Amount         float64            `json:"amount" bson:"amount"`
-	Type           TxnType            `json:"type" bson:"type"`
-	Status         TxnStatus          `json:"status" bson:"status"`
-	CreatedAt      primitive.DateTime `bson:"created_at" json:"created_at" default:"Now()"`
-	UpdatedAt      primitive.DateTime `bson:"updated_at" json:"updated_at" default:"Now()"`
+	ID             primitive.ObjectID   `json:"id,omitempty" bson:"_id"`
+	TransactionUID string               `json:"transaction_uid,omitempty" bson:"transaction_uid"`
+	FromID         primitive.ObjectID   `json:"from_id" binding:"required" bson:"from_id"`
+	ToID           primitive.ObjectID   `json:"to_id" binding:"required" bson:"to_id"`
+	Amount         Money                `json:"amount" bson:"amount"`
+	SourceAmount   Money                `json:"source_amount" bson:"source_amount"`
+	ExchangeRate   float64              `json:"exchange_rate" bson:"exchange_rate"`
+	BudgetAmount   Money                `json:"budget_amount,omitempty" bson:"budget_amount,omitempty"`
+	EventID        primitive.ObjectID   `json:"event_id,omitempty" bson:"event_id,omitempty"`
+	OrderIDs       []primitive.ObjectID `json:"order_ids,omitempty" bson:"order_ids,omitempty"`
+	RestaurantID   primitive.ObjectID   `json:"restaurant_id,omitempty" bson:"restaurant_id,omitempty"`
+	Fee            Money                `json:"fee,omitempty" bson:"fee,omitempty"`
+	Tip            Money                `json:"tip,omitempty" bson:"tip,omitempty"`
+	FeePercentage  float64              `json:"fee_percentage,omitempty" bson:"fee_percentage,omitempty"`
+	OriginalID     primitive.ObjectID   `json:"original_id,omitempty" bson:"original_id,omitempty"`
+	Refunds        []primitive.ObjectID `json:"refunds,omitempty" bson:"refunds,omitempty"`
+	RefundedAmount Money                `json:"refunded_amount,omitempty" bson:"refunded_amount,omitempty"`
+	RefundedBy     primitive.ObjectID   `json:"refunded_by,omitempty" bson:"refunded_by,omitempty"`
+	Reason         string               `json:"reason,omitempty" bson:"reason,omitempty"`
+	Type           TxnType              `json:"type" bson:"type"`
+	Status         TxnStatus            `json:"status" bson:"status"`
+	CreatedAt      primitive.DateTime   `bson:"created_at" json:"created_at" default:"Now()"`
+	UpdatedAt      primitive.DateTime   `bson:"updated_at" json:"updated_at" default:"Now()"`
 }
 
 type TransactionStatus struct {
@@ -56,14 +97,18 @@ type TransactionStatus struct {
 type SendMoneyOtherUser struct {
 	Username string  `form:"username" binding:"required"`
 	Amount   float64 `form:"amount" binding:"required"`
+	Currency string  `form:"currency"`
 	TxnPin   string  `form:"txn_pin" binding:"required"`
 }
 
+// SenfMoneyOtherBank withdraws from the wallet to the user's linked bank account
+// The account number and bank code default to the linked account and must match it if given
 type SenfMoneyOtherBank struct {
-	AccountNumber string  `json:"account_number" binding:"required"`
-	Amount        float64 `json:"amount" binding:"required"`
-	TxnPin        string  `json:"txn_pin" binding:"required"`
-	BankCode      string  `json:"bank_code" binding:"required"`
+	AccountNumber string  `json:"account_number" form:"account_number"`
+	Amount        float64 `json:"amount" form:"amount" binding:"required,gt=0"`
+	Currency      string  `json:"currency" form:"currency"`
+	TxnPin        string  `json:"txn_pin" form:"txn_pin" binding:"required"`
+	BankCode      string  `json:"bank_code" form:"bank_code"`
 }
 
 func GetTransaction(ctx context.Context, filter bson.M) (Transactions, error) {
@@ -84,20 +129,67 @@ func InsertTransaction(ctx context.Context, txn Transactions) (Transactions, err
 	return txn, err
 }
 
-func VerifyWalletSufficientBalance(ctx context.Context, user UserResponse, amount float64) bool {
+// QuotePayment works out what paying amount costs the wallet
+// The wallet pays in the amount's currency if it holds enough of it,
+// otherwise the amount is converted from the wallet's home currency
+// It returns the amount taken from the wallet and how many units of the
+// amount's currency one unit of the wallet currency bought
+func QuotePayment(ctx context.Context, wallet Wallet, amount Money) (Money, float64, error) {
+	if amount.Currency == wallet.Currency || wallet.Balance(amount.Currency).GreaterThanOrEqual(amount) {
+		return amount, 1, nil
+	}
+
+	rate, err := GetFXRate(ctx, wallet.Currency, amount.Currency)
+	if err != nil {
+		return Money{}, 0, err
+	}
+
+	return ConvertMoney(amount, wallet.Currency, 1/rate), rate, nil
+}
+
+func VerifyWalletSufficientBalance(ctx context.Context, user UserResponse, amount Money) bool {
+	wallet, err := GetWallet(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return false
+	}
+
+	source, _, err := QuotePayment(ctx, wallet, amount)
+	if err != nil {
+		return false
+	}
+
+	return wallet.Balance(source.Currency).GreaterThanOrEqual(source)
+}
+
+// VerifyEventPaymentBalance reports whether the user's wallet and their budget for the
+// event together cover the amount, see UpdateSenderTransaction
+func VerifyEventPaymentBalance(ctx context.Context, user UserResponse, eventID primitive.ObjectID, amount Money) bool {
 	wallet, err := GetWallet(ctx, bson.M{"user_id": user.ID})
 	if err != nil {
 		return false
 	}
-	return wallet.Balance >= amount
+
+	source, _, err := QuotePayment(ctx, wallet, amount)
+	if err != nil {
+		return false
+	}
+
+	available := wallet.Balance(source.Currency)
+	if budget, err := GetBudget(ctx, eventID, user.ID); err == nil && budget.Amount.Currency == source.Currency {
+		available = available.Add(budget.Amount)
+	}
+
+	return available.GreaterThanOrEqual(source)
 }
 
 // UpdateSenderTransaction updates the sender wallet balance
-// It tries to get the money from the budget first
-// If the budget is not sufficient, it gets the rest from the wallet
-// it updates the wallet balance and returns true if successful
-// TODO: have it return the transaction and an error
-func UpdateSenderTransaction(ctx context.Context, user UserResponse, amount float64, txn Transactions) (Transactions, error) {
+// amount is in the currency the sender pays in
+// For event payments it takes the money from the sender's budget for the event first
+// if the budget is in that currency, whatever the budget does not cover comes from the
+// wallet and what is left of the budget goes back to the wallet
+// The wallet is only debited if it holds enough to cover the rest
+// It must be called inside a transaction, see UpdateWalletBalance
+func UpdateSenderTransaction(ctx context.Context, user UserResponse, amount Money, txn Transactions) (Transactions, error) {
 	funcName := ut.GetFunctionName()
 
 	if txn.Status != TxnStart {
@@ -105,22 +197,42 @@ func UpdateSenderTransaction(ctx context.Context, user UserResponse, amount floa
 	}
 
 	// Get Money from the budget
-	budgetAmount := UnlockBudget(ctx, txn.ToID, user)
-	SetInfo(fmt.Sprintf("Unlocked budget amount: %f", budgetAmount), funcName)
+	budgetAmount := ZeroMoney(amount.Currency)
+	if !txn.EventID.IsZero() {
+		var err error
+		budgetAmount, err = ConsumeBudget(ctx, txn.EventID, user.ID, amount, txn.ID)
+		if err != nil {
+			SetDebug("error consuming budget: "+err.Error(), funcName)
+			return txn, err
+		}
+	}
+	SetInfo(fmt.Sprintf("Budget amount used: %s", budgetAmount), funcName)
 
-	amount = amount - budgetAmount
+	amount = amount.Sub(budgetAmount)
 
-	// Update the wallet to get the rest from the wallet or return the rest to the wallet
-	filter := bson.M{"user_id": user.ID}
-	update := bson.M{"$inc": bson.M{
-		"balance": -amount,
-	}}
+	// Record how much of the amount came from the budget for the ledger
+	if !budgetAmount.IsZero() {
+		_, err := transactionCollection.UpdateOne(ctx, bson.M{"_id": txn.ID}, bson.M{"$set": bson.M{"budget_amount": budgetAmount}})
+		if err != nil {
+			SetDebug("error recording budget amount: "+err.Error(), funcName)
+			return txn, err
+		}
+	}
 
-	_, err := walletCollection.UpdateOne(ctx, filter, update)
+	// Get the rest from the wallet
+	// the balance filter stops the wallet from going below zero
+	filter := walletHasAtLeast(amount)
+	filter["user_id"] = user.ID
+	update := bson.M{"$inc": walletInc(amount.Neg())}
+
+	updateResult, err := walletCollection.UpdateOne(ctx, filter, update)
 	if err != nil {
 		SetDebug("error updating sender wallet balance: "+err.Error(), funcName)
 		return txn, err
 	}
+	if updateResult.MatchedCount != 1 {
+		return txn, errors.New("insufficient balance")
+	}
 
 	// Update transaction status to pending
 	txn, err = UpdateAndReturnTransaction(ctx, txn, TxnPending)
@@ -133,9 +245,9 @@ func UpdateSenderTransaction(ctx context.Context, user UserResponse, amount floa
 }
 
 // UpdateReceiverTransaction updates the receiver wallet balance
-// It adds the amount to the receiver wallet balance
+// It adds the amount to the receiver wallet balance in the amount's currency
 // It returns true if successful
-func UpdateReceiverTransaction(ctx context.Context, to_id primitive.ObjectID, amount float64, txn Transactions) bool {
+func UpdateReceiverTransaction(ctx context.Context, to_id primitive.ObjectID, amount Money, txn Transactions) bool {
 	funcName := ut.GetFunctionName()
 
 	if txn.Status != TxnPending {
@@ -144,16 +256,14 @@ func UpdateReceiverTransaction(ctx context.Context, to_id primitive.ObjectID, am
 	}
 
 	filter := bson.M{"user_id": to_id}
-	update := bson.M{"$inc": bson.M{
-		"balance": +amount,
-	}}
+	update := bson.M{"$inc": walletInc(amount)}
 
 	updateResult, err := walletCollection.UpdateOne(ctx, filter, update)
 	if err != nil {
 		SetDebug("error updating receiver wallet balance: "+err.Error(), funcName)
 		return false
 	}
-	return updateResult.ModifiedCount == 1
+	return updateResult.MatchedCount == 1
 }
 
 // UpdateAndReturnTransaction updates the transaction status and returns the updated transaction
@@ -163,7 +273,8 @@ func UpdateAndReturnTransaction(ctx context.Context, txn Transactions, status Tx
 	// Update transaction status to success
 	filter := bson.M{"transaction_uid": txn.TransactionUID, "_id": txn.ID}
 	update := bson.M{"$set": bson.M{
-		"status": status,
+		"status":     status,
+		"updated_at": primitive.NewDateTimeFromTime(time.Now()),
 	}}
 	// update and return new document
 	updateResult, errs := transactionCollection.UpdateOne(ctx, filter, update)
@@ -185,62 +296,124 @@ func UpdateAndReturnTransaction(ctx context.Context, txn Transactions, status Tx
 }
 
 // UpdateWalletBalance updates the wallet balance of the sender and receiver
-// If an error occurs, it rolls back the transaction and updates the transaction status to fail
+// The sender debit, receiver credit, ledger entries and status change run in one
+// MongoDB transaction, so either all of them are applied or none are
+// If the transaction aborts, the transaction status is set to fail
 // If the transaction is successful, it updates the transaction status to success
 func UpdateWalletBalance(ctx context.Context, txn Transactions) (Transactions, error) {
 	funcName := ut.GetFunctionName()
 
 	fromUser := GetUserByID(ctx, txn.FromID)
 
-	txn, err := UpdateSenderTransaction(ctx, fromUser, txn.Amount, txn)
-	if err != nil {
-
-		SetDebug("error updating sender transaction: "+err.Error(), funcName)
+	var result Transactions
 
-		_, _ = UpdateAndReturnTransaction(ctx, txn, TxnFail)
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		pending, err := UpdateSenderTransaction(sessCtx, fromUser, txn.SourceAmount, txn)
+		if err != nil {
+			SetDebug("error updating sender transaction: "+err.Error(), funcName)
+			return err
+		}
 
-		return txn, err
-	}
+		// The receiver gets the amount less the platform fee, if any
+		if !UpdateReceiverTransaction(sessCtx, pending.ToID, pending.NetAmount(), pending) {
+			SetDebug("error updating receiver transaction", funcName)
+			return errors.New("error updating receiver transaction")
+		}
 
-	if !UpdateReceiverTransaction(ctx, txn.ToID, txn.Amount, txn) {
-		// Rollback to Sender
-		SetDebug("error updating receiver transaction", funcName)
+		if err = CreditPlatformWallet(sessCtx, pending.Fee); err != nil {
+			SetDebug("error crediting platform fee: "+err.Error(), funcName)
+			return err
+		}
 
-		_, _ = UpdateSenderTransaction(ctx, fromUser, -txn.Amount, txn)
+		// Post the transfer to the ledger
+		err = PostLedgerEntries(sessCtx, TransferLedgerEntries(pending))
+		if err != nil {
+			SetDebug("error posting transfer to ledger: "+err.Error(), funcName)
+			return err
+		}
 
-		txn, err := UpdateAndReturnTransaction(ctx, txn, TxnFail)
+		result, err = UpdateAndReturnTransaction(sessCtx, pending, TxnSuccess)
 		if err != nil {
+			SetDebug("error updating transaction for success: "+err.Error(), funcName)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		// Nothing was applied, record the failure
+		failed, errs := UpdateAndReturnTransaction(ctx, txn, TxnFail)
+		if errs != nil {
+			SetDebug("error updating transaction for fail: "+errs.Error(), funcName)
 			return txn, err
 		}
 
-		return txn, errors.New("error updating receiver transaction")
+		return failed, err
+	}
+
+	return result, nil
+}
+
+// recordFailedPayment keeps a payment whose transaction was rolled back, with a status of fail
+// Payments made inside a caller's transaction lose their fail status with everything else
+// when it aborts, so the attempt is written again once the transaction is over
+// Attempts that never got as far as creating a transaction are not recorded
+func recordFailedPayment(ctx context.Context, txn Transactions) Transactions {
+	funcName := ut.GetFunctionName()
+
+	if txn.ID.IsZero() {
+		return txn
 	}
 
-	txn, err = UpdateAndReturnTransaction(ctx, txn, TxnSuccess)
+	txn.Status = TxnFail
+	txn.UpdatedAt = primitive.NewDateTimeFromTime(time.Now())
+	_, err := transactionCollection.ReplaceOne(ctx, bson.M{"_id": txn.ID}, txn, options.Replace().SetUpsert(true))
 	if err != nil {
-		SetDebug("error updating transaction for success: "+err.Error(), funcName)
-		return txn, err
+		SetDebug("error recording failed payment: "+err.Error(), funcName)
 	}
 
-	return txn, nil
+	return txn
 }
 
 // StartDebitTransaction starts a debit transaction
-// It creates a transaction with the sender, receiver and amount
+// It creates a transaction from the draft's sender, receiver, amount,
+// the event and orders it pays for and the platform fee and tip, if any
+// The receiver gets the amount in its currency, the sender pays in the currency
+// chosen by QuotePayment and the rate used is recorded on the transaction
 // It stores the transaction in the database with a status of start
 // Then it updates the wallet balance of the sender and receiver
-func startDebitTransaction(from, to primitive.ObjectID, amount float64) (Transactions, error) {
+// Called inside a transaction it joins it, so callers can update the orders and
+// the event the payment is for in the same transaction, see RunInTransaction
+func startDebitTransaction(ctx context.Context, draft Transactions) (Transactions, error) {
 	funcName := ut.GetFunctionName()
 
-	ctx := context.Background()
+	wallet, err := GetWallet(ctx, bson.M{"user_id": draft.FromID})
+	if err != nil {
+		SetDebug("error getting sender wallet: "+err.Error(), funcName)
+		return Transactions{}, err
+	}
+
+	source, rate, err := QuotePayment(ctx, wallet, draft.Amount)
+	if err != nil {
+		SetDebug("error quoting payment: "+err.Error(), funcName)
+		return Transactions{}, err
+	}
 
 	// create transaction
 	txn := Transactions{
 		ID:             primitive.NewObjectID(),
-		TransactionUID: TransactionUID,
-		FromID:         from,
-		ToID:           to,
-		Amount:         amount,
+		TransactionUID: NewTransactionUID(),
+		FromID:         draft.FromID,
+		ToID:           draft.ToID,
+		Amount:         draft.Amount,
+		SourceAmount:   source,
+		ExchangeRate:   rate,
+		EventID:        draft.EventID,
+		OrderIDs:       draft.OrderIDs,
+		RestaurantID:   draft.RestaurantID,
+		Fee:            draft.Fee,
+		FeePercentage:  draft.FeePercentage,
+		Tip:            draft.Tip,
 		Type:           Debit,
 		Status:         TxnStart,
 		CreatedAt:      primitive.NewDateTimeFromTime(time.Now()),
@@ -248,7 +421,7 @@ func startDebitTransaction(from, to primitive.ObjectID, amount float64) (Transac
 	}
 
 	// insert transaction
-	txn, err := InsertTransaction(ctx, txn)
+	txn, err = InsertTransaction(ctx, txn)
 	if err != nil {
 		SetDebug("error inserting transaction: "+err.Error(), funcName)
 		return txn, err
@@ -268,97 +441,166 @@ func startDebitTransaction(from, to primitive.ObjectID, amount float64) (Transac
 type EventBillPayment struct {
 	EventID primitive.ObjectID `form:"event_id" bson:"event_id" binding:"required"`
 	TxnPin  string             `form:"txn_pin" bson:"txn_pin" binding:"required"`
+	TipRequest
 }
 
 // SendtoVenuePayforEvent sends money to venues
 // Anyone can pay for the total bill of an event
-// It returns the transaction and error if any
+// The restaurant's fee percentage of the bill goes to the platform, the owner gets the rest
+// and all of the tip, if any
+// The payment, the event finishing, the orders being paid and the budgets being released
+// run in one transaction, see UpdateEventandOrders
+// It returns the transaction, the budgets released and error if any
 // It returns error if the user has insufficient balance
 // It returns error if the event is not found
-func SendtoVenuePayforEvent(ctx context.Context, event Event, user UserResponse) (Transactions, error) {
+func SendtoVenuePayforEvent(ctx context.Context, event Event, user UserResponse, tipRequest TipRequest) (Transactions, []Budget, error) {
 	funcName := ut.GetFunctionName()
 
 	var txn Transactions
+	var released []Budget
 
 	// Get Venue Owner
 	restaurant, err := GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
 	if err != nil {
 		SetDebug("error getting restaurant: "+err.Error(), funcName)
-		return txn, err
+		return txn, released, err
 	}
 
-	// check if user has sufficient balance
-	if !VerifyWalletSufficientBalance(ctx, user, event.Bill) {
-		return txn, errors.New("insufficient balance")
-	}
+	err = RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		txn = Transactions{}
 
-	// start debit transaction
-	// Send Money to Venue Owner
-	txn, err = startDebitTransaction(user.ID, restaurant.OwnerID, event.Bill)
+		// the bill is read again so a payment made meanwhile is not paid twice
+		event, err := GetEvent(sessCtx, bson.M{"_id": event.ID})
+		if err != nil {
+			return err
+		}
+		if event.EventStatus == Finished || !event.Bill.IsPositive() {
+			return errors.New("the bill for this event has already been paid")
+		}
+
+		tip, err := tipRequest.Tip(event.Bill)
+		if err != nil {
+			return err
+		}
+
+		if err := CheckLimit(sessCtx, user, OpBillPayment, event.Bill.Add(tip)); err != nil {
+			return err
+		}
+
+		// check if user has sufficient balance
+		if !VerifyEventPaymentBalance(sessCtx, user, event.ID, event.Bill.Add(tip)) {
+			return errors.New("insufficient balance")
+		}
+
+		// The whole bill covers every unpaid order of the event
+		orders, err := GetOrders(sessCtx, bson.M{"event_id": event.ID, "paid": false})
+		if err != nil {
+			SetDebug("error getting orders: "+err.Error(), funcName)
+			return err
+		}
+
+		// start debit transaction
+		// Send Money to Venue Owner
+		txn, err = startDebitTransaction(sessCtx, Transactions{
+			FromID:        user.ID,
+			ToID:          restaurant.OwnerID,
+			Amount:        event.Bill.Add(tip),
+			EventID:       event.ID,
+			OrderIDs:      orderIDs(orders),
+			RestaurantID:  restaurant.ID,
+			Fee:           PlatformFee(event.Bill, restaurant.FeePercentage),
+			FeePercentage: restaurant.FeePercentage,
+			Tip:           tip,
+		})
+		if err != nil {
+			SetDebug("error starting debit transaction: "+err.Error(), funcName)
+			return err
+		}
+
+		// Event Status to Finished, Orders Paid to True and budgets left over are returned
+		released, err = UpdateEventandOrders(sessCtx, event, txn)
+		if err != nil {
+			SetDebug("error updating event and orders: "+err.Error(), funcName)
+		}
+		return err
+	})
 	if err != nil {
-		SetDebug("error starting debit transaction: "+err.Error(), funcName)
-		return txn, err
+		return recordFailedPayment(ctx, txn), nil, err
 	}
 
-	return txn, nil
+	return txn, released, nil
 }
 
 // SendToHost sends money to the host of the event
 // It takes a context and an event and a user
 // It gets the total bill from orders made for the event
 // and sends the money to the host
-// Get Unlocks the budget for the user and adds it to the wallet balance
+// The user's budget for the event pays first, see UpdateSenderTransaction
+// A tip, if any, goes to the host with the bill
+// The payment and the user's orders being paid run in one transaction, see UpdateCustomerOrders,
+// the event bill stays as it is since the host still pays the venue
 // It returns a transaction and an error
-func SendToHost(ctx context.Context, event Event, user UserResponse) (Transactions, error) {
+func SendToHost(ctx context.Context, event Event, user UserResponse, tipRequest TipRequest) (Transactions, error) {
 	funcName := ut.GetFunctionName()
 
-	// Get Venue Owner
-	restaurant, err := GetRestaurant(ctx, bson.M{"_id": event.RestaurantID})
-	if err != nil {
-		SetDebug("error getting restaurant: "+err.Error(), funcName)
-		return Transactions{}, err
-	}
+	var txn Transactions
 
-	var orders []Order
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		txn = Transactions{}
 
-	// Get total bill from orders
-	orders, err = GetOrders(ctx, bson.M{"event_id": event.ID, "customer_id": user.ID, "paid": false})
-	if err != nil {
-		SetDebug("error getting orders: "+err.Error(), funcName)
-		return Transactions{}, err
-	}
+		// Get total bill from the user's orders and portions of shared orders
+		orders, totalBill, err := OwnBill(sessCtx, event.ID, user.ID)
+		if err != nil {
+			SetDebug("error getting orders: "+err.Error(), funcName)
+			return err
+		}
 
-	var totalBill float64
-	for _, order := range orders {
-		totalBill += order.Bill
-	}
+		SetInfo(fmt.Sprintf("total bill: %s", totalBill), funcName)
 
-	SetInfo(fmt.Sprintf("total bill: %f", totalBill), funcName)
+		// Check if totalBill is greater than 0
+		if !totalBill.IsPositive() {
+			SetDebug("total bill is less than or equal to 0", funcName)
+			return errors.New("there are no orders to pay for")
+		}
 
-	err = BudgetoWallet(ctx, restaurant.OwnerID, user)
-	if err != nil {
-		SetDebug("error returning budget: "+err.Error(), funcName)
-		return Transactions{}, err
-	}
+		tip, err := tipRequest.Tip(totalBill)
+		if err != nil {
+			return err
+		}
 
-	// Check if totalBill is greater than 0
-	if totalBill <= 0 {
-		SetDebug("total bill is less than or equal to 0", funcName)
-		return Transactions{}, errors.New("there are no orders to pay for")
-	}
+		if err := CheckLimit(sessCtx, user, OpBillPayment, totalBill.Add(tip)); err != nil {
+			return err
+		}
 
-	// check if user has sufficient balance
-	if !VerifyWalletSufficientBalance(ctx, user, totalBill) {
-		SetDebug("insufficient balance", funcName)
-		return Transactions{}, errors.New("insufficient balance")
-	}
+		// check if user has sufficient balance
+		if !VerifyEventPaymentBalance(sessCtx, user, event.ID, totalBill.Add(tip)) {
+			SetDebug("insufficient balance", funcName)
+			return errors.New("insufficient balance")
+		}
+
+		// Start Debit Transaction
+		// Send money to Host of Event
+		txn, err = startDebitTransaction(sessCtx, Transactions{
+			FromID:   user.ID,
+			ToID:     event.HostID,
+			Amount:   totalBill.Add(tip),
+			EventID:  event.ID,
+			OrderIDs: orderIDs(orders),
+			Tip:      tip,
+		})
+		if err != nil {
+			SetDebug("error starting debit transaction: "+err.Error(), funcName)
+			return err
+		}
 
-	// Start Debit Transaction
-	// Send money to Host of Event
-	txn, err := startDebitTransaction(user.ID, event.HostID, totalBill)
+		// The user's orders are paid so they are not sent to the host again
+		if err = UpdateCustomerOrders(sessCtx, event, user, txn); err != nil {
+			SetDebug("error updating customer orders: "+err.Error(), funcName)
+		}
+		return err
+	})
 	if err != nil {
-		SetDebug("error starting debit transaction: "+err.Error(), funcName)
-		return txn, err
+		return recordFailedPayment(ctx, txn), err
 	}
 
 	return txn, nil
@@ -366,8 +608,12 @@ func SendToHost(ctx context.Context, event Event, user UserResponse) (Transactio
 
 // SendMoneyPayOwnBill sends money to venue to pay for own bill
 // It takes a context, the user and the event
+// The restaurant's fee percentage of the bill goes to the platform, the owner gets the rest
+// and all of the tip, if any
+// The user's budget for the event pays first, see UpdateSenderTransaction
+// The payment and the user's orders being paid run in one transaction, see UpdateCustomerOrders
 // It returns a transaction and an error
-func PayOwnBillforEvent(ctx context.Context, event Event, user UserResponse) (Transactions, error) {
+func PayOwnBillforEvent(ctx context.Context, event Event, user UserResponse, tipRequest TipRequest) (Transactions, error) {
 	funcName := ut.GetFunctionName()
 
 	var txn Transactions
@@ -379,40 +625,63 @@ func PayOwnBillforEvent(ctx context.Context, event Event, user UserResponse) (Tr
 		return txn, err
 	}
 
-	var orders []Order
+	err = RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		txn = Transactions{}
 
-	// Get total bill from orders
-	orders, err = GetOrders(ctx, bson.M{"event_id": event.ID, "customer_id": user.ID, "paid": false})
-	if err != nil {
-		SetDebug("error getting orders: "+err.Error(), funcName)
-		return Transactions{}, err
-	}
+		// Get total bill from the user's orders and portions of shared orders
+		orders, totalBill, err := OwnBill(sessCtx, event.ID, user.ID)
+		if err != nil {
+			SetDebug("error getting orders: "+err.Error(), funcName)
+			return err
+		}
 
-	var totalBill float64
-	for _, order := range orders {
-		totalBill += order.Bill
-	}
+		SetInfo(fmt.Sprintf("total bill: %s", totalBill), funcName)
 
-	SetInfo(fmt.Sprintf("total bill: %f", totalBill), funcName)
+		if !totalBill.IsPositive() {
+			return errors.New("there are no orders to pay for")
+		}
 
-	err = BudgetoWallet(ctx, restaurant.OwnerID, user)
-	if err != nil {
-		SetDebug("error returning budget: "+err.Error(), funcName)
-		return Transactions{}, err
-	}
+		tip, err := tipRequest.Tip(totalBill)
+		if err != nil {
+			return err
+		}
 
-	// check if user has sufficient balance
-	if !VerifyWalletSufficientBalance(ctx, user, totalBill) {
-		SetDebug("insufficient balance", funcName)
-		return Transactions{}, errors.New("insufficient balance")
-	}
+		if err := CheckLimit(sessCtx, user, OpBillPayment, totalBill.Add(tip)); err != nil {
+			return err
+		}
 
-	// start debit transaction
-	// Send Money to Venue Owner
-	txn, err = startDebitTransaction(user.ID, restaurant.OwnerID, totalBill)
+		// check if user has sufficient balance
+		if !VerifyEventPaymentBalance(sessCtx, user, event.ID, totalBill.Add(tip)) {
+			SetDebug("insufficient balance", funcName)
+			return errors.New("insufficient balance")
+		}
+
+		// start debit transaction
+		// Send Money to Venue Owner
+		txn, err = startDebitTransaction(sessCtx, Transactions{
+			FromID:        user.ID,
+			ToID:          restaurant.OwnerID,
+			Amount:        totalBill.Add(tip),
+			EventID:       event.ID,
+			OrderIDs:      orderIDs(orders),
+			RestaurantID:  restaurant.ID,
+			Fee:           PlatformFee(totalBill, restaurant.FeePercentage),
+			FeePercentage: restaurant.FeePercentage,
+			Tip:           tip,
+		})
+		if err != nil {
+			SetDebug("error starting debit transaction: "+err.Error(), funcName)
+			return err
+		}
+
+		// Update All Customer Orders for the Event to paid
+		if err = UpdateCustomerOrders(sessCtx, event, user, txn); err != nil {
+			SetDebug("error updating customer orders: "+err.Error(), funcName)
+		}
+		return err
+	})
 	if err != nil {
-		SetDebug("error starting debit transaction: "+err.Error(), funcName)
-		return txn, err
+		return recordFailedPayment(ctx, txn), err
 	}
 
 	return txn, nil
@@ -421,17 +690,42 @@ func PayOwnBillforEvent(ctx context.Context, event Event, user UserResponse) (Tr
 // SendToOtherUsers sends money to other users
 // It takes a context, the user the money is being sent to and the user sending the money
 // It returns a transaction and an error
-func SendToOtherUsers(ctx context.Context, toUser UserResponse, fromUser UserResponse, amount float64) (Transactions, error) {
+func SendToOtherUsers(ctx context.Context, toUser UserResponse, fromUser UserResponse, amount Money) (Transactions, error) {
+	return sendToOtherUsers(ctx, toUser, fromUser, amount, primitive.NilObjectID)
+}
+
+// sendToOtherUsers sends money to another user, for an event if eventID is set
+// The sender's budget for the event pays first, see UpdateSenderTransaction
+// A transfer for an event counts towards the bill payment limits like every payment
+// with an event on it, see limitFilter
+func sendToOtherUsers(ctx context.Context, toUser UserResponse, fromUser UserResponse, amount Money, eventID primitive.ObjectID) (Transactions, error) {
 	funcName := ut.GetFunctionName()
 
+	op := OpSend
+	if !eventID.IsZero() {
+		op = OpBillPayment
+	}
+	if err := CheckLimit(ctx, fromUser, op, amount); err != nil {
+		return Transactions{}, err
+	}
+
 	// check if user has sufficient balance
-	if !VerifyWalletSufficientBalance(ctx, fromUser, amount) {
+	sufficient := VerifyWalletSufficientBalance(ctx, fromUser, amount)
+	if !eventID.IsZero() {
+		sufficient = VerifyEventPaymentBalance(ctx, fromUser, eventID, amount)
+	}
+	if !sufficient {
 		return Transactions{}, errors.New("insufficient balance")
 	}
 
 	// start debit transaction
 	//Send Money to User
-	txn, err := startDebitTransaction(fromUser.ID, toUser.ID, amount)
+	txn, err := startDebitTransaction(ctx, Transactions{
+		FromID:  fromUser.ID,
+		ToID:    toUser.ID,
+		Amount:  amount,
+		EventID: eventID,
+	})
 	if err != nil {
 		SetDebug("error starting debit transaction: "+err.Error(), funcName)
 		return txn, err
@@ -440,6 +734,15 @@ func SendToOtherUsers(ctx context.Context, toUser UserResponse, fromUser UserRes
 	return txn, nil
 }
 
+// orderIDs returns the ids of the orders
+func orderIDs(orders []Order) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, 0, len(orders))
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+	}
+	return ids
+}
+
 func VerificationforEventPayment(ctx context.Context, request EventBillPayment, event Event, user UserResponse) error {
 	funcName := ut.GetFunctionName()
 
@@ -450,11 +753,16 @@ func VerificationforEventPayment(ctx context.Context, request EventBillPayment,
 		return errors.New("event is not ongoing")
 	}
 
+	// Once the host confirms a split everyone pays their share of it
+	if !event.SplitID.IsZero() {
+		return ErrEventBillSplit
+	}
+
 	//verify pin
-	if !VeryfyPin(ctx, user, request.TxnPin) {
-		SetError(nil, "Invalid Pin", funcName)
+	if err := VeryfyPin(ctx, user, request.TxnPin); err != nil {
+		SetError(err, "Invalid Pin", funcName)
 
-		return errors.New("invalid pin")
+		return err
 	}
 
 	return nil
@@ -2,24 +2,73 @@ package helpers
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
 
-	"github.com/Rhaqim/thedutchapp/pkg/auth"
 	"github.com/Rhaqim/thedutchapp/pkg/config"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var walletCollection = config.WalletCollection
 
+// Wallet holds a balance per currency in minor units, keyed by currency code
+// Currency is the wallet's home currency, payments in other currencies
+// are converted from it
 type Wallet struct {
 	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 	UserID    primitive.ObjectID `json:"user_id" bson:"user_id"`
-	Balance   float64            `json:"balance,omitempty" bson:"balance" default:"0"`
+	Currency  string             `json:"currency" bson:"currency"`
+	Balances  map[string]int64   `json:"balances" bson:"balances"`
 	TxnPin    string             `json:"txn_pin" bson:"txn_pin" binding:"required,min=4,max=4"`
 	CreatedAt primitive.DateTime `json:"created_at,omitempty" bson:"created_at,omitempty" default:"time.Now()"`
 	UpdatedAt primitive.DateTime `json:"updated_at,omitempty" bson:"updated_at,omitempty" default:"time.Now()"`
 }
 
+// Balance returns the amount the wallet holds in the currency
+func (w Wallet) Balance(currency string) Money {
+	return NewMoney(w.Balances[currency], currency)
+}
+
+// HomeBalance returns the amount the wallet holds in its home currency
+func (w Wallet) HomeBalance() Money {
+	return w.Balance(w.Currency)
+}
+
+// AllBalances returns every balance the wallet holds
+func (w Wallet) AllBalances() []Money {
+	var balances []Money
+	for currency, amount := range w.Balances {
+		balances = append(balances, NewMoney(amount, currency))
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].Currency < balances[j].Currency
+	})
+	return balances
+}
+
+// walletBalanceField is the field that holds the wallet balance in the currency
+func walletBalanceField(currency string) string {
+	return "balances." + currency
+}
+
+// walletInc returns the $inc document that moves the wallet balance by m
+func walletInc(m Money) bson.M {
+	return bson.M{walletBalanceField(m.Currency): m.Amount}
+}
+
+// walletHasAtLeast returns the filter that matches wallets holding at least m
+func walletHasAtLeast(m Money) bson.M {
+	if !m.IsPositive() {
+		return bson.M{}
+	}
+	return bson.M{walletBalanceField(m.Currency): bson.M{"$gte": m.Amount}}
+}
+
 type CreateWalletRequest struct {
 	TxnPin string `form:"txn_pin" bson:"txn_pin" binding:"required,min=4,max=4"`
 }
@@ -30,19 +79,33 @@ type ChangePinRequest struct {
 }
 
 type FundWalletRequest struct {
-	Amount float64 `form:"amount" bson:"amount"`
+	Amount   float64 `form:"amount" bson:"amount"`
+	Currency string  `form:"currency" bson:"currency"`
 }
 
 type FundWalletResponse struct {
-	Amount      int    `json:"amount" bson:"amount"`
-	Reference   string `json:"reference" bson:"reference"`
-	Transaction string `json:"transaction" bson:"transaction"`
+	AuthorizationURL string `json:"authorization_url"`
+	AccessCode       string `json:"access_code"`
+	Reference        string `json:"reference"`
+	Amount           Money  `json:"amount"`
 }
 
-func FundWalletPaystack(request FundWalletRequest, user UserResponse) (float64, error) {
-	funcName := "FundWalletPaystack"
+var ErrFundingNotPending = errors.New("wallet funding is not pending")
 
-	ctx := context.Background()
+// FundWalletPaystack starts funding the wallet through the payment provider
+// It stores a pending credit transaction and returns where the user pays for it
+// The wallet is only credited once the provider confirms the payment, see CompleteWalletFunding
+func FundWalletPaystack(ctx context.Context, request FundWalletRequest, user UserResponse) (FundWalletResponse, error) {
+	funcName := ut.GetFunctionName()
+
+	amount := MoneyFromMajor(request.Amount, request.Currency)
+	if !amount.IsPositive() {
+		return FundWalletResponse{}, errors.New("amount must be greater than zero")
+	}
+
+	if err := CheckLimit(ctx, user, OpFund, amount); err != nil {
+		return FundWalletResponse{}, err
+	}
 
 	// Insert new Credit transaction
 	createdAt, updatedAt := CreatedAtUpdatedAt()
@@ -50,9 +113,11 @@ func FundWalletPaystack(request FundWalletRequest, user UserResponse) (float64,
 		ID:             primitive.NewObjectID(),
 		FromID:         user.ID,
 		ToID:           user.ID,
-		Amount:         request.Amount,
-		TransactionUID: TransactionUID,
-		Status:         TxnStart,
+		Amount:         amount,
+		SourceAmount:   amount,
+		ExchangeRate:   1,
+		TransactionUID: NewTransactionUID(),
+		Status:         TxnPending,
 		Type:           Credit,
 		CreatedAt:      createdAt,
 		UpdatedAt:      updatedAt,
@@ -60,79 +125,100 @@ func FundWalletPaystack(request FundWalletRequest, user UserResponse) (float64,
 
 	_, err := transactionCollection.InsertOne(ctx, transaction)
 	if err != nil {
-		SetError(err, "Error creating transaction", funcName)
-		return 0, err
+		SetDebug("error creating transaction: "+err.Error(), funcName)
+		return FundWalletResponse{}, err
 	}
 
-	// Await a response from the Paystack API
-	// if there's an error set it to failed
-	var amountPaystack float64 = request.Amount
-
-	// Update Transaction status to success and amount from the paystack
-	filter := bson.M{"_id": transaction.ID}
-	update := bson.M{"$set": bson.M{
-		"status": TxnSuccess,
-		"amount": amountPaystack,
-	}}
-	_, err = transactionCollection.UpdateOne(ctx, filter, update)
+	authorization, err := Payments.InitializeCharge(ctx, Charge{
+		Email:     user.Email,
+		Amount:    amount,
+		Reference: transaction.TransactionUID,
+		Metadata:  map[string]string{"user_id": user.ID.Hex()},
+	})
 	if err != nil {
-		SetError(err, "Error updating transaction", funcName)
-		return 0, err
+		SetDebug("error initializing charge: "+err.Error(), funcName)
+		if _, errs := UpdateAndReturnTransaction(ctx, transaction, TxnFail); errs != nil {
+			SetDebug("error updating transaction for fail: "+errs.Error(), funcName)
+		}
+		return FundWalletResponse{}, err
 	}
 
-	return request.Amount, nil
+	return FundWalletResponse{
+		AuthorizationURL: authorization.AuthorizationURL,
+		AccessCode:       authorization.AccessCode,
+		Reference:        transaction.TransactionUID,
+		Amount:           amount,
+	}, nil
 }
 
-// func FundWalletPaystack(request FundWalletRequest, user UserResponse) (FundWalletResponse, error) {
-// // Create a new Paystack client
-// 	client := paystack.NewClient(paystack.ClientOptions{
-// 		SecretKey: os.Getenv("PAYSTACK_SECRET_KEY"),
-// 	})
-
-// 	// Create a new Paystack transaction
-// 	transaction := paystack.Transaction{
-// 		Amount:   int(request.Amount * 100),
-// 		Email:    user.Email,
-// 		Metadata: map[string]interface{}{"user_id": user.ID},
-// 	}
-
-// 	// Initialize the transaction
-// 	transaction.Initialize(client)
-
-// 	// Await a response from the Paystack API
-// 	paystackResponse, err := transaction.Charge()
-// 	if err != nil {
-// 		return FundWalletResponse{}, err
-// 	}
-
-// 	var paystackResponse FundWalletResponse
-
-// 	return paystackResponse, nil
-
-// Await a response from the Paystack API
-// paystackResponse, err := hp.FundWalletPaystack(request, user)
-// if err != nil {
-//  // Update transaction status to failed
-//  filter := bson.M{"_id": transaction.ID}
-//  update := bson.M{"$set": bson.M{
-//   "status": hp.Failed,
-//  }}
-
-// 	response := hp.SetError(err, "Error funding wallet", funcName)
-// 	c.AbortWithStatusJSON(http.StatusBadRequest, response)
-// 	return
-// }
-
-// user.Wallet += request.Amount
-
-// _, err = transactionCollection.UpdateOne(ctx, filter, update)
-// if err != nil {
-//  response := hp.SetError(err, "Error updating transaction", funcName)
-//  c.AbortWithStatusJSON(http.StatusBadRequest, response)
-//  return
-// }
-
-// }
+// CompleteWalletFunding settles the funding the charge was for
+// A successful charge for the full amount credits the wallet and posts the funding to
+// the ledger, any other charge fails the funding
+// Providers repeat notifications, a funding that already succeeded is returned as it is
+func CompleteWalletFunding(ctx context.Context, charge ChargeResult) (Transactions, error) {
+	funcName := ut.GetFunctionName()
+
+	var txn Transactions
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		var err error
+		txn, err = GetTransaction(sessCtx, bson.M{"transaction_uid": charge.Reference, "type": Credit})
+		if err != nil {
+			SetDebug("error getting funding transaction: "+err.Error(), funcName)
+			return err
+		}
+
+		if txn.Status == TxnSuccess {
+			return nil
+		}
+		if txn.Status != TxnPending {
+			return ErrFundingNotPending
+		}
+
+		status := TxnSuccess
+		if !charge.Succeeded() || charge.Amount.Currency != txn.Amount.Currency || charge.Amount.Amount != txn.Amount.Amount {
+			SetInfo(fmt.Sprintf("charge %s %s for %s, expected %s", charge.Reference, charge.Status, charge.Amount, txn.Amount), funcName)
+			status = TxnFail
+		}
+
+		// only one notification moves the funding out of pending
+		result, err := transactionCollection.UpdateOne(sessCtx,
+			bson.M{"_id": txn.ID, "status": TxnPending},
+			bson.M{"$set": bson.M{"status": status, "updated_at": primitive.NewDateTimeFromTime(time.Now())}},
+		)
+		if err != nil {
+			SetDebug("error updating funding transaction: "+err.Error(), funcName)
+			return err
+		}
+		if result.ModifiedCount != 1 {
+			return ErrFundingNotPending
+		}
+		txn.Status = status
+
+		if status != TxnSuccess {
+			return nil
+		}
+
+		result, err = walletCollection.UpdateOne(sessCtx, bson.M{"user_id": txn.ToID}, bson.M{"$inc": walletInc(txn.Amount)})
+		if err != nil {
+			SetDebug("error updating wallet balance: "+err.Error(), funcName)
+			return err
+		}
+		if result.MatchedCount != 1 {
+			return errors.New("wallet not found")
+		}
+
+		// Post the funding to the ledger
+		if err = PostLedgerEntries(sessCtx, FundingLedgerEntries(txn)); err != nil {
+			SetDebug("error posting funding to ledger: "+err.Error(), funcName)
+			return err
+		}
+
+		return nil
+	})
+
+	return txn, err
+}
 
 func GetWallet(ctx context.Context, filter bson.M) (Wallet, error) {
 	var wallet Wallet
@@ -168,116 +254,11 @@ func CheckifWalletExists(ctx context.Context, filter bson.M) (bool, error) {
 	return true, nil
 }
 
-func VeryfyPin(ctx context.Context, user UserResponse, pin string) bool {
-	funcName := "VeryfyPin"
-
-	// Check that pin sent is correct
-	// Get wallet
-	filter := bson.M{
-		"_id": user.Wallet,
-	}
-	wallet, err := GetWallet(ctx, filter)
-	if err != nil {
-		SetError(err, "Error fetching wallet", funcName)
-		return false
-	}
-
-	// Check if pin is correct
-	if !auth.CheckPasswordHash(pin, wallet.TxnPin) {
-		SetError(err, "Incorrect pin", funcName)
-		return false
-	}
-
-	return true
-}
-
-/* Budget */
-var budgetCollection = config.BudgetCollection
-
-type Budget struct {
-	ID         primitive.ObjectID `json:"id,omitempty" bson:"_id"`
-	UserID     primitive.ObjectID `json:"user_id" bson:"user_id" binding:"required"`
-	IntendedID primitive.ObjectID `json:"intended_id" bson:"intended_id" binding:"required"`
-	Amount     float64            `json:"amount" bson:"amount" binding:"required"`
-}
-
-func GetBudget(ctx context.Context, filter bson.M) float64 {
-	var budget Budget
-
-	err := budgetCollection.FindOne(ctx, filter).Decode(&budget)
-	if err != nil {
-		return 0
-	}
-
-	return budget.Amount
-}
-
-// TODO: Logic to lock amount soecified as budget for an expense
-// LockBudget and UnlockBudget
-// LockBudget locks the amount specified as budget for an expense
-// UnlockBudget unlocks the amount to be either transferred to wallet or refunded to user
-func LockBudget(ctx context.Context, wallet Wallet, amount float64, intended_id primitive.ObjectID) error {
-	// Subtract amount from wallet balance
-	wallet.Balance = wallet.Balance - amount
-
-	_, err := walletCollection.UpdateOne(ctx, bson.M{"_id": wallet.ID}, bson.M{"$set": bson.M{"balance": wallet.Balance}})
-	if err != nil {
-		return err
-	}
-
-	// Create a new budget
-	budget := Budget{
-		ID:         primitive.NewObjectID(),
-		UserID:     wallet.UserID,
-		IntendedID: intended_id,
-		Amount:     amount,
-	}
-
-	_, err = budgetCollection.InsertOne(ctx, budget)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-// UnlockBudget unlocks the amount to be either transferred to wallet or refunded to user
-func UnlockBudget(ctx context.Context, intended_id primitive.ObjectID, user UserResponse) float64 {
-	// Get budget for the event
-	var amount float64
-
-	filter := bson.M{"intended_id": intended_id, "user_id": user.ID}
-	amount = GetBudget(ctx, filter)
-
-	// Delete budget
-	_, err := budgetCollection.DeleteOne(ctx, filter)
-	if err != nil {
-		return 0
-	}
-
-	return amount
-}
-
-func BudgetoWallet(ctx context.Context, intended_id primitive.ObjectID, user UserResponse) error {
-	funcName := "BudgetoWaller"
-
-	// Put Budget back in Wallet
-	budgetAmount := UnlockBudget(ctx, intended_id, user)
-
-	err := UpdateWallet(ctx, bson.M{"user_id": user.ID}, bson.M{"$inc": bson.M{"balance": +budgetAmount}})
-	if err != nil {
-		SetDebug("error updating wallet: "+err.Error(), funcName)
-		return err
-	}
-
-	return nil
-}
-
-func AddMoney(ctx context.Context, user UserResponse, amount float64) error {
+func AddMoney(ctx context.Context, user UserResponse, amount Money) error {
 	funcName := "AddMoney"
 
 	// Save amount in database
-	err := UpdateWallet(ctx, bson.M{"user_id": user.ID}, bson.M{"$inc": bson.M{"balance": +amount}})
+	err := UpdateWallet(ctx, bson.M{"user_id": user.ID}, bson.M{"$inc": walletInc(amount)})
 	if err != nil {
 		SetDebug("error updating wallet: "+err.Error(), funcName)
 		return err
@@ -0,0 +1,182 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrWithdrawalNotPending = errors.New("withdrawal is not pending")
+	ErrWithdrawalMismatch   = errors.New("payout does not match the withdrawal")
+)
+
+// LinkedBankAccount returns the bank account withdrawals are paid to
+// The account number and bank code of the request must match it if they are given
+func LinkedBankAccount(user UserResponse, request SenfMoneyOtherBank) (BankAccount, error) {
+	account := user.Account
+	if account.AccountNumber == "" || account.BankCode == "" {
+		return account, errors.New("no bank account linked")
+	}
+
+	if (request.AccountNumber != "" && request.AccountNumber != account.AccountNumber) ||
+		(request.BankCode != "" && request.BankCode != account.BankCode) {
+		return account, errors.New("withdrawals can only be made to the linked bank account")
+	}
+
+	return account, nil
+}
+
+// WithdrawToBank holds the amount in the user's wallet and sends it to the bank account
+// The hold and the pending withdrawal are stored in one MongoDB transaction before the
+// provider is called, the provider's webhook then settles or reverses it, see CompleteWithdrawal
+// If the provider refuses the payout the hold is released at once, other errors leave the
+// withdrawal pending because the payout may still go through
+func WithdrawToBank(ctx context.Context, user UserResponse, amount Money, account BankAccount) (Transactions, error) {
+	funcName := ut.GetFunctionName()
+
+	if !amount.IsPositive() {
+		return Transactions{}, errors.New("amount must be greater than zero")
+	}
+
+	if err := CheckLimit(ctx, user, OpWithdraw, amount); err != nil {
+		return Transactions{}, err
+	}
+
+	createdAt, updatedAt := CreatedAtUpdatedAt()
+	txn := Transactions{
+		ID:             primitive.NewObjectID(),
+		TransactionUID: NewTransactionUID(),
+		FromID:         user.ID,
+		ToID:           user.ID,
+		Amount:         amount,
+		SourceAmount:   amount,
+		ExchangeRate:   1,
+		Type:           Withdrawal,
+		Status:         TxnPending,
+		CreatedAt:      createdAt,
+		UpdatedAt:      updatedAt,
+	}
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		// the balance filter stops the wallet from going below zero
+		filter := walletHasAtLeast(amount)
+		filter["user_id"] = user.ID
+		result, err := walletCollection.UpdateOne(sessCtx, filter, bson.M{"$inc": walletInc(amount.Neg())})
+		if err != nil {
+			SetDebug("error holding withdrawal: "+err.Error(), funcName)
+			return err
+		}
+		if result.MatchedCount != 1 {
+			return errors.New("insufficient balance")
+		}
+
+		if _, err = transactionCollection.InsertOne(sessCtx, txn); err != nil {
+			SetDebug("error inserting withdrawal: "+err.Error(), funcName)
+			return err
+		}
+
+		return PostLedgerEntries(sessCtx, WithdrawalHoldLedgerEntries(txn))
+	})
+	if err != nil {
+		return Transactions{}, err
+	}
+
+	_, err = Payments.SendPayout(ctx, Payout{
+		Reference: txn.TransactionUID,
+		Amount:    amount,
+		Account:   account,
+		Reason:    "Wallet withdrawal " + txn.TransactionUID,
+	})
+	if err != nil {
+		SetDebug("error sending payout: "+err.Error(), funcName)
+
+		var providerErr *ProviderError
+		if errors.As(err, &providerErr) && providerErr.Rejected() {
+			reversed, errs := CompleteWithdrawal(ctx, txn.TransactionUID, txn.Amount, false)
+			if errs != nil {
+				SetDebug("error releasing withdrawal hold: "+errs.Error(), funcName)
+			} else {
+				txn = reversed
+			}
+		}
+		return txn, err
+	}
+
+	return txn, nil
+}
+
+// CompleteWithdrawal settles a pending withdrawal once the provider reports on the payout
+// A paid withdrawal leaves the platform, otherwise the money goes back to the wallet
+// Providers repeat notifications, a withdrawal that was already settled or reversed is
+// returned as it is
+// A payout reported for another amount or currency than was held is rejected and the
+// withdrawal stays pending
+func CompleteWithdrawal(ctx context.Context, reference string, amount Money, paid bool) (Transactions, error) {
+	funcName := ut.GetFunctionName()
+
+	var txn Transactions
+
+	err := RunInTransaction(ctx, func(sessCtx mongo.SessionContext) error {
+		var err error
+		txn, err = GetTransaction(sessCtx, bson.M{"transaction_uid": reference, "type": Withdrawal})
+		if err != nil {
+			SetDebug("error getting withdrawal: "+err.Error(), funcName)
+			return err
+		}
+
+		if txn.Status == TxnSuccess || txn.Status == TxnReversed {
+			return nil
+		}
+		if txn.Status != TxnPending {
+			return ErrWithdrawalNotPending
+		}
+		if amount.Currency != txn.Amount.Currency || amount.Amount != txn.Amount.Amount {
+			SetInfo(fmt.Sprintf("payout %s for %s, expected %s", reference, amount, txn.Amount), funcName)
+			return ErrWithdrawalMismatch
+		}
+
+		status := TxnSuccess
+		if !paid {
+			status = TxnReversed
+		}
+
+		// only one notification moves the withdrawal out of pending
+		result, err := transactionCollection.UpdateOne(sessCtx,
+			bson.M{"_id": txn.ID, "status": TxnPending},
+			bson.M{"$set": bson.M{"status": status, "updated_at": primitive.NewDateTimeFromTime(time.Now())}},
+		)
+		if err != nil {
+			SetDebug("error updating withdrawal: "+err.Error(), funcName)
+			return err
+		}
+		if result.ModifiedCount != 1 {
+			return ErrWithdrawalNotPending
+		}
+		txn.Status = status
+
+		if paid {
+			return PostLedgerEntries(sessCtx, WithdrawalSettledLedgerEntries(txn))
+		}
+
+		// Release the hold back to the wallet
+		result, err = walletCollection.UpdateOne(sessCtx, bson.M{"user_id": txn.FromID}, bson.M{"$inc": walletInc(txn.Amount)})
+		if err != nil {
+			SetDebug("error releasing withdrawal hold: "+err.Error(), funcName)
+			return err
+		}
+		if result.MatchedCount != 1 {
+			return errors.New("wallet not found")
+		}
+
+		return PostLedgerEntries(sessCtx, WithdrawalReversedLedgerEntries(txn))
+	})
+
+	return txn, err
+}
@@ -0,0 +1,206 @@
+package jobs
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/Rhaqim/thedutchapp/pkg/config"
+	hp "github.com/Rhaqim/thedutchapp/pkg/helpers"
+	nf "github.com/Rhaqim/thedutchapp/pkg/notifications"
+	ut "github.com/Rhaqim/thedutchapp/pkg/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var jobCollection = config.JobCollection
+
+// Job is work the server runs in the background every Interval
+// Jobs must be safe to run again, a run that fails is tried at the next interval
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context, now time.Time) error
+}
+
+// Jobs are the jobs Start runs
+var Jobs = []Job{
+	{
+		Name:     "monthly_statements",
+		Interval: time.Hour,
+		Run: func(ctx context.Context, now time.Time) error {
+			_, err := hp.SendMonthlyStatements(ctx, now)
+			return err
+		},
+	},
+	{
+		Name:     "scheduled_transfers",
+		Interval: config.ScheduledTransferInterval,
+		Run:      runScheduledTransfers,
+	},
+	{
+		Name:     "settlement_reminders",
+		Interval: config.SettlementReminderInterval,
+		Run:      runSettlementReminders,
+	},
+}
+
+// reminderHeaders are the notifications sent at each reminder stage
+var reminderHeaders = map[hp.ReminderStage]config.NotificationMessage{
+	hp.ReminderDueSoon: config.PaymentDueSoon,
+	hp.ReminderDue:     config.PaymentDue,
+	hp.ReminderOverdue: config.PaymentOverdue,
+}
+
+// runSettlementReminders reminds attendees who still owe for an event as its settlement
+// deadline nears and passes, with a notification at every stage and an email from the
+// deadline on, and tells the host who has not paid once the deadline has passed
+// Shares charged automatically at the deadline are reported to the attendee and the host
+func runSettlementReminders(ctx context.Context, now time.Time) error {
+	funcName := ut.GetFunctionName()
+
+	reminders, err := hp.RunSettlementReminders(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, reminder := range reminders {
+		event := reminder.Event
+		deadline := event.SettlementDeadline.Time().UTC().Format(time.RFC1123)
+
+		for _, run := range reminder.Charges {
+			if run.Err == nil {
+				nf.AlertUserOrLog(config.PaymentAutoCharged, "Your share of "+run.Paid().String()+" for "+event.Title+
+					" was paid automatically at the settlement deadline.", run.Share.UserID, funcName)
+				nf.AlertUserOrLog(config.PaymentAutoCharged, run.Share.Username+"'s share of "+run.Paid().String()+" for "+
+					event.Title+" was paid automatically.", event.HostID, funcName)
+				continue
+			}
+			nf.AlertUserOrLog(config.AutoChargeFailed, "Your share of "+run.Share.Owed.String()+" for "+event.Title+
+				" could not be paid automatically: "+run.Err.Error()+".", run.Share.UserID, funcName)
+		}
+
+		for _, share := range reminder.Shares {
+			msg := "You owe " + share.Owed.String() + " for " + event.Title + ", due " + deadline + "."
+			if reminder.Stage == hp.ReminderOverdue {
+				msg = "Your share of " + share.Owed.String() + " for " + event.Title + " was due " + deadline + " and is overdue."
+			}
+			nf.AlertUserOrLog(reminderHeaders[reminder.Stage], msg, share.UserID, funcName)
+
+			if reminder.Stage < hp.ReminderDue {
+				continue
+			}
+			user := hp.GetUserByID(ctx, share.UserID)
+			if err := hp.SendSettlementReminderEmail(user, share, reminder.Stage); err != nil {
+				hp.SetDebug("Error sending reminder email: "+err.Error(), funcName)
+			}
+		}
+
+		if reminder.Stage >= hp.ReminderDue && len(reminder.Shares) > 0 {
+			nf.AlertUserOrLog(config.SettlementOverdue, strconv.Itoa(len(reminder.Shares))+" attendees have not paid their share of "+
+				event.Title+" by the settlement deadline.", event.HostID, funcName)
+		}
+	}
+
+	return nil
+}
+
+// runScheduledTransfers sends the scheduled transfers that are due and tells
+// the sender and receiver how each one went
+func runScheduledTransfers(ctx context.Context, now time.Time) error {
+	funcName := ut.GetFunctionName()
+
+	runs, err := hp.RunDueScheduledTransfers(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		transfer := run.Transfer
+
+		if run.Err == nil {
+			nf.AlertUserOrLog(config.ScheduledTransferSent, "Your scheduled transfer of "+transfer.Amount.String()+" was sent.", transfer.FromID, funcName)
+			nf.AlertUserOrLog(config.Transaction_, "You received a scheduled transfer of "+transfer.Amount.String()+".", transfer.ToID, funcName)
+			continue
+		}
+
+		msg := "Your scheduled transfer of " + transfer.Amount.String() + " could not be sent: " + run.Err.Error() + "."
+		nf.AlertUserOrLog(config.ScheduledTransferFailed, msg, transfer.FromID, funcName)
+
+		if transfer.Status == hp.SchedulePaused {
+			nf.AlertUserOrLog(config.ScheduledTransferPaused, "Your scheduled transfer was paused after failing "+
+				strconv.Itoa(transfer.Failures)+" times in a row. Resume it once your wallet can cover it.", transfer.FromID, funcName)
+		}
+	}
+
+	return nil
+}
+
+// Start runs every job in Jobs in the background until ctx is done
+func Start(ctx context.Context) {
+	for _, job := range Jobs {
+		go schedule(ctx, job)
+	}
+}
+
+// schedule runs the job now and then every interval
+func schedule(ctx context.Context, job Job) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		runOnce(ctx, job, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquire takes the job's lease until the next interval
+// Every instance of the server schedules the jobs, the lease lets only one of them run it
+func acquire(ctx context.Context, job Job, now time.Time) (bool, error) {
+	_, err := jobCollection.UpdateOne(ctx,
+		bson.M{"_id": job.Name, "locked_until": bson.M{"$lte": primitive.NewDateTimeFromTime(now)}},
+		bson.M{"$set": bson.M{"locked_until": primitive.NewDateTimeFromTime(now.Add(job.Interval))}},
+		options.Update().SetUpsert(true),
+	)
+	// another instance holds the lease, so the upsert collides with its document
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// runOnce runs the job if no other instance is running it and records the outcome
+func runOnce(ctx context.Context, job Job, now time.Time) {
+	funcName := ut.GetFunctionName()
+
+	ok, err := acquire(ctx, job, now)
+	if err != nil {
+		hp.SetDebug("error acquiring job "+job.Name+": "+err.Error(), funcName)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, config.JobTimeout)
+	defer cancel()
+
+	status := bson.M{"last_run_at": primitive.NewDateTimeFromTime(now), "last_error": ""}
+	if err = job.Run(runCtx, now); err != nil {
+		hp.SetDebug("job "+job.Name+" failed: "+err.Error(), funcName)
+		status["last_error"] = err.Error()
+	}
+
+	_, err = jobCollection.UpdateOne(ctx, bson.M{"_id": job.Name}, bson.M{"$set": status})
+	if err != nil {
+		hp.SetDebug("error recording job "+job.Name+": "+err.Error(), funcName)
+	}
+}
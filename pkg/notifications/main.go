@@ -464,3 +464,11 @@ func AlertUser(header config.NotificationMessage, message string, user_id primit
 
 	return nil
 }
+
+// AlertUserOrLog sends a notification to a user and only logs it when it fails,
+// for alerts that should not fail the request or job that sends them
+func AlertUserOrLog(header config.NotificationMessage, message string, user_id primitive.ObjectID, funcName string) {
+	if err := AlertUser(header, message, user_id); err != nil {
+		hp.SetDebug("Error sending notification: "+err.Error(), funcName)
+	}
+}
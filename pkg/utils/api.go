@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -16,12 +17,17 @@ const (
 	DELETE APIMethods = "DELETE"
 )
 
+const FinicityBaseURL = "https://api.finicity.com/"
+
+// BankApiStruct is a request to a bank or payment provider API
 type BankApiStruct struct {
 	Method        APIMethods
 	URL           string
 	Body          io.Reader
 	ContentType   string
 	Authorization string
+	Context       context.Context
+	Client        *http.Client
 }
 
 type BankAPI interface {
@@ -29,29 +35,45 @@ type BankAPI interface {
 	TransferFunds() (int, []byte, error)
 }
 
-func InitBankApi(method APIMethods, endpoint string, body io.Reader, authorization string) *BankApiStruct {
+// NewBankAPIRequest returns a JSON request to any provider's API
+// authorization is the full value of the Authorization header
+func NewBankAPIRequest(ctx context.Context, method APIMethods, url string, body io.Reader, authorization string) *BankApiStruct {
 	return &BankApiStruct{
 		Method:        method,
-		URL:           "https://api.finicity.com/" + endpoint,
+		URL:           url,
 		Body:          body,
 		ContentType:   "application/json",
-		Authorization: "Bearer " + authorization,
+		Authorization: authorization,
+		Context:       ctx,
+		Client:        http.DefaultClient,
 	}
 }
 
+func InitBankApi(method APIMethods, endpoint string, body io.Reader, authorization string) *BankApiStruct {
+	return NewBankAPIRequest(context.Background(), method, FinicityBaseURL+endpoint, body, "Bearer "+authorization)
+}
+
 func NewBankAPI(data io.Reader) BankAPI {
-	return &BankApiStruct{
-		Method:        POST,
-		URL:           "https://api.finicity.com/aggregation/v2/customers",
-		Body:          data,
-		ContentType:   "application/json",
-		Authorization: "Bearer 0e" + GetEnv("FINICITY_API_KEY"),
+	return NewBankAPIRequest(context.Background(), POST, FinicityBaseURL+"aggregation/v2/customers", data, "Bearer 0e"+GetEnv("FINICITY_API_KEY"))
+}
+
+// request builds the HTTP request, requests made without a constructor get the defaults
+func (api *BankApiStruct) request() (*http.Client, *http.Request, error) {
+	ctx := api.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	client := api.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, string(api.Method), api.URL, api.Body)
+	return client, req, err
 }
 
 func (api *BankApiStruct) Call() (int, []byte, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest(string(api.Method), api.URL, api.Body)
+	client, req, err := api.request()
 	if err != nil {
 		return 0, nil, err
 	}
@@ -70,8 +92,7 @@ func (api *BankApiStruct) Call() (int, []byte, error) {
 }
 
 func (api *BankApiStruct) TransferFunds() (int, []byte, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest(string(api.Method), api.URL, api.Body)
+	client, req, err := api.request()
 	if err != nil {
 		return 500, nil, err
 	}